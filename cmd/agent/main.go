@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/agent"
+)
+
+// Version is set at build time via ldflags
+var Version = "dev"
+
+func main() {
+	server := flag.String("server", os.Getenv("BOXCHECKR_SERVER"), "BoxCheckr server URL")
+	token := flag.String("token", os.Getenv("BOXCHECKR_TOKEN"), "machine enrollment token (default: the token saved by a previous run)")
+	code := flag.String("code", "", "one-time bootstrap code from the machine page, exchanged for the token")
+	sign := flag.Bool("sign", true, "register a key when exchanging a bootstrap code, and sign reports with it")
+	dryRun := flag.Bool("dry-run", false, "print the inventory as JSON instead of submitting it")
+	showVersion := flag.Bool("version", false, "print the agent version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println("boxcheckr-agent", Version)
+		return
+	}
+
+	if !*dryRun && *server == "" {
+		fmt.Fprintln(os.Stderr, "Usage: boxcheckr-agent -server URL [-code CODE | -token TOKEN]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	if runtime.GOOS == "linux" && os.Geteuid() != 0 {
+		fmt.Println("Warning: Not running as root. Some checks (firewall status) may be inaccurate.")
+		fmt.Println("For best results, run with sudo.")
+		fmt.Println()
+	}
+
+	payload, err := agent.Collect(runtime.GOOS, agent.LocalSystem{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(payload)
+		return
+	}
+
+	fmt.Println("BoxCheckr Agent")
+	fmt.Println("===============")
+	fmt.Printf("Hostname: %s\n", payload.Hostname)
+	fmt.Printf("OS: %s %s\n", payload.OS, payload.OSVersion)
+	fmt.Printf("Disk Encrypted: %s (%s)\n", payload.DiskEncryptionStatus, payload.DiskEncryptionDetails)
+	fmt.Printf("Antivirus: %s (%s)\n", payload.AntivirusStatus, payload.AntivirusDetails)
+	fmt.Printf("Firewall: %s (%s)\n", payload.FirewallStatus, payload.FirewallDetails)
+	fmt.Printf("Screen Lock: %s (%s)\n", payload.ScreenLockStatus, payload.ScreenLockDetails)
+	fmt.Println()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var key ed25519.PrivateKey
+	if *token == "" {
+		t, k, err := resolveToken(ctx, *server, *code, *sign)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		*token, key = t, k
+	} else {
+		key = savedKey()
+	}
+
+	fmt.Printf("Sending inventory to %s...\n", *server)
+
+	if err := agent.Submit(ctx, http.DefaultClient, *server, *token, key, payload); err != nil {
+		fmt.Printf("Error submitting inventory: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Success! Inventory submitted.")
+}
+
+// resolveToken exchanges a bootstrap code for the machine's token and saves it,
+// or falls back to the token saved by an earlier run. It also returns the key
+// to sign reports with: with sign, a new key is registered along with the
+// code; otherwise it's the saved key, if any.
+func resolveToken(ctx context.Context, server, code string, sign bool) (string, ed25519.PrivateKey, error) {
+	path, pathErr := agent.TokenPath()
+
+	if code != "" {
+		var publicKey ed25519.PublicKey
+		var key ed25519.PrivateKey
+		if sign {
+			var err error
+			if publicKey, key, err = ed25519.GenerateKey(nil); err != nil {
+				return "", nil, err
+			}
+		}
+
+		token, err := agent.Bootstrap(ctx, http.DefaultClient, server, code, publicKey)
+		if err == nil {
+			if pathErr == nil {
+				if err := agent.SaveToken(path, token); err != nil {
+					fmt.Printf("Warning: could not save token to %s: %v\n", path, err)
+				}
+			}
+			if key != nil {
+				if keyPath, err := agent.KeyPath(); err == nil {
+					if err := agent.SaveKey(keyPath, key); err != nil {
+						fmt.Printf("Warning: could not save signing key to %s: %v\n", keyPath, err)
+					}
+				}
+			}
+			return token, key, nil
+		}
+		fmt.Printf("Warning: bootstrap code rejected (%v); trying saved token\n", err)
+	}
+
+	if pathErr != nil {
+		return "", nil, pathErr
+	}
+	token, err := agent.LoadToken(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("no token: copy a fresh command from the machine page")
+	}
+	return token, savedKey(), nil
+}
+
+// savedKey returns the signing key saved by an earlier run, or nil if the
+// machine sends unsigned reports
+func savedKey() ed25519.PrivateKey {
+	path, err := agent.KeyPath()
+	if err != nil {
+		return nil
+	}
+	key, err := agent.LoadKey(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: %v; sending an unsigned report\n", err)
+		}
+		return nil
+	}
+	return key
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/backup"
+)
+
+const backupUsage = `Usage: boxcheckr backup [file]
+
+Writes a consistent copy of the SQLite database at DATABASE_PATH, and can run
+while the server does. Without a file, the copy goes in BACKUP_DIR (or the
+current directory) as boxcheckr-YYYYMMDD-HHMMSS.db.
+`
+
+const restoreUsage = `Usage: boxcheckr restore file
+
+Replaces the SQLite database at DATABASE_PATH with a backup. Stop the server
+first. The backup is checked before anything changes, and the current
+database is kept alongside as DATABASE_PATH.pre-restore-YYYYMMDD-HHMMSS.
+`
+
+const exportUsage = `Usage: boxcheckr export [file]
+
+Writes every table as JSON to file, or to stdout without one, for moving to
+another instance with boxcheckr import. Works with SQLite and PostgreSQL.
+`
+
+const importUsage = `Usage: boxcheckr import file
+
+Loads a boxcheckr export into the database at DATABASE_URL or DATABASE_PATH,
+which must be empty. Use - to read from stdin.
+`
+
+// parseArgs parses a command's flags and returns its arguments, of which
+// there must be between min and max
+func parseArgs(name, usage string, args []string, min, max int) ([]string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), usage) }
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() < min || fs.NArg() > max {
+		fs.Usage()
+		return nil, fmt.Errorf("wrong number of arguments: %d", fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+// runBackup implements the backup command
+func runBackup(dbPath, databaseURL, backupDir string, args []string) error {
+	args, err := parseArgs("backup", backupUsage, args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	database, err := openDatabase(dbPath, databaseURL, false)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	path := ""
+	if len(args) == 1 {
+		path = args[0]
+		err = database.Backup(path)
+	} else {
+		if backupDir == "" {
+			backupDir = "."
+		}
+		path, err = backup.Create(database, backupDir, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Backed up to %s\n", path)
+	return nil
+}
+
+// runRestore implements the restore command
+func runRestore(dbPath, databaseURL string, args []string) error {
+	args, err := parseArgs("restore", restoreUsage, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if databaseURL != "" {
+		return errors.New("restore only supports SQLite; use pg_restore or boxcheckr import for PostgreSQL")
+	}
+
+	aside, err := backup.Restore(args[0], dbPath, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s to %s\n", args[0], dbPath)
+	if aside != "" {
+		fmt.Printf("The previous database is at %s\n", aside)
+	}
+	return nil
+}
+
+// runExport implements the export command
+func runExport(dbPath, databaseURL string, args []string) error {
+	args, err := parseArgs("export", exportUsage, args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	database, err := openDatabase(dbPath, databaseURL, true)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	if len(args) == 0 || args[0] == "-" {
+		return database.Export(os.Stdout)
+	}
+
+	// Write to a temporary file so a failed export leaves nothing behind
+	tmp, err := os.CreateTemp(filepath.Dir(args[0]), ".boxcheckr-export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := database.Export(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), args[0])
+}
+
+// runImport implements the import command
+func runImport(dbPath, databaseURL string, args []string) error {
+	args, err := parseArgs("import", importUsage, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	database, err := openDatabase(dbPath, databaseURL, true)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	if err := database.Import(r); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Imported %s\n", args[0])
+	return nil
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/jclement/boxcheckr/internal/auth"
-	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/backup"
 	"github.com/jclement/boxcheckr/internal/handlers"
 	"github.com/jclement/boxcheckr/internal/middleware"
+	"github.com/jclement/boxcheckr/internal/notify"
+	"github.com/jclement/boxcheckr/internal/retention"
+	"github.com/jclement/boxcheckr/internal/webhook"
 )
 
 // Version is set at build time via ldflags
@@ -30,21 +36,174 @@ func main() {
 		dbPath = "./boxcheckr.db"
 	}
 
-	database, err := db.New(dbPath)
+	// DATABASE_URL selects PostgreSQL instead of the SQLite file
+	databaseURL := os.Getenv("DATABASE_URL")
+
+	// Backups are written here by the scheduler and the admin page
+	backupDir := os.Getenv("BACKUP_DIR")
+
+	if len(os.Args) > 1 {
+		var err error
+		switch cmd := os.Args[1]; cmd {
+		case "migrate":
+			err = runMigrate(dbPath, databaseURL, os.Args[2:])
+		case "backup":
+			err = runBackup(dbPath, databaseURL, backupDir, os.Args[2:])
+		case "restore":
+			err = runRestore(dbPath, databaseURL, os.Args[2:])
+		case "export":
+			err = runExport(dbPath, databaseURL, os.Args[2:])
+		case "import":
+			err = runImport(dbPath, databaseURL, os.Args[2:])
+		default:
+			log.Fatalf("Unknown command %q (expected migrate, backup, restore, export or import)", cmd)
+		}
+		if err != nil {
+			log.Fatalf("%s failed: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	agentDir := os.Getenv("AGENT_DIR")
+	if agentDir == "" {
+		agentDir = "./agents"
+	}
+
+	// Machines that go this many days without reporting are shown as overdue
+	checkInDays := 8
+	if v := os.Getenv("CHECKIN_SLA_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 {
+			log.Fatalf("Invalid CHECKIN_SLA_DAYS: %q", v)
+		}
+		checkInDays = days
+	}
+
+	// Archived machines can be purged once archived this many days
+	archivePurgeDays := 365
+	if v := os.Getenv("ARCHIVE_PURGE_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			log.Fatalf("Invalid ARCHIVE_PURGE_DAYS: %q", v)
+		}
+		archivePurgeDays = days
+	}
+
+	// Snapshots older than RETENTION_DAYS are thinned; unset keeps them all
+	retentionPolicy, err := retention.ParsePolicy(os.Getenv("RETENTION_DAYS"), os.Getenv("RETENTION_PERIOD"))
+	if err != nil {
+		log.Fatalf("Invalid retention settings: %v", err)
+	}
+
+	// Scheduled backups need both BACKUP_DIR and BACKUP_INTERVAL
+	var backupInterval time.Duration
+	if v := os.Getenv("BACKUP_INTERVAL"); v != "" {
+		backupInterval, err = time.ParseDuration(v)
+		if err != nil || backupInterval < time.Minute {
+			log.Fatalf("Invalid BACKUP_INTERVAL: %q", v)
+		}
+	}
+	backupKeep := 7
+	if v := os.Getenv("BACKUP_KEEP"); v != "" {
+		backupKeep, err = strconv.Atoi(v)
+		if err != nil || backupKeep < 0 {
+			log.Fatalf("Invalid BACKUP_KEEP: %q", v)
+		}
+	}
+
+	database, err := openDatabase(dbPath, databaseURL, true)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer database.Close()
 
-	oidcProvider, err := auth.NewOIDCProvider(baseURL)
-	if err != nil {
-		log.Fatalf("Failed to initialize OIDC provider: %v", err)
+	// DEV_AUTH replaces OIDC with a user picker, so the UI works offline
+	devAuth := os.Getenv("DEV_AUTH") == "true"
+	var oidcProvider *auth.OIDCProvider
+	if devAuth {
+		log.Printf("WARNING: DEV_AUTH is enabled. Anyone can sign in as any user, including as an admin.")
+		log.Printf("WARNING: Never set DEV_AUTH on a server reachable by others.")
+	} else {
+		oidcConfig, err := auth.ConfigFromEnv()
+		if err != nil {
+			log.Fatalf("Invalid OIDC settings: %v", err)
+		}
+		oidcProvider, err = auth.NewOIDCProvider(baseURL, oidcConfig)
+		if err != nil {
+			log.Fatalf("Failed to initialize OIDC provider: %v", err)
+		}
 	}
 
-	sessionStore := middleware.NewSessionStore()
+	// Thin out old snapshots in the background, if configured
+	retentionJob := retention.New(database, retentionPolicy)
+	go retentionJob.Run(context.Background())
+
+	// Back up the database on a schedule, if configured
+	if backupDir != "" && backupInterval > 0 {
+		go backup.NewScheduler(database, backupDir, backupInterval, backupKeep).Run(context.Background())
+		log.Printf("Backing up to %s every %s, keeping %d", backupDir, backupInterval, backupKeep)
+	}
+
+	// Deliver queued webhook events in the background
+	go webhook.NewWorker(database).Run(context.Background())
+
+	// Email notifications are enabled by configuring an SMTP server
+	var notifier *notify.Notifier
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		cfg := notify.SMTPConfig{
+			Host:     smtpHost,
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+		}
+		if cfg.Port == "" {
+			cfg.Port = "587"
+		}
+		if cfg.From == "" {
+			log.Fatalf("SMTP_FROM is required when SMTP_HOST is set")
+		}
+
+		notifier, err = notify.New(database, notify.NewSMTPSender(cfg), baseURL, os.Getenv("NOTIFY_TEMPLATE_DIR"))
+		if err != nil {
+			log.Fatalf("Failed to initialize email notifications: %v", err)
+		}
+		go notifier.Run(context.Background())
+		log.Printf("Email notifications enabled via %s:%s", cfg.Host, cfg.Port)
+	}
+
+	sessionConfig, err := middleware.SessionConfigFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := middleware.SetTrustedProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		log.Fatalf("%v", err)
+	}
+	// Only re-validate with the provider when there is one; a nil
+	// *OIDCProvider in the interface would look configured
+	var revalidator middleware.Revalidator
+	if oidcProvider != nil {
+		revalidator = oidcProvider
+	}
+	sessionStore := middleware.NewSessionStore(database, sessionConfig, revalidator)
+	go sessionStore.Run(context.Background())
 	authMiddleware := middleware.NewAuthMiddleware(sessionStore, database)
 
-	h := handlers.New(database, oidcProvider, sessionStore, baseURL, Version)
+	h := handlers.New(handlers.Config{
+		DB:               database,
+		OIDC:             oidcProvider,
+		Sessions:         sessionStore,
+		BaseURL:          baseURL,
+		Version:          Version,
+		AgentDir:         agentDir,
+		CheckInDays:      checkInDays,
+		ArchivePurgeDays: archivePurgeDays,
+		Notifier:         notifier,
+		Retention:        retentionJob,
+		BackupDir:        backupDir,
+		BackupKeep:       backupKeep,
+		DevAuth:          devAuth,
+	})
 
 	mux := http.NewServeMux()
 
@@ -55,33 +214,90 @@ func main() {
 	mux.HandleFunc("GET /auth/login", h.Login)
 	mux.HandleFunc("GET /auth/callback", h.Callback)
 	mux.HandleFunc("GET /auth/logout", h.Logout)
+	if devAuth {
+		mux.HandleFunc("GET /auth/dev", h.DevLogin)
+		mux.HandleFunc("POST /auth/dev", h.DevLoginSubmit)
+	}
 
 	// User routes (require auth)
 	mux.Handle("GET /", authMiddleware.RequireAuth(http.HandlerFunc(h.Dashboard)))
 	mux.Handle("GET /enroll", authMiddleware.RequireAuth(http.HandlerFunc(h.EnrollPage)))
 	mux.Handle("POST /enroll", authMiddleware.RequireAuth(http.HandlerFunc(h.EnrollMachine)))
 	mux.Handle("GET /machines/{id}", authMiddleware.RequireAuth(http.HandlerFunc(h.MachineDetail)))
-	mux.Handle("POST /machines/{id}/delete", authMiddleware.RequireAuth(http.HandlerFunc(h.DeleteMachine)))
+	mux.Handle("GET /machines/{id}/snapshots/{a}/diff/{b}", authMiddleware.RequireAuth(http.HandlerFunc(h.SnapshotDiffPage)))
+	mux.Handle("POST /machines/{id}/install-command", authMiddleware.RequireAuth(http.HandlerFunc(h.GenerateInstallCommand)))
+	mux.Handle("POST /machines/{id}/archive", authMiddleware.RequireAuth(http.HandlerFunc(h.ArchiveMachine)))
+	mux.Handle("POST /machines/{id}/token/rotate", authMiddleware.RequireAuth(http.HandlerFunc(h.RotateMachineToken)))
+	mux.Handle("POST /machines/{id}/token/disable", authMiddleware.RequireAuth(http.HandlerFunc(h.DisableMachineToken)))
+	mux.Handle("POST /machines/{id}/token/enable", authMiddleware.RequireAuth(http.HandlerFunc(h.EnableMachineToken)))
+	mux.Handle("POST /machines/{id}/signing-key/clear", authMiddleware.RequireAuth(http.HandlerFunc(h.ClearMachineSigningKey)))
+	mux.Handle("POST /settings/notifications", authMiddleware.RequireAuth(http.HandlerFunc(h.UpdateNotificationSettings)))
+	mux.Handle("POST /auth/logout-everywhere", authMiddleware.RequireAuth(http.HandlerFunc(h.LogoutEverywhere)))
 
 	// Script endpoint - NO AUTH (called by curl from terminal)
 	mux.HandleFunc("GET /machines/{id}/script", h.MachineScript)
 
+	// Compiled agent downloads - NO AUTH (binaries contain no secrets)
+	mux.HandleFunc("GET /agent/{os}/{arch}", h.AgentBinary)
+
 	// Machine notes (admin only)
 	mux.Handle("POST /machines/{id}/notes", authMiddleware.RequireAdmin(http.HandlerFunc(h.AddMachineNote)))
 	mux.Handle("POST /machines/{id}/notes/{noteId}/delete", authMiddleware.RequireAdmin(http.HandlerFunc(h.DeleteMachineNote)))
 
+	// Check-in interval override (admin only)
+	mux.Handle("POST /machines/{id}/checkin", authMiddleware.RequireAdmin(http.HandlerFunc(h.SetMachineCheckIn)))
+
+	// Legal hold, exempting a machine from snapshot retention (admin only)
+	mux.Handle("POST /machines/{id}/legal-hold", authMiddleware.RequireAdmin(http.HandlerFunc(h.SetMachineLegalHold)))
+
 	// Admin routes (require admin)
 	mux.Handle("GET /admin/machines", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminMachines)))
-	mux.Handle("POST /admin/machines/{id}/delete", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminDeleteMachine)))
+	mux.Handle("GET /admin/machines/export", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminExportMachines)))
+	mux.Handle("GET /admin/machines/archived", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminArchivedMachines)))
+	mux.Handle("POST /admin/machines/{id}/archive", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminArchiveMachine)))
+	mux.Handle("POST /admin/machines/{id}/restore", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminRestoreMachine)))
+	mux.Handle("POST /admin/machines/{id}/purge", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminPurgeMachine)))
 	mux.Handle("GET /admin/share", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminShareLinks)))
 	mux.Handle("POST /admin/share", authMiddleware.RequireAdmin(http.HandlerFunc(h.CreateShareLink)))
+	mux.Handle("GET /admin/share/{id}", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminShareLink)))
+	mux.Handle("POST /admin/share/{id}/expiry", authMiddleware.RequireAdmin(http.HandlerFunc(h.UpdateShareLinkExpiry)))
+	mux.Handle("POST /admin/share/{id}/revoke", authMiddleware.RequireAdmin(http.HandlerFunc(h.RevokeShareLink)))
 	mux.Handle("POST /admin/share/{id}/delete", authMiddleware.RequireAdmin(http.HandlerFunc(h.DeleteShareLink)))
+	mux.Handle("GET /admin/policies", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminPolicies)))
+	mux.Handle("POST /admin/policies", authMiddleware.RequireAdmin(http.HandlerFunc(h.CreatePolicyRule)))
+	mux.Handle("POST /admin/policies/{id}/toggle", authMiddleware.RequireAdmin(http.HandlerFunc(h.TogglePolicyRule)))
+	mux.Handle("POST /admin/policies/{id}/delete", authMiddleware.RequireAdmin(http.HandlerFunc(h.DeletePolicyRule)))
+	mux.Handle("GET /admin/webhooks", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminWebhooks)))
+	mux.Handle("POST /admin/webhooks", authMiddleware.RequireAdmin(http.HandlerFunc(h.CreateWebhook)))
+	mux.Handle("POST /admin/webhooks/{id}/toggle", authMiddleware.RequireAdmin(http.HandlerFunc(h.ToggleWebhook)))
+	mux.Handle("POST /admin/webhooks/{id}/delete", authMiddleware.RequireAdmin(http.HandlerFunc(h.DeleteWebhook)))
+	mux.Handle("GET /admin/api-keys", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminAPIKeys)))
+	mux.Handle("POST /admin/api-keys", authMiddleware.RequireAdmin(http.HandlerFunc(h.CreateAPIKey)))
+	mux.Handle("POST /admin/api-keys/{id}/delete", authMiddleware.RequireAdmin(http.HandlerFunc(h.DeleteAPIKey)))
+	mux.Handle("GET /admin/retention", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminRetention)))
+	mux.Handle("POST /admin/retention/run", authMiddleware.RequireAdmin(http.HandlerFunc(h.RunRetention)))
+	mux.Handle("GET /admin/backups", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminBackups)))
+	mux.Handle("POST /admin/backups", authMiddleware.RequireAdmin(http.HandlerFunc(h.CreateBackup)))
+	mux.Handle("GET /admin/backups/{name}", authMiddleware.RequireAdmin(http.HandlerFunc(h.DownloadBackup)))
+	mux.Handle("GET /admin/sessions", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminSessions)))
+	mux.Handle("POST /admin/sessions/{id}/delete", authMiddleware.RequireAdmin(http.HandlerFunc(h.RevokeSession)))
+	mux.Handle("POST /admin/users/{id}/sessions/delete", authMiddleware.RequireAdmin(http.HandlerFunc(h.RevokeUserSessions)))
+	mux.Handle("GET /admin/audit", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminAudit)))
+	mux.Handle("GET /admin/audit/export", authMiddleware.RequireAdmin(http.HandlerFunc(h.AdminExportAudit)))
 
 	// Public share link view (NO AUTH)
 	mux.HandleFunc("GET /share/{id}", h.ViewSharedInventory)
+	mux.HandleFunc("POST /share/{id}", h.UnlockSharedInventory)
 
 	// API routes (token auth)
 	mux.HandleFunc("POST /api/v1/inventory", h.SubmitInventory)
+	mux.HandleFunc("POST /api/v1/bootstrap", h.BootstrapExchange)
+
+	// Read-only REST API (API key auth)
+	mux.HandleFunc("GET /api/v1/machines", h.APIListMachines)
+	mux.HandleFunc("GET /api/v1/machines/{id}", h.APIGetMachine)
+	mux.HandleFunc("GET /api/v1/machines/{id}/snapshots", h.APIListSnapshots)
+	mux.HandleFunc("GET /api/v1/users", h.APIListUsers)
 
 	log.Printf("BoxCheckr starting on port %s", port)
 	log.Printf("Base URL: %s", baseURL)
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+const migrateUsage = `Usage: boxcheckr migrate [-dry-run]
+       boxcheckr migrate status
+
+Applies pending schema migrations to DATABASE_URL (PostgreSQL) if it is set,
+otherwise to DATABASE_PATH (SQLite). The server also does this at startup.
+-dry-run applies them in a transaction that is rolled back, to check they
+would succeed. status lists every migration and when it was applied.
+`
+
+// openDatabase opens PostgreSQL if databaseURL is set, otherwise the SQLite
+// file at dbPath, applying pending migrations if migrate is set
+func openDatabase(dbPath, databaseURL string, migrate bool) (*db.DB, error) {
+	switch {
+	case databaseURL != "" && migrate:
+		return db.NewPostgres(databaseURL)
+	case databaseURL != "":
+		return db.OpenPostgres(databaseURL)
+	case migrate:
+		return db.New(dbPath)
+	default:
+		return db.Open(dbPath)
+	}
+}
+
+// runMigrate implements the migrate command
+func runMigrate(dbPath, databaseURL string, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(fs.Output(), migrateUsage) }
+	dryRun := fs.Bool("dry-run", false, "check pending migrations without applying them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	status := false
+	switch fs.Arg(0) {
+	case "":
+	case "status":
+		status = true
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate command %q", fs.Arg(0))
+	}
+
+	database, err := openDatabase(dbPath, databaseURL, false)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	if status {
+		migrations, err := database.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, m := range migrations {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+		}
+		return tw.Flush()
+	}
+
+	applied, err := database.Migrate(*dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "Applied"
+	if *dryRun {
+		verb = "Would apply"
+	}
+	for _, m := range applied {
+		fmt.Printf("%s migration %d: %s\n", verb, m.Version, m.Name)
+	}
+	if len(applied) == 0 {
+		fmt.Printf("Database is up to date (version %d)\n", database.SchemaVersion())
+	}
+	return nil
+}
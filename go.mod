@@ -1,12 +1,15 @@
 module github.com/jclement/boxcheckr
 
-go 1.25
+go 1.25.0
 
 require (
 	github.com/coreos/go-oidc/v3 v3.10.0
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/sessions v1.2.2
+	github.com/jackc/pgx/v5 v5.11.0
+	golang.org/x/crypto v0.19.0
 	golang.org/x/oauth2 v0.18.0
+	golang.org/x/sync v0.17.0
 	modernc.org/sqlite v1.46.1
 )
 
@@ -15,12 +18,15 @@ require (
 	github.com/go-jose/go-jose/v4 v4.0.1 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/gorilla/securecookie v1.1.2 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
+	github.com/jackc/puddle/v2 v2.2.2 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/ncruces/go-strftime v1.0.0 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
-	golang.org/x/crypto v0.19.0 // indirect
 	golang.org/x/exp v0.0.0-20251023183803-a4bb9ffd2546 // indirect
 	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/text v0.29.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
 	modernc.org/libc v1.67.6 // indirect
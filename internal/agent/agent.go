@@ -0,0 +1,223 @@
+// Package agent collects the BoxCheckr inventory on the local machine and
+// submits it to the server. It performs the same checks as the shell and
+// PowerShell scripts, but builds the payload with encoding/json.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/inventory"
+)
+
+// System is the agent's view of the host. Collectors only touch the machine
+// through it so they can be tested against recorded command output.
+type System interface {
+	// Run executes a command and returns its combined output
+	Run(name string, args ...string) (string, error)
+	HasCommand(name string) bool
+	ReadFile(path string) (string, error)
+	Exists(path string) bool
+	Glob(pattern string) []string
+	Hostname() (string, error)
+	HomeDir() string
+	Now() time.Time
+}
+
+// Collector fills in part of the inventory payload
+type Collector interface {
+	Name() string
+	Collect(sys System, p *inventory.Payload)
+}
+
+type collector struct {
+	name    string
+	collect func(sys System, p *inventory.Payload)
+}
+
+func (c collector) Name() string                             { return c.name }
+func (c collector) Collect(sys System, p *inventory.Payload) { c.collect(sys, p) }
+
+// Collectors returns the checks for a platform (a GOOS value)
+func Collectors(goos string) ([]Collector, error) {
+	switch goos {
+	case "linux":
+		return linuxCollectors, nil
+	case "darwin":
+		return darwinCollectors, nil
+	case "windows":
+		return windowsCollectors, nil
+	}
+	return nil, fmt.Errorf("unsupported platform %q", goos)
+}
+
+// Collect runs every collector for the platform and returns the payload.
+// Collectors only set a control's status when they couldn't check it;
+// the server takes the rest from the booleans.
+func Collect(goos string, sys System) (*inventory.Payload, error) {
+	collectors, err := Collectors(goos)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &inventory.Payload{OS: goos}
+	if hostname, err := sys.Hostname(); err == nil {
+		p.Hostname = hostname
+	}
+
+	for _, c := range collectors {
+		c.Collect(sys, p)
+	}
+	return p, nil
+}
+
+// Submit posts the payload to the server's inventory endpoint, signed with
+// key unless it is nil
+func Submit(ctx context.Context, client *http.Client, serverURL, token string, key ed25519.PrivateKey, p *inventory.Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimRight(serverURL, "/") + "/api/v1/inventory"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	if key != nil {
+		if err := inventory.Sign(req.Header, key, body, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	var result struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil || result.Status != "ok" {
+		return fmt.Errorf("unexpected response: %s", strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
+
+// LocalSystem runs real commands on the current machine
+type LocalSystem struct {
+	// Timeout bounds each command; zero means 30 seconds
+	Timeout time.Duration
+}
+
+func (s LocalSystem) Run(name string, args ...string) (string, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	return string(out), err
+}
+
+func (s LocalSystem) HasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+func (s LocalSystem) ReadFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	return string(data), err
+}
+
+func (s LocalSystem) Exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (s LocalSystem) Glob(pattern string) []string {
+	matches, _ := filepath.Glob(pattern)
+	return matches
+}
+
+func (s LocalSystem) Hostname() (string, error) {
+	return os.Hostname()
+}
+
+func (s LocalSystem) HomeDir() string {
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+func (s LocalSystem) Now() time.Time {
+	return time.Now()
+}
+
+// succeeded runs a command and reports whether it exited cleanly
+func succeeded(sys System, name string, args ...string) bool {
+	_, err := sys.Run(name, args...)
+	return err == nil
+}
+
+// appendDetail joins detail strings the way the scripts do ("a, b")
+func appendDetail(details, more string) string {
+	if details == "" {
+		return more
+	}
+	return details + ", " + more
+}
+
+// daysSince returns the whole days between t and the system's clock
+func daysSince(sys System, t time.Time) *int {
+	days := int(sys.Now().Sub(t).Hours() / 24)
+	return &days
+}
+
+// countLines counts the lines of out that satisfy match
+func countLines(out string, match func(line string) bool) *int {
+	n := 0
+	for _, line := range strings.Split(out, "\n") {
+		if match(strings.TrimSpace(line)) {
+			n++
+		}
+	}
+	return &n
+}
+
+// bootTime formats a boot time the way the scripts report it
+func bootTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// addCheck records a named check with one of the inventory.Check* statuses
+func addCheck(p *inventory.Payload, id, status, value, details string) {
+	p.Checks = append(p.Checks, inventory.Check{ID: id, Status: status, Value: value, Details: details})
+}
+
+// passIf is the status of a check that was made
+func passIf(passed bool) string {
+	if passed {
+		return inventory.CheckPass
+	}
+	return inventory.CheckFail
+}
@@ -0,0 +1,480 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/inventory"
+)
+
+// fakeSystem answers commands and file reads from fixtures. Commands that are
+// not listed fail, like pgrep with no match.
+type fakeSystem struct {
+	commands map[string]string
+	files    map[string]string
+	home     string
+	now      time.Time
+}
+
+func cmdline(name string, args ...string) string {
+	return strings.Join(append([]string{name}, args...), " ")
+}
+
+func ps(script string) string {
+	return cmdline("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+}
+
+func (f *fakeSystem) Run(name string, args ...string) (string, error) {
+	out, ok := f.commands[cmdline(name, args...)]
+	if !ok {
+		return "", fmt.Errorf("exit status 1")
+	}
+	return out, nil
+}
+
+func (f *fakeSystem) HasCommand(name string) bool {
+	for cmd := range f.commands {
+		if cmd == name || strings.HasPrefix(cmd, name+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeSystem) ReadFile(p string) (string, error) {
+	data, ok := f.files[p]
+	if !ok {
+		return "", fmt.Errorf("%s: no such file", p)
+	}
+	return data, nil
+}
+
+func (f *fakeSystem) Exists(p string) bool {
+	if _, ok := f.files[p]; ok {
+		return true
+	}
+	for name := range f.files {
+		if strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeSystem) Glob(pattern string) []string {
+	var matches []string
+	for name := range f.files {
+		for dir := name; dir != "/" && dir != "."; dir = path.Dir(dir) {
+			if ok, _ := path.Match(pattern, dir); ok {
+				matches = append(matches, dir)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+func (f *fakeSystem) Hostname() (string, error) { return "test-host", nil }
+func (f *fakeSystem) HomeDir() string           { return f.home }
+func (f *fakeSystem) Now() time.Time            { return f.now }
+
+func intPtr(n int) *int { return &n }
+
+// booted is the boot time in the fixtures, 2024-05-01T08:30:00Z
+const booted = 1714552200
+
+func TestCollectLinux(t *testing.T) {
+	sys := &fakeSystem{
+		home: "/home/alice",
+		now:  time.Unix(booted, 0).Add(3*24*time.Hour + 5*time.Hour),
+		commands: map[string]string{
+			"uname -r":                        "6.8.0-31-generic\n",
+			"stat -c %Y /var/lib/dpkg/status": "1714552200\n",
+			"apt-get -s upgrade": "NOTE: This is only a simulation!\n" +
+				"Inst libssl3 [3.0.13-0ubuntu3] (3.0.13-0ubuntu3.1 Ubuntu:24.04/noble-updates, Ubuntu:24.04/noble-security [amd64])\n" +
+				"Inst tzdata [2024a-2] (2024a-3ubuntu1 Ubuntu:24.04/noble-updates [all])\n" +
+				"Conf libssl3 (3.0.13-0ubuntu3.1 Ubuntu:24.04/noble-updates, Ubuntu:24.04/noble-security [amd64])\n",
+			"lsblk -o TYPE":          "TYPE\ndisk\npart\ncrypt\nlvm\n",
+			"pgrep -x falcon-sensor": "1234\n",
+			"ufw status":             "Status: inactive\n",
+			"gsettings get org.gnome.desktop.screensaver lock-enabled": "true\n",
+			"gsettings get org.gnome.desktop.session idle-delay":       "uint32 300\n",
+		},
+		files: map[string]string{
+			"/etc/os-release": "NAME=\"Ubuntu\"\nVERSION_ID=\"24.04\"\nID=ubuntu\n",
+			aptAutoUpgrades:   "APT::Periodic::Update-Package-Lists \"1\";\nAPT::Periodic::Unattended-Upgrade \"1\";\n",
+			"/proc/stat":      "cpu  4705 356 584 3699 23 23 0 0 0 0\nbtime 1714552200\nprocesses 3400\n",
+			sshdConfig:        "Include /etc/ssh/sshd_config.d/*.conf\nPermitRootLogin yes\n",
+			"/etc/ssh/sshd_config.d/50-cloud-init.conf": "PasswordAuthentication no\n",
+			"/etc/ssh/sshd_config.d/60-hardening.conf":  "permitrootlogin no\n",
+		},
+	}
+
+	p, err := Collect("linux", sys)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+
+	want := inventory.Payload{
+		Hostname:              "test-host",
+		OS:                    "linux",
+		OSVersion:             "24.04",
+		DiskEncrypted:         true,
+		DiskEncryptionDetails: "LUKS encryption detected",
+		AntivirusEnabled:      true,
+		AntivirusDetails:      "CrowdStrike Falcon",
+		FirewallEnabled:       false,
+		FirewallDetails:       "ufw inactive",
+		ScreenLockEnabled:     true,
+		ScreenLockTimeout:     5,
+		ScreenLockDetails:     "GNOME screen lock after 5 minutes",
+
+		OSBuild:                "6.8.0-31-generic",
+		DaysSinceUpdate:        intPtr(3),
+		PendingSecurityUpdates: intPtr(1),
+		AutoUpdateEnabled:      true,
+		AutoUpdateDetails:      "unattended-upgrades enabled",
+		LastBootAt:             "2024-05-01T08:30:00Z",
+
+		Checks: []inventory.Check{
+			{ID: "ssh_root_login_disabled", Status: "pass", Value: "no", Details: "PermitRootLogin no (/etc/ssh/sshd_config.d/60-hardening.conf)"},
+		},
+	}
+	if !reflect.DeepEqual(*p, want) {
+		t.Errorf("Unexpected payload:\n got %+v\nwant %+v", *p, want)
+	}
+}
+
+func TestCollectLinuxFallbacks(t *testing.T) {
+	sys := &fakeSystem{
+		home: "/home/bob",
+		now:  time.Unix(booted, 0).Add(40 * 24 * time.Hour),
+		commands: map[string]string{
+			"rpm -qa --qf %{INSTALLTIME}\\n":                           "1714000000\n1714552200\n1713000000\n",
+			"dnf -q updateinfo list --security":                        "FEDORA-2024-1a2b Important/Sec. openssl-1:3.2.1-2.fc40.x86_64\nFEDORA-2024-3c4d Moderate/Sec.  curl-8.6.0-8.fc40.x86_64\n",
+			"systemctl is-enabled --quiet dnf-automatic-install.timer": "",
+			"systemctl is-active --quiet firewalld":                    "",
+			"firewall-cmd":                                             "",
+			"pgrep -x clamd":                                           "99\n",
+		},
+		files: map[string]string{
+			"/sys/class/block/dm-0/dm/uuid":     "CRYPT-LUKS2-abc-luks\n",
+			"/home/bob/.config/kscreenlockerrc": "[Daemon]\nAutolock=true\nTimeout=10\n",
+			sshdConfig:                          "#PermitRootLogin prohibit-password\nMatch User backup\n    PermitRootLogin yes\n",
+		},
+	}
+
+	p, err := Collect("linux", sys)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+
+	if p.OSVersion != "unknown" {
+		t.Errorf("Expected unknown OS version without os-release, got %q", p.OSVersion)
+	}
+	if !p.DiskEncrypted || p.DiskEncryptionDetails != "dm-crypt encryption detected" {
+		t.Errorf("Expected dm-crypt detection, got %v %q", p.DiskEncrypted, p.DiskEncryptionDetails)
+	}
+	if !p.AntivirusEnabled || p.AntivirusDetails != "ClamAV active" {
+		t.Errorf("Expected ClamAV, got %v %q", p.AntivirusEnabled, p.AntivirusDetails)
+	}
+	if !p.FirewallEnabled || p.FirewallDetails != "firewalld active" {
+		t.Errorf("Expected firewalld, got %v %q", p.FirewallEnabled, p.FirewallDetails)
+	}
+	if !p.ScreenLockEnabled || p.ScreenLockTimeout != 10 {
+		t.Errorf("Expected KDE lock after 10 minutes, got %v %d", p.ScreenLockEnabled, p.ScreenLockTimeout)
+	}
+	if p.DaysSinceUpdate == nil || *p.DaysSinceUpdate != 40 {
+		t.Errorf("Expected the newest RPM install 40 days ago, got %v", p.DaysSinceUpdate)
+	}
+	if p.PendingSecurityUpdates == nil || *p.PendingSecurityUpdates != 2 {
+		t.Errorf("Expected 2 pending security advisories, got %v", p.PendingSecurityUpdates)
+	}
+	if !p.AutoUpdateEnabled || p.AutoUpdateDetails != "dnf-automatic enabled" {
+		t.Errorf("Expected dnf-automatic, got %v %q", p.AutoUpdateEnabled, p.AutoUpdateDetails)
+	}
+	if p.OSBuild != "" || p.LastBootAt != "" {
+		t.Errorf("Expected no build or boot time without uname and /proc/stat, got %q %q", p.OSBuild, p.LastBootAt)
+	}
+	// Root can log in with a key by default, and Match blocks don't count
+	if len(p.Checks) != 1 || p.Checks[0].Status != "fail" || p.Checks[0].Value != "prohibit-password" {
+		t.Errorf("Expected the default PermitRootLogin to fail, got %+v", p.Checks)
+	}
+}
+
+func TestCollectLinuxUnknown(t *testing.T) {
+	// Not root, no lsblk and no desktop: controls it can't check are unknown
+	sys := &fakeSystem{
+		home:     "/home/bob",
+		commands: map[string]string{"ufw": ""},
+	}
+
+	p, err := Collect("linux", sys)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+
+	got := []string{p.DiskEncryptionStatus, p.AntivirusStatus, p.FirewallStatus, p.ScreenLockStatus}
+	// The antivirus was checked, so its status comes from the boolean
+	want := []string{inventory.CheckUnknown, "", inventory.CheckUnknown, inventory.CheckUnknown}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected statuses %v, got %v", want, got)
+	}
+	if p.FirewallDetails != "ufw status unknown (requires root)" {
+		t.Errorf("Unexpected firewall details %q", p.FirewallDetails)
+	}
+	// Without an SSH server there's no root login to disable
+	if len(p.Checks) != 1 || p.Checks[0].Status != inventory.CheckNotApplicable {
+		t.Errorf("Expected the SSH check not to apply without sshd, got %+v", p.Checks)
+	}
+}
+
+func TestCollectDarwin(t *testing.T) {
+	sys := &fakeSystem{
+		now: time.Unix(booted, 0).Add(24 * time.Hour),
+		commands: map[string]string{
+			"sw_vers -buildVersion":                                     "23E224\n",
+			"defaults read " + installHistory:                           installHistoryFixture,
+			"softwareupdate -l":                                         "Software Update Tool\n\nFinding available software\nSoftware Update found the following new or updated software:\n* Label: macOS Sonoma 14.5-23F79\n\tTitle: macOS Sonoma 14.5, Version: 14.5, Size: 6291456K, Recommended: YES, Action: restart,\n",
+			"sysctl -n kern.boottime":                                   "{ sec = 1714552200, usec = 417000 } Wed May  1 08:30:00 2024\n",
+			"spctl --status":                                            "assessments enabled\n",
+			"sw_vers -productVersion":                                   "14.4.1\n",
+			"fdesetup status":                                           "FileVault is On.\n",
+			"pgrep -x SentinelAgent":                                    "512\n",
+			socketfilterfw + " --getglobalstate":                        "Firewall is disabled. (State = 0)\n",
+			"defaults read com.apple.screensaver askForPassword":        "1\n",
+			"defaults -currentHost read com.apple.screensaver idleTime": "600\n",
+		},
+		files: map[string]string{
+			xprotectBundle + "/Contents/Info.plist": "",
+			socketfilterfw:                          "",
+		},
+	}
+
+	p, err := Collect("darwin", sys)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+
+	want := inventory.Payload{
+		Hostname:              "test-host",
+		OS:                    "darwin",
+		OSVersion:             "14.4.1",
+		DiskEncrypted:         true,
+		DiskEncryptionDetails: "FileVault enabled",
+		AntivirusEnabled:      true,
+		AntivirusDetails:      "XProtect active, SentinelOne",
+		FirewallEnabled:       false,
+		FirewallDetails:       "macOS Application Firewall disabled",
+		ScreenLockEnabled:     true,
+		ScreenLockTimeout:     10,
+		ScreenLockDetails:     "Screen lock immediately after 10 min idle",
+
+		OSBuild:                "23E224",
+		DaysSinceUpdate:        intPtr(29),
+		PendingSecurityUpdates: intPtr(1),
+		AutoUpdateEnabled:      false,
+		AutoUpdateDetails:      "macOS updates not installed automatically",
+		LastBootAt:             "2024-05-01T08:30:00Z",
+
+		Checks: []inventory.Check{{ID: "gatekeeper_enabled", Status: "pass", Details: "Gatekeeper enabled"}},
+	}
+	if !reflect.DeepEqual(*p, want) {
+		t.Errorf("Unexpected payload:\n got %+v\nwant %+v", *p, want)
+	}
+}
+
+// installHistoryFixture is `defaults read` of the install history. The newest
+// install came from the App Store, not softwareupdated.
+const installHistoryFixture = `(
+        {
+        date = "2024-03-08 09:15:00 +0000";
+        displayName = "macOS Sonoma 14.4";
+        displayVersion = "14.4";
+        processName = softwareupdated;
+    },
+        {
+        date = "2024-04-02 10:00:00 +0000";
+        displayName = "macOS Sonoma 14.4.1";
+        displayVersion = "14.4.1";
+        packageIdentifiers =         (
+            "com.apple.pkg.update.os.14.4.1.23E224"
+        );
+        processName = softwareupdated;
+    },
+        {
+        date = "2024-04-20 16:45:00 +0000";
+        displayName = Xcode;
+        displayVersion = "15.3";
+        processName = appstoreagent;
+    }
+)
+`
+
+func TestCollectWindows(t *testing.T) {
+	sys := &fakeSystem{
+		now: time.Unix(booted, 0).Add(6 * 24 * time.Hour),
+		commands: map[string]string{
+			ps(psLastUpdate):     "2024-04-25T02:00:00Z\r\n",
+			ps(psPendingUpdates): "2\r\n",
+			ps(psLastBoot):       "2024-05-01T08:30:00Z\r\n",
+			cmdline("reg", "query", regCurrentVersion, "/v", "UBR"):       "\r\nHKEY_LOCAL_MACHINE\\SOFTWARE\\Microsoft\\Windows NT\\CurrentVersion\r\n    UBR    REG_DWORD    0xdbf\r\n",
+			cmdline("reg", "query", regPoliciesSystem, "/v", "EnableLUA"): "\r\nHKEY_LOCAL_MACHINE\\SOFTWARE\\Microsoft\\Windows\\CurrentVersion\\Policies\\System\r\n    EnableLUA    REG_DWORD    0x1\r\n",
+			ps(psOSVersion): "10.0.22631|22631\r\n",
+			ps(psBitLocker): "On|XtsAes128\r\n",
+			ps(psAVProduct): "Windows Defender|397568\r\nNorton Security|266240\r\nOld AV|393472\r\n",
+			ps(psDefender):  "True|2024-05-01\r\n",
+			ps(psFirewall):  "Domain|True\r\nPrivate|True\r\nPublic|False\r\n",
+			cmdline("reg", "query", regDesktop, "/v", "ScreenSaverIsSecure"):          "\r\nHKEY_CURRENT_USER\\Control Panel\\Desktop\r\n    ScreenSaverIsSecure    REG_SZ    1\r\n",
+			cmdline("reg", "query", regDesktop, "/v", "ScreenSaveTimeOut"):            "\r\nHKEY_CURRENT_USER\\Control Panel\\Desktop\r\n    ScreenSaveTimeOut    REG_SZ    900\r\n",
+			cmdline("reg", "query", regDesktop, "/v", "DelayLockInterval"):            "\r\nHKEY_CURRENT_USER\\Control Panel\\Desktop\r\n    DelayLockInterval    REG_DWORD    0x0\r\n",
+			cmdline("powercfg", "/query", "SCHEME_CURRENT", "SUB_VIDEO", "VIDEOIDLE"): "    Current AC Power Setting Index: 0x00000258\r\n    Current DC Power Setting Index: 0x0000012c\r\n",
+		},
+	}
+
+	p, err := Collect("windows", sys)
+	if err != nil {
+		t.Fatalf("Collect failed: %v", err)
+	}
+
+	want := inventory.Payload{
+		Hostname:              "test-host",
+		OS:                    "windows",
+		OSVersion:             "10.0.22631 (Build 22631)",
+		DiskEncrypted:         true,
+		DiskEncryptionDetails: "BitLocker enabled (XtsAes128)",
+		AntivirusEnabled:      true,
+		AntivirusDetails:      "Windows Defender (signatures: 2024-05-01), Norton Security",
+		FirewallEnabled:       true,
+		FirewallDetails:       "Windows Firewall enabled (Domain, Private)",
+		ScreenLockEnabled:     true,
+		ScreenLockTimeout:     10,
+		ScreenLockDetails:     "Sign-in required on wake, Screen saver lock (15 min), Display off (10 min)",
+
+		OSBuild:                "22631.3519",
+		DaysSinceUpdate:        intPtr(12),
+		PendingSecurityUpdates: intPtr(2),
+		AutoUpdateEnabled:      true,
+		AutoUpdateDetails:      "Windows Update installs automatically",
+		LastBootAt:             "2024-05-01T08:30:00Z",
+
+		Checks: []inventory.Check{{ID: "uac_enabled", Status: "pass", Details: "User Account Control enabled"}},
+	}
+	if !reflect.DeepEqual(*p, want) {
+		t.Errorf("Unexpected payload:\n got %+v\nwant %+v", *p, want)
+	}
+}
+
+func TestCollectUnsupported(t *testing.T) {
+	if _, err := Collect("plan9", &fakeSystem{}); err == nil {
+		t.Error("Expected error for unsupported platform")
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	var got inventory.Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/inventory" || r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"status":"ok","machine":"Laptop"}`))
+	}))
+	defer server.Close()
+
+	p := &inventory.Payload{Hostname: "host", DiskEncryptionDetails: `Volume "C:" encrypted`}
+	if err := Submit(context.Background(), server.Client(), server.URL+"/", "tok", nil, p); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, *p) {
+		t.Errorf("Server received %+v, expected %+v", got, *p)
+	}
+
+	if err := Submit(context.Background(), server.Client(), server.URL, "wrong", nil, p); err == nil {
+		t.Error("Expected error for rejected token")
+	}
+}
+
+func TestSubmitSigned(t *testing.T) {
+	publicKey, key, _ := ed25519.GenerateKey(nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if _, err := inventory.Verify(r.Header, publicKey, body, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"status":"ok","machine":"Laptop"}`))
+	}))
+	defer server.Close()
+
+	p := &inventory.Payload{Hostname: "host"}
+	if err := Submit(context.Background(), server.Client(), server.URL, "tok", key, p); err != nil {
+		t.Fatalf("Expected a signed report to verify: %v", err)
+	}
+	if err := Submit(context.Background(), server.Client(), server.URL, "tok", nil, p); err == nil {
+		t.Error("Expected an unsigned report to be rejected")
+	}
+
+	path := filepath.Join(t.TempDir(), "boxcheckr", "key")
+	if err := SaveKey(path, key); err != nil {
+		t.Fatalf("SaveKey failed: %v", err)
+	}
+	if got, err := LoadKey(path); err != nil || !got.Equal(key) {
+		t.Errorf("LoadKey returned a different key (%v)", err)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	var registered string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Code      string `json:"code"`
+			PublicKey string `json:"public_key"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		registered = req.PublicKey
+		if r.URL.Path != "/api/v1/bootstrap" || req.Code != "good" {
+			http.Error(w, "Invalid or expired code", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"token":"machine-token","machine":"Laptop"}`))
+	}))
+	defer server.Close()
+
+	token, err := Bootstrap(context.Background(), server.Client(), server.URL, "good", nil)
+	if err != nil || token != "machine-token" {
+		t.Fatalf("Expected machine-token, got %q (%v)", token, err)
+	}
+	if registered != "" {
+		t.Errorf("Expected no key to be registered, got %q", registered)
+	}
+	if _, err := Bootstrap(context.Background(), server.Client(), server.URL, "spent", nil); err == nil {
+		t.Error("Expected error for rejected code")
+	}
+
+	publicKey, _, _ := ed25519.GenerateKey(nil)
+	Bootstrap(context.Background(), server.Client(), server.URL, "good", publicKey)
+	if registered != inventory.EncodePublicKey(publicKey) {
+		t.Errorf("Expected the public key to be registered, got %q", registered)
+	}
+
+	path := filepath.Join(t.TempDir(), "boxcheckr", "token")
+	if err := SaveToken(path, token); err != nil {
+		t.Fatalf("SaveToken failed: %v", err)
+	}
+	if got, err := LoadToken(path); err != nil || got != token {
+		t.Errorf("LoadToken returned %q (%v), expected %q", got, err, token)
+	}
+}
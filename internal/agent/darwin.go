@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/inventory"
+)
+
+var darwinCollectors = []Collector{
+	collector{"os", darwinOSVersion},
+	collector{"disk", darwinDiskEncryption},
+	collector{"antivirus", darwinAntivirus},
+	collector{"firewall", darwinFirewall},
+	collector{"screen lock", darwinScreenLock},
+	collector{"updates", darwinUpdates},
+	collector{"last boot", darwinLastBoot},
+	collector{"gatekeeper", darwinGatekeeper},
+}
+
+const (
+	xprotectBundle       = "/Library/Apple/System/Library/CoreServices/XProtect.bundle"
+	socketfilterfw       = "/usr/libexec/ApplicationFirewall/socketfilterfw"
+	installHistory       = "/Library/Receipts/InstallHistory.plist"
+	softwareUpdatePrefs  = "/Library/Preferences/com.apple.SoftwareUpdate"
+	installHistoryLayout = "2006-01-02 15:04:05 -0700"
+)
+
+var bootTimeRE = regexp.MustCompile(`sec = ([0-9]+)`)
+
+func darwinOSVersion(sys System, p *inventory.Payload) {
+	out, err := sys.Run("sw_vers", "-productVersion")
+	if err != nil {
+		p.OSVersion = "unknown"
+		return
+	}
+	p.OSVersion = strings.TrimSpace(out)
+
+	if out, err := sys.Run("sw_vers", "-buildVersion"); err == nil {
+		p.OSBuild = strings.TrimSpace(out)
+	}
+}
+
+func darwinDiskEncryption(sys System, p *inventory.Payload) {
+	out, _ := sys.Run("fdesetup", "status")
+	if strings.Contains(out, "FileVault is On") {
+		p.DiskEncrypted = true
+		p.DiskEncryptionDetails = "FileVault enabled"
+	} else {
+		p.DiskEncryptionDetails = "FileVault disabled"
+	}
+}
+
+func darwinAntivirus(sys System, p *inventory.Payload) {
+	if sys.Exists(xprotectBundle) {
+		p.AntivirusEnabled = true
+		p.AntivirusDetails = "XProtect active"
+	}
+	if succeeded(sys, "pgrep", "-x", "falcon") || succeeded(sys, "pgrep", "-x", "CrowdStrike") {
+		p.AntivirusDetails = appendDetail(p.AntivirusDetails, "CrowdStrike Falcon")
+	}
+	if succeeded(sys, "pgrep", "-x", "SentinelAgent") {
+		p.AntivirusDetails = appendDetail(p.AntivirusDetails, "SentinelOne")
+	}
+}
+
+func darwinFirewall(sys System, p *inventory.Payload) {
+	if !sys.Exists(socketfilterfw) {
+		p.FirewallStatus = inventory.CheckUnknown
+		p.FirewallDetails = "Firewall status unknown"
+		return
+	}
+
+	out, _ := sys.Run(socketfilterfw, "--getglobalstate")
+	if strings.Contains(out, "enabled") {
+		p.FirewallEnabled = true
+		p.FirewallDetails = "macOS Application Firewall enabled"
+	} else {
+		p.FirewallDetails = "macOS Application Firewall disabled"
+	}
+}
+
+func darwinScreenLock(sys System, p *inventory.Payload) {
+	askForPassword := defaultsRead(sys, "read", "com.apple.screensaver", "askForPassword")
+	askDelay := defaultsRead(sys, "read", "com.apple.screensaver", "askForPasswordDelay")
+
+	// An unset askForPassword means the system default, which requires a
+	// password on modern macOS unless MDM says otherwise
+	if askForPassword == "1" || askForPassword == "" {
+		out, _ := sys.Run("security", "authorizationdb", "read", "system.login.screensaver")
+		if strings.Contains(out, "authenticate-session-owner") {
+			p.ScreenLockEnabled = true
+		}
+		if askDelay == "0" || askDelay == "" || askForPassword == "1" {
+			p.ScreenLockEnabled = true
+		}
+	}
+
+	if !p.ScreenLockEnabled {
+		if askForPassword == "0" {
+			p.ScreenLockDetails = "Password not required after sleep"
+		} else {
+			p.ScreenLockStatus = inventory.CheckUnknown
+			p.ScreenLockDetails = "Screen lock status unknown"
+		}
+		return
+	}
+
+	idleTime, _ := strconv.Atoi(defaultsRead(sys, "-currentHost", "read", "com.apple.screensaver", "idleTime"))
+	displaySleep := pmsetDisplaySleep(sys)
+
+	switch {
+	case idleTime > 0:
+		p.ScreenLockTimeout = idleTime / 60
+		if askDelay == "0" || askDelay == "" {
+			p.ScreenLockDetails = fmt.Sprintf("Screen lock immediately after %d min idle", p.ScreenLockTimeout)
+		} else {
+			delay, _ := strconv.Atoi(askDelay)
+			p.ScreenLockDetails = fmt.Sprintf("Screen lock %d min after %d min idle", delay/60, p.ScreenLockTimeout)
+		}
+	case displaySleep > 0:
+		p.ScreenLockTimeout = displaySleep
+		p.ScreenLockDetails = fmt.Sprintf("Display sleep %d min (password/Touch ID required)", displaySleep)
+	default:
+		p.ScreenLockDetails = "Password/Touch ID required (no auto-idle configured)"
+	}
+}
+
+func darwinUpdates(sys System, p *inventory.Payload) {
+	if last, ok := lastSoftwareUpdate(sys); ok {
+		p.DaysSinceUpdate = daysSince(sys, last)
+	}
+
+	// softwareupdate doesn't say which updates are security fixes, so count
+	// every pending update
+	if out, err := sys.Run("softwareupdate", "-l"); err == nil {
+		p.PendingSecurityUpdates = countLines(out, func(line string) bool { return strings.HasPrefix(line, "* Label:") })
+	}
+
+	if defaultsRead(sys, "read", softwareUpdatePrefs, "AutomaticallyInstallMacOSUpdates") == "1" {
+		p.AutoUpdateEnabled = true
+		p.AutoUpdateDetails = "macOS updates install automatically"
+	} else {
+		p.AutoUpdateDetails = "macOS updates not installed automatically"
+	}
+}
+
+// lastSoftwareUpdate finds the newest install by softwareupdated in the
+// install history. `defaults read` prints each install's keys in order, so
+// its date comes before its processName:
+//
+//	date = "2024-04-02 10:00:00 +0000";
+//	displayName = "macOS Sonoma 14.4.1";
+//	processName = softwareupdated;
+func lastSoftwareUpdate(sys System) (time.Time, bool) {
+	out, err := sys.Run("defaults", "read", installHistory)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var date, last time.Time
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), " = ")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `";`)
+		switch key {
+		case "date":
+			date, _ = time.Parse(installHistoryLayout, value)
+		case "processName":
+			if value == "softwareupdated" && date.After(last) {
+				last = date
+			}
+		}
+	}
+	return last, !last.IsZero()
+}
+
+// darwinLastBoot parses `sysctl -n kern.boottime`, which looks like
+// "{ sec = 1714552200, usec = 0 } Wed May  1 08:30:00 2024"
+func darwinLastBoot(sys System, p *inventory.Payload) {
+	out, err := sys.Run("sysctl", "-n", "kern.boottime")
+	if err != nil {
+		return
+	}
+	if m := bootTimeRE.FindStringSubmatch(out); m != nil {
+		secs, _ := strconv.ParseInt(m[1], 10, 64)
+		p.LastBootAt = bootTime(time.Unix(secs, 0))
+	}
+}
+
+// darwinGatekeeper reads `spctl --status`, which prints "assessments
+// enabled" or "assessments disabled"
+func darwinGatekeeper(sys System, p *inventory.Payload) {
+	out, _ := sys.Run("spctl", "--status")
+	switch strings.TrimSpace(out) {
+	case "assessments enabled":
+		addCheck(p, "gatekeeper_enabled", inventory.CheckPass, "", "Gatekeeper enabled")
+	case "assessments disabled":
+		addCheck(p, "gatekeeper_enabled", inventory.CheckFail, "", "Gatekeeper disabled")
+	default:
+		addCheck(p, "gatekeeper_enabled", inventory.CheckUnknown, "", "Gatekeeper status unknown")
+	}
+}
+
+// defaultsRead returns the value printed by `defaults <args>`, or "" if it is not set
+func defaultsRead(sys System, args ...string) string {
+	out, err := sys.Run("defaults", args...)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// pmsetDisplaySleep returns the displaysleep minutes from `pmset -g`
+func pmsetDisplaySleep(sys System) int {
+	out, err := sys.Run("pmset", "-g")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) >= 2 && f[0] == "displaysleep" {
+			n, _ := strconv.Atoi(f[1])
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,303 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/inventory"
+)
+
+var linuxCollectors = []Collector{
+	collector{"os", linuxOSVersion},
+	collector{"disk", linuxDiskEncryption},
+	collector{"antivirus", linuxAntivirus},
+	collector{"firewall", linuxFirewall},
+	collector{"screen lock", linuxScreenLock},
+	collector{"updates", linuxUpdates},
+	collector{"last boot", linuxLastBoot},
+	collector{"ssh", linuxSSHRootLogin},
+}
+
+const (
+	aptAutoUpgrades = "/etc/apt/apt.conf.d/20auto-upgrades"
+	sshdConfig      = "/etc/ssh/sshd_config"
+)
+
+var digitsRE = regexp.MustCompile(`[0-9]+`)
+
+func linuxOSVersion(sys System, p *inventory.Payload) {
+	if out, err := sys.Run("uname", "-r"); err == nil {
+		p.OSBuild = strings.TrimSpace(out)
+	}
+
+	p.OSVersion = "unknown"
+	release, err := sys.ReadFile("/etc/os-release")
+	if err != nil {
+		return
+	}
+	if v := osReleaseValue(release, "VERSION_ID"); v != "" {
+		p.OSVersion = v
+	}
+}
+
+// osReleaseValue reads a KEY=value (optionally quoted) line from os-release
+func osReleaseValue(release, key string) string {
+	for _, line := range strings.Split(release, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok && k == key {
+			return strings.Trim(v, `"'`)
+		}
+	}
+	return ""
+}
+
+func linuxDiskEncryption(sys System, p *inventory.Payload) {
+	if sys.HasCommand("lsblk") {
+		out, err := sys.Run("lsblk", "-o", "TYPE")
+		if err == nil && strings.Contains(out, "crypt") {
+			p.DiskEncrypted = true
+			p.DiskEncryptionDetails = "LUKS encryption detected"
+		} else {
+			p.DiskEncryptionDetails = "No LUKS encryption detected"
+		}
+	}
+
+	for _, dm := range sys.Glob("/sys/class/block/dm-*") {
+		uuid, err := sys.ReadFile(path.Join(dm, "dm", "uuid"))
+		if err == nil && strings.Contains(uuid, "CRYPT") {
+			p.DiskEncrypted = true
+			p.DiskEncryptionDetails = "dm-crypt encryption detected"
+			break
+		}
+	}
+
+	if p.DiskEncryptionDetails == "" {
+		p.DiskEncryptionStatus = inventory.CheckUnknown
+		p.DiskEncryptionDetails = "Disk encryption status unknown"
+	}
+}
+
+func linuxAntivirus(sys System, p *inventory.Payload) {
+	if succeeded(sys, "systemctl", "is-active", "--quiet", "clamav-daemon") || succeeded(sys, "pgrep", "-x", "clamd") {
+		p.AntivirusEnabled = true
+		p.AntivirusDetails = "ClamAV active"
+	}
+	if succeeded(sys, "pgrep", "-x", "falcon-sensor") {
+		p.AntivirusEnabled = true
+		p.AntivirusDetails = appendDetail(p.AntivirusDetails, "CrowdStrike Falcon")
+	}
+	if succeeded(sys, "pgrep", "-x", "sentinelone") {
+		p.AntivirusEnabled = true
+		p.AntivirusDetails = appendDetail(p.AntivirusDetails, "SentinelOne")
+	}
+}
+
+func linuxFirewall(sys System, p *inventory.Payload) {
+	switch {
+	case sys.HasCommand("ufw"):
+		out, err := sys.Run("ufw", "status")
+		first, _, _ := strings.Cut(out, "\n")
+		// "Status: inactive" also contains "active", so match the whole word
+		if err != nil {
+			p.FirewallStatus = inventory.CheckUnknown
+			p.FirewallDetails = "ufw status unknown (requires root)"
+		} else if strings.TrimSpace(first) == "Status: active" {
+			p.FirewallEnabled = true
+			p.FirewallDetails = "ufw active"
+		} else {
+			p.FirewallDetails = "ufw inactive"
+		}
+	case sys.HasCommand("firewall-cmd"):
+		if succeeded(sys, "systemctl", "is-active", "--quiet", "firewalld") {
+			p.FirewallEnabled = true
+			p.FirewallDetails = "firewalld active"
+		} else {
+			p.FirewallDetails = "firewalld inactive"
+		}
+	case sys.HasCommand("iptables"):
+		out, _ := sys.Run("iptables", "-L")
+		if strings.Count(out, "\n") > 8 {
+			p.FirewallEnabled = true
+			p.FirewallDetails = "iptables rules configured"
+		} else {
+			p.FirewallDetails = "iptables (minimal/no rules)"
+		}
+	default:
+		p.FirewallDetails = "No firewall detected"
+	}
+}
+
+func linuxScreenLock(sys System, p *inventory.Payload) {
+	kdeConfig := path.Join(sys.HomeDir(), ".config", "kscreenlockerrc")
+
+	switch {
+	case sys.HasCommand("gsettings"):
+		out, _ := sys.Run("gsettings", "get", "org.gnome.desktop.screensaver", "lock-enabled")
+		if strings.TrimSpace(out) != "true" {
+			p.ScreenLockDetails = "GNOME screen lock disabled"
+			return
+		}
+		p.ScreenLockEnabled = true
+
+		out, _ = sys.Run("gsettings", "get", "org.gnome.desktop.session", "idle-delay")
+		// Output is typed, e.g. "uint32 300", so take the last number
+		numbers := digitsRE.FindAllString(out, -1)
+		idle := 0
+		if len(numbers) > 0 {
+			idle, _ = strconv.Atoi(numbers[len(numbers)-1])
+		}
+		if idle > 0 {
+			p.ScreenLockTimeout = idle / 60
+			p.ScreenLockDetails = fmt.Sprintf("GNOME screen lock after %d minutes", p.ScreenLockTimeout)
+		} else {
+			p.ScreenLockDetails = "GNOME screen lock enabled (no idle timeout)"
+		}
+	case sys.Exists(kdeConfig):
+		config, _ := sys.ReadFile(kdeConfig)
+		if !strings.Contains(config, "Autolock=true") {
+			p.ScreenLockDetails = "KDE screen lock disabled"
+			return
+		}
+		p.ScreenLockEnabled = true
+
+		timeout, _ := strconv.Atoi(iniValue(config, "Timeout"))
+		if timeout > 0 {
+			p.ScreenLockTimeout = timeout
+			p.ScreenLockDetails = fmt.Sprintf("KDE screen lock after %d minutes", timeout)
+		} else {
+			p.ScreenLockDetails = "KDE screen lock enabled"
+		}
+	default:
+		p.ScreenLockStatus = inventory.CheckUnknown
+		p.ScreenLockDetails = "Screen lock settings unknown"
+	}
+}
+
+func linuxUpdates(sys System, p *inventory.Payload) {
+	var lastUpdate int64
+	switch {
+	case sys.HasCommand("apt-get"):
+		// dpkg's status file changes whenever packages are installed or upgraded
+		if out, err := sys.Run("stat", "-c", "%Y", "/var/lib/dpkg/status"); err == nil {
+			lastUpdate, _ = strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+		}
+		if out, err := sys.Run("apt-get", "-s", "upgrade"); err == nil {
+			p.PendingSecurityUpdates = countLines(out, func(line string) bool {
+				return strings.HasPrefix(line, "Inst ") && strings.Contains(line, "-security")
+			})
+		}
+		config, _ := sys.ReadFile(aptAutoUpgrades)
+		if strings.Contains(config, `APT::Periodic::Unattended-Upgrade "1"`) {
+			p.AutoUpdateEnabled = true
+			p.AutoUpdateDetails = "unattended-upgrades enabled"
+		} else {
+			p.AutoUpdateDetails = "unattended-upgrades not enabled"
+		}
+	case sys.HasCommand("dnf"):
+		if out, err := sys.Run("rpm", "-qa", "--qf", `%{INSTALLTIME}\n`); err == nil {
+			for _, line := range strings.Split(out, "\n") {
+				if t, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64); err == nil && t > lastUpdate {
+					lastUpdate = t
+				}
+			}
+		}
+		if out, err := sys.Run("dnf", "-q", "updateinfo", "list", "--security"); err == nil {
+			p.PendingSecurityUpdates = countLines(out, func(line string) bool { return line != "" })
+		}
+		if succeeded(sys, "systemctl", "is-enabled", "--quiet", "dnf-automatic.timer") ||
+			succeeded(sys, "systemctl", "is-enabled", "--quiet", "dnf-automatic-install.timer") {
+			p.AutoUpdateEnabled = true
+			p.AutoUpdateDetails = "dnf-automatic enabled"
+		} else {
+			p.AutoUpdateDetails = "dnf-automatic not enabled"
+		}
+	default:
+		p.AutoUpdateDetails = "Package manager not recognised"
+	}
+
+	if lastUpdate > 0 {
+		p.DaysSinceUpdate = daysSince(sys, time.Unix(lastUpdate, 0))
+	}
+}
+
+// linuxLastBoot reads the boot time (btime, in Unix seconds) from /proc/stat
+func linuxLastBoot(sys System, p *inventory.Payload) {
+	stat, err := sys.ReadFile("/proc/stat")
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(stat, "\n") {
+		if v, ok := strings.CutPrefix(line, "btime "); ok {
+			if secs, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				p.LastBootAt = bootTime(time.Unix(secs, 0))
+			}
+			return
+		}
+	}
+}
+
+// linuxSSHRootLogin checks that sshd refuses root logins. `sshd -T` prints
+// the effective settings but needs root, so otherwise the config is read:
+// sshd keeps the first value it sees, and stock configs include
+// sshd_config.d/*.conf before their own settings.
+func linuxSSHRootLogin(sys System, p *inventory.Payload) {
+	if !sys.Exists(sshdConfig) {
+		addCheck(p, "ssh_root_login_disabled", inventory.CheckNotApplicable, "", "OpenSSH server not installed")
+		return
+	}
+
+	var value, source string
+	if out, err := sys.Run("sshd", "-T"); err == nil {
+		value, source = sshdOption(out, "permitrootlogin"), "sshd -T"
+	}
+	if value == "" {
+		files := sys.Glob("/etc/ssh/sshd_config.d/*.conf")
+		sort.Strings(files)
+		for _, file := range append(files, sshdConfig) {
+			config, _ := sys.ReadFile(file)
+			if value = sshdOption(config, "permitrootlogin"); value != "" {
+				source = file
+				break
+			}
+		}
+	}
+	if value == "" {
+		value, source = "prohibit-password", "OpenSSH default"
+	}
+
+	addCheck(p, "ssh_root_login_disabled", passIf(value == "no"), value, fmt.Sprintf("PermitRootLogin %s (%s)", value, source))
+}
+
+// sshdOption returns the first value of an sshd keyword, lowercased, ignoring
+// Match blocks
+func sshdOption(config, keyword string) string {
+	for _, line := range strings.Split(config, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if strings.EqualFold(f[0], "Match") {
+			break
+		}
+		if len(f) >= 2 && strings.EqualFold(f[0], keyword) {
+			return strings.ToLower(f[1])
+		}
+	}
+	return ""
+}
+
+// iniValue returns the first Key=value entry in an ini-style file
+func iniValue(config, key string) string {
+	for _, line := range strings.Split(config, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if ok && k == key {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/jclement/boxcheckr/internal/inventory"
+)
+
+// TokenPath is where the machine's token is kept between runs. It matches the
+// location used by the install scripts.
+func TokenPath() (string, error) {
+	return statePath("token")
+}
+
+// KeyPath is where the key the agent signs reports with is kept
+func KeyPath() (string, error) {
+	return statePath("key")
+}
+
+func statePath(name string) (string, error) {
+	if runtime.GOOS == "windows" {
+		dir := os.Getenv("LOCALAPPDATA")
+		if dir == "" {
+			return "", fmt.Errorf("LOCALAPPDATA is not set")
+		}
+		return filepath.Join(dir, "BoxCheckr", name), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".boxcheckr", name), nil
+}
+
+// LoadToken reads a saved token
+func LoadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SaveToken stores the token readable only by the current user
+func SaveToken(path, token string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(token+"\n"), 0o600)
+}
+
+// LoadKey reads a saved signing key
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a signing key", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// SaveKey stores the signing key readable only by the current user
+func SaveKey(path string, key ed25519.PrivateKey) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0o600)
+}
+
+// Bootstrap exchanges a single-use bootstrap code for the machine's token.
+// A non-nil publicKey is registered, and the server then only accepts
+// reports signed with its private key.
+func Bootstrap(ctx context.Context, client *http.Client, serverURL, code string, publicKey ed25519.PublicKey) (string, error) {
+	fields := map[string]string{"code": code}
+	if publicKey != nil {
+		fields["public_key"] = inventory.EncodePublicKey(publicKey)
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+
+	url := strings.TrimRight(serverURL, "/") + "/api/v1/bootstrap"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil || result.Token == "" {
+		return "", fmt.Errorf("unexpected response: %s", strings.TrimSpace(string(respBody)))
+	}
+	return result.Token, nil
+}
@@ -0,0 +1,295 @@
+package agent
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/inventory"
+)
+
+var windowsCollectors = []Collector{
+	collector{"os", windowsOSVersion},
+	collector{"disk", windowsDiskEncryption},
+	collector{"antivirus", windowsAntivirus},
+	collector{"firewall", windowsFirewall},
+	collector{"screen lock", windowsScreenLock},
+	collector{"updates", windowsUpdates},
+	collector{"last boot", windowsLastBoot},
+	collector{"uac", windowsUAC},
+}
+
+// PowerShell snippets print pipe-separated fields so the output is trivial to parse
+const (
+	psOSVersion = `$os = Get-CimInstance Win32_OperatingSystem; "$($os.Version)|$($os.BuildNumber)"`
+	psBitLocker = `$v = Get-BitLockerVolume -MountPoint 'C:' -ErrorAction Stop; "$($v.ProtectionStatus)|$($v.EncryptionMethod)"`
+	psAVProduct = `Get-CimInstance -Namespace root/SecurityCenter2 -ClassName AntiVirusProduct -ErrorAction Stop | ForEach-Object { "$($_.displayName)|$($_.productState)" }`
+	psDefender  = `$d = Get-MpComputerStatus -ErrorAction Stop; "$($d.RealTimeProtectionEnabled)|$(if ($d.AntivirusSignatureLastUpdated) { $d.AntivirusSignatureLastUpdated.ToString('yyyy-MM-dd') })"`
+	psFirewall  = `Get-NetFirewallProfile -ErrorAction Stop | ForEach-Object { "$($_.Name)|$($_.Enabled)" }`
+	psLastBoot  = `(Get-CimInstance Win32_OperatingSystem).LastBootUpTime.ToUniversalTime().ToString('yyyy-MM-ddTHH:mm:ssZ')`
+)
+
+// Windows Update agent queries. The history skips Defender's daily
+// signature updates, which would hide missed OS patches.
+const (
+	psLastUpdate     = `$s = (New-Object -ComObject Microsoft.Update.Session).CreateUpdateSearcher(); $s.QueryHistory(0, $s.GetTotalHistoryCount()) | Where-Object { $_.ResultCode -eq 2 -and $_.Title -notmatch 'Security Intelligence|Definition Update' } | Sort-Object Date -Descending | Select-Object -First 1 | ForEach-Object { $_.Date.ToUniversalTime().ToString('yyyy-MM-ddTHH:mm:ssZ') }`
+	psPendingUpdates = `$s = (New-Object -ComObject Microsoft.Update.Session).CreateUpdateSearcher(); @($s.Search("IsInstalled=0 and IsHidden=0 and Type='Software'").Updates | Where-Object { $_.Categories | Where-Object { $_.Name -eq 'Security Updates' } }).Count`
+)
+
+const (
+	regPoliciesSystem = `HKLM\SOFTWARE\Microsoft\Windows\CurrentVersion\Policies\System`
+	regWakePolicy     = `HKLM\SOFTWARE\Policies\Microsoft\Power\PowerSettings\0e796bdb-100d-47d6-a2d5-f7d2daa51f51`
+	regDesktop        = `HKCU\Control Panel\Desktop`
+	regWinlogon       = `HKCU\SOFTWARE\Microsoft\Windows NT\CurrentVersion\Winlogon`
+	regCurrentVersion = `HKLM\SOFTWARE\Microsoft\Windows NT\CurrentVersion`
+	regAutoUpdate     = `HKLM\SOFTWARE\Policies\Microsoft\Windows\WindowsUpdate\AU`
+)
+
+func powershell(sys System, script string) (string, error) {
+	out, err := sys.Run("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	return strings.TrimSpace(out), err
+}
+
+func windowsOSVersion(sys System, p *inventory.Payload) {
+	out, err := powershell(sys, psOSVersion)
+	version, build, ok := strings.Cut(out, "|")
+	if err != nil || !ok {
+		p.OSVersion = "unknown"
+		return
+	}
+	p.OSVersion = fmt.Sprintf("%s (Build %s)", version, build)
+
+	// The update build revision (UBR) changes with each cumulative update
+	if ubr, ok := regQuery(sys, regCurrentVersion, "UBR"); ok {
+		p.OSBuild = fmt.Sprintf("%s.%d", build, regInt(ubr))
+	} else {
+		p.OSBuild = build
+	}
+}
+
+func windowsDiskEncryption(sys System, p *inventory.Payload) {
+	out, err := powershell(sys, psBitLocker)
+	if err != nil {
+		p.DiskEncryptionStatus = inventory.CheckUnknown
+		p.DiskEncryptionDetails = "BitLocker status unknown (may require admin)"
+		return
+	}
+
+	status, method, _ := strings.Cut(out, "|")
+	if status == "On" {
+		p.DiskEncrypted = true
+		p.DiskEncryptionDetails = fmt.Sprintf("BitLocker enabled (%s)", method)
+	} else {
+		p.DiskEncryptionDetails = "BitLocker not enabled"
+	}
+}
+
+func windowsAntivirus(sys System, p *inventory.Payload) {
+	var products []string
+
+	// Security Center lists every registered product. productState is a
+	// bitmask; bits 12-15 hold the on/off state.
+	if out, err := powershell(sys, psAVProduct); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			name, state, ok := strings.Cut(strings.TrimSpace(line), "|")
+			if !ok {
+				continue
+			}
+			n, err := strconv.Atoi(state)
+			if err == nil && (n>>12)&0xF == 1 {
+				products = append(products, name)
+			}
+		}
+	}
+
+	if out, err := powershell(sys, psDefender); err == nil {
+		enabled, updated, _ := strings.Cut(out, "|")
+		if enabled == "True" {
+			defender := "Windows Defender"
+			if updated != "" {
+				defender += fmt.Sprintf(" (signatures: %s)", updated)
+			}
+			found := false
+			for i, name := range products {
+				if name == "Windows Defender" {
+					products[i] = defender
+					found = true
+				}
+			}
+			if !found {
+				products = append(products, defender)
+			}
+		}
+	}
+
+	if len(products) > 0 {
+		p.AntivirusEnabled = true
+		p.AntivirusDetails = strings.Join(products, ", ")
+	} else {
+		p.AntivirusDetails = "No active antivirus detected"
+	}
+}
+
+func windowsFirewall(sys System, p *inventory.Payload) {
+	out, err := powershell(sys, psFirewall)
+	if err != nil {
+		p.FirewallStatus = inventory.CheckUnknown
+		p.FirewallDetails = "Firewall status unknown"
+		return
+	}
+
+	var enabled []string
+	for _, line := range strings.Split(out, "\n") {
+		name, state, ok := strings.Cut(strings.TrimSpace(line), "|")
+		if ok && state == "True" {
+			enabled = append(enabled, name)
+		}
+	}
+
+	if len(enabled) > 0 {
+		p.FirewallEnabled = true
+		p.FirewallDetails = fmt.Sprintf("Windows Firewall enabled (%s)", strings.Join(enabled, ", "))
+	} else {
+		p.FirewallDetails = "Windows Firewall disabled"
+	}
+}
+
+func windowsScreenLock(sys System, p *inventory.Payload) {
+	var features []string
+	minutes := func(seconds int) int { return int(math.Round(float64(seconds) / 60)) }
+	useShorter := func(m int) {
+		if p.ScreenLockTimeout == 0 || m < p.ScreenLockTimeout {
+			p.ScreenLockTimeout = m
+		}
+	}
+
+	// Sign-in on wake: lock must not be disabled, and the wake policy (or the
+	// user's DelayLockInterval) must be immediate or unset
+	lockDisabled, _ := regQuery(sys, regPoliciesSystem, "DisableLockWorkstation")
+	wakeDelay, hasWakeDelay := regQuery(sys, regWakePolicy, "ACSettingIndex")
+	if !hasWakeDelay {
+		wakeDelay, hasWakeDelay = regQuery(sys, regDesktop, "DelayLockInterval")
+	}
+	if regInt(lockDisabled) != 1 && (!hasWakeDelay || regInt(wakeDelay) == 0) {
+		features = append(features, "Sign-in required on wake")
+		p.ScreenLockEnabled = true
+	}
+
+	if v, _ := regQuery(sys, regWinlogon, "EnableGoodbye"); regInt(v) == 1 {
+		features = append(features, "Dynamic Lock enabled")
+		p.ScreenLockEnabled = true
+	}
+
+	secure, _ := regQuery(sys, regDesktop, "ScreenSaverIsSecure")
+	if ssTimeout, ok := regQuery(sys, regDesktop, "ScreenSaveTimeOut"); ok && secure == "1" && regInt(ssTimeout) > 0 {
+		p.ScreenLockEnabled = true
+		p.ScreenLockTimeout = minutes(regInt(ssTimeout))
+		features = append(features, fmt.Sprintf("Screen saver lock (%d min)", p.ScreenLockTimeout))
+	}
+
+	if seconds := powercfgDisplayTimeout(sys); seconds > 0 {
+		m := minutes(seconds)
+		useShorter(m)
+		features = append(features, fmt.Sprintf("Display off (%d min)", m))
+	}
+
+	if v, _ := regQuery(sys, regPoliciesSystem, "InactivityTimeoutSecs"); regInt(v) > 0 {
+		m := minutes(regInt(v))
+		features = append(features, fmt.Sprintf("Inactivity lock (%d min)", m))
+		p.ScreenLockEnabled = true
+		useShorter(m)
+	}
+
+	if len(features) > 0 {
+		p.ScreenLockDetails = strings.Join(features, ", ")
+	} else {
+		p.ScreenLockDetails = "No automatic lock configured"
+	}
+}
+
+func windowsUpdates(sys System, p *inventory.Payload) {
+	if out, err := powershell(sys, psLastUpdate); err == nil {
+		if last, err := time.Parse(time.RFC3339, out); err == nil {
+			p.DaysSinceUpdate = daysSince(sys, last)
+		}
+	}
+	if out, err := powershell(sys, psPendingUpdates); err == nil {
+		if n, err := strconv.Atoi(out); err == nil {
+			p.PendingSecurityUpdates = &n
+		}
+	}
+
+	if v, ok := regQuery(sys, regAutoUpdate, "NoAutoUpdate"); ok && regInt(v) == 1 {
+		p.AutoUpdateDetails = "Automatic updates disabled by policy"
+	} else {
+		p.AutoUpdateEnabled = true
+		p.AutoUpdateDetails = "Windows Update installs automatically"
+	}
+}
+
+func windowsLastBoot(sys System, p *inventory.Payload) {
+	if out, err := powershell(sys, psLastBoot); err == nil {
+		if t, err := time.Parse(time.RFC3339, out); err == nil {
+			p.LastBootAt = bootTime(t)
+		}
+	}
+}
+
+// windowsUAC reads EnableLUA, which is 1 unless User Account Control has
+// been turned off
+func windowsUAC(sys System, p *inventory.Payload) {
+	v, ok := regQuery(sys, regPoliciesSystem, "EnableLUA")
+	if !ok {
+		addCheck(p, "uac_enabled", inventory.CheckUnknown, "", "UAC status unknown")
+		return
+	}
+	if regInt(v) == 1 {
+		addCheck(p, "uac_enabled", inventory.CheckPass, "", "User Account Control enabled")
+	} else {
+		addCheck(p, "uac_enabled", inventory.CheckFail, "", "User Account Control disabled")
+	}
+}
+
+// regQuery reads a single registry value with reg.exe. Output looks like:
+//
+//	HKEY_CURRENT_USER\Control Panel\Desktop
+//	    ScreenSaveTimeOut    REG_SZ    600
+func regQuery(sys System, key, name string) (string, bool) {
+	out, err := sys.Run("reg", "query", key, "/v", name)
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) >= 3 && strings.EqualFold(f[0], name) && strings.HasPrefix(f[1], "REG_") {
+			return strings.Join(f[2:], " "), true
+		}
+	}
+	return "", false
+}
+
+// regInt parses REG_DWORD ("0x1") and numeric REG_SZ ("600") values
+func regInt(v string) int {
+	if hex, ok := strings.CutPrefix(v, "0x"); ok {
+		n, _ := strconv.ParseInt(hex, 16, 64)
+		return int(n)
+	}
+	n, _ := strconv.Atoi(v)
+	return n
+}
+
+// powercfgDisplayTimeout returns the AC display-off timeout in seconds
+func powercfgDisplayTimeout(sys System) int {
+	out, err := sys.Run("powercfg", "/query", "SCHEME_CURRENT", "SUB_VIDEO", "VIDEOIDLE")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if _, v, ok := strings.Cut(line, "Current AC Power Setting Index:"); ok {
+			return regInt(strings.TrimSpace(v))
+		}
+	}
+	return 0
+}
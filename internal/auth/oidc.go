@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -10,61 +11,152 @@ import (
 	"golang.org/x/oauth2"
 )
 
-type OIDCProvider struct {
-	provider    *oidc.Provider
-	verifier    *oidc.IDTokenVerifier
-	oauth2Cfg   oauth2.Config
-	adminRole   string
-}
+// Config describes an OpenID Connect provider and how its claims map to
+// BoxCheckr users
+type Config struct {
+	Name         string // Shown on the sign-in button, e.g. "Okta"
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
 
-type Claims struct {
-	Subject string   `json:"sub"`
-	Email   string   `json:"email"`
-	Name    string   `json:"name"`
-	Roles   []string `json:"roles"`
+	// EmailClaim carries the user's email; preferred_username is used if it's empty
+	EmailClaim string
+
+	// Users whose AdminClaim holds any of AdminValues are admins. The claim
+	// may be a string or a list, and a dotted path reaches into nested
+	// objects, e.g. realm_access.roles.
+	AdminClaim  string
+	AdminValues []string
 }
 
-func NewOIDCProvider(baseURL string) (*OIDCProvider, error) {
-	ctx := context.Background()
+// ConfigFromEnv reads the OIDC_* variables. The older AZURE_* variables
+// configure Microsoft Entra ID when OIDC_ISSUER_URL isn't set.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Name:         os.Getenv("OIDC_PROVIDER_NAME"),
+		IssuerURL:    os.Getenv("OIDC_ISSUER_URL"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		Scopes:       strings.Fields(strings.ReplaceAll(os.Getenv("OIDC_SCOPES"), ",", " ")),
+		EmailClaim:   os.Getenv("OIDC_EMAIL_CLAIM"),
+		AdminClaim:   os.Getenv("OIDC_ADMIN_CLAIM"),
+		AdminValues:  splitList(os.Getenv("OIDC_ADMIN_VALUES")),
+	}
 
-	tenantID := os.Getenv("AZURE_TENANT_ID")
-	clientID := os.Getenv("AZURE_CLIENT_ID")
-	clientSecret := os.Getenv("AZURE_CLIENT_SECRET")
-	adminRole := os.Getenv("AZURE_ADMIN_ROLE")
+	if cfg.IssuerURL == "" {
+		tenantID := os.Getenv("AZURE_TENANT_ID")
+		cfg.ClientID = os.Getenv("AZURE_CLIENT_ID")
+		cfg.ClientSecret = os.Getenv("AZURE_CLIENT_SECRET")
+		if tenantID == "" || cfg.ClientID == "" || cfg.ClientSecret == "" {
+			return cfg, fmt.Errorf("OIDC_ISSUER_URL, OIDC_CLIENT_ID and OIDC_CLIENT_SECRET are required (or AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET for Microsoft Entra ID)")
+		}
+		cfg.IssuerURL = fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", tenantID)
+		if cfg.Name == "" {
+			cfg.Name = "Microsoft"
+		}
+		if role := os.Getenv("AZURE_ADMIN_ROLE"); role != "" && len(cfg.AdminValues) == 0 {
+			cfg.AdminValues = []string{role}
+		}
+	}
+
+	if cfg.ClientID == "" || cfg.ClientSecret == "" {
+		return cfg, fmt.Errorf("OIDC_CLIENT_ID and OIDC_CLIENT_SECRET are required")
+	}
+	return cfg.withDefaults(), nil
+}
 
-	if tenantID == "" || clientID == "" || clientSecret == "" {
-		return nil, fmt.Errorf("AZURE_TENANT_ID, AZURE_CLIENT_ID, and AZURE_CLIENT_SECRET are required")
+// withDefaults fills in the settings that suit Microsoft Entra ID and most
+// other providers
+func (c Config) withDefaults() Config {
+	if c.Name == "" {
+		c.Name = "SSO"
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	} else if !containsFold(c.Scopes, oidc.ScopeOpenID) {
+		c.Scopes = append([]string{oidc.ScopeOpenID}, c.Scopes...)
+	}
+	if c.EmailClaim == "" {
+		c.EmailClaim = "email"
+	}
+	if c.AdminClaim == "" {
+		c.AdminClaim = "roles"
+	}
+	if len(c.AdminValues) == 0 {
+		c.AdminValues = []string{"InventoryAdmin"}
 	}
+	return c
+}
 
-	if adminRole == "" {
-		adminRole = "InventoryAdmin"
+// splitList splits a comma separated setting, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	issuerURL := fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", tenantID)
+type OIDCProvider struct {
+	provider  *oidc.Provider
+	verifier  *oidc.IDTokenVerifier
+	oauth2Cfg oauth2.Config
+	cfg       Config
+}
 
-	provider, err := oidc.NewProvider(ctx, issuerURL)
+type Claims struct {
+	Subject string `json:"sub"`
+	Email   string `json:"email"`
+	Name    string `json:"name"`
+
+	// Roles holds the values of the configured admin claim
+	Roles []string `json:"roles"`
+
+	// RefreshToken re-validates the user with Refresh. Providers only issue
+	// one when asked, usually with the offline_access scope.
+	RefreshToken string `json:"-"`
+}
+
+// ErrRefreshRejected means the provider refused a refresh token with
+// invalid_grant, e.g. because the user was disabled or signed out. Other
+// failures, such as an outage or rate limiting, are returned as plain errors.
+var ErrRefreshRejected = errors.New("refresh token rejected")
+
+func NewOIDCProvider(baseURL string, cfg Config) (*OIDCProvider, error) {
+	ctx := context.Background()
+	cfg = cfg.withDefaults()
+
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create OIDC provider: %w", err)
 	}
 
 	oauth2Cfg := oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
 		RedirectURL:  baseURL + "/auth/callback",
 		Endpoint:     provider.Endpoint(),
-		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		Scopes:       cfg.Scopes,
 	}
 
-	verifier := provider.Verifier(&oidc.Config{ClientID: clientID})
+	verifier := provider.Verifier(&oidc.Config{ClientID: cfg.ClientID})
 
 	return &OIDCProvider{
 		provider:  provider,
 		verifier:  verifier,
 		oauth2Cfg: oauth2Cfg,
-		adminRole: adminRole,
+		cfg:       cfg,
 	}, nil
 }
 
+// Name is the provider's name for the sign-in button
+func (p *OIDCProvider) Name() string {
+	return p.cfg.Name
+}
+
 func (p *OIDCProvider) AuthCodeURL(state string) string {
 	return p.oauth2Cfg.AuthCodeURL(state)
 }
@@ -75,9 +167,39 @@ func (p *OIDCProvider) Exchange(ctx context.Context, code string) (*Claims, erro
 		return nil, fmt.Errorf("failed to exchange code: %w", err)
 	}
 
+	claims, err := p.claims(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if claims == nil {
+		return nil, fmt.Errorf("no id_token in response")
+	}
+	return claims, nil
+}
+
+// Refresh redeems a refresh token for the user's current claims and the
+// refresh token to use next time. The claims are nil if the provider doesn't
+// return an ID token on refresh, in which case only the token is known to
+// still be valid.
+func (p *OIDCProvider) Refresh(ctx context.Context, refreshToken string) (*Claims, string, error) {
+	token, err := p.oauth2Cfg.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			return nil, "", fmt.Errorf("%w: %v", ErrRefreshRejected, err)
+		}
+		return nil, "", fmt.Errorf("failed to refresh token: %w", err)
+	}
+	claims, err := p.claims(ctx, token)
+	return claims, token.RefreshToken, err
+}
+
+// claims verifies the ID token in a token response and reads its claims,
+// or returns nil if there is no ID token
+func (p *OIDCProvider) claims(ctx context.Context, token *oauth2.Token) (*Claims, error) {
 	rawIDToken, ok := token.Extra("id_token").(string)
 	if !ok {
-		return nil, fmt.Errorf("no id_token in response")
+		return nil, nil
 	}
 
 	idToken, err := p.verifier.Verify(ctx, rawIDToken)
@@ -85,35 +207,75 @@ func (p *OIDCProvider) Exchange(ctx context.Context, code string) (*Claims, erro
 		return nil, fmt.Errorf("failed to verify ID token: %w", err)
 	}
 
-	var claims struct {
-		Email string   `json:"email"`
-		Name  string   `json:"name"`
-		Roles []string `json:"roles"`
-	}
-	if err := idToken.Claims(&claims); err != nil {
+	var raw map[string]interface{}
+	if err := idToken.Claims(&raw); err != nil {
 		return nil, fmt.Errorf("failed to parse claims: %w", err)
 	}
 
+	claims := &Claims{
+		Subject:      idToken.Subject,
+		Email:        firstString(claimValues(raw, p.cfg.EmailClaim)),
+		Name:         firstString(claimValues(raw, "name")),
+		Roles:        claimValues(raw, p.cfg.AdminClaim),
+		RefreshToken: token.RefreshToken,
+	}
+
 	// Also try preferred_username if email is empty
 	if claims.Email == "" {
-		var altClaims struct {
-			PreferredUsername string `json:"preferred_username"`
-		}
-		idToken.Claims(&altClaims)
-		claims.Email = altClaims.PreferredUsername
+		claims.Email = firstString(claimValues(raw, "preferred_username"))
 	}
 
-	return &Claims{
-		Subject: idToken.Subject,
-		Email:   claims.Email,
-		Name:    claims.Name,
-		Roles:   claims.Roles,
-	}, nil
+	return claims, nil
 }
 
 func (p *OIDCProvider) IsAdmin(claims *Claims) bool {
 	for _, role := range claims.Roles {
-		if strings.EqualFold(role, p.adminRole) {
+		if containsFold(p.cfg.AdminValues, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimValues returns the claim at a dotted path as strings. A list gives
+// one value per element; other JSON values are formatted as text.
+func claimValues(claims map[string]interface{}, path string) []string {
+	var v interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	var values []string
+	for _, item := range list {
+		switch item := item.(type) {
+		case nil, map[string]interface{}, []interface{}:
+		case string:
+			values = append(values, item)
+		default:
+			values = append(values, fmt.Sprint(item))
+		}
+	}
+	return values
+}
+
+func firstString(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
 			return true
 		}
 	}
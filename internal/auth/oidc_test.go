@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeIssuer is a minimal OIDC provider that answers every code with an ID
+// token holding claims
+type fakeIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	f := &fakeIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                f.URL,
+			"authorization_endpoint":                f.URL + "/authorize",
+			"token_endpoint":                        f.URL + "/token",
+			"jwks_uri":                              f.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   b64(key.N.Bytes()),
+				"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     f.idToken(t),
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// idToken signs the issuer's claims, adding the standard ones
+func (f *fakeIssuer) idToken(t *testing.T) string {
+	claims := map[string]interface{}{
+		"iss": f.URL,
+		"aud": "boxcheckr",
+		"sub": "user-1",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range f.claims {
+		claims[k] = v
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("generic", func(t *testing.T) {
+		t.Setenv("OIDC_ISSUER_URL", "https://example.okta.com")
+		t.Setenv("OIDC_CLIENT_ID", "id")
+		t.Setenv("OIDC_CLIENT_SECRET", "secret")
+		t.Setenv("OIDC_SCOPES", "profile email groups")
+		t.Setenv("OIDC_ADMIN_CLAIM", "groups")
+		t.Setenv("OIDC_ADMIN_VALUES", "IT Admins, Security")
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatalf("ConfigFromEnv failed: %v", err)
+		}
+		if cfg.IssuerURL != "https://example.okta.com" || cfg.Name != "SSO" || cfg.EmailClaim != "email" || cfg.AdminClaim != "groups" {
+			t.Errorf("Unexpected config %+v", cfg)
+		}
+		if want := []string{"openid", "profile", "email", "groups"}; !slices.Equal(cfg.Scopes, want) {
+			t.Errorf("Expected scopes %v, got %v", want, cfg.Scopes)
+		}
+		if want := []string{"IT Admins", "Security"}; !slices.Equal(cfg.AdminValues, want) {
+			t.Errorf("Expected admin values %v, got %v", want, cfg.AdminValues)
+		}
+	})
+
+	t.Run("azure", func(t *testing.T) {
+		t.Setenv("AZURE_TENANT_ID", "tenant")
+		t.Setenv("AZURE_CLIENT_ID", "id")
+		t.Setenv("AZURE_CLIENT_SECRET", "secret")
+		t.Setenv("AZURE_ADMIN_ROLE", "Admins")
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatalf("ConfigFromEnv failed: %v", err)
+		}
+		if cfg.IssuerURL != "https://login.microsoftonline.com/tenant/v2.0" || cfg.Name != "Microsoft" || cfg.AdminClaim != "roles" || !slices.Equal(cfg.AdminValues, []string{"Admins"}) {
+			t.Errorf("Unexpected config %+v", cfg)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		t.Setenv("OIDC_ISSUER_URL", "https://example.okta.com")
+		if _, err := ConfigFromEnv(); err == nil {
+			t.Error("Expected missing client credentials to fail")
+		}
+	})
+}
+
+func TestExchange(t *testing.T) {
+	issuer := newFakeIssuer(t)
+
+	tests := []struct {
+		name      string
+		cfg       Config
+		claims    map[string]interface{}
+		wantEmail string
+		wantAdmin bool
+	}{
+		{
+			name:      "entra app role",
+			claims:    map[string]interface{}{"preferred_username": "alice@example.com", "name": "Alice", "roles": []string{"InventoryAdmin"}},
+			wantEmail: "alice@example.com",
+			wantAdmin: true,
+		},
+		{
+			name:      "okta group",
+			cfg:       Config{AdminClaim: "groups", AdminValues: []string{"it-admins"}},
+			claims:    map[string]interface{}{"email": "bob@example.com", "groups": []string{"Everyone", "IT-Admins"}},
+			wantEmail: "bob@example.com",
+			wantAdmin: true,
+		},
+		{
+			name:      "keycloak realm role",
+			cfg:       Config{AdminClaim: "realm_access.roles", AdminValues: []string{"admin"}},
+			claims:    map[string]interface{}{"email": "carol@example.com", "realm_access": map[string]interface{}{"roles": []string{"admin"}}},
+			wantEmail: "carol@example.com",
+			wantAdmin: true,
+		},
+		{
+			name:      "custom boolean claim",
+			cfg:       Config{EmailClaim: "upn", AdminClaim: "is_admin", AdminValues: []string{"true"}},
+			claims:    map[string]interface{}{"upn": "dave@example.com", "is_admin": true},
+			wantEmail: "dave@example.com",
+			wantAdmin: true,
+		},
+		{
+			name:      "google without admin claim",
+			claims:    map[string]interface{}{"email": "erin@example.com", "hd": "example.com"},
+			wantEmail: "erin@example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.IssuerURL = issuer.URL
+			tt.cfg.ClientID = "boxcheckr"
+			tt.cfg.ClientSecret = "secret"
+			p, err := NewOIDCProvider("http://localhost:8080", tt.cfg)
+			if err != nil {
+				t.Fatalf("NewOIDCProvider failed: %v", err)
+			}
+
+			issuer.claims = tt.claims
+			claims, err := p.Exchange(context.Background(), "code")
+			if err != nil {
+				t.Fatalf("Exchange failed: %v", err)
+			}
+			if claims.Subject != "user-1" || claims.Email != tt.wantEmail {
+				t.Errorf("Expected user-1 <%s>, got %+v", tt.wantEmail, claims)
+			}
+			if got := p.IsAdmin(claims); got != tt.wantAdmin {
+				t.Errorf("IsAdmin = %v, want %v (claims %+v)", got, tt.wantAdmin, claims)
+			}
+		})
+	}
+
+	p, _ := NewOIDCProvider("http://localhost:8080", Config{IssuerURL: issuer.URL, ClientID: "someone-else", ClientSecret: "secret"})
+	if _, err := p.Exchange(context.Background(), "code"); err == nil {
+		t.Error("Expected a token for another client to be rejected")
+	}
+}
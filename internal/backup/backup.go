@@ -0,0 +1,240 @@
+// Package backup writes timestamped SQLite backups, rotates and restores them
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+// Backup files are named boxcheckr-YYYYMMDD-HHMMSS.db, in UTC
+const (
+	filePrefix = "boxcheckr-"
+	fileSuffix = ".db"
+	timeLayout = "20060102-150405"
+)
+
+// File is a backup in the backup directory
+type File struct {
+	Name    string
+	Size    int64
+	Created time.Time
+}
+
+// SizeString returns the file's size for display, e.g. "1.2 MB"
+func (f File) SizeString() string {
+	const unit = 1024
+	if f.Size < unit {
+		return fmt.Sprintf("%d B", f.Size)
+	}
+	div, exp := int64(unit), 0
+	for n := f.Size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(f.Size)/float64(div), "KMGT"[exp])
+}
+
+// FileName returns the name of a backup taken at t
+func FileName(t time.Time) string {
+	return filePrefix + t.UTC().Format(timeLayout) + fileSuffix
+}
+
+// parseFileName returns when a backup was taken, or false if name isn't a backup
+func parseFileName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, filePrefix) || !strings.HasSuffix(name, fileSuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(timeLayout, strings.TrimSuffix(strings.TrimPrefix(name, filePrefix), fileSuffix))
+	return t, err == nil
+}
+
+// Create backs up the database into dir, creating it if needed, and returns
+// the backup's path
+func Create(database db.BackupStore, dir string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, FileName(now))
+	if err := database.Backup(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// List returns the backups in dir, newest first. A missing dir has none.
+func List(dir string) ([]File, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []File
+	for _, e := range entries {
+		created, ok := parseFileName(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, File{Name: e.Name(), Size: info.Size(), Created: created})
+	}
+	slices.SortFunc(files, func(a, b File) int { return b.Created.Compare(a.Created) })
+	return files, nil
+}
+
+// Path returns the path of the named backup in dir, or false if name isn't
+// a backup file name
+func Path(dir, name string) (string, bool) {
+	if _, ok := parseFileName(name); !ok || filepath.Base(name) != name {
+		return "", false
+	}
+	return filepath.Join(dir, name), true
+}
+
+// Rotate deletes all but the newest keep backups in dir and returns the
+// names of those deleted. keep 0 keeps them all.
+func Rotate(dir string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+	files, err := List(dir)
+	if err != nil || len(files) <= keep {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, f := range files[keep:] {
+		if err := os.Remove(filepath.Join(dir, f.Name)); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, f.Name)
+	}
+	return deleted, nil
+}
+
+// Restore replaces the SQLite database at path with a backup, after checking
+// the backup is intact and not from a newer schema. The server must be
+// stopped. The replaced database, if any, is moved aside and its new path
+// returned. The restored database is migrated when the server next starts.
+func Restore(backupPath, path string, now time.Time) (string, error) {
+	tmp := path + ".restore"
+	if err := copyFile(backupPath, tmp); err != nil {
+		return "", err
+	}
+	defer removeDatabase(tmp)
+
+	if _, err := db.CheckBackup(tmp); err != nil {
+		return "", fmt.Errorf("%s: %w", backupPath, err)
+	}
+
+	// Move the current database aside with its WAL, which may hold
+	// changes that haven't been checkpointed
+	aside := ""
+	if _, err := os.Stat(path); err == nil {
+		aside = path + ".pre-restore-" + now.UTC().Format(timeLayout)
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Rename(path+suffix, aside+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+		}
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return aside, nil
+}
+
+// removeDatabase removes a SQLite file and its WAL, if they exist
+func removeDatabase(path string) {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Scheduler backs up on an interval, keeping the newest few backups
+type Scheduler struct {
+	db       db.BackupStore
+	dir      string
+	interval time.Duration
+	keep     int
+	now      func() time.Time
+}
+
+// NewScheduler creates a scheduler that backs up into dir every interval,
+// keeping the newest keep backups
+func NewScheduler(database db.BackupStore, dir string, interval time.Duration, keep int) *Scheduler {
+	return &Scheduler{
+		db:       database,
+		dir:      dir,
+		interval: interval,
+		keep:     keep,
+		now:      time.Now,
+	}
+}
+
+// RunOnce takes a backup and rotates old ones
+func (s *Scheduler) RunOnce() error {
+	path, err := Create(s.db, s.dir, s.now())
+	if err != nil {
+		return err
+	}
+	log.Printf("Backed up database to %s", path)
+
+	deleted, err := Rotate(s.dir, s.keep)
+	for _, name := range deleted {
+		log.Printf("Deleted old backup %s", name)
+	}
+	return err
+}
+
+// Run backs up every interval until ctx is cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.RunOnce(); err != nil {
+			log.Printf("Scheduled backup failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+var now = time.Date(2026, 6, 17, 12, 0, 0, 0, time.UTC)
+
+// newDatabase creates a migrated database with one machine
+func newDatabase(t *testing.T, path string) *db.DB {
+	t.Helper()
+	database, err := db.New(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	database.UpsertUser("user-1", "user@example.com", "User", false)
+	database.CreateMachine("user-1", "Laptop")
+	return database
+}
+
+func names(files []File) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func TestCreateListRotate(t *testing.T) {
+	database := newDatabase(t, filepath.Join(t.TempDir(), "boxcheckr.db"))
+	dir := filepath.Join(t.TempDir(), "backups")
+
+	if files, err := List(dir); err != nil || len(files) != 0 {
+		t.Errorf("Expected a missing directory to have no backups, got %v, %v", files, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		path, err := Create(database, dir, now.Add(time.Duration(i)*time.Hour))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if want := filepath.Join(dir, FileName(now.Add(time.Duration(i)*time.Hour))); path != want {
+			t.Errorf("Expected backup at %s, got %s", want, path)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0o600)
+
+	files, err := List(dir)
+	want := []string{"boxcheckr-20260617-140000.db", "boxcheckr-20260617-130000.db", "boxcheckr-20260617-120000.db"}
+	if err != nil || !slices.Equal(names(files), want) {
+		t.Fatalf("Expected %v newest first, got %v, %v", want, names(files), err)
+	}
+	if files[0].Size == 0 || !files[0].Created.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("Expected size and time to be set, got %+v", files[0])
+	}
+
+	if deleted, err := Rotate(dir, 0); err != nil || len(deleted) != 0 {
+		t.Errorf("Expected keep 0 to keep everything, got %v, %v", deleted, err)
+	}
+	deleted, err := Rotate(dir, 2)
+	if err != nil || !slices.Equal(deleted, want[2:]) {
+		t.Errorf("Expected %v deleted, got %v, %v", want[2:], deleted, err)
+	}
+	if files, _ := List(dir); !slices.Equal(names(files), want[:2]) {
+		t.Errorf("Expected %v left, got %v", want[:2], names(files))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Error("Expected other files to be left alone")
+	}
+}
+
+func TestPath(t *testing.T) {
+	if path, ok := Path("/backups", "boxcheckr-20260617-120000.db"); !ok || path != "/backups/boxcheckr-20260617-120000.db" {
+		t.Errorf("Expected a backup name to be accepted, got %q, %v", path, ok)
+	}
+	for _, name := range []string{"", "boxcheckr.db", "../boxcheckr-20260617-120000.db", "boxcheckr-2026-.db", "notes.txt"} {
+		if _, ok := Path("/backups", name); ok {
+			t.Errorf("Expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	source := newDatabase(t, filepath.Join(dir, "source.db"))
+	backupPath, err := Create(source, filepath.Join(dir, "backups"), now)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// The database being replaced has no machines
+	path := filepath.Join(dir, "boxcheckr.db")
+	current, _ := db.New(path)
+	current.Close()
+
+	aside, err := Restore(backupPath, path, now)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if want := path + ".pre-restore-20260617-120000"; aside != want {
+		t.Errorf("Expected the old database at %s, got %s", want, aside)
+	}
+	if _, err := os.Stat(aside); err != nil {
+		t.Errorf("Expected the old database to be kept: %v", err)
+	}
+	if _, err := os.Stat(path + ".restore"); !os.IsNotExist(err) {
+		t.Error("Expected the temporary copy to be removed")
+	}
+
+	restored, err := db.New(path)
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	defer restored.Close()
+	if machines, _ := restored.GetMachinesByUser("user-1"); len(machines) != 1 {
+		t.Errorf("Expected the restored database to hold 1 machine, got %d", len(machines))
+	}
+
+	// Nothing changes if the backup is bad
+	garbage := filepath.Join(dir, "garbage.db")
+	os.WriteFile(garbage, []byte("not a database"), 0o600)
+	if _, err := Restore(garbage, path, now.Add(time.Hour)); err == nil {
+		t.Error("Expected restoring a non-database file to fail")
+	}
+	if _, err := os.Stat(path + ".pre-restore-20260617-130000"); !os.IsNotExist(err) {
+		t.Error("Expected a failed restore to leave the database in place")
+	}
+}
+
+func TestSchedulerRunOnce(t *testing.T) {
+	database := newDatabase(t, filepath.Join(t.TempDir(), "boxcheckr.db"))
+	dir := t.TempDir()
+
+	s := NewScheduler(database, dir, time.Hour, 2)
+	for i := 0; i < 3; i++ {
+		s.now = func() time.Time { return now.Add(time.Duration(i) * time.Hour) }
+		if err := s.RunOnce(); err != nil {
+			t.Fatalf("RunOnce failed: %v", err)
+		}
+	}
+	if files, _ := List(dir); len(files) != 2 || !files[0].Created.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("Expected the newest 2 backups kept, got %v", names(files))
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	tests := map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KB", 5 << 20: "5.0 MB"}
+	for size, want := range tests {
+		if got := (File{Size: size}).SizeString(); got != want {
+			t.Errorf("SizeString(%d) = %q, want %q", size, got, want)
+		}
+	}
+}
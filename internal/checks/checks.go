@@ -0,0 +1,215 @@
+// Package checks is the registry of named checks agents report.
+//
+// Besides the fixed payload fields, agents send a "checks" array of
+// {id, status, value, details} results. The registry gives known check IDs a
+// display name and the platforms they apply to, so a new control needs an
+// entry here and an agent change, but no schema change. Checks that aren't
+// registered are still stored and shown by their ID. The four original
+// controls are registered too, reading their fixed snapshot fields.
+package checks
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/inventory"
+)
+
+// Limits on a reported check
+const (
+	MaxChecks        = 100
+	maxIDLength      = 64
+	maxValueLength   = 256
+	maxDetailsLength = 1024
+)
+
+// Check is a registered check
+type Check struct {
+	ID        string
+	Name      string
+	Platforms []string // Empty if it applies to every platform
+
+	// legacy reads a check reported as fixed snapshot fields
+	legacy func(s *db.InventorySnapshot) (db.ControlStatus, string)
+}
+
+// Legacy reports whether the check is read from fixed snapshot fields rather
+// than the checks array
+func (c Check) Legacy() bool {
+	return c.legacy != nil
+}
+
+// AppliesTo reports whether the check is expected on a platform
+func (c Check) AppliesTo(os string) bool {
+	return len(c.Platforms) == 0 || slices.Contains(c.Platforms, os)
+}
+
+// registry lists the known checks in display order
+var registry = []Check{
+	{ID: "disk_encrypted", Name: "Disk Encryption", legacy: func(s *db.InventorySnapshot) (db.ControlStatus, string) {
+		return s.DiskEncryptionStatus.Or(s.DiskEncrypted), s.DiskEncryptionDetails
+	}},
+	{ID: "antivirus_enabled", Name: "Antivirus", legacy: func(s *db.InventorySnapshot) (db.ControlStatus, string) {
+		return s.AntivirusStatus.Or(s.AntivirusEnabled), s.AntivirusDetails
+	}},
+	{ID: "firewall_enabled", Name: "Firewall", legacy: func(s *db.InventorySnapshot) (db.ControlStatus, string) {
+		return s.FirewallStatus.Or(s.FirewallEnabled), s.FirewallDetails
+	}},
+	{ID: "screen_lock_enabled", Name: "Screen Lock", legacy: func(s *db.InventorySnapshot) (db.ControlStatus, string) {
+		return s.ScreenLockStatus.Or(s.ScreenLockEnabled), s.ScreenLockDetails
+	}},
+	{ID: "ssh_root_login_disabled", Name: "SSH Root Login Disabled", Platforms: []string{"linux"}},
+	{ID: "gatekeeper_enabled", Name: "Gatekeeper", Platforms: []string{"darwin"}},
+	{ID: "uac_enabled", Name: "User Account Control", Platforms: []string{"windows"}},
+}
+
+// All returns the registered checks in display order
+func All() []Check {
+	return slices.Clone(registry)
+}
+
+// Lookup returns the registered check with an ID
+func Lookup(id string) (Check, bool) {
+	for _, c := range registry {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return Check{}, false
+}
+
+// Name is a check's display name, or its ID if it isn't registered
+func Name(id string) string {
+	if c, ok := Lookup(id); ok {
+		return c.Name
+	}
+	return id
+}
+
+// ValidID reports whether id can name a check: lowercase letters, digits,
+// '_', '-' and '.', such as "acme.vpn_connected"
+func ValidID(id string) bool {
+	if id == "" || len(id) > maxIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidStatus reports whether status is pass, fail, unknown or not_applicable
+func ValidStatus(status string) bool {
+	switch status {
+	case inventory.CheckPass, inventory.CheckFail, inventory.CheckUnknown, inventory.CheckNotApplicable:
+		return true
+	}
+	return false
+}
+
+// Validate checks the checks array of a payload
+func Validate(checks []inventory.Check) error {
+	if len(checks) > MaxChecks {
+		return fmt.Errorf("at most %d checks can be reported", MaxChecks)
+	}
+	seen := make(map[string]bool, len(checks))
+	for _, c := range checks {
+		if !ValidID(c.ID) {
+			return fmt.Errorf("invalid check ID %q", c.ID)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("check %s is reported twice", c.ID)
+		}
+		seen[c.ID] = true
+		if r, ok := Lookup(c.ID); ok && r.Legacy() {
+			return fmt.Errorf("check %s is reported with its own fields", c.ID)
+		}
+		if !ValidStatus(c.Status) {
+			return fmt.Errorf("check %s has invalid status %q", c.ID, c.Status)
+		}
+		if len(c.Value) > maxValueLength || len(c.Details) > maxDetailsLength {
+			return fmt.Errorf("check %s is too long", c.ID)
+		}
+	}
+	return nil
+}
+
+// Result is a check's outcome in a snapshot
+type Result struct {
+	ID      string
+	Name    string
+	Status  string // pass, fail, unknown or not_applicable
+	Value   string
+	Details string
+	Legacy  bool
+}
+
+// Passed reports whether the check passed
+func (r Result) Passed() bool {
+	return r.Status == inventory.CheckPass
+}
+
+// Failed reports whether the check failed
+func (r Result) Failed() bool {
+	return r.Status == inventory.CheckFail
+}
+
+// Label is the check's status for display
+func (r Result) Label() string {
+	return db.ControlStatus(r.Status).Label()
+}
+
+// Results lists every check in a snapshot: the legacy checks, then the
+// registered checks for its platform, then unregistered checks by ID.
+// Registered checks the machine didn't report are unknown.
+func Results(s *db.InventorySnapshot) []Result {
+	reported := make(map[string]db.SnapshotCheck, len(s.Checks))
+	for _, c := range s.Checks {
+		reported[c.CheckID] = c
+	}
+
+	var results []Result
+	for _, c := range registry {
+		if c.Legacy() {
+			status, details := c.legacy(s)
+			results = append(results, Result{ID: c.ID, Name: c.Name, Status: string(status), Details: details, Legacy: true})
+			continue
+		}
+		r, ok := reported[c.ID]
+		if !ok && !c.AppliesTo(s.OS) {
+			continue
+		}
+		delete(reported, c.ID)
+		if !ok {
+			results = append(results, Result{ID: c.ID, Name: c.Name, Status: inventory.CheckUnknown, Details: "Not reported"})
+			continue
+		}
+		results = append(results, Result{ID: c.ID, Name: c.Name, Status: r.Status, Value: r.Value, Details: r.Details})
+	}
+
+	var others []Result
+	for _, r := range reported {
+		others = append(others, Result{ID: r.CheckID, Name: r.CheckID, Status: r.Status, Value: r.Value, Details: r.Details})
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].ID < others[j].ID })
+	return append(results, others...)
+}
+
+// Status is the status of one check in a snapshot, or "" if it wasn't
+// reported
+func Status(s *db.InventorySnapshot, id string) string {
+	if c, ok := Lookup(id); ok && c.Legacy() {
+		status, _ := c.legacy(s)
+		return string(status)
+	}
+	for _, c := range s.Checks {
+		if c.CheckID == id {
+			return c.Status
+		}
+	}
+	return ""
+}
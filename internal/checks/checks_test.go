@@ -0,0 +1,90 @@
+package checks
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/inventory"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		checks  []inventory.Check
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"registered", []inventory.Check{{ID: "ssh_root_login_disabled", Status: "pass", Value: "no"}}, false},
+		{"unregistered", []inventory.Check{{ID: "acme.vpn_connected", Status: "unknown"}}, false},
+		{"not applicable", []inventory.Check{{ID: "uac_enabled", Status: "not_applicable"}}, false},
+		{"bad ID", []inventory.Check{{ID: "SSH Root", Status: "pass"}}, true},
+		{"empty ID", []inventory.Check{{Status: "pass"}}, true},
+		{"bad status", []inventory.Check{{ID: "uac_enabled", Status: "ok"}}, true},
+		{"duplicate", []inventory.Check{{ID: "uac_enabled", Status: "pass"}, {ID: "uac_enabled", Status: "fail"}}, true},
+		{"legacy", []inventory.Check{{ID: "disk_encrypted", Status: "pass"}}, true},
+		{"long details", []inventory.Check{{ID: "uac_enabled", Status: "pass", Details: strings.Repeat("x", 2000)}}, true},
+		{"too many", make([]inventory.Check, MaxChecks+1), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.checks)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResults(t *testing.T) {
+	s := &db.InventorySnapshot{
+		OS:                    "linux",
+		DiskEncrypted:         true,
+		DiskEncryptionDetails: "LUKS",
+		Checks: []db.SnapshotCheck{
+			{CheckID: "gatekeeper_enabled", Status: "fail"},
+			{CheckID: "acme.vpn_connected", Status: "pass", Value: "wg0"},
+		},
+	}
+
+	var got []string
+	for _, r := range Results(s) {
+		got = append(got, r.ID+"="+r.Status)
+	}
+	want := "disk_encrypted=pass antivirus_enabled=fail firewall_enabled=fail screen_lock_enabled=fail " +
+		"ssh_root_login_disabled=unknown gatekeeper_enabled=fail acme.vpn_connected=pass"
+	if strings.Join(got, " ") != want {
+		t.Errorf("Results() = %v, want %s", got, want)
+	}
+
+	results := Results(s)
+	if r := results[0]; !r.Legacy || r.Name != "Disk Encryption" || r.Details != "LUKS" {
+		t.Errorf("Unexpected legacy result %+v", r)
+	}
+	if r := results[len(results)-1]; r.Legacy || r.Name != "acme.vpn_connected" || r.Value != "wg0" {
+		t.Errorf("Unexpected unregistered result %+v", r)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s := &db.InventorySnapshot{
+		FirewallEnabled:  true,
+		ScreenLockStatus: db.StatusUnknown,
+		AntivirusStatus:  db.StatusNotApplicable,
+		Checks:           []db.SnapshotCheck{{CheckID: "uac_enabled", Status: "fail"}},
+	}
+	tests := map[string]string{
+		"firewall_enabled":    "pass",
+		"disk_encrypted":      "fail",
+		"screen_lock_enabled": "unknown",
+		"antivirus_enabled":   "not_applicable",
+		"uac_enabled":         "fail",
+		"gatekeeper_enabled":  "",
+	}
+	for id, want := range tests {
+		if got := Status(s, id); got != want {
+			t.Errorf("Status(%s) = %q, want %q", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// API key operations
+//
+// API keys are issued by admins for the read-only REST API. Like bootstrap
+// codes, only a hash of the key is stored, so a key can't be shown again.
+
+// apiKeyPrefix marks BoxCheckr API keys, e.g. for secret scanners
+const apiKeyPrefix = "bck_"
+
+// CreateAPIKey issues a key with the given scopes. A nil expiresAt creates a
+// key that never expires.
+func (db *DB) CreateAPIKey(name, createdBy string, scopes []string, expiresAt *time.Time) (*APIKey, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	key := apiKeyPrefix + strings.TrimRight(token, "=")
+
+	var id int64
+	err = db.conn.QueryRow(`
+		INSERT INTO api_keys (name, key_hash, prefix, scopes, created_by, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, name, hashSecret(key), key[:len(apiKeyPrefix)+8], strings.Join(scopes, ","), createdBy, expiresAt).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := db.getAPIKey(`k.id = ?`, id)
+	if err != nil || k == nil {
+		return nil, err
+	}
+	k.Key = key
+	return k, nil
+}
+
+const apiKeyColumns = `k.id, k.name, k.prefix, k.scopes, k.created_by, COALESCE(u.email, ''),
+		k.expires_at, k.last_used_at, k.created_at`
+
+func scanAPIKey(scan func(...interface{}) error) (*APIKey, error) {
+	var k APIKey
+	var expiresAt, lastUsedAt sql.NullTime
+	if err := scan(&k.ID, &k.Name, &k.Prefix, &k.Scopes, &k.CreatedBy, &k.CreatedByEmail,
+		&expiresAt, &lastUsedAt, &k.CreatedAt); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	return &k, nil
+}
+
+func (db *DB) getAPIKey(where string, arg interface{}) (*APIKey, error) {
+	row := db.conn.QueryRow(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys k
+		LEFT JOIN users u ON u.id = k.created_by
+		WHERE `+where, arg)
+	k, err := scanAPIKey(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return k, err
+}
+
+// GetAPIKey returns a key by ID, or nil if there is none
+func (db *DB) GetAPIKey(id int64) (*APIKey, error) {
+	return db.getAPIKey(`k.id = ?`, id)
+}
+
+func (db *DB) GetAPIKeys() ([]APIKey, error) {
+	rows, err := db.conn.Query(`
+		SELECT ` + apiKeyColumns + `
+		FROM api_keys k
+		LEFT JOIN users u ON u.id = k.created_by
+		ORDER BY k.created_at DESC, k.id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, rows.Err()
+}
+
+// AuthenticateAPIKey returns the unexpired key matching key and records that
+// it was used, or nil if there is none
+func (db *DB) AuthenticateAPIKey(key string) (*APIKey, error) {
+	k, err := db.getAPIKey(`k.key_hash = ?`, hashSecret(key))
+	if err != nil || k == nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if k.Expired(now) {
+		return nil, nil
+	}
+
+	if _, err := db.conn.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now, k.ID); err != nil {
+		return nil, err
+	}
+	k.LastUsedAt = &now
+	return k, nil
+}
+
+// DeleteAPIKey revokes a key
+func (db *DB) DeleteAPIKey(id int64) error {
+	_, err := db.conn.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+	return err
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Audit log operations
+//
+// The audit log is append-only: triggers reject updates and deletes, and
+// each entry's hash covers the previous entry's, so rows changed or removed
+// by other means show up in VerifyAuditLog.
+
+// auditMu keeps concurrent appends in this process from forking the chain.
+// PostgreSQL instances also lock the table, see CreateAuditEvent.
+var auditMu sync.Mutex
+
+// auditHash is the hash of an entry chained to prevHash
+func auditHash(e *AuditEvent, prevHash string) string {
+	fields, _ := json.Marshal([]string{
+		prevHash,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		e.ActorID, e.ActorEmail, e.Action, e.TargetType, e.TargetID,
+		e.IPAddress, e.UserAgent, e.Before, e.After,
+	})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAuditEvent appends an entry to the audit log, setting its ID,
+// time and hashes
+func (db *DB) CreateAuditEvent(e *AuditEvent) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if tx.dialect == dialectPostgres {
+		if _, err := tx.Exec(`LOCK TABLE audit_events IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+			return err
+		}
+	}
+
+	var prevHash string
+	err = tx.QueryRow(`SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// Stored times keep microseconds on every backend, so the hash must too
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.PrevHash = prevHash
+	e.Hash = auditHash(e, prevHash)
+	err = tx.QueryRow(`
+		INSERT INTO audit_events (created_at, actor_id, actor_email, action, target_type, target_id,
+			ip_address, user_agent, before_data, after_data, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, e.CreatedAt, e.ActorID, e.ActorEmail, e.Action, e.TargetType, e.TargetID,
+		e.IPAddress, e.UserAgent, e.Before, e.After, e.PrevHash, e.Hash).Scan(&e.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const auditColumns = `id, created_at, actor_id, actor_email, action, target_type, target_id,
+		ip_address, user_agent, before_data, after_data, prev_hash, hash`
+
+func scanAuditEvent(scan func(...interface{}) error) (*AuditEvent, error) {
+	var e AuditEvent
+	if err := scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.ActorEmail, &e.Action, &e.TargetType, &e.TargetID,
+		&e.IPAddress, &e.UserAgent, &e.Before, &e.After, &e.PrevHash, &e.Hash); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// GetAuditEvents returns the entries matching filter, newest first
+func (db *DB) GetAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	var events []AuditEvent
+	err := db.EachAuditEvent(filter, func(e *AuditEvent) error {
+		events = append(events, *e)
+		return nil
+	})
+	return events, err
+}
+
+// EachAuditEvent calls fn for each entry matching filter, newest first,
+// without loading them all at once. Iteration stops at the first error from
+// fn, which is returned.
+func (db *DB) EachAuditEvent(filter AuditFilter, fn func(*AuditEvent) error) error {
+	query := `SELECT ` + auditColumns + ` FROM audit_events WHERE 1=1`
+	args := []interface{}{}
+
+	if filter.Query != "" {
+		query += ` AND (LOWER(actor_email) LIKE LOWER(?) OR LOWER(target_id) LIKE LOWER(?) OR ip_address LIKE ?)`
+		q := "%" + filter.Query + "%"
+		args = append(args, q, q, q)
+	}
+	if filter.Action != "" {
+		query += ` AND action = ?`
+		args = append(args, filter.Action)
+	}
+	if !filter.From.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, filter.To.UTC())
+	}
+	query += ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanAuditEvent(rows.Scan)
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetAuditActions returns the actions recorded so far, for filtering
+func (db *DB) GetAuditActions() ([]string, error) {
+	rows, err := db.conn.Query(`SELECT DISTINCT action FROM audit_events ORDER BY action`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var actions []string
+	for rows.Next() {
+		var action string
+		if err := rows.Scan(&action); err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+// VerifyAuditLog recomputes the hash chain from the oldest entry and reports
+// the first entry that doesn't match
+func (db *DB) VerifyAuditLog() (*AuditVerification, error) {
+	rows, err := db.conn.Query(`SELECT ` + auditColumns + ` FROM audit_events ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	v := &AuditVerification{}
+	for rows.Next() {
+		e, err := scanAuditEvent(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		v.Events++
+		if v.BrokenAt == 0 && (e.PrevHash != v.Head || e.Hash != auditHash(e, v.Head)) {
+			v.BrokenAt = e.ID
+		}
+		v.Head = e.Hash
+	}
+	return v, rows.Err()
+}
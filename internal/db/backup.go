@@ -0,0 +1,87 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrBackupUnsupported is returned by Backup on PostgreSQL
+var ErrBackupUnsupported = errors.New("online backups are only supported for SQLite; use pg_dump or boxcheckr export for PostgreSQL")
+
+// Backup writes a consistent copy of the SQLite database to path, which must
+// not exist. The database stays usable while it runs. Sessions' refresh
+// tokens are left out of the copy, since they are stored in the clear.
+func (db *DB) Backup(path string) error {
+	if db.conn.dialect != dialectSQLite {
+		return ErrBackupUnsupported
+	}
+	if _, err := db.conn.Exec(`VACUUM INTO ?`, path); err != nil {
+		return err
+	}
+	if err := scrubBackup(path); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to remove refresh tokens from backup: %w", err)
+	}
+	return nil
+}
+
+// scrubBackup clears the refresh tokens in a backup, then vacuums it so they
+// don't linger in free pages
+func scrubBackup(path string) error {
+	backup, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	if _, err := backup.conn.Exec(`UPDATE sessions SET refresh_token = ''`); err != nil {
+		return err
+	}
+	_, err = backup.conn.Exec(`VACUUM`)
+	return err
+}
+
+// CheckBackup checks that the SQLite file at path is an intact BoxCheckr
+// database that this build can migrate, and returns its schema version.
+// Opening the file switches it to WAL mode.
+func CheckBackup(path string) (int, error) {
+	db, err := Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.conn.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return 0, fmt.Errorf("not a SQLite database: %w", err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	var machines, migrations int
+	err = db.conn.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'machines'),
+			(SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations')
+	`).Scan(&machines, &migrations)
+	if err != nil {
+		return 0, err
+	}
+	if machines == 0 {
+		return 0, errors.New("not a BoxCheckr database")
+	}
+
+	// Databases from before schema_migrations are version 0
+	version := 0
+	if migrations > 0 {
+		if err := db.conn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+	if version > db.SchemaVersion() {
+		return 0, fmt.Errorf("schema version %d is newer than this build supports (%d)", version, db.SchemaVersion())
+	}
+	return version, nil
+}
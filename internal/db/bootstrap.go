@@ -0,0 +1,116 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// Bootstrap code operations
+//
+// A bootstrap code is embedded in install scripts and commands instead of the
+// machine's enrollment token. It is exchanged once, shortly after it is
+// issued, for the token. Only a hash of the code is stored.
+
+// hashSecret returns the stored form of a bearer credential such as a
+// bootstrap code or API key
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateBootstrapCode issues a new code for a machine and clears out the
+// machine's expired or redeemed codes
+func (db *DB) CreateBootstrapCode(machineID string, ttl time.Duration) (*BootstrapCode, error) {
+	code, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	bc := &BootstrapCode{
+		Code:      code,
+		MachineID: machineID,
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	}
+
+	if _, err := db.conn.Exec(`
+		DELETE FROM bootstrap_codes WHERE machine_id = ? AND (expires_at <= ? OR used_at IS NOT NULL)
+	`, machineID, now); err != nil {
+		return nil, err
+	}
+
+	_, err = db.conn.Exec(`
+		INSERT INTO bootstrap_codes (code_hash, machine_id, expires_at, created_at) VALUES (?, ?, ?, ?)
+	`, hashSecret(code), machineID, bc.ExpiresAt, bc.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return bc, nil
+}
+
+// GetActiveBootstrapCode returns the machine's newest code that is unused and
+// unexpired, or nil if there is none. Its Code is empty, as only the hash is
+// kept.
+func (db *DB) GetActiveBootstrapCode(machineID string) (*BootstrapCode, error) {
+	bc := &BootstrapCode{MachineID: machineID}
+	err := db.conn.QueryRow(`
+		SELECT expires_at, created_at FROM bootstrap_codes
+		WHERE machine_id = ? AND used_at IS NULL AND expires_at > ?
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, machineID, time.Now().UTC()).Scan(&bc.ExpiresAt, &bc.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bc, nil
+}
+
+// ValidBootstrapCode reports whether a code was issued for the machine and has
+// not expired. It does not consume the code, and a redeemed code stays valid
+// here so monitor mode can fetch its local copy of the script.
+func (db *DB) ValidBootstrapCode(machineID, code string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM bootstrap_codes
+		WHERE code_hash = ? AND machine_id = ? AND expires_at > ?
+	`, hashSecret(code), machineID, time.Now().UTC()).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// RedeemBootstrapCode consumes a code and returns its machine, or nil if the
+// code is unknown, expired or already used
+func (db *DB) RedeemBootstrapCode(code string) (*Machine, error) {
+	hash := hashSecret(code)
+	now := time.Now().UTC()
+
+	result, err := db.conn.Exec(`
+		UPDATE bootstrap_codes SET used_at = ?
+		WHERE code_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, now, hash, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+
+	var machineID string
+	err = db.conn.QueryRow(`SELECT machine_id FROM bootstrap_codes WHERE code_hash = ?`, hash).Scan(&machineID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db.GetMachine(machineID)
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"database/sql"
+	"slices"
+)
+
+// Snapshot check operations
+//
+// Besides the fixed columns on inventory_snapshots, agents report any number
+// of named checks, stored one row each in snapshot_checks. New checks need no
+// schema change; internal/checks knows their names and platforms.
+
+// insertSnapshotChecks stores the checks reported with a snapshot
+func insertSnapshotChecks(tx *dbTx, snapshotID int64, checks []SnapshotCheck) error {
+	for _, c := range checks {
+		if _, err := tx.Exec(`
+			INSERT INTO snapshot_checks (snapshot_id, check_id, status, value, details)
+			VALUES (?, ?, ?, ?, ?)
+		`, snapshotID, c.CheckID, c.Status, c.Value, c.Details); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSnapshotChecks returns the checks reported with a snapshot, by ID
+func (db *DB) GetSnapshotChecks(snapshotID int64) ([]SnapshotCheck, error) {
+	rows, err := db.conn.Query(`
+		SELECT snapshot_id, check_id, status, value, details
+		FROM snapshot_checks
+		WHERE snapshot_id = ?
+		ORDER BY check_id
+	`, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checks []SnapshotCheck
+	for rows.Next() {
+		var c SnapshotCheck
+		if err := rows.Scan(&c.SnapshotID, &c.CheckID, &c.Status, &c.Value, &c.Details); err != nil {
+			return nil, err
+		}
+		checks = append(checks, c)
+	}
+	return checks, rows.Err()
+}
+
+// loadLatestChecks fills in the checks of snapshots returned by
+// GetLatestSnapshots, in one query
+func (db *DB) loadLatestChecks(snapshots []InventorySnapshot) error {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	index := make(map[int64]int, len(snapshots))
+	for i, s := range snapshots {
+		index[s.ID] = i
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT c.snapshot_id, c.check_id, c.status, c.value, c.details
+		FROM machines m
+		JOIN snapshot_checks c ON c.snapshot_id = (
+			SELECT id FROM inventory_snapshots
+			WHERE machine_id = m.id
+			ORDER BY collected_at DESC
+			LIMIT 1
+		)
+		WHERE m.archived_at IS NULL
+		ORDER BY c.snapshot_id, c.check_id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c SnapshotCheck
+		if err := rows.Scan(&c.SnapshotID, &c.CheckID, &c.Status, &c.Value, &c.Details); err != nil {
+			return err
+		}
+		if i, ok := index[c.SnapshotID]; ok {
+			snapshots[i].Checks = append(snapshots[i].Checks, c)
+		}
+	}
+	return rows.Err()
+}
+
+// SnapshotCheckIDs returns the IDs of the named checks reported by any of
+// the snapshots, sorted
+func SnapshotCheckIDs(snapshots ...*InventorySnapshot) []string {
+	var ids []string
+	for _, s := range snapshots {
+		for _, c := range s.Checks {
+			if !slices.Contains(ids, c.CheckID) {
+				ids = append(ids, c.CheckID)
+			}
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// checkStatus is the status of a named check in a snapshot, or "" if it
+// wasn't reported
+func (s *InventorySnapshot) checkStatus(id string) string {
+	for _, c := range s.Checks {
+		if c.CheckID == id {
+			return c.Status
+		}
+	}
+	return ""
+}
+
+// checkCursor reads snapshot_checks rows in the order a query streams their
+// snapshots, so a long history's checks aren't loaded at once. The rows must
+// be ordered like the snapshots, then by check ID.
+type checkCursor struct {
+	rows    *sql.Rows
+	pending *SnapshotCheck
+}
+
+func (db *DB) checkCursor(query string, args ...interface{}) (*checkCursor, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &checkCursor{rows: rows}, nil
+}
+
+// fill sets the checks of the next snapshot in the stream
+func (c *checkCursor) fill(s *InventorySnapshot) error {
+	s.Checks = nil
+	for {
+		if c.pending == nil {
+			if !c.rows.Next() {
+				return c.rows.Err()
+			}
+			var sc SnapshotCheck
+			if err := c.rows.Scan(&sc.SnapshotID, &sc.CheckID, &sc.Status, &sc.Value, &sc.Details); err != nil {
+				return err
+			}
+			c.pending = &sc
+		}
+		if c.pending.SnapshotID != s.ID {
+			return nil
+		}
+		s.Checks = append(s.Checks, *c.pending)
+		c.pending = nil
+	}
+}
+
+func (c *checkCursor) Close() error {
+	return c.rows.Close()
+}
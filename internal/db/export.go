@@ -0,0 +1,420 @@
+package db
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ExportFormat is the version of the JSON written by Export
+const ExportFormat = 1
+
+type columnKind int
+
+const (
+	kindText columnKind = iota
+	kindInt
+	kindBool
+	kindTime
+)
+
+type exportColumn struct {
+	name string
+	kind columnKind
+}
+
+type exportTable struct {
+	name     string
+	orderBy  string
+	identity bool // id is generated by the database
+	columns  []exportColumn
+}
+
+func text(name string) exportColumn      { return exportColumn{name, kindText} }
+func integer(name string) exportColumn   { return exportColumn{name, kindInt} }
+func boolean(name string) exportColumn   { return exportColumn{name, kindBool} }
+func timestamp(name string) exportColumn { return exportColumn{name, kindTime} }
+
+// unexportedTables hold state that shouldn't move between instances
+var unexportedTables = []string{"sessions", "inventory_nonces"}
+
+// exportTables lists every other table in an order that satisfies foreign
+// keys. Columns added by later migrations must be added here too.
+var exportTables = []exportTable{
+	{name: "users", orderBy: "id", columns: []exportColumn{
+		text("id"), text("email"), text("name"), boolean("is_admin"),
+		boolean("email_opt_out"), timestamp("digest_sent_at"), timestamp("created_at"),
+	}},
+	{name: "machines", orderBy: "id", columns: []exportColumn{
+		text("id"), text("user_id"), text("name"), text("enrollment_token"), text("mode"),
+		integer("checkin_days"), boolean("legal_hold"), timestamp("created_at"),
+		timestamp("archived_at"), text("archived_by"), text("archive_reason"),
+		text("token_prefix"), timestamp("token_created_at"), text("previous_token_hash"),
+		timestamp("previous_token_expires_at"), timestamp("token_disabled_at"),
+		timestamp("token_last_used_at"), text("token_last_used_ip"),
+		text("public_key"), timestamp("public_key_registered_at"),
+	}},
+	{name: "inventory_snapshots", orderBy: "id", identity: true, columns: []exportColumn{
+		integer("id"), text("machine_id"), timestamp("collected_at"), text("hostname"), text("os"), text("os_version"),
+		boolean("disk_encrypted"), text("disk_encryption_details"), boolean("antivirus_enabled"), text("antivirus_details"),
+		boolean("firewall_enabled"), text("firewall_details"), boolean("screen_lock_enabled"), integer("screen_lock_timeout"),
+		text("screen_lock_details"), text("raw_data"), boolean("signed"),
+		text("os_build"), integer("days_since_update"), integer("pending_security_updates"),
+		boolean("auto_update_enabled"), text("auto_update_details"), timestamp("last_boot_at"),
+		text("disk_encryption_status"), text("antivirus_status"), text("firewall_status"), text("screen_lock_status"),
+	}},
+	{name: "machine_notes", orderBy: "id", identity: true, columns: []exportColumn{
+		integer("id"), text("machine_id"), text("author_id"), text("content"), timestamp("created_at"), timestamp("updated_at"),
+	}},
+	{name: "share_links", orderBy: "id", columns: []exportColumn{
+		text("id"), text("created_by"), timestamp("expires_at"), timestamp("as_of"), timestamp("created_at"),
+		text("label"), text("filter_owner"), text("filter_machine"), text("filter_os"),
+		boolean("show_notes"), boolean("show_owner_emails"), text("password_hash"),
+		timestamp("revoked_at"), text("revoked_by"), text("revoke_reason"),
+	}},
+	{name: "share_link_views", orderBy: "id", identity: true, columns: []exportColumn{
+		integer("id"), text("link_id"), timestamp("viewed_at"), text("ip_address"), text("user_agent"),
+		boolean("failed"),
+	}},
+	{name: "policy_rules", orderBy: "id", identity: true, columns: []exportColumn{
+		integer("id"), text("name"), text("field"), text("operator"), text("value"), text("os"),
+		boolean("enabled"), timestamp("created_at"),
+	}},
+	{name: "policy_results", orderBy: "snapshot_id, rule_id", columns: []exportColumn{
+		integer("snapshot_id"), integer("rule_id"), text("rule_name"), text("expression"),
+		boolean("passed"), text("actual"), timestamp("evaluated_at"),
+	}},
+	{name: "snapshot_checks", orderBy: "snapshot_id, check_id", columns: []exportColumn{
+		integer("snapshot_id"), text("check_id"), text("status"), text("value"), text("details"),
+	}},
+	{name: "bootstrap_codes", orderBy: "code_hash", columns: []exportColumn{
+		text("code_hash"), text("machine_id"), timestamp("expires_at"), timestamp("used_at"), timestamp("created_at"),
+	}},
+	{name: "webhooks", orderBy: "id", identity: true, columns: []exportColumn{
+		integer("id"), text("url"), text("secret"), text("events"), boolean("enabled"), timestamp("created_at"),
+	}},
+	{name: "webhook_deliveries", orderBy: "id", identity: true, columns: []exportColumn{
+		integer("id"), integer("webhook_id"), text("event_id"), text("event"), text("payload"), text("status"),
+		integer("attempts"), timestamp("next_attempt_at"), timestamp("last_attempt_at"),
+		integer("last_status_code"), text("last_error"), timestamp("created_at"),
+	}},
+	{name: "control_alerts", orderBy: "machine_id, control", columns: []exportColumn{
+		text("machine_id"), text("control"), timestamp("sent_at"),
+	}},
+	{name: "api_keys", orderBy: "id", identity: true, columns: []exportColumn{
+		integer("id"), text("name"), text("key_hash"), text("prefix"), text("scopes"), text("created_by"),
+		timestamp("expires_at"), timestamp("last_used_at"), timestamp("created_at"),
+	}},
+	{name: "audit_events", orderBy: "id", identity: true, columns: []exportColumn{
+		integer("id"), timestamp("created_at"), text("actor_id"), text("actor_email"), text("action"),
+		text("target_type"), text("target_id"), text("ip_address"), text("user_agent"),
+		text("before_data"), text("after_data"), text("prev_hash"), text("hash"),
+	}},
+}
+
+// Export writes every table as JSON. The output can be loaded into a SQLite
+// or PostgreSQL database with Import. Rows are streamed, so large databases
+// aren't held in memory.
+func (db *DB) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `{"format":%d,"exported_at":%q,"tables":[`, ExportFormat, time.Now().UTC().Format(time.RFC3339))
+	for i, t := range exportTables {
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		if err := db.exportTable(bw, t); err != nil {
+			return fmt.Errorf("exporting %s: %w", t.name, err)
+		}
+	}
+	bw.WriteString("]}\n")
+	return bw.Flush()
+}
+
+func (db *DB) exportTable(w *bufio.Writer, t exportTable) error {
+	names := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		names[i] = c.name
+	}
+	header, _ := json.Marshal(names)
+	fmt.Fprintf(w, "\n"+`{"name":%q,"columns":%s,"rows":[`, t.name, header)
+
+	rows, err := db.conn.Query(`SELECT ` + strings.Join(names, ", ") + ` FROM ` + t.name + ` ORDER BY ` + t.orderBy)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	dest := make([]interface{}, len(t.columns))
+	for i, c := range t.columns {
+		switch c.kind {
+		case kindInt:
+			dest[i] = new(sql.NullInt64)
+		case kindBool:
+			dest[i] = new(sql.NullBool)
+		case kindTime:
+			dest[i] = new(sql.NullTime)
+		default:
+			dest[i] = new(sql.NullString)
+		}
+	}
+
+	values := make([]interface{}, len(t.columns))
+	first := true
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, d := range dest {
+			values[i] = nil
+			switch v := d.(type) {
+			case *sql.NullInt64:
+				if v.Valid {
+					values[i] = v.Int64
+				}
+			case *sql.NullBool:
+				if v.Valid {
+					values[i] = v.Bool
+				}
+			case *sql.NullTime:
+				if v.Valid {
+					values[i] = v.Time.UTC().Format(time.RFC3339Nano)
+				}
+			case *sql.NullString:
+				if v.Valid {
+					values[i] = v.String
+				}
+			}
+		}
+		row, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		if !first {
+			w.WriteString(",")
+		}
+		first = false
+		w.WriteString("\n")
+		w.Write(row)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.WriteString("]}")
+	return nil
+}
+
+// Import loads the output of Export into the database, which must be
+// migrated and empty. Everything is loaded in one transaction.
+func (db *DB) Import(r io.Reader) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, t := range exportTables {
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM ` + t.name).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("database is not empty: %s has %d rows", t.name, n)
+		}
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	format := 0
+	err = eachKey(dec, func(key string) error {
+		switch key {
+		case "format":
+			if err := dec.Decode(&format); err != nil {
+				return err
+			}
+			if format != ExportFormat {
+				return fmt.Errorf("unsupported export format %d", format)
+			}
+			return nil
+		case "tables":
+			if format == 0 {
+				return errors.New("export format must come before the tables")
+			}
+			return eachElement(dec, func() error {
+				return importTable(tx, dec)
+			})
+		default:
+			var skip json.RawMessage
+			return dec.Decode(&skip)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if format == 0 {
+		return errors.New("not a BoxCheckr export")
+	}
+
+	// Exports from before tokens were hashed carry them in plaintext
+	if err := hashMachineTokens(tx); err != nil {
+		return err
+	}
+
+	// Generated IDs continue after the imported ones. SQLite tracks this
+	// itself; PostgreSQL identity sequences have to be moved on.
+	if db.conn.dialect == dialectPostgres {
+		for _, t := range exportTables {
+			if !t.identity {
+				continue
+			}
+			if _, err := tx.Exec(`SELECT setval(pg_get_serial_sequence('` + t.name + `', 'id'), COALESCE((SELECT MAX(id) FROM ` + t.name + `), 0) + 1, false)`); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// importTable reads one table object and inserts its rows
+func importTable(tx *dbTx, dec *json.Decoder) error {
+	var table *exportTable
+	var columns []exportColumn
+	var insert string
+	err := eachKey(dec, func(key string) error {
+		switch key {
+		case "name":
+			var name string
+			if err := dec.Decode(&name); err != nil {
+				return err
+			}
+			i := slices.IndexFunc(exportTables, func(t exportTable) bool { return t.name == name })
+			if i < 0 {
+				return fmt.Errorf("unknown table %q", name)
+			}
+			table = &exportTables[i]
+			return nil
+		case "columns":
+			var names []string
+			if err := dec.Decode(&names); err != nil {
+				return err
+			}
+			if table == nil {
+				return errors.New("table name must come before its columns")
+			}
+			for _, name := range names {
+				i := slices.IndexFunc(table.columns, func(c exportColumn) bool { return c.name == name })
+				if i < 0 {
+					return fmt.Errorf("unknown column %s.%s", table.name, name)
+				}
+				columns = append(columns, table.columns[i])
+			}
+			insert = `INSERT INTO ` + table.name + ` (` + strings.Join(names, ", ") + `) VALUES (` +
+				strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ") + `)`
+			return nil
+		case "rows":
+			if insert == "" {
+				return errors.New("table name and columns must come before its rows")
+			}
+			return eachElement(dec, func() error {
+				var raw []json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					return err
+				}
+				if len(raw) != len(columns) {
+					return fmt.Errorf("%s: row has %d values, expected %d", table.name, len(raw), len(columns))
+				}
+				args := make([]interface{}, len(raw))
+				for i, v := range raw {
+					arg, err := importValue(columns[i].kind, v)
+					if err != nil {
+						return fmt.Errorf("%s.%s: %w", table.name, columns[i].name, err)
+					}
+					args[i] = arg
+				}
+				if _, err := tx.Exec(insert, args...); err != nil {
+					return fmt.Errorf("%s: %w", table.name, err)
+				}
+				return nil
+			})
+		default:
+			var skip json.RawMessage
+			return dec.Decode(&skip)
+		}
+	})
+	return err
+}
+
+// importValue converts an exported JSON value back to a query argument
+func importValue(kind columnKind, raw json.RawMessage) (interface{}, error) {
+	if string(raw) == "null" {
+		return nil, nil
+	}
+	switch kind {
+	case kindInt:
+		var v int64
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case kindBool:
+		var v bool
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	case kindTime:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	default:
+		var v string
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	}
+}
+
+// eachKey calls fn for each key of the JSON object at the decoder, which
+// must consume the key's value
+func eachKey(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err := fn(tok.(string)); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// eachElement calls fn for each element of the JSON array at the decoder,
+// which must consume the element
+func eachElement(dec *json.Decoder, fn func() error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return fmt.Errorf("invalid export: expected %v, got %v", want, tok)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Machine token operations
+//
+// Each machine has an enrollment token that its agent or scripts send with
+// every report. Like API keys, only a hash of the token is stored, in
+// enrollment_token, so a token is only known when it is issued. Rotating a
+// token can keep the old one working for a grace period while the machine
+// switches over.
+
+// tokenPrefix is the start of a token, shown so tokens can be told apart
+func tokenPrefix(token string) string {
+	if len(token) > 8 {
+		return token[:8]
+	}
+	return token
+}
+
+// RotateMachineToken issues a new token for a machine and returns it. The
+// old token keeps working for grace, unless the machine's tokens are
+// disabled; rotating re-enables them.
+func (db *DB) RotateMachineToken(id string, grace time.Duration) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	// The expiry is bound as a single typed value, since Postgres can't infer
+	// the type of parameters in a CASE. Disabled tokens get no grace period.
+	rotate := `
+		UPDATE machines SET
+			previous_token_hash = enrollment_token, previous_token_expires_at = ?,
+			enrollment_token = ?, token_prefix = ?, token_created_at = ?, token_disabled_at = NULL
+		WHERE id = ?`
+	now := time.Now().UTC()
+	res, err := db.conn.Exec(rotate+` AND token_disabled_at IS NULL`, now.Add(grace), hashSecret(token), tokenPrefix(token), now, id)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		if _, err := db.conn.Exec(rotate, now, hashSecret(token), tokenPrefix(token), now, id); err != nil {
+			return "", err
+		}
+	}
+	return token, nil
+}
+
+// SetMachineTokenDisabled stops a machine's tokens, including one in its
+// grace period, from working, or lets them work again
+func (db *DB) SetMachineTokenDisabled(id string, disabled bool) error {
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now().UTC()
+		disabledAt = &now
+	}
+	_, err := db.conn.Exec(`UPDATE machines SET token_disabled_at = ? WHERE id = ?`, disabledAt, id)
+	return err
+}
+
+// RecordMachineTokenUse notes when and from where a machine last reported
+func (db *DB) RecordMachineTokenUse(id, ipAddress string) error {
+	_, err := db.conn.Exec(`
+		UPDATE machines SET token_last_used_at = ?, token_last_used_ip = ? WHERE id = ?
+	`, time.Now().UTC(), ipAddress, id)
+	return err
+}
+
+// hashMachineTokens replaces plaintext tokens, from machines created before
+// tokens were hashed, with their hashes. Those machines have no token prefix,
+// so hashed tokens are never hashed again.
+func hashMachineTokens(tx *dbTx) error {
+	rows, err := tx.Query(`SELECT id, enrollment_token, created_at FROM machines WHERE token_prefix = ''`)
+	if err != nil {
+		return err
+	}
+	type machineToken struct {
+		id, token string
+		createdAt sql.NullTime
+	}
+	var tokens []machineToken
+	for rows.Next() {
+		var t machineToken
+		if err := rows.Scan(&t.id, &t.token, &t.createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, t := range tokens {
+		if _, err := tx.Exec(`
+			UPDATE machines SET enrollment_token = ?, token_prefix = ?, token_created_at = ? WHERE id = ?
+		`, hashSecret(t.token), tokenPrefix(t.token), t.createdAt, t.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
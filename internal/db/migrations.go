@@ -0,0 +1,564 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Schema changes are numbered migrations, applied in order at startup and
+// recorded in schema_migrations. SQLite and PostgreSQL each have their own
+// list (see postgres.go), as their DDL differs. Each runs in a transaction with its record,
+// so a failed migration leaves nothing behind. To change the schema, append
+// a migration; never edit one that has shipped.
+//
+// SQLite databases created before schema_migrations existed have no record
+// of what they contain, and hold at most the schema of SQLite migrations 1
+// to 8, so those are idempotent: such a database is migrated from version 0
+// whatever state it is in. Later SQLite migrations, and every PostgreSQL one,
+// only run on databases that record their version, so they run exactly once
+// and needn't be idempotent.
+
+// Migration is a schema change. AppliedAt is nil until it has been applied.
+type Migration struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+
+	up func(tx *dbTx) error
+}
+
+// sqliteMigrations is the SQLite schema history, oldest first
+var sqliteMigrations = []Migration{
+	{Version: 1, Name: "initial schema", up: execSQL(`
+		CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			is_admin BOOLEAN DEFAULT FALSE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS machines (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			name TEXT NOT NULL,
+			enrollment_token TEXT UNIQUE NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS inventory_snapshots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			machine_id TEXT NOT NULL REFERENCES machines(id),
+			collected_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			hostname TEXT,
+			os TEXT,
+			os_version TEXT,
+			disk_encrypted BOOLEAN,
+			disk_encryption_details TEXT,
+			antivirus_enabled BOOLEAN,
+			antivirus_details TEXT,
+			firewall_enabled BOOLEAN,
+			firewall_details TEXT,
+			screen_lock_enabled BOOLEAN,
+			screen_lock_timeout INTEGER,
+			screen_lock_details TEXT,
+			raw_data TEXT
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_machines_user_id ON machines(user_id);
+		CREATE INDEX IF NOT EXISTS idx_machines_enrollment_token ON machines(enrollment_token);
+		CREATE INDEX IF NOT EXISTS idx_inventory_snapshots_machine_id ON inventory_snapshots(machine_id);
+		CREATE INDEX IF NOT EXISTS idx_inventory_snapshots_collected_at ON inventory_snapshots(collected_at);
+
+		CREATE TABLE IF NOT EXISTS machine_notes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			machine_id TEXT NOT NULL REFERENCES machines(id) ON DELETE CASCADE,
+			author_id TEXT NOT NULL REFERENCES users(id),
+			content TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_machine_notes_machine_id ON machine_notes(machine_id);
+
+		CREATE TABLE IF NOT EXISTS share_links (
+			id TEXT PRIMARY KEY,
+			created_by TEXT NOT NULL REFERENCES users(id),
+			expires_at DATETIME NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_share_links_expires_at ON share_links(expires_at);
+	`)},
+
+	{Version: 2, Name: "compliance policy", up: execSQL(`
+		CREATE TABLE IF NOT EXISTS policy_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			field TEXT NOT NULL,
+			operator TEXT NOT NULL,
+			value TEXT NOT NULL,
+			os TEXT NOT NULL DEFAULT '',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS policy_results (
+			snapshot_id INTEGER NOT NULL REFERENCES inventory_snapshots(id),
+			rule_id INTEGER NOT NULL,
+			rule_name TEXT NOT NULL,
+			expression TEXT NOT NULL,
+			passed BOOLEAN NOT NULL,
+			actual TEXT,
+			evaluated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (snapshot_id, rule_id)
+		);
+	`)},
+
+	{Version: 3, Name: "bootstrap codes", up: execSQL(`
+		CREATE TABLE IF NOT EXISTS bootstrap_codes (
+			code_hash TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL REFERENCES machines(id),
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_bootstrap_codes_machine_id ON bootstrap_codes(machine_id);
+	`)},
+
+	{Version: 4, Name: "machine mode and check-in interval", up: addColumns(
+		column{"machines", "mode", "TEXT NOT NULL DEFAULT ''"},
+		column{"machines", "checkin_days", "INTEGER NOT NULL DEFAULT 0"},
+	)},
+
+	{Version: 5, Name: "webhooks", up: execSQL(`
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL DEFAULT '',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER NOT NULL REFERENCES webhooks(id),
+			event_id TEXT NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME NOT NULL,
+			last_attempt_at DATETIME,
+			last_status_code INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+		CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id);
+	`)},
+
+	{Version: 6, Name: "email notifications", up: func(tx *dbTx) error {
+		if err := addColumns(
+			column{"users", "email_opt_out", "BOOLEAN NOT NULL DEFAULT FALSE"},
+			column{"users", "digest_sent_at", "DATETIME"},
+		)(tx); err != nil {
+			return err
+		}
+		return execSQL(`
+			CREATE TABLE IF NOT EXISTS control_alerts (
+				machine_id TEXT NOT NULL REFERENCES machines(id),
+				control TEXT NOT NULL,
+				sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (machine_id, control)
+			);
+		`)(tx)
+	}},
+
+	{Version: 7, Name: "api keys", up: execSQL(`
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			key_hash TEXT NOT NULL UNIQUE,
+			prefix TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			created_by TEXT NOT NULL REFERENCES users(id),
+			expires_at DATETIME,
+			last_used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)},
+
+	{Version: 8, Name: "share link as-of time", up: addColumns(
+		column{"share_links", "as_of", "DATETIME"},
+	)},
+
+	{Version: 9, Name: "machine legal hold", up: addColumns(
+		column{"machines", "legal_hold", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	)},
+
+	{Version: 10, Name: "server-side sessions", up: execSQL(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+			refresh_token TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip_address TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			refreshed_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+	`)},
+
+	{Version: 11, Name: "audit log", up: execSQL(`
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at DATETIME NOT NULL,
+			actor_id TEXT NOT NULL DEFAULT '',
+			actor_email TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			target_type TEXT NOT NULL DEFAULT '',
+			target_id TEXT NOT NULL DEFAULT '',
+			ip_address TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			before_data TEXT NOT NULL DEFAULT '',
+			after_data TEXT NOT NULL DEFAULT '',
+			prev_hash TEXT NOT NULL DEFAULT '',
+			hash TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_events_created ON audit_events(created_at);
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit_events is append-only'); END;
+	`)},
+
+	{Version: 12, Name: "machine archiving", up: addColumns(
+		column{"machines", "archived_at", "DATETIME"},
+		column{"machines", "archived_by", "TEXT NOT NULL DEFAULT ''"},
+		column{"machines", "archive_reason", "TEXT NOT NULL DEFAULT ''"},
+	)},
+
+	{Version: 13, Name: "scoped share links", up: func(tx *dbTx) error {
+		if err := addColumns(
+			column{"share_links", "label", "TEXT NOT NULL DEFAULT ''"},
+			column{"share_links", "filter_owner", "TEXT NOT NULL DEFAULT ''"},
+			column{"share_links", "filter_machine", "TEXT NOT NULL DEFAULT ''"},
+			column{"share_links", "filter_os", "TEXT NOT NULL DEFAULT ''"},
+			column{"share_links", "show_notes", "BOOLEAN NOT NULL DEFAULT TRUE"},
+			column{"share_links", "show_owner_emails", "BOOLEAN NOT NULL DEFAULT TRUE"},
+			column{"share_links", "password_hash", "TEXT NOT NULL DEFAULT ''"},
+			column{"share_links", "revoked_at", "DATETIME"},
+			column{"share_links", "revoked_by", "TEXT NOT NULL DEFAULT ''"},
+			column{"share_links", "revoke_reason", "TEXT NOT NULL DEFAULT ''"},
+		)(tx); err != nil {
+			return err
+		}
+		return execSQL(`
+			CREATE TABLE IF NOT EXISTS share_link_views (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				link_id TEXT NOT NULL REFERENCES share_links(id),
+				viewed_at DATETIME NOT NULL,
+				ip_address TEXT NOT NULL DEFAULT '',
+				user_agent TEXT NOT NULL DEFAULT ''
+			);
+			CREATE INDEX IF NOT EXISTS idx_share_link_views_link ON share_link_views(link_id, viewed_at);
+		`)(tx)
+	}},
+
+	// enrollment_token keeps its name but now holds the token's hash
+	{Version: 14, Name: "hashed machine tokens", up: func(tx *dbTx) error {
+		if err := addColumns(
+			column{"machines", "token_prefix", "TEXT NOT NULL DEFAULT ''"},
+			column{"machines", "token_created_at", "DATETIME"},
+			column{"machines", "previous_token_hash", "TEXT"},
+			column{"machines", "previous_token_expires_at", "DATETIME"},
+			column{"machines", "token_disabled_at", "DATETIME"},
+			column{"machines", "token_last_used_at", "DATETIME"},
+			column{"machines", "token_last_used_ip", "TEXT NOT NULL DEFAULT ''"},
+		)(tx); err != nil {
+			return err
+		}
+		if err := execSQL(`
+			CREATE INDEX IF NOT EXISTS idx_machines_previous_token ON machines(previous_token_hash);
+		`)(tx); err != nil {
+			return err
+		}
+		return hashMachineTokens(tx)
+	}},
+
+	{Version: 15, Name: "signed inventory", up: func(tx *dbTx) error {
+		if err := addColumns(
+			column{"machines", "public_key", "TEXT NOT NULL DEFAULT ''"},
+			column{"machines", "public_key_registered_at", "DATETIME"},
+			column{"inventory_snapshots", "signed", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		)(tx); err != nil {
+			return err
+		}
+		return execSQL(`
+			CREATE TABLE IF NOT EXISTS inventory_nonces (
+				machine_id TEXT NOT NULL REFERENCES machines(id),
+				nonce TEXT NOT NULL,
+				created_at DATETIME NOT NULL,
+				PRIMARY KEY (machine_id, nonce)
+			);
+		`)(tx)
+	}},
+
+	{Version: 16, Name: "patch level", up: addColumns(
+		column{"inventory_snapshots", "os_build", "TEXT NOT NULL DEFAULT ''"},
+		column{"inventory_snapshots", "days_since_update", "INTEGER"},
+		column{"inventory_snapshots", "pending_security_updates", "INTEGER"},
+		column{"inventory_snapshots", "auto_update_enabled", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		column{"inventory_snapshots", "auto_update_details", "TEXT NOT NULL DEFAULT ''"},
+		column{"inventory_snapshots", "last_boot_at", "DATETIME"},
+	)},
+
+	{Version: 17, Name: "snapshot checks", up: execSQL(`
+		CREATE TABLE IF NOT EXISTS snapshot_checks (
+			snapshot_id INTEGER NOT NULL REFERENCES inventory_snapshots(id),
+			check_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			value TEXT NOT NULL DEFAULT '',
+			details TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (snapshot_id, check_id)
+		);
+	`)},
+
+	{Version: 18, Name: "control statuses", up: func(tx *dbTx) error {
+		if err := addColumns(
+			column{"inventory_snapshots", "disk_encryption_status", "TEXT NOT NULL DEFAULT ''"},
+			column{"inventory_snapshots", "antivirus_status", "TEXT NOT NULL DEFAULT ''"},
+			column{"inventory_snapshots", "firewall_status", "TEXT NOT NULL DEFAULT ''"},
+			column{"inventory_snapshots", "screen_lock_status", "TEXT NOT NULL DEFAULT ''"},
+		)(tx); err != nil {
+			return err
+		}
+		return execSQL(backfillControlStatuses)(tx)
+	}},
+
+	{Version: 19, Name: "failed share link unlocks", up: func(tx *dbTx) error {
+		if err := addColumns(
+			column{"share_link_views", "failed", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		)(tx); err != nil {
+			return err
+		}
+		return execSQL(`
+			CREATE INDEX IF NOT EXISTS idx_share_link_views_ip ON share_link_views(ip_address, viewed_at);
+		`)(tx)
+	}},
+}
+
+// backfillControlStatuses sets the statuses of snapshots reported before
+// statuses were, from their booleans
+const backfillControlStatuses = `
+	UPDATE inventory_snapshots SET disk_encryption_status = CASE WHEN disk_encrypted THEN 'pass' ELSE 'fail' END WHERE disk_encryption_status = '';
+	UPDATE inventory_snapshots SET antivirus_status = CASE WHEN antivirus_enabled THEN 'pass' ELSE 'fail' END WHERE antivirus_status = '';
+	UPDATE inventory_snapshots SET firewall_status = CASE WHEN firewall_enabled THEN 'pass' ELSE 'fail' END WHERE firewall_status = '';
+	UPDATE inventory_snapshots SET screen_lock_status = CASE WHEN screen_lock_enabled THEN 'pass' ELSE 'fail' END WHERE screen_lock_status = '';
+`
+
+func execSQL(query string) func(tx *dbTx) error {
+	return func(tx *dbTx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+type column struct{ table, name, definition string }
+
+func addColumns(columns ...column) func(tx *dbTx) error {
+	return func(tx *dbTx) error {
+		for _, c := range columns {
+			if err := addColumnIfMissing(tx, c.table, c.name, c.definition); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrations returns the schema history for the database's dialect
+func (db *DB) migrations() []Migration {
+	if db.conn.dialect == dialectPostgres {
+		return postgresMigrations
+	}
+	return sqliteMigrations
+}
+
+// SchemaVersion is the version of the newest migration
+func (db *DB) SchemaVersion() int {
+	m := db.migrations()
+	return m[len(m)-1].Version
+}
+
+// MigrationStatus returns every migration, with AppliedAt set on those that
+// have been applied. It doesn't change the database.
+func (db *DB) MigrationStatus() ([]Migration, error) {
+	exists := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`
+	if db.conn.dialect == dialectPostgres {
+		exists = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'`
+	}
+	var n int
+	if err := db.conn.QueryRow(exists).Scan(&n); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+	if n > 0 {
+		rows, err := db.conn.Query(`SELECT version, applied_at FROM schema_migrations`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var version int
+			var at time.Time
+			if err := rows.Scan(&version, &at); err != nil {
+				return nil, err
+			}
+			applied[version] = at
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	migrations := db.migrations()
+	status := make([]Migration, len(migrations))
+	for i, m := range migrations {
+		status[i] = m
+		if at, ok := applied[m.Version]; ok {
+			status[i].AppliedAt = &at
+		}
+	}
+	return status, nil
+}
+
+// Migrate applies pending migrations in order and returns them. With dryRun,
+// they are applied in a single transaction that is rolled back, to check
+// they would succeed without changing anything.
+func (db *DB) Migrate(dryRun bool) ([]Migration, error) {
+	status, err := db.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range status {
+		if m.AppliedAt == nil {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	tx, err := db.beginMigration()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { tx.Rollback() }()
+
+	var applied []Migration
+	for _, m := range pending {
+		// Another instance may have applied it since the status was read
+		var n int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, m.Version).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			continue
+		}
+
+		if err := m.up(tx); err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.Version, m.Name); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m)
+		if dryRun {
+			continue
+		}
+
+		// Commit each migration on its own
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		if tx, err = db.beginMigration(); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return applied, nil
+	}
+	return applied, tx.Commit()
+}
+
+// migrationLockID is the PostgreSQL advisory lock held while migrating
+const migrationLockID = 0x626f78636b72 // "boxckr"
+
+// beginMigration starts a transaction for a migration, creating
+// schema_migrations if needed. On PostgreSQL it holds a lock so instances
+// starting at the same time migrate one after the other.
+func (db *DB) beginMigration() (*dbTx, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	appliedAt := "DATETIME"
+	if db.conn.dialect == dialectPostgres {
+		appliedAt = "TIMESTAMPTZ"
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, migrationLockID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at ` + appliedAt + ` DEFAULT CURRENT_TIMESTAMP
+		)
+	`); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// addColumnIfMissing adds a column to an existing table, for databases created
+// before the column was part of the schema
+func addColumnIfMissing(tx *dbTx, table, column, definition string) error {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
@@ -1,21 +1,116 @@
 package db
 
-import "time"
+import (
+	"slices"
+	"strings"
+	"time"
+)
 
 type User struct {
-	ID        string    `json:"id"`
-	Email     string    `json:"email"`
-	Name      string    `json:"name"`
-	IsAdmin   bool      `json:"is_admin"`
-	CreatedAt time.Time `json:"created_at"`
+	ID          string    `json:"id"`
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	IsAdmin     bool      `json:"is_admin"`
+	EmailOptOut bool      `json:"email_opt_out"` // User turned off notification emails
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 type Machine struct {
 	ID              string    `json:"id"`
 	UserID          string    `json:"user_id"`
 	Name            string    `json:"name"`
-	EnrollmentToken string    `json:"enrollment_token"`
+	EnrollmentToken string    `json:"-"`            // Only set when a token is issued; just its hash is stored
+	TokenPrefix     string    `json:"token_prefix"` // Start of the current token, to tell tokens apart
+	Mode            string    `json:"mode"`         // Install mode reported at bootstrap; empty if unknown
+	CheckInDays     int       `json:"checkin_days"` // Admin override of the check-in interval; 0 uses the default
+	LegalHold       bool      `json:"legal_hold"`   // Exempt from snapshot retention
 	CreatedAt       time.Time `json:"created_at"`
+
+	// Archived machines are hidden from default views but keep their history
+	ArchivedAt    *time.Time `json:"archived_at,omitempty"`
+	ArchivedBy    string     `json:"archived_by,omitempty"`
+	ArchiveReason string     `json:"archive_reason,omitempty"`
+
+	// Enrollment token state, set by GetMachine and GetMachineByToken
+	TokenIssuedAt          *time.Time `json:"token_issued_at,omitempty"`
+	PreviousTokenExpiresAt *time.Time `json:"previous_token_expires_at,omitempty"` // End of the grace period after a rotation
+	TokenDisabledAt        *time.Time `json:"token_disabled_at,omitempty"`
+	TokenLastUsedAt        *time.Time `json:"token_last_used_at,omitempty"`
+	TokenLastUsedIP        string     `json:"token_last_used_ip,omitempty"`
+
+	// Ed25519 key the compiled agent registered at bootstrap, base64 encoded.
+	// Machines with a key must sign their reports.
+	PublicKey             string     `json:"public_key,omitempty"`
+	PublicKeyRegisteredAt *time.Time `json:"public_key_registered_at,omitempty"`
+}
+
+// Install modes, as chosen on the machine page
+const (
+	ModeOneTime = "onetime"
+	ModeMonitor = "monitor"
+)
+
+// Check-in states, see CheckInState
+const (
+	CheckInHealthy       = "healthy"
+	CheckInOverdue       = "overdue"
+	CheckInNeverReported = "never_reported"
+)
+
+// ExpectedCheckInDays returns how often the machine should report, or 0 when
+// it isn't expected to report again. Machines installed in monitor mode, and
+// older ones whose mode is unknown, use defaultDays.
+func (m *Machine) ExpectedCheckInDays(defaultDays int) int {
+	if m.CheckInDays > 0 {
+		return m.CheckInDays
+	}
+	if m.Mode == ModeOneTime {
+		return 0
+	}
+	return defaultDays
+}
+
+// TokenDisabled reports whether the machine's tokens have been disabled
+func (m *Machine) TokenDisabled() bool {
+	return m.TokenDisabledAt != nil
+}
+
+// InTokenGrace reports whether the token replaced by the last rotation is
+// still accepted at now
+func (m *Machine) InTokenGrace(now time.Time) bool {
+	return m.PreviousTokenExpiresAt != nil && now.Before(*m.PreviousTokenExpiresAt)
+}
+
+// Archived reports whether the machine has been archived
+func (m *Machine) Archived() bool {
+	return m.ArchivedAt != nil
+}
+
+// PurgeableAt is when an archived machine may be permanently deleted, once
+// it has been archived for purgeDays
+func (m *Machine) PurgeableAt(purgeDays int) time.Time {
+	if m.ArchivedAt == nil {
+		return time.Time{}
+	}
+	return m.ArchivedAt.AddDate(0, 0, purgeDays)
+}
+
+// CanPurge reports whether the machine may be permanently deleted: it must
+// have been archived for purgeDays and not be on legal hold
+func (m *Machine) CanPurge(purgeDays int, now time.Time) bool {
+	return m.Archived() && !m.LegalHold && !now.Before(m.PurgeableAt(purgeDays))
+}
+
+// CheckInState classifies a machine by when it last reported (nil if never)
+func (m *Machine) CheckInState(lastReport *time.Time, defaultDays int, now time.Time) string {
+	if lastReport == nil {
+		return CheckInNeverReported
+	}
+	days := m.ExpectedCheckInDays(defaultDays)
+	if days > 0 && now.Sub(*lastReport) > time.Duration(days)*24*time.Hour {
+		return CheckInOverdue
+	}
+	return CheckInHealthy
 }
 
 type InventorySnapshot struct {
@@ -35,6 +130,132 @@ type InventorySnapshot struct {
 	ScreenLockTimeout     int       `json:"screen_lock_timeout"`
 	ScreenLockDetails     string    `json:"screen_lock_details"`
 	RawData               string    `json:"raw_data"`
+	Signed                bool      `json:"signed"` // Signed by the machine's registered key
+
+	// Control statuses. The booleans above are true only when the status is
+	// pass, so a control the agent couldn't check isn't counted as passing.
+	DiskEncryptionStatus ControlStatus `json:"disk_encryption_status"`
+	AntivirusStatus      ControlStatus `json:"antivirus_status"`
+	FirewallStatus       ControlStatus `json:"firewall_status"`
+	ScreenLockStatus     ControlStatus `json:"screen_lock_status"`
+
+	// Patch level. Nil values weren't reported, by older scripts or because
+	// the agent couldn't tell.
+	OSBuild                string     `json:"os_build"`
+	DaysSinceUpdate        *int       `json:"days_since_update"`
+	PendingSecurityUpdates *int       `json:"pending_security_updates"`
+	AutoUpdateEnabled      bool       `json:"auto_update_enabled"`
+	AutoUpdateDetails      string     `json:"auto_update_details"`
+	LastBootAt             *time.Time `json:"last_boot_at"`
+
+	// Named checks reported alongside the fixed fields (see SnapshotCheck).
+	// Loaded by GetSnapshot, GetLatestSnapshot and GetLatestSnapshots.
+	Checks []SnapshotCheck `json:"checks,omitempty"`
+
+	// Policy verdict counts for this snapshot (see PolicyResult)
+	PolicyPassed int `json:"policy_passed"`
+	PolicyFailed int `json:"policy_failed"`
+}
+
+// ControlStatus is the outcome of a control: pass, fail, unknown (the agent
+// couldn't tell) or not_applicable
+type ControlStatus string
+
+// Control statuses
+const (
+	StatusPass          ControlStatus = "pass"
+	StatusFail          ControlStatus = "fail"
+	StatusUnknown       ControlStatus = "unknown"
+	StatusNotApplicable ControlStatus = "not_applicable"
+)
+
+// fillStatuses sets the statuses of controls reported only as booleans, and
+// makes each boolean true only if its control passed
+func (s *InventorySnapshot) fillStatuses() {
+	for _, c := range []struct {
+		status *ControlStatus
+		passed *bool
+	}{
+		{&s.DiskEncryptionStatus, &s.DiskEncrypted},
+		{&s.AntivirusStatus, &s.AntivirusEnabled},
+		{&s.FirewallStatus, &s.FirewallEnabled},
+		{&s.ScreenLockStatus, &s.ScreenLockEnabled},
+	} {
+		*c.status = c.status.Or(*c.passed)
+		*c.passed = *c.status == StatusPass
+	}
+}
+
+// Or is c, or the status of a control reported only as a boolean if c is
+// empty
+func (c ControlStatus) Or(passed bool) ControlStatus {
+	switch {
+	case c != "":
+		return c
+	case passed:
+		return StatusPass
+	}
+	return StatusFail
+}
+
+// Value is the status as the control's boolean field: "true" if it passed,
+// "false" if it failed, otherwise the status itself
+func (c ControlStatus) Value() string {
+	switch c {
+	case StatusPass:
+		return "true"
+	case StatusFail:
+		return "false"
+	}
+	return string(c)
+}
+
+// Failed reports whether the control was checked and failed
+func (c ControlStatus) Failed() bool {
+	return c == StatusFail
+}
+
+// Unknown reports whether the agent couldn't check the control
+func (c ControlStatus) Unknown() bool {
+	return c == StatusUnknown
+}
+
+// Label is the status for display
+func (c ControlStatus) Label() string {
+	switch c {
+	case StatusPass:
+		return "Pass"
+	case StatusFail:
+		return "Fail"
+	case StatusNotApplicable:
+		return "N/A"
+	}
+	return "Unknown"
+}
+
+// PolicyEvaluated reports whether any policy rule applied to this snapshot
+func (s *InventorySnapshot) PolicyEvaluated() bool {
+	return s.PolicyPassed+s.PolicyFailed > 0
+}
+
+// Compliant reports whether every applicable policy rule passed
+func (s *InventorySnapshot) Compliant() bool {
+	return s.PolicyEvaluated() && s.PolicyFailed == 0
+}
+
+// SecurityUpdatesPending reports whether the machine said security updates
+// were waiting to be installed
+func (s *InventorySnapshot) SecurityUpdatesPending() bool {
+	return s.PendingSecurityUpdates != nil && *s.PendingSecurityUpdates > 0
+}
+
+// UptimeDays is how many whole days the machine had been up when the
+// snapshot was collected, or zero if it didn't report its boot time
+func (s *InventorySnapshot) UptimeDays() int {
+	if s.LastBootAt == nil {
+		return 0
+	}
+	return int(s.CollectedAt.Sub(*s.LastBootAt).Hours() / 24)
 }
 
 // MachineWithLatest combines machine info with its latest snapshot
@@ -50,6 +271,16 @@ type MachineWithOwner struct {
 	OwnerName  string             `json:"owner_name"`
 	Latest     *InventorySnapshot `json:"latest,omitempty"`
 	Notes      []MachineNote      `json:"notes,omitempty"`
+	NoteCount  int                `json:"note_count"`
+	CheckIn    string             `json:"check_in,omitempty"` // Check-in state, filled in by the caller
+}
+
+// LastReport returns when the machine last reported, or nil if it never has
+func (m *MachineWithOwner) LastReport() *time.Time {
+	if m.Latest == nil {
+		return nil
+	}
+	return &m.Latest.CollectedAt
 }
 
 // MachineNote represents an admin note on a machine
@@ -63,10 +294,233 @@ type MachineNote struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// ShareLink represents a time-limited shareable link to view all machines in the organization
+// ShareLink represents a time-limited shareable link to view the machines
+// in its scope
 type ShareLink struct {
-	ID        string    `json:"id"`
-	CreatedBy string    `json:"created_by"` // Admin who created the link
-	ExpiresAt time.Time `json:"expires_at"`
+	ID        string     `json:"id"`
+	CreatedBy string     `json:"created_by"` // Admin who created the link
+	ExpiresAt time.Time  `json:"expires_at"`
+	AsOf      *time.Time `json:"as_of,omitempty"` // Point in time the link shows; nil for the current state
+	CreatedAt time.Time  `json:"created_at"`
+	Label     string     `json:"label"` // Shown to admins only, e.g. who the link is for
+
+	// Scope: machines matching every set filter, as on the admin machines page
+	FilterOwner   string `json:"filter_owner"`
+	FilterMachine string `json:"filter_machine"`
+	FilterOS      string `json:"filter_os"` // Reported OS, e.g. darwin
+
+	ShowNotes       bool   `json:"show_notes"`
+	ShowOwnerEmails bool   `json:"show_owner_emails"`
+	PasswordHash    string `json:"-"` // bcrypt; empty if the link has no password
+
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy    string     `json:"revoked_by,omitempty"`
+	RevokeReason string     `json:"revoke_reason,omitempty"`
+
+	// Access log summary, set by GetAllShareLinks
+	ViewCount    int        `json:"view_count"`
+	LastViewedAt *time.Time `json:"last_viewed_at,omitempty"`
+}
+
+// ShareLinkView is one access log entry of a share link
+type ShareLinkView struct {
+	ID        int64     `json:"id"`
+	LinkID    string    `json:"link_id"`
+	ViewedAt  time.Time `json:"viewed_at"`
+	IPAddress string    `json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	Failed    bool      `json:"failed"` // A wrong password was entered
+}
+
+// BootstrapCode is a short-lived, single-use credential that install scripts
+// exchange for the machine's enrollment token. Code is only set when issued.
+type BootstrapCode struct {
+	Code      string     `json:"-"`
+	MachineID string     `json:"machine_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Webhook is an admin-configured URL that receives signed event notifications
+type Webhook struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`      // HMAC-SHA256 signing key, shown to admins
+	Events    string    `json:"events"` // Comma-separated event types; empty subscribes to all
+	Enabled   bool      `json:"enabled"`
 	CreatedAt time.Time `json:"created_at"`
 }
+
+// EventList returns the subscribed event types, or nil for all events
+func (w Webhook) EventList() []string {
+	if w.Events == "" {
+		return nil
+	}
+	return strings.Split(w.Events, ",")
+}
+
+// Webhook delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed" // Gave up after the last retry
+)
+
+// WebhookDelivery is one event queued for one webhook, with the outcome of its latest attempt
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	WebhookID      int64      `json:"webhook_id"`
+	WebhookURL     string     `json:"webhook_url"`
+	Secret         string     `json:"-"`
+	EventID        string     `json:"event_id"`
+	Event          string     `json:"event"`
+	Payload        string     `json:"payload"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	LastStatusCode int        `json:"last_status_code"`
+	LastError      string     `json:"last_error"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// Session is a signed-in browser. Its cookie holds a random token; only a
+// hash of the token is stored, as the session's ID. Token is only set when
+// the session is created.
+type Session struct {
+	ID           string    `json:"id"`
+	Token        string    `json:"-"`
+	UserID       string    `json:"user_id"`
+	UserEmail    string    `json:"user_email"`
+	UserName     string    `json:"user_name"`
+	IsAdmin      bool      `json:"is_admin"`
+	RefreshToken string    `json:"-"` // OIDC refresh token, if the provider issued one
+	UserAgent    string    `json:"user_agent"`
+	IPAddress    string    `json:"ip_address"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastSeenAt   time.Time `json:"last_seen_at"`
+	RefreshedAt  time.Time `json:"refreshed_at"` // When IsAdmin was last re-evaluated
+	ExpiresAt    time.Time `json:"expires_at"`   // Absolute expiry
+}
+
+// AuditEvent is an entry in the append-only audit log. Each entry's Hash
+// covers its fields and the previous entry's hash, so editing or removing an
+// entry breaks the chain (see VerifyAuditLog).
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ActorID    string    `json:"actor_id"` // Empty for anonymous actions, e.g. share link views
+	ActorEmail string    `json:"actor_email"`
+	Action     string    `json:"action"` // e.g. "machine.deleted"
+	TargetType string    `json:"target_type"`
+	TargetID   string    `json:"target_id"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	Before     string    `json:"before,omitempty"` // JSON of the target before the action
+	After      string    `json:"after,omitempty"`  // JSON of the target after the action
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash"`
+}
+
+// AuditFilter selects audit events. Zero values match everything.
+type AuditFilter struct {
+	Query  string // Matches the actor, target or IP address
+	Action string
+	From   time.Time
+	To     time.Time // Exclusive
+	Limit  int
+}
+
+// AuditVerification is the result of checking the audit log's hash chain
+type AuditVerification struct {
+	Events   int64  // Entries checked
+	Head     string // Hash of the newest entry
+	BrokenAt int64  // ID of the first entry that doesn't match, or 0 if the chain is intact
+}
+
+// APIKey authenticates a client of the read-only REST API. Only a hash of the
+// key is stored; Key is only set when the key is created.
+type APIKey struct {
+	ID             int64      `json:"id"`
+	Name           string     `json:"name"`
+	Key            string     `json:"-"`
+	Prefix         string     `json:"prefix"` // Start of the key, to tell keys apart
+	Scopes         string     `json:"scopes"` // Comma-separated, see APIScopes
+	CreatedBy      string     `json:"created_by"`
+	CreatedByEmail string     `json:"created_by_email"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"` // nil if the key never expires
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// API key scopes
+const (
+	ScopeMachinesRead  = "machines:read"
+	ScopeSnapshotsRead = "snapshots:read"
+	ScopeUsersRead     = "users:read"
+)
+
+// APIScopes lists every scope an API key can be granted
+var APIScopes = []string{ScopeMachinesRead, ScopeSnapshotsRead, ScopeUsersRead}
+
+// ScopeList returns the granted scopes
+func (k APIKey) ScopeList() []string {
+	if k.Scopes == "" {
+		return nil
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+// HasScope reports whether the key was granted scope
+func (k APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.ScopeList(), scope)
+}
+
+// Expired reports whether the key had expired at now
+func (k APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// PolicyRule is an admin-defined compliance rule, e.g. "disk_encrypted == true"
+type PolicyRule struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Field     string    `json:"field"`    // Inventory field, named after the agent JSON key
+	Operator  string    `json:"operator"` // One of ==, !=, <, <=, >, >=
+	Value     string    `json:"value"`
+	OS        string    `json:"os"` // Restrict to a platform (darwin, linux, windows); empty applies to all
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Expression renders the rule as it is shown to admins and recorded with each result
+func (r PolicyRule) Expression() string {
+	expr := r.Field + " " + r.Operator + " " + r.Value
+	if r.OS != "" {
+		expr += " for " + r.OS
+	}
+	return expr
+}
+
+// SnapshotCheck is one named check an agent reported, such as
+// "ssh_root_login_disabled". Status is pass, fail, unknown or not_applicable.
+type SnapshotCheck struct {
+	SnapshotID int64  `json:"-"`
+	CheckID    string `json:"id"`
+	Status     string `json:"status"`
+	Value      string `json:"value,omitempty"`
+	Details    string `json:"details,omitempty"`
+}
+
+// PolicyResult is the persisted verdict of one rule against one snapshot.
+// The rule name and expression are copied so history survives rule edits and deletion.
+type PolicyResult struct {
+	SnapshotID  int64     `json:"snapshot_id"`
+	RuleID      int64     `json:"rule_id"`
+	RuleName    string    `json:"rule_name"`
+	Expression  string    `json:"expression"`
+	Passed      bool      `json:"passed"`
+	Actual      string    `json:"actual"` // The value the rule saw, for display
+	EvaluatedAt time.Time `json:"evaluated_at"`
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"strings"
+	"time"
+)
+
+// Notification operations
+
+func (db *DB) SetUserEmailOptOut(userID string, optOut bool) error {
+	_, err := db.conn.Exec(`UPDATE users SET email_opt_out = ? WHERE id = ?`, optOut, userID)
+	return err
+}
+
+// GetUsersDueDigest returns users with at least one active machine who haven't
+// opted out and haven't been sent a digest since the given time
+func (db *DB) GetUsersDueDigest(since time.Time) ([]User, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, email, name, is_admin, email_opt_out, created_at
+		FROM users u
+		WHERE email_opt_out = FALSE
+			AND (digest_sent_at IS NULL OR digest_sent_at <= ?)
+			AND EXISTS (SELECT 1 FROM machines m WHERE m.user_id = u.id AND m.archived_at IS NULL)
+		ORDER BY id
+	`, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.IsAdmin, &u.EmailOptOut, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (db *DB) MarkDigestSent(userID string, at time.Time) error {
+	_, err := db.conn.Exec(`UPDATE users SET digest_sent_at = ? WHERE id = ?`, at.UTC(), userID)
+	return err
+}
+
+// GetAlertedControls returns the controls the machine's owner has already
+// been emailed about and that have not recovered since
+func (db *DB) GetAlertedControls(machineID string) ([]string, error) {
+	rows, err := db.conn.Query(`SELECT control FROM control_alerts WHERE machine_id = ? ORDER BY control`, machineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var controls []string
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, err
+		}
+		controls = append(controls, c)
+	}
+	return controls, rows.Err()
+}
+
+// SetAlertedControls replaces the machine's alerted controls with the ones
+// currently failing, so a control that recovers is alerted again if it fails later
+func (db *DB) SetAlertedControls(machineID string, controls []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Drop recovered controls, keeping the original sent time for the rest
+	query := `DELETE FROM control_alerts WHERE machine_id = ?`
+	args := []interface{}{machineID}
+	if len(controls) > 0 {
+		query += ` AND control NOT IN (?` + strings.Repeat(`, ?`, len(controls)-1) + `)`
+		for _, c := range controls {
+			args = append(args, c)
+		}
+	}
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	for _, c := range controls {
+		if _, err := tx.Exec(`
+			INSERT INTO control_alerts (machine_id, control, sent_at) VALUES (?, ?, ?)
+			ON CONFLICT DO NOTHING
+		`, machineID, c, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
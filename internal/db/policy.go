@@ -0,0 +1,189 @@
+package db
+
+import (
+	"database/sql"
+)
+
+// policyCountColumns selects the pass/fail verdict counts for the snapshot aliased as s
+const policyCountColumns = `(SELECT COUNT(*) FROM policy_results pr WHERE pr.snapshot_id = s.id AND pr.passed = TRUE),
+			(SELECT COUNT(*) FROM policy_results pr WHERE pr.snapshot_id = s.id AND pr.passed = FALSE)`
+
+// Policy rule operations
+
+func (db *DB) CreatePolicyRule(rule *PolicyRule) (*PolicyRule, error) {
+	var id int64
+	err := db.conn.QueryRow(`
+		INSERT INTO policy_rules (name, field, operator, value, os, enabled) VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`, rule.Name, rule.Field, rule.Operator, rule.Value, rule.OS, rule.Enabled).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.GetPolicyRule(id)
+}
+
+func (db *DB) GetPolicyRule(id int64) (*PolicyRule, error) {
+	var r PolicyRule
+	err := db.conn.QueryRow(`
+		SELECT id, name, field, operator, value, os, enabled, created_at
+		FROM policy_rules
+		WHERE id = ?
+	`, id).Scan(&r.ID, &r.Name, &r.Field, &r.Operator, &r.Value, &r.OS, &r.Enabled, &r.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// GetPolicyRules returns all rules, or only enabled ones when enabledOnly is set
+func (db *DB) GetPolicyRules(enabledOnly bool) ([]PolicyRule, error) {
+	query := `
+		SELECT id, name, field, operator, value, os, enabled, created_at
+		FROM policy_rules
+	`
+	if enabledOnly {
+		query += ` WHERE enabled = TRUE`
+	}
+	query += ` ORDER BY LOWER(name), id`
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []PolicyRule
+	for rows.Next() {
+		var r PolicyRule
+		if err := rows.Scan(&r.ID, &r.Name, &r.Field, &r.Operator, &r.Value, &r.OS, &r.Enabled, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (db *DB) SetPolicyRuleEnabled(id int64, enabled bool) error {
+	_, err := db.conn.Exec(`UPDATE policy_rules SET enabled = ? WHERE id = ?`, enabled, id)
+	return err
+}
+
+// DeletePolicyRule removes a rule. Results already recorded against snapshots are kept.
+func (db *DB) DeletePolicyRule(id int64) error {
+	_, err := db.conn.Exec(`DELETE FROM policy_rules WHERE id = ?`, id)
+	return err
+}
+
+// Policy result operations
+
+// SavePolicyResults replaces the recorded verdict for a snapshot
+func (db *DB) SavePolicyResults(snapshotID int64, results []PolicyResult) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM policy_results WHERE snapshot_id = ?`, snapshotID); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		if _, err := tx.Exec(`
+			INSERT INTO policy_results (snapshot_id, rule_id, rule_name, expression, passed, actual)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, snapshotID, r.RuleID, r.RuleName, r.Expression, r.Passed, r.Actual); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) GetPolicyResults(snapshotID int64) ([]PolicyResult, error) {
+	rows, err := db.conn.Query(`
+		SELECT snapshot_id, rule_id, rule_name, expression, passed, COALESCE(actual, ''), evaluated_at
+		FROM policy_results
+		WHERE snapshot_id = ?
+		ORDER BY passed, LOWER(rule_name)
+	`, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []PolicyResult
+	for rows.Next() {
+		var r PolicyResult
+		if err := rows.Scan(&r.SnapshotID, &r.RuleID, &r.RuleName, &r.Expression, &r.Passed, &r.Actual, &r.EvaluatedAt); err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// GetLatestSnapshots returns the most recent snapshot of every active machine,
+// with its checks but without raw data
+func (db *DB) GetLatestSnapshots() ([]InventorySnapshot, error) {
+	rows, err := db.conn.Query(`
+		SELECT s.id, s.machine_id, s.collected_at, s.hostname, s.os, s.os_version,
+		       s.disk_encrypted, s.disk_encryption_details, s.antivirus_enabled, s.antivirus_details,
+		       s.firewall_enabled, s.firewall_details, s.screen_lock_enabled, s.screen_lock_timeout, s.screen_lock_details,
+		       s.os_build, s.days_since_update, s.pending_security_updates,
+		       s.auto_update_enabled, s.auto_update_details, s.last_boot_at,
+		       s.disk_encryption_status, s.antivirus_status, s.firewall_status, s.screen_lock_status
+		FROM machines m
+		JOIN inventory_snapshots s ON s.id = (
+			SELECT id FROM inventory_snapshots
+			WHERE machine_id = m.id
+			ORDER BY collected_at DESC
+			LIMIT 1
+		)
+		WHERE m.archived_at IS NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snapshots []InventorySnapshot
+	for rows.Next() {
+		var s InventorySnapshot
+		var firewallEnabled, screenLockEnabled sql.NullBool
+		var screenLockTimeout sql.NullInt64
+		var firewallDetails, screenLockDetails sql.NullString
+		var daysSinceUpdate, pendingUpdates sql.NullInt64
+		var lastBootAt sql.NullTime
+		if err := rows.Scan(&s.ID, &s.MachineID, &s.CollectedAt, &s.Hostname, &s.OS, &s.OSVersion,
+			&s.DiskEncrypted, &s.DiskEncryptionDetails, &s.AntivirusEnabled, &s.AntivirusDetails,
+			&firewallEnabled, &firewallDetails, &screenLockEnabled, &screenLockTimeout, &screenLockDetails,
+			&s.OSBuild, &daysSinceUpdate, &pendingUpdates,
+			&s.AutoUpdateEnabled, &s.AutoUpdateDetails, &lastBootAt,
+			&s.DiskEncryptionStatus, &s.AntivirusStatus, &s.FirewallStatus, &s.ScreenLockStatus); err != nil {
+			return nil, err
+		}
+		s.DaysSinceUpdate = intPtr(daysSinceUpdate)
+		s.PendingSecurityUpdates = intPtr(pendingUpdates)
+		s.LastBootAt = timePtr(lastBootAt)
+		s.FirewallEnabled = firewallEnabled.Bool
+		s.FirewallDetails = firewallDetails.String
+		s.ScreenLockEnabled = screenLockEnabled.Bool
+		s.ScreenLockTimeout = int(screenLockTimeout.Int64)
+		s.ScreenLockDetails = screenLockDetails.String
+		snapshots = append(snapshots, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := db.loadLatestChecks(snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
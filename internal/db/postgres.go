@@ -0,0 +1,322 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// NewPostgres connects to a PostgreSQL database, e.g.
+// "postgres://boxcheckr:secret@db:5432/boxcheckr", and applies any pending
+// migrations. Several servers can share one database.
+func NewPostgres(dsn string) (*DB, error) {
+	db, err := OpenPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Migrate(false); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to run migrations: %w", err)
+	}
+
+	return db, nil
+}
+
+// OpenPostgres connects to a PostgreSQL database without migrating it
+func OpenPostgres(dsn string) (*DB, error) {
+	sqlDB, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return &DB{conn: &conn{DB: sqlDB, dialect: dialectPostgres}}, nil
+}
+
+// postgresMigrations is the PostgreSQL schema history, oldest first. It
+// starts from the schema as of SQLite migration 8.
+var postgresMigrations = []Migration{
+	{Version: 1, Name: "initial schema", up: execSQL(`
+		CREATE TABLE users (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			is_admin BOOLEAN DEFAULT FALSE,
+			email_opt_out BOOLEAN NOT NULL DEFAULT FALSE,
+			digest_sent_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE machines (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			name TEXT NOT NULL,
+			enrollment_token TEXT UNIQUE NOT NULL,
+			mode TEXT NOT NULL DEFAULT '',
+			checkin_days INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE inventory_snapshots (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			machine_id TEXT NOT NULL REFERENCES machines(id),
+			collected_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			hostname TEXT,
+			os TEXT,
+			os_version TEXT,
+			disk_encrypted BOOLEAN,
+			disk_encryption_details TEXT,
+			antivirus_enabled BOOLEAN,
+			antivirus_details TEXT,
+			firewall_enabled BOOLEAN,
+			firewall_details TEXT,
+			screen_lock_enabled BOOLEAN,
+			screen_lock_timeout INTEGER,
+			screen_lock_details TEXT,
+			raw_data TEXT
+		);
+
+		CREATE INDEX idx_machines_user_id ON machines(user_id);
+		CREATE INDEX idx_inventory_snapshots_machine_id ON inventory_snapshots(machine_id);
+		CREATE INDEX idx_inventory_snapshots_collected_at ON inventory_snapshots(collected_at);
+
+		CREATE TABLE machine_notes (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			machine_id TEXT NOT NULL REFERENCES machines(id) ON DELETE CASCADE,
+			author_id TEXT NOT NULL REFERENCES users(id),
+			content TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX idx_machine_notes_machine_id ON machine_notes(machine_id);
+
+		CREATE TABLE share_links (
+			id TEXT PRIMARY KEY,
+			created_by TEXT NOT NULL REFERENCES users(id),
+			expires_at TIMESTAMPTZ NOT NULL,
+			as_of TIMESTAMPTZ,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX idx_share_links_expires_at ON share_links(expires_at);
+
+		CREATE TABLE policy_rules (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			name TEXT NOT NULL,
+			field TEXT NOT NULL,
+			operator TEXT NOT NULL,
+			value TEXT NOT NULL,
+			os TEXT NOT NULL DEFAULT '',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE policy_results (
+			snapshot_id BIGINT NOT NULL REFERENCES inventory_snapshots(id),
+			rule_id BIGINT NOT NULL,
+			rule_name TEXT NOT NULL,
+			expression TEXT NOT NULL,
+			passed BOOLEAN NOT NULL,
+			actual TEXT,
+			evaluated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (snapshot_id, rule_id)
+		);
+
+		CREATE TABLE bootstrap_codes (
+			code_hash TEXT PRIMARY KEY,
+			machine_id TEXT NOT NULL REFERENCES machines(id),
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX idx_bootstrap_codes_machine_id ON bootstrap_codes(machine_id);
+
+		CREATE TABLE webhooks (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL DEFAULT '',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE webhook_deliveries (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			webhook_id BIGINT NOT NULL REFERENCES webhooks(id),
+			event_id TEXT NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMPTZ NOT NULL,
+			last_attempt_at TIMESTAMPTZ,
+			last_status_code INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+		CREATE INDEX idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id);
+
+		CREATE TABLE control_alerts (
+			machine_id TEXT NOT NULL REFERENCES machines(id),
+			control TEXT NOT NULL,
+			sent_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (machine_id, control)
+		);
+
+		CREATE TABLE api_keys (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			name TEXT NOT NULL,
+			key_hash TEXT NOT NULL UNIQUE,
+			prefix TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			created_by TEXT NOT NULL REFERENCES users(id),
+			expires_at TIMESTAMPTZ,
+			last_used_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		);
+	`)},
+
+	{Version: 2, Name: "machine legal hold", up: execSQL(`
+		ALTER TABLE machines ADD COLUMN legal_hold BOOLEAN NOT NULL DEFAULT FALSE;
+	`)},
+
+	{Version: 3, Name: "server-side sessions", up: execSQL(`
+		CREATE TABLE sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL REFERENCES users(id),
+			is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+			refresh_token TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip_address TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			last_seen_at TIMESTAMPTZ NOT NULL,
+			refreshed_at TIMESTAMPTZ NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+		CREATE INDEX idx_sessions_user ON sessions(user_id);
+	`)},
+
+	{Version: 4, Name: "audit log", up: execSQL(`
+		CREATE TABLE audit_events (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			created_at TIMESTAMPTZ NOT NULL,
+			actor_id TEXT NOT NULL DEFAULT '',
+			actor_email TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			target_type TEXT NOT NULL DEFAULT '',
+			target_id TEXT NOT NULL DEFAULT '',
+			ip_address TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			before_data TEXT NOT NULL DEFAULT '',
+			after_data TEXT NOT NULL DEFAULT '',
+			prev_hash TEXT NOT NULL DEFAULT '',
+			hash TEXT NOT NULL
+		);
+		CREATE INDEX idx_audit_events_created ON audit_events(created_at);
+		CREATE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_events is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER audit_events_no_change BEFORE UPDATE OR DELETE ON audit_events
+			FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+		CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+	`)},
+
+	{Version: 5, Name: "machine archiving", up: execSQL(`
+		ALTER TABLE machines ADD COLUMN archived_at TIMESTAMPTZ;
+		ALTER TABLE machines ADD COLUMN archived_by TEXT NOT NULL DEFAULT '';
+		ALTER TABLE machines ADD COLUMN archive_reason TEXT NOT NULL DEFAULT '';
+	`)},
+
+	{Version: 6, Name: "scoped share links", up: execSQL(`
+		ALTER TABLE share_links ADD COLUMN label TEXT NOT NULL DEFAULT '';
+		ALTER TABLE share_links ADD COLUMN filter_owner TEXT NOT NULL DEFAULT '';
+		ALTER TABLE share_links ADD COLUMN filter_machine TEXT NOT NULL DEFAULT '';
+		ALTER TABLE share_links ADD COLUMN filter_os TEXT NOT NULL DEFAULT '';
+		ALTER TABLE share_links ADD COLUMN show_notes BOOLEAN NOT NULL DEFAULT TRUE;
+		ALTER TABLE share_links ADD COLUMN show_owner_emails BOOLEAN NOT NULL DEFAULT TRUE;
+		ALTER TABLE share_links ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';
+		ALTER TABLE share_links ADD COLUMN revoked_at TIMESTAMPTZ;
+		ALTER TABLE share_links ADD COLUMN revoked_by TEXT NOT NULL DEFAULT '';
+		ALTER TABLE share_links ADD COLUMN revoke_reason TEXT NOT NULL DEFAULT '';
+		CREATE TABLE share_link_views (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+			link_id TEXT NOT NULL REFERENCES share_links(id),
+			viewed_at TIMESTAMPTZ NOT NULL,
+			ip_address TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX idx_share_link_views_link ON share_link_views(link_id, viewed_at);
+	`)},
+
+	// enrollment_token keeps its name but now holds the token's hash
+	{Version: 7, Name: "hashed machine tokens", up: func(tx *dbTx) error {
+		if err := execSQL(`
+			ALTER TABLE machines ADD COLUMN token_prefix TEXT NOT NULL DEFAULT '';
+			ALTER TABLE machines ADD COLUMN token_created_at TIMESTAMPTZ;
+			ALTER TABLE machines ADD COLUMN previous_token_hash TEXT;
+			ALTER TABLE machines ADD COLUMN previous_token_expires_at TIMESTAMPTZ;
+			ALTER TABLE machines ADD COLUMN token_disabled_at TIMESTAMPTZ;
+			ALTER TABLE machines ADD COLUMN token_last_used_at TIMESTAMPTZ;
+			ALTER TABLE machines ADD COLUMN token_last_used_ip TEXT NOT NULL DEFAULT '';
+			CREATE INDEX idx_machines_previous_token ON machines(previous_token_hash);
+		`)(tx); err != nil {
+			return err
+		}
+		return hashMachineTokens(tx)
+	}},
+
+	{Version: 8, Name: "signed inventory", up: execSQL(`
+		ALTER TABLE machines ADD COLUMN public_key TEXT NOT NULL DEFAULT '';
+		ALTER TABLE machines ADD COLUMN public_key_registered_at TIMESTAMPTZ;
+		ALTER TABLE inventory_snapshots ADD COLUMN signed BOOLEAN NOT NULL DEFAULT FALSE;
+		CREATE TABLE inventory_nonces (
+			machine_id TEXT NOT NULL REFERENCES machines(id),
+			nonce TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (machine_id, nonce)
+		);
+	`)},
+
+	{Version: 9, Name: "patch level", up: execSQL(`
+		ALTER TABLE inventory_snapshots ADD COLUMN os_build TEXT NOT NULL DEFAULT '';
+		ALTER TABLE inventory_snapshots ADD COLUMN days_since_update INTEGER;
+		ALTER TABLE inventory_snapshots ADD COLUMN pending_security_updates INTEGER;
+		ALTER TABLE inventory_snapshots ADD COLUMN auto_update_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE inventory_snapshots ADD COLUMN auto_update_details TEXT NOT NULL DEFAULT '';
+		ALTER TABLE inventory_snapshots ADD COLUMN last_boot_at TIMESTAMPTZ;
+	`)},
+
+	{Version: 10, Name: "snapshot checks", up: execSQL(`
+		CREATE TABLE snapshot_checks (
+			snapshot_id BIGINT NOT NULL REFERENCES inventory_snapshots(id),
+			check_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			value TEXT NOT NULL DEFAULT '',
+			details TEXT NOT NULL DEFAULT '',
+			PRIMARY KEY (snapshot_id, check_id)
+		);
+	`)},
+
+	{Version: 11, Name: "control statuses", up: execSQL(`
+		ALTER TABLE inventory_snapshots ADD COLUMN disk_encryption_status TEXT NOT NULL DEFAULT '';
+		ALTER TABLE inventory_snapshots ADD COLUMN antivirus_status TEXT NOT NULL DEFAULT '';
+		ALTER TABLE inventory_snapshots ADD COLUMN firewall_status TEXT NOT NULL DEFAULT '';
+		ALTER TABLE inventory_snapshots ADD COLUMN screen_lock_status TEXT NOT NULL DEFAULT '';
+	` + backfillControlStatuses)},
+
+	{Version: 12, Name: "failed share link unlocks", up: execSQL(`
+		ALTER TABLE share_link_views ADD COLUMN failed BOOLEAN NOT NULL DEFAULT FALSE;
+		CREATE INDEX idx_share_link_views_ip ON share_link_views(ip_address, viewed_at);
+	`)},
+}
@@ -0,0 +1,96 @@
+package db
+
+import "strings"
+
+// SetMachineLegalHold exempts a machine's snapshots from retention, or lifts the hold
+func (db *DB) SetMachineLegalHold(id string, hold bool) error {
+	_, err := db.conn.Exec(`UPDATE machines SET legal_hold = ? WHERE id = ?`, hold, id)
+	return err
+}
+
+// EachRetentionSnapshot calls fn for every snapshot of machines that aren't
+// on legal hold or archived, grouped by machine and oldest first. Only the ID, machine,
+// collection time, controls and checks are set.
+func (db *DB) EachRetentionSnapshot(fn func(*InventorySnapshot) error) error {
+	const from = `
+		FROM inventory_snapshots s
+		JOIN machines m ON m.id = s.machine_id`
+	const where = `
+		WHERE m.legal_hold = FALSE AND m.archived_at IS NULL`
+	rows, err := db.conn.Query(`
+		SELECT s.id, s.machine_id, s.collected_at,
+		       s.disk_encrypted, s.antivirus_enabled, s.firewall_enabled, s.screen_lock_enabled,
+		       s.disk_encryption_status, s.antivirus_status, s.firewall_status, s.screen_lock_status` + from + where + `
+		ORDER BY s.machine_id, s.collected_at, s.id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	checks, err := db.checkCursor(`
+		SELECT c.snapshot_id, c.check_id, c.status, c.value, c.details` + from + `
+		JOIN snapshot_checks c ON c.snapshot_id = s.id` + where + `
+		ORDER BY s.machine_id, s.collected_at, s.id, c.check_id
+	`)
+	if err != nil {
+		return err
+	}
+	defer checks.Close()
+
+	for rows.Next() {
+		var s InventorySnapshot
+		if err := rows.Scan(&s.ID, &s.MachineID, &s.CollectedAt,
+			&s.DiskEncrypted, &s.AntivirusEnabled, &s.FirewallEnabled, &s.ScreenLockEnabled,
+			&s.DiskEncryptionStatus, &s.AntivirusStatus, &s.FirewallStatus, &s.ScreenLockStatus); err != nil {
+			return err
+		}
+		if err := checks.fill(&s); err != nil {
+			return err
+		}
+		if err := fn(&s); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// DeleteSnapshots deletes snapshots with their policy results and checks,
+// returning how many snapshots were deleted
+func (db *DB) DeleteSnapshots(ids []int64) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	const batch = 500
+	for len(ids) > 0 {
+		n := min(len(ids), batch)
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+		args := make([]interface{}, n)
+		for i, id := range ids[:n] {
+			args[i] = id
+		}
+		ids = ids[n:]
+
+		if _, err := tx.Exec(`DELETE FROM policy_results WHERE snapshot_id IN (`+placeholders+`)`, args...); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`DELETE FROM snapshot_checks WHERE snapshot_id IN (`+placeholders+`)`, args...); err != nil {
+			return 0, err
+		}
+		result, err := tx.Exec(`DELETE FROM inventory_snapshots WHERE id IN (`+placeholders+`)`, args...)
+		if err != nil {
+			return 0, err
+		}
+		n64, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += n64
+	}
+
+	return deleted, tx.Commit()
+}
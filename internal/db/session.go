@@ -0,0 +1,158 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Session operations
+//
+// Sessions are looked up by the token in the session cookie. Like API keys,
+// only a hash of the token is stored, so a copy of the database can't be
+// used to sign in. The identity provider's refresh token is stored as is,
+// which is why sessions are left out of exports and backups don't keep it.
+
+// CreateSession starts a session for a user that ends at expiresAt at the latest
+func (db *DB) CreateSession(userID string, isAdmin bool, refreshToken, userAgent, ipAddress string, expiresAt time.Time) (*Session, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	s := &Session{
+		ID:           hashSecret(token),
+		Token:        token,
+		UserID:       userID,
+		IsAdmin:      isAdmin,
+		RefreshToken: refreshToken,
+		UserAgent:    userAgent,
+		IPAddress:    ipAddress,
+		CreatedAt:    now,
+		LastSeenAt:   now,
+		RefreshedAt:  now,
+		ExpiresAt:    expiresAt.UTC(),
+	}
+	_, err = db.conn.Exec(`
+		INSERT INTO sessions (id, user_id, is_admin, refresh_token, user_agent, ip_address, created_at, last_seen_at, refreshed_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, s.ID, s.UserID, s.IsAdmin, s.RefreshToken, s.UserAgent, s.IPAddress, s.CreatedAt, s.LastSeenAt, s.RefreshedAt, s.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+const sessionColumns = `s.id, s.user_id, COALESCE(u.email, ''), COALESCE(u.name, ''), s.is_admin, s.refresh_token,
+		s.user_agent, s.ip_address, s.created_at, s.last_seen_at, s.refreshed_at, s.expires_at`
+
+func scanSession(scan func(...interface{}) error) (*Session, error) {
+	var s Session
+	if err := scan(&s.ID, &s.UserID, &s.UserEmail, &s.UserName, &s.IsAdmin, &s.RefreshToken,
+		&s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.RefreshedAt, &s.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetSessionByToken returns the session for a cookie token, expired or not,
+// or nil if there is none
+func (db *DB) GetSessionByToken(token string) (*Session, error) {
+	row := db.conn.QueryRow(`
+		SELECT `+sessionColumns+`
+		FROM sessions s
+		LEFT JOIN users u ON u.id = s.user_id
+		WHERE s.id = ?
+	`, hashSecret(token))
+	s, err := scanSession(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return s, err
+}
+
+// GetSession returns a session by ID, or nil if there is none
+func (db *DB) GetSession(id string) (*Session, error) {
+	row := db.conn.QueryRow(`
+		SELECT `+sessionColumns+`
+		FROM sessions s
+		LEFT JOIN users u ON u.id = s.user_id
+		WHERE s.id = ?
+	`, id)
+	s, err := scanSession(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return s, err
+}
+
+// GetSessions returns the sessions seen since idleSince that haven't expired
+// by now, most recently seen first
+func (db *DB) GetSessions(idleSince, now time.Time) ([]Session, error) {
+	rows, err := db.conn.Query(`
+		SELECT `+sessionColumns+`
+		FROM sessions s
+		LEFT JOIN users u ON u.id = s.user_id
+		WHERE s.last_seen_at >= ? AND s.expires_at > ?
+		ORDER BY s.last_seen_at DESC, s.id
+	`, idleSince.UTC(), now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		s, err := scanSession(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *s)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession records that a session was used
+func (db *DB) TouchSession(id string, at time.Time) error {
+	_, err := db.conn.Exec(`UPDATE sessions SET last_seen_at = ? WHERE id = ?`, at.UTC(), id)
+	return err
+}
+
+// UpdateSessionRole records a re-evaluation of a session's admin role, and
+// the refresh token to use for the next one. It only updates the session if
+// it was last refreshed at refreshedAt, and reports false if another
+// re-evaluation got there first.
+func (db *DB) UpdateSessionRole(id string, isAdmin bool, refreshToken string, refreshedAt, at time.Time) (bool, error) {
+	result, err := db.conn.Exec(`UPDATE sessions SET is_admin = ?, refresh_token = ?, refreshed_at = ? WHERE id = ? AND refreshed_at = ?`,
+		isAdmin, refreshToken, at.UTC(), id, refreshedAt.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteSession ends a session
+func (db *DB) DeleteSession(id string) error {
+	_, err := db.conn.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+// DeleteUserSessions ends all of a user's sessions and returns how many there were
+func (db *DB) DeleteUserSessions(userID string) (int64, error) {
+	result, err := db.conn.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredSessions deletes sessions last seen before idleSince or
+// expired by now, and returns how many there were
+func (db *DB) DeleteExpiredSessions(idleSince, now time.Time) (int64, error) {
+	result, err := db.conn.Exec(`DELETE FROM sessions WHERE last_seen_at < ? OR expires_at <= ?`, idleSince.UTC(), now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Revoked reports whether an admin revoked the link
+func (l *ShareLink) Revoked() bool {
+	return l.RevokedAt != nil
+}
+
+// Active reports whether the link works at now
+func (l *ShareLink) Active(now time.Time) bool {
+	return !l.Revoked() && now.Before(l.ExpiresAt)
+}
+
+// HasPassword reports whether viewers must enter a password
+func (l *ShareLink) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+// CheckPassword reports whether password unlocks the link
+func (l *ShareLink) CheckPassword(password string) bool {
+	return l.HasPassword() && bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(password)) == nil
+}
+
+// UnlockToken is kept in a cookie once the password has been entered. It
+// changes if the password does, and can't be made without the hash.
+func (l *ShareLink) UnlockToken() string {
+	return hashSecret(l.ID + "\x00" + l.PasswordHash)
+}
+
+// HashSharePassword hashes a share link password for PasswordHash
+func HashSharePassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
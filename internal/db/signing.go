@@ -0,0 +1,45 @@
+package db
+
+import "time"
+
+// Signed inventory
+//
+// The compiled agent can register an Ed25519 public key when it redeems a
+// bootstrap code. Its reports then carry a signature over a timestamp, a
+// random nonce and the body. Nonces are kept just long enough to reject
+// replays; older reports are rejected by their timestamp.
+
+// SetMachinePublicKey registers the key a machine signs its reports with.
+// An empty key lets the machine send unsigned reports again.
+func (db *DB) SetMachinePublicKey(id, publicKey string) error {
+	var registeredAt *time.Time
+	if publicKey != "" {
+		now := time.Now().UTC()
+		registeredAt = &now
+	}
+	_, err := db.conn.Exec(`
+		UPDATE machines SET public_key = ?, public_key_registered_at = ? WHERE id = ?
+	`, publicKey, registeredAt, id)
+	return err
+}
+
+// UseInventoryNonce records a signed report's nonce and reports whether the
+// machine hadn't used it before. The machine's nonces from before since are
+// dropped first.
+func (db *DB) UseInventoryNonce(machineID, nonce string, since time.Time) (bool, error) {
+	if _, err := db.conn.Exec(`
+		DELETE FROM inventory_nonces WHERE machine_id = ? AND created_at < ?
+	`, machineID, since.UTC()); err != nil {
+		return false, err
+	}
+
+	result, err := db.conn.Exec(`
+		INSERT INTO inventory_nonces (machine_id, nonce, created_at) VALUES (?, ?, ?)
+		ON CONFLICT DO NOTHING
+	`, machineID, nonce, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
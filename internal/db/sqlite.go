@@ -12,93 +12,35 @@ import (
 )
 
 type DB struct {
-	conn *sql.DB
+	conn *conn
 }
 
+// New opens the database and applies any pending migrations
 func New(path string) (*DB, error) {
-	conn, err := sql.Open("sqlite", path+"?_journal_mode=WAL&_foreign_keys=on")
+	db, err := Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return nil, err
 	}
 
-	db := &DB{conn: conn}
-	if err := db.migrate(); err != nil {
-		conn.Close()
+	if _, err := db.Migrate(false); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to run migrations: %w", err)
 	}
 
 	return db, nil
 }
 
-func (db *DB) Close() error {
-	return db.conn.Close()
+// Open opens the database without migrating it
+func Open(path string) (*DB, error) {
+	sqlDB, err := sql.Open("sqlite", path+"?_journal_mode=WAL&_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return &DB{conn: &conn{DB: sqlDB, dialect: dialectSQLite}}, nil
 }
 
-func (db *DB) migrate() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS users (
-		id TEXT PRIMARY KEY,
-		email TEXT NOT NULL UNIQUE,
-		name TEXT NOT NULL,
-		is_admin BOOLEAN DEFAULT FALSE,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS machines (
-		id TEXT PRIMARY KEY,
-		user_id TEXT NOT NULL REFERENCES users(id),
-		name TEXT NOT NULL,
-		enrollment_token TEXT UNIQUE NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS inventory_snapshots (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		machine_id TEXT NOT NULL REFERENCES machines(id),
-		collected_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		hostname TEXT,
-		os TEXT,
-		os_version TEXT,
-		disk_encrypted BOOLEAN,
-		disk_encryption_details TEXT,
-		antivirus_enabled BOOLEAN,
-		antivirus_details TEXT,
-		firewall_enabled BOOLEAN,
-		firewall_details TEXT,
-		screen_lock_enabled BOOLEAN,
-		screen_lock_timeout INTEGER,
-		screen_lock_details TEXT,
-		raw_data TEXT
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_machines_user_id ON machines(user_id);
-	CREATE INDEX IF NOT EXISTS idx_machines_enrollment_token ON machines(enrollment_token);
-	CREATE INDEX IF NOT EXISTS idx_inventory_snapshots_machine_id ON inventory_snapshots(machine_id);
-	CREATE INDEX IF NOT EXISTS idx_inventory_snapshots_collected_at ON inventory_snapshots(collected_at);
-
-	CREATE TABLE IF NOT EXISTS machine_notes (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		machine_id TEXT NOT NULL REFERENCES machines(id) ON DELETE CASCADE,
-		author_id TEXT NOT NULL REFERENCES users(id),
-		content TEXT NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_machine_notes_machine_id ON machine_notes(machine_id);
-
-	CREATE TABLE IF NOT EXISTS share_links (
-		id TEXT PRIMARY KEY,
-		created_by TEXT NOT NULL REFERENCES users(id),
-		expires_at DATETIME NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_share_links_expires_at ON share_links(expires_at);
-	`
-
-	_, err := db.conn.Exec(schema)
-	return err
+func (db *DB) Close() error {
+	return db.conn.Close()
 }
 
 // User operations
@@ -116,8 +58,8 @@ func (db *DB) UpsertUser(id, email, name string, isAdmin bool) (*User, error) {
 
 func (db *DB) GetUser(id string) (*User, error) {
 	var u User
-	err := db.conn.QueryRow(`SELECT id, email, name, is_admin, created_at FROM users WHERE id = ?`, id).
-		Scan(&u.ID, &u.Email, &u.Name, &u.IsAdmin, &u.CreatedAt)
+	err := db.conn.QueryRow(`SELECT id, email, name, is_admin, email_opt_out, created_at FROM users WHERE id = ?`, id).
+		Scan(&u.ID, &u.Email, &u.Name, &u.IsAdmin, &u.EmailOptOut, &u.CreatedAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -127,6 +69,25 @@ func (db *DB) GetUser(id string) (*User, error) {
 	return &u, nil
 }
 
+// GetUsers returns every user, ordered by ID
+func (db *DB) GetUsers() ([]User, error) {
+	rows, err := db.conn.Query(`SELECT id, email, name, is_admin, email_opt_out, created_at FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.IsAdmin, &u.EmailOptOut, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
 // Machine operations
 
 func generateToken() (string, error) {
@@ -137,6 +98,8 @@ func generateToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
+// CreateMachine creates a machine with a new enrollment token, which is set
+// on the returned machine and can't be read back later
 func (db *DB) CreateMachine(userID, name string) (*Machine, error) {
 	id := uuid.New().String()
 	token, err := generateToken()
@@ -145,51 +108,90 @@ func (db *DB) CreateMachine(userID, name string) (*Machine, error) {
 	}
 
 	_, err = db.conn.Exec(`
-		INSERT INTO machines (id, user_id, name, enrollment_token) VALUES (?, ?, ?, ?)
-	`, id, userID, name, token)
+		INSERT INTO machines (id, user_id, name, enrollment_token, token_prefix, token_created_at) VALUES (?, ?, ?, ?, ?, ?)
+	`, id, userID, name, hashSecret(token), tokenPrefix(token), time.Now().UTC())
 	if err != nil {
 		return nil, err
 	}
 
-	return db.GetMachine(id)
+	m, err := db.GetMachine(id)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	m.EnrollmentToken = token
+	return m, nil
 }
 
+// GetMachine returns a machine, archived or not
 func (db *DB) GetMachine(id string) (*Machine, error) {
+	return scanMachine(db.conn.QueryRow(`SELECT `+machineColumns+` FROM machines WHERE id = ?`, id).Scan)
+}
+
+// GetMachineByToken returns the machine with an enrollment token, archived
+// or not. The token replaced by the last rotation matches until its grace
+// period ends. Machines with disabled tokens are returned too.
+func (db *DB) GetMachineByToken(token string) (*Machine, error) {
+	hash := hashSecret(token)
+	return scanMachine(db.conn.QueryRow(`
+		SELECT `+machineColumns+` FROM machines
+		WHERE enrollment_token = ? OR (previous_token_hash = ? AND previous_token_expires_at > ?)
+	`, hash, hash, time.Now().UTC()).Scan)
+}
+
+const machineColumns = `id, user_id, name, token_prefix, mode, checkin_days, legal_hold, created_at, archived_at, archived_by, archive_reason,
+	token_created_at, previous_token_expires_at, token_disabled_at, token_last_used_at, token_last_used_ip,
+	public_key, public_key_registered_at`
+
+// scanMachine reads machineColumns, or returns nil if there is no row
+func scanMachine(scan func(...interface{}) error) (*Machine, error) {
 	var m Machine
-	err := db.conn.QueryRow(`SELECT id, user_id, name, enrollment_token, created_at FROM machines WHERE id = ?`, id).
-		Scan(&m.ID, &m.UserID, &m.Name, &m.EnrollmentToken, &m.CreatedAt)
+	var archivedAt, tokenIssuedAt, previousExpiresAt, disabledAt, lastUsedAt, keyRegisteredAt sql.NullTime
+	err := scan(&m.ID, &m.UserID, &m.Name, &m.TokenPrefix, &m.Mode, &m.CheckInDays, &m.LegalHold, &m.CreatedAt,
+		&archivedAt, &m.ArchivedBy, &m.ArchiveReason,
+		&tokenIssuedAt, &previousExpiresAt, &disabledAt, &lastUsedAt, &m.TokenLastUsedIP,
+		&m.PublicKey, &keyRegisteredAt)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
+	m.ArchivedAt = timePtr(archivedAt)
+	m.TokenIssuedAt = timePtr(tokenIssuedAt)
+	m.PreviousTokenExpiresAt = timePtr(previousExpiresAt)
+	m.TokenDisabledAt = timePtr(disabledAt)
+	m.TokenLastUsedAt = timePtr(lastUsedAt)
+	m.PublicKeyRegisteredAt = timePtr(keyRegisteredAt)
 	return &m, nil
 }
 
-func (db *DB) GetMachineByToken(token string) (*Machine, error) {
-	var m Machine
-	err := db.conn.QueryRow(`SELECT id, user_id, name, enrollment_token, created_at FROM machines WHERE enrollment_token = ?`, token).
-		Scan(&m.ID, &m.UserID, &m.Name, &m.EnrollmentToken, &m.CreatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
+// timePtr returns a nullable time as a pointer, nil for NULL
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
 	}
-	if err != nil {
-		return nil, err
+	return &t.Time
+}
+
+// intPtr returns a nullable integer as a pointer, nil for NULL
+func intPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
 	}
-	return &m, nil
+	v := int(n.Int64)
+	return &v
 }
 
 func (db *DB) GetMachinesByUser(userID string) ([]Machine, error) {
 	rows, err := db.conn.Query(`
-		SELECT m.id, m.user_id, m.name, m.enrollment_token, m.created_at
+		SELECT m.id, m.user_id, m.name, m.token_prefix, m.mode, m.checkin_days, m.legal_hold, m.created_at
 		FROM machines m
 		LEFT JOIN (
 			SELECT machine_id, MAX(collected_at) as last_update
 			FROM inventory_snapshots
 			GROUP BY machine_id
 		) s ON m.id = s.machine_id
-		WHERE m.user_id = ?
+		WHERE m.user_id = ? AND m.archived_at IS NULL
 		ORDER BY COALESCE(s.last_update, m.created_at) DESC
 	`, userID)
 	if err != nil {
@@ -200,7 +202,7 @@ func (db *DB) GetMachinesByUser(userID string) ([]Machine, error) {
 	var machines []Machine
 	for rows.Next() {
 		var m Machine
-		if err := rows.Scan(&m.ID, &m.UserID, &m.Name, &m.EnrollmentToken, &m.CreatedAt); err != nil {
+		if err := rows.Scan(&m.ID, &m.UserID, &m.Name, &m.TokenPrefix, &m.Mode, &m.CheckInDays, &m.LegalHold, &m.CreatedAt); err != nil {
 			return nil, err
 		}
 		machines = append(machines, m)
@@ -208,14 +210,17 @@ func (db *DB) GetMachinesByUser(userID string) ([]Machine, error) {
 	return machines, rows.Err()
 }
 
-// GetMachinesWithLatestByUser returns all machines for a user with their latest snapshot in a single query
+// GetMachinesWithLatestByUser returns all of a user's active machines with their latest snapshot in a single query
 func (db *DB) GetMachinesWithLatestByUser(userID string) ([]MachineWithLatest, error) {
 	rows, err := db.conn.Query(`
 		SELECT
-			m.id, m.user_id, m.name, m.enrollment_token, m.created_at,
+			m.id, m.user_id, m.name, m.token_prefix, m.mode, m.checkin_days, m.legal_hold, m.created_at,
 			s.id, s.collected_at, s.hostname, s.os, s.os_version,
 			s.disk_encrypted, s.disk_encryption_details, s.antivirus_enabled, s.antivirus_details,
-			s.firewall_enabled, s.firewall_details, s.screen_lock_enabled, s.screen_lock_timeout, s.screen_lock_details
+			s.firewall_enabled, s.firewall_details, s.screen_lock_enabled, s.screen_lock_timeout, s.screen_lock_details,
+			s.disk_encryption_status, s.antivirus_status, s.firewall_status, s.screen_lock_status,
+			s.signed, s.os_build, s.days_since_update, s.pending_security_updates,
+			s.auto_update_enabled, s.auto_update_details, s.last_boot_at, `+policyCountColumns+`
 		FROM machines m
 		LEFT JOIN inventory_snapshots s ON s.id = (
 			SELECT id FROM inventory_snapshots
@@ -223,7 +228,7 @@ func (db *DB) GetMachinesWithLatestByUser(userID string) ([]MachineWithLatest, e
 			ORDER BY collected_at DESC
 			LIMIT 1
 		)
-		WHERE m.user_id = ?
+		WHERE m.user_id = ? AND m.archived_at IS NULL
 		ORDER BY COALESCE(s.collected_at, m.created_at) DESC
 	`, userID)
 	if err != nil {
@@ -239,36 +244,58 @@ func (db *DB) GetMachinesWithLatestByUser(userID string) ([]MachineWithLatest, e
 		var hostname, os, osVersion sql.NullString
 		var diskEncrypted, avEnabled sql.NullBool
 		var diskDetails, avDetails sql.NullString
-		var fwEnabled, slEnabled sql.NullBool
+		var fwEnabled, slEnabled, signed sql.NullBool
 		var fwDetails, slDetails sql.NullString
 		var slTimeout sql.NullInt64
+		var osBuild, auDetails sql.NullString
+		var daysSinceUpdate, pendingUpdates sql.NullInt64
+		var auEnabled sql.NullBool
+		var lastBootAt sql.NullTime
+		var deStatus, avStatus, fwStatus, slStatus sql.NullString
+		var policyPassed, policyFailed int
 
 		if err := rows.Scan(
-			&mwl.ID, &mwl.UserID, &mwl.Name, &mwl.EnrollmentToken, &mwl.CreatedAt,
+			&mwl.ID, &mwl.UserID, &mwl.Name, &mwl.TokenPrefix, &mwl.Mode, &mwl.CheckInDays, &mwl.LegalHold, &mwl.CreatedAt,
 			&snapshotID, &collectedAt, &hostname, &os, &osVersion,
 			&diskEncrypted, &diskDetails, &avEnabled, &avDetails,
 			&fwEnabled, &fwDetails, &slEnabled, &slTimeout, &slDetails,
+			&deStatus, &avStatus, &fwStatus, &slStatus,
+			&signed, &osBuild, &daysSinceUpdate, &pendingUpdates,
+			&auEnabled, &auDetails, &lastBootAt, &policyPassed, &policyFailed,
 		); err != nil {
 			return nil, err
 		}
 
 		if snapshotID.Valid {
 			mwl.Latest = &InventorySnapshot{
-				ID:                    snapshotID.Int64,
-				MachineID:             mwl.ID,
-				CollectedAt:           collectedAt.Time,
-				Hostname:              hostname.String,
-				OS:                    os.String,
-				OSVersion:             osVersion.String,
-				DiskEncrypted:         diskEncrypted.Bool,
-				DiskEncryptionDetails: diskDetails.String,
-				AntivirusEnabled:      avEnabled.Bool,
-				AntivirusDetails:      avDetails.String,
-				FirewallEnabled:       fwEnabled.Bool,
-				FirewallDetails:       fwDetails.String,
-				ScreenLockEnabled:     slEnabled.Bool,
-				ScreenLockTimeout:     int(slTimeout.Int64),
-				ScreenLockDetails:     slDetails.String,
+				ID:                     snapshotID.Int64,
+				MachineID:              mwl.ID,
+				CollectedAt:            collectedAt.Time,
+				Hostname:               hostname.String,
+				OS:                     os.String,
+				OSVersion:              osVersion.String,
+				DiskEncrypted:          diskEncrypted.Bool,
+				DiskEncryptionDetails:  diskDetails.String,
+				AntivirusEnabled:       avEnabled.Bool,
+				AntivirusDetails:       avDetails.String,
+				FirewallEnabled:        fwEnabled.Bool,
+				FirewallDetails:        fwDetails.String,
+				ScreenLockEnabled:      slEnabled.Bool,
+				ScreenLockTimeout:      int(slTimeout.Int64),
+				ScreenLockDetails:      slDetails.String,
+				DiskEncryptionStatus:   ControlStatus(deStatus.String),
+				AntivirusStatus:        ControlStatus(avStatus.String),
+				FirewallStatus:         ControlStatus(fwStatus.String),
+				ScreenLockStatus:       ControlStatus(slStatus.String),
+				Signed:                 signed.Bool,
+				OSBuild:                osBuild.String,
+				DaysSinceUpdate:        intPtr(daysSinceUpdate),
+				PendingSecurityUpdates: intPtr(pendingUpdates),
+				AutoUpdateEnabled:      auEnabled.Bool,
+				AutoUpdateDetails:      auDetails.String,
+				LastBootAt:             timePtr(lastBootAt),
+				PolicyPassed:           policyPassed,
+				PolicyFailed:           policyFailed,
 			}
 		}
 
@@ -277,6 +304,42 @@ func (db *DB) GetMachinesWithLatestByUser(userID string) ([]MachineWithLatest, e
 	return machines, rows.Err()
 }
 
+// SetMachineMode records the install mode reported by the machine's script.
+// A machine that was ever installed for monitoring stays in monitor mode, as
+// its scheduled job keeps running after later one-time runs.
+func (db *DB) SetMachineMode(id, mode string) error {
+	query := `UPDATE machines SET mode = ? WHERE id = ?`
+	if mode != ModeMonitor {
+		query += ` AND mode != '` + ModeMonitor + `'`
+	}
+	_, err := db.conn.Exec(query, mode, id)
+	return err
+}
+
+// SetMachineCheckInDays overrides the machine's expected check-in interval; 0 restores the default
+func (db *DB) SetMachineCheckInDays(id string, days int) error {
+	_, err := db.conn.Exec(`UPDATE machines SET checkin_days = ? WHERE id = ?`, days, id)
+	return err
+}
+
+// ArchiveMachine hides a machine from default views, keeping its history.
+// Archiving an archived machine does nothing.
+func (db *DB) ArchiveMachine(id, archivedBy, reason string) error {
+	_, err := db.conn.Exec(`
+		UPDATE machines SET archived_at = ?, archived_by = ?, archive_reason = ?
+		WHERE id = ? AND archived_at IS NULL
+	`, time.Now().UTC(), archivedBy, reason, id)
+	return err
+}
+
+// RestoreMachine returns an archived machine to default views
+func (db *DB) RestoreMachine(id string) error {
+	_, err := db.conn.Exec(`UPDATE machines SET archived_at = NULL, archived_by = '', archive_reason = '' WHERE id = ?`, id)
+	return err
+}
+
+// DeleteMachine permanently deletes a machine and its history. Machines are
+// normally archived instead; see Machine.CanPurge.
 func (db *DB) DeleteMachine(id string) error {
 	tx, err := db.conn.Begin()
 	if err != nil {
@@ -284,10 +347,25 @@ func (db *DB) DeleteMachine(id string) error {
 	}
 	defer tx.Rollback()
 
-	// Delete snapshots first
+	// Delete policy results, checks and snapshots first
+	if _, err := tx.Exec(`DELETE FROM policy_results WHERE snapshot_id IN (SELECT id FROM inventory_snapshots WHERE machine_id = ?)`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM snapshot_checks WHERE snapshot_id IN (SELECT id FROM inventory_snapshots WHERE machine_id = ?)`, id); err != nil {
+		return err
+	}
 	if _, err := tx.Exec(`DELETE FROM inventory_snapshots WHERE machine_id = ?`, id); err != nil {
 		return err
 	}
+	if _, err := tx.Exec(`DELETE FROM bootstrap_codes WHERE machine_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM control_alerts WHERE machine_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM inventory_nonces WHERE machine_id = ?`, id); err != nil {
+		return err
+	}
 
 	// Delete machine
 	if _, err := tx.Exec(`DELETE FROM machines WHERE id = ?`, id); err != nil {
@@ -297,143 +375,303 @@ func (db *DB) DeleteMachine(id string) error {
 	return tx.Commit()
 }
 
-// Admin: Get all machines with owner info and latest snapshot in a single query
-func (db *DB) GetAllMachinesWithOwners(filterOwner, filterMachine string) ([]MachineWithOwner, error) {
+// Admin: Get all active machines with owner info and latest snapshot in a single query.
+// A non-zero asOf shows the fleet as it was at that time: each machine's
+// latest snapshot at or before asOf, leaving out machines enrolled later and
+// including machines archived since.
+func (db *DB) GetAllMachinesWithOwners(filterOwner, filterMachine string, asOf time.Time) ([]MachineWithOwner, error) {
+	var machines []MachineWithOwner
+	err := db.EachMachineWithOwner(filterOwner, filterMachine, asOf, func(m *MachineWithOwner) error {
+		machines = append(machines, *m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Notes still fetched separately (one-to-many relationship)
+	for i := range machines {
+		notes, _ := db.machineNotes(machines[i].ID, asOf)
+		machines[i].Notes = notes
+	}
+
+	return machines, nil
+}
+
+// EachMachineWithOwner calls fn for each machine matching the filters, in the
+// same order as GetAllMachinesWithOwners, without loading them all at once.
+// Notes are not loaded; NoteCount is set instead. asOf works as for
+// GetAllMachinesWithOwners. Iteration stops at the first error from fn, which
+// is returned.
+func (db *DB) EachMachineWithOwner(filterOwner, filterMachine string, asOf time.Time, fn func(*MachineWithOwner) error) error {
+	return db.eachMachineWithOwner(machineListing{owner: filterOwner, machine: filterMachine, asOf: asOf}, fn)
+}
+
+// GetMachinesWithOwnersAfter returns up to limit active machines matching
+// the filters, ordered by ID, starting after the machine with ID afterID
+// ("" for the first). Notes are not loaded; NoteCount is set instead.
+func (db *DB) GetMachinesWithOwnersAfter(filterOwner, filterMachine, afterID string, limit int) ([]MachineWithOwner, error) {
+	var machines []MachineWithOwner
+	listing := machineListing{owner: filterOwner, machine: filterMachine, afterID: afterID, limit: limit}
+	err := db.eachMachineWithOwner(listing, func(m *MachineWithOwner) error {
+		machines = append(machines, *m)
+		return nil
+	})
+	return machines, err
+}
+
+// GetArchivedMachines returns archived machines with owner info and latest
+// snapshot, most recently archived first
+func (db *DB) GetArchivedMachines() ([]MachineWithOwner, error) {
+	var machines []MachineWithOwner
+	err := db.eachMachineWithOwner(machineListing{archived: true}, func(m *MachineWithOwner) error {
+		machines = append(machines, *m)
+		return nil
+	})
+	return machines, err
+}
+
+// machineListing selects the machines eachMachineWithOwner lists
+type machineListing struct {
+	owner, machine string
+	asOf           time.Time
+	archived       bool
+
+	// A non-zero limit lists up to limit machines by ID, after afterID
+	afterID string
+	limit   int
+}
+
+// eachMachineWithOwner lists either active or archived machines
+func (db *DB) eachMachineWithOwner(l machineListing, fn func(*MachineWithOwner) error) error {
+	// Without asOf, the latest snapshot is the newest one and every note counts
+	noteCutoff, snapshotCutoff := "", ""
+	args := []interface{}{}
+	if !l.asOf.IsZero() {
+		noteCutoff = `AND n.created_at <= ?`
+		snapshotCutoff = `AND collected_at <= ?`
+		args = append(args, l.asOf.UTC(), l.asOf.UTC())
+	}
+
 	query := `
 		SELECT
-			m.id, m.user_id, m.name, m.enrollment_token, m.created_at,
+			m.id, m.user_id, m.name, m.token_prefix, m.mode, m.checkin_days, m.legal_hold, m.created_at,
+			m.archived_at, m.archived_by, m.archive_reason,
 			u.email, u.name,
+			(SELECT COUNT(*) FROM machine_notes n WHERE n.machine_id = m.id ` + noteCutoff + `),
 			s.id, s.collected_at, s.hostname, s.os, s.os_version,
 			s.disk_encrypted, s.disk_encryption_details, s.antivirus_enabled, s.antivirus_details,
-			s.firewall_enabled, s.firewall_details, s.screen_lock_enabled, s.screen_lock_timeout, s.screen_lock_details
+			s.firewall_enabled, s.firewall_details, s.screen_lock_enabled, s.screen_lock_timeout, s.screen_lock_details,
+			s.disk_encryption_status, s.antivirus_status, s.firewall_status, s.screen_lock_status,
+			s.signed, s.os_build, s.days_since_update, s.pending_security_updates,
+			s.auto_update_enabled, s.auto_update_details, s.last_boot_at, ` + policyCountColumns + `
 		FROM machines m
 		JOIN users u ON m.user_id = u.id
 		LEFT JOIN inventory_snapshots s ON s.id = (
 			SELECT id FROM inventory_snapshots
-			WHERE machine_id = m.id
+			WHERE machine_id = m.id ` + snapshotCutoff + `
 			ORDER BY collected_at DESC
 			LIMIT 1
 		)
 		WHERE 1=1
 	`
-	args := []interface{}{}
 
-	if filterOwner != "" {
-		query += ` AND (u.email LIKE ? OR u.name LIKE ?)`
-		args = append(args, "%"+filterOwner+"%", "%"+filterOwner+"%")
+	switch {
+	case l.archived:
+		query += ` AND m.archived_at IS NOT NULL`
+	case l.asOf.IsZero():
+		query += ` AND m.archived_at IS NULL`
+	default:
+		query += ` AND m.created_at <= ? AND (m.archived_at IS NULL OR m.archived_at > ?)`
+		args = append(args, l.asOf.UTC(), l.asOf.UTC())
+	}
+	if l.owner != "" {
+		query += ` AND (LOWER(u.email) LIKE LOWER(?) OR LOWER(u.name) LIKE LOWER(?))`
+		args = append(args, "%"+l.owner+"%", "%"+l.owner+"%")
 	}
-	if filterMachine != "" {
-		query += ` AND m.name LIKE ?`
-		args = append(args, "%"+filterMachine+"%")
+	if l.machine != "" {
+		query += ` AND LOWER(m.name) LIKE LOWER(?)`
+		args = append(args, "%"+l.machine+"%")
 	}
 
-	query += ` ORDER BY LOWER(u.name), LOWER(u.email), COALESCE(s.collected_at, m.created_at) DESC`
+	switch {
+	case l.limit > 0:
+		query += ` AND m.id > ? ORDER BY m.id LIMIT ?`
+		args = append(args, l.afterID, l.limit)
+	case l.archived:
+		query += ` ORDER BY m.archived_at DESC`
+	default:
+		query += ` ORDER BY LOWER(u.name), LOWER(u.email), COALESCE(s.collected_at, m.created_at) DESC`
+	}
 
 	rows, err := db.conn.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var machines []MachineWithOwner
 	for rows.Next() {
 		var m MachineWithOwner
+		var archivedAt sql.NullTime
 		var snapshotID sql.NullInt64
 		var collectedAt sql.NullTime
 		var hostname, os, osVersion sql.NullString
 		var diskEncrypted, avEnabled sql.NullBool
 		var diskDetails, avDetails sql.NullString
-		var fwEnabled, slEnabled sql.NullBool
+		var fwEnabled, slEnabled, signed sql.NullBool
 		var fwDetails, slDetails sql.NullString
 		var slTimeout sql.NullInt64
+		var osBuild, auDetails sql.NullString
+		var daysSinceUpdate, pendingUpdates sql.NullInt64
+		var auEnabled sql.NullBool
+		var lastBootAt sql.NullTime
+		var deStatus, avStatus, fwStatus, slStatus sql.NullString
+		var policyPassed, policyFailed int
 
 		if err := rows.Scan(
-			&m.ID, &m.UserID, &m.Name, &m.EnrollmentToken, &m.CreatedAt,
+			&m.ID, &m.UserID, &m.Name, &m.TokenPrefix, &m.Mode, &m.CheckInDays, &m.LegalHold, &m.CreatedAt,
+			&archivedAt, &m.ArchivedBy, &m.ArchiveReason,
 			&m.OwnerEmail, &m.OwnerName,
+			&m.NoteCount,
 			&snapshotID, &collectedAt, &hostname, &os, &osVersion,
 			&diskEncrypted, &diskDetails, &avEnabled, &avDetails,
 			&fwEnabled, &fwDetails, &slEnabled, &slTimeout, &slDetails,
+			&deStatus, &avStatus, &fwStatus, &slStatus,
+			&signed, &osBuild, &daysSinceUpdate, &pendingUpdates,
+			&auEnabled, &auDetails, &lastBootAt, &policyPassed, &policyFailed,
 		); err != nil {
-			return nil, err
+			return err
+		}
+		if archivedAt.Valid {
+			m.ArchivedAt = &archivedAt.Time
 		}
 
 		if snapshotID.Valid {
 			m.Latest = &InventorySnapshot{
-				ID:                    snapshotID.Int64,
-				MachineID:             m.ID,
-				CollectedAt:           collectedAt.Time,
-				Hostname:              hostname.String,
-				OS:                    os.String,
-				OSVersion:             osVersion.String,
-				DiskEncrypted:         diskEncrypted.Bool,
-				DiskEncryptionDetails: diskDetails.String,
-				AntivirusEnabled:      avEnabled.Bool,
-				AntivirusDetails:      avDetails.String,
-				FirewallEnabled:       fwEnabled.Bool,
-				FirewallDetails:       fwDetails.String,
-				ScreenLockEnabled:     slEnabled.Bool,
-				ScreenLockTimeout:     int(slTimeout.Int64),
-				ScreenLockDetails:     slDetails.String,
+				ID:                     snapshotID.Int64,
+				MachineID:              m.ID,
+				CollectedAt:            collectedAt.Time,
+				Hostname:               hostname.String,
+				OS:                     os.String,
+				OSVersion:              osVersion.String,
+				DiskEncrypted:          diskEncrypted.Bool,
+				DiskEncryptionDetails:  diskDetails.String,
+				AntivirusEnabled:       avEnabled.Bool,
+				AntivirusDetails:       avDetails.String,
+				FirewallEnabled:        fwEnabled.Bool,
+				FirewallDetails:        fwDetails.String,
+				ScreenLockEnabled:      slEnabled.Bool,
+				ScreenLockTimeout:      int(slTimeout.Int64),
+				ScreenLockDetails:      slDetails.String,
+				DiskEncryptionStatus:   ControlStatus(deStatus.String),
+				AntivirusStatus:        ControlStatus(avStatus.String),
+				FirewallStatus:         ControlStatus(fwStatus.String),
+				ScreenLockStatus:       ControlStatus(slStatus.String),
+				Signed:                 signed.Bool,
+				OSBuild:                osBuild.String,
+				DaysSinceUpdate:        intPtr(daysSinceUpdate),
+				PendingSecurityUpdates: intPtr(pendingUpdates),
+				AutoUpdateEnabled:      auEnabled.Bool,
+				AutoUpdateDetails:      auDetails.String,
+				LastBootAt:             timePtr(lastBootAt),
+				PolicyPassed:           policyPassed,
+				PolicyFailed:           policyFailed,
 			}
 		}
 
-		machines = append(machines, m)
-	}
-
-	// Notes still fetched separately (one-to-many relationship)
-	for i := range machines {
-		notes, _ := db.GetMachineNotes(machines[i].ID)
-		machines[i].Notes = notes
+		if err := fn(&m); err != nil {
+			return err
+		}
 	}
 
-	return machines, rows.Err()
+	return rows.Err()
 }
 
 // Inventory operations
 
+// CreateSnapshot stores a snapshot and its checks, and fills in its ID,
+// MachineID, collection time and any control statuses it was only given
+// booleans for
 func (db *DB) CreateSnapshot(machineID string, snapshot *InventorySnapshot) error {
-	_, err := db.conn.Exec(`
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	snapshot.fillStatuses()
+	err = tx.QueryRow(`
 		INSERT INTO inventory_snapshots
-		(machine_id, hostname, os, os_version, disk_encrypted, disk_encryption_details, antivirus_enabled, antivirus_details, firewall_enabled, firewall_details, screen_lock_enabled, screen_lock_timeout, screen_lock_details, raw_data)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		(machine_id, hostname, os, os_version, disk_encrypted, disk_encryption_details, antivirus_enabled, antivirus_details, firewall_enabled, firewall_details, screen_lock_enabled, screen_lock_timeout, screen_lock_details, raw_data, signed,
+		 os_build, days_since_update, pending_security_updates, auto_update_enabled, auto_update_details, last_boot_at,
+		 disk_encryption_status, antivirus_status, firewall_status, screen_lock_status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id, collected_at
 	`, machineID, snapshot.Hostname, snapshot.OS, snapshot.OSVersion,
 		snapshot.DiskEncrypted, snapshot.DiskEncryptionDetails,
 		snapshot.AntivirusEnabled, snapshot.AntivirusDetails,
 		snapshot.FirewallEnabled, snapshot.FirewallDetails,
 		snapshot.ScreenLockEnabled, snapshot.ScreenLockTimeout, snapshot.ScreenLockDetails,
-		snapshot.RawData)
-	return err
+		snapshot.RawData, snapshot.Signed,
+		snapshot.OSBuild, snapshot.DaysSinceUpdate, snapshot.PendingSecurityUpdates,
+		snapshot.AutoUpdateEnabled, snapshot.AutoUpdateDetails, snapshot.LastBootAt,
+		snapshot.DiskEncryptionStatus, snapshot.AntivirusStatus, snapshot.FirewallStatus, snapshot.ScreenLockStatus).Scan(&snapshot.ID, &snapshot.CollectedAt)
+	if err != nil {
+		return err
+	}
+	if err := insertSnapshotChecks(tx, snapshot.ID, snapshot.Checks); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	snapshot.MachineID = machineID
+	for i := range snapshot.Checks {
+		snapshot.Checks[i].SnapshotID = snapshot.ID
+	}
+	return nil
 }
 
+// GetLatestSnapshot returns a machine's most recent snapshot and its checks,
+// or nil if it has none
 func (db *DB) GetLatestSnapshot(machineID string) (*InventorySnapshot, error) {
 	var s InventorySnapshot
-	var firewallEnabled, screenLockEnabled sql.NullBool
-	var screenLockTimeout sql.NullInt64
-	var firewallDetails, screenLockDetails sql.NullString
-	err := db.conn.QueryRow(`
-		SELECT id, machine_id, collected_at, hostname, os, os_version,
-		       disk_encrypted, disk_encryption_details, antivirus_enabled, antivirus_details,
-		       firewall_enabled, firewall_details, screen_lock_enabled, screen_lock_timeout, screen_lock_details,
-		       raw_data
-		FROM inventory_snapshots
+	err := scanSnapshot(db.conn.QueryRow(`
+		SELECT `+snapshotColumns+`
+		FROM inventory_snapshots s
 		WHERE machine_id = ?
 		ORDER BY collected_at DESC
 		LIMIT 1
-	`, machineID).Scan(&s.ID, &s.MachineID, &s.CollectedAt, &s.Hostname, &s.OS, &s.OSVersion,
-		&s.DiskEncrypted, &s.DiskEncryptionDetails, &s.AntivirusEnabled, &s.AntivirusDetails,
-		&firewallEnabled, &firewallDetails, &screenLockEnabled, &screenLockTimeout, &screenLockDetails,
-		&s.RawData)
+	`, machineID), &s)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	s.FirewallEnabled = firewallEnabled.Bool
-	s.FirewallDetails = firewallDetails.String
-	s.ScreenLockEnabled = screenLockEnabled.Bool
-	s.ScreenLockTimeout = int(screenLockTimeout.Int64)
-	s.ScreenLockDetails = screenLockDetails.String
+	if s.Checks, err = db.GetSnapshotChecks(s.ID); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// GetSnapshot returns a snapshot and its checks by ID, or nil if there is none
+func (db *DB) GetSnapshot(id int64) (*InventorySnapshot, error) {
+	var s InventorySnapshot
+	err := scanSnapshot(db.conn.QueryRow(`
+		SELECT `+snapshotColumns+`
+		FROM inventory_snapshots s
+		WHERE id = ?
+	`, id), &s)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Checks, err = db.GetSnapshotChecks(s.ID); err != nil {
+		return nil, err
+	}
 	return &s, nil
 }
 
@@ -443,11 +681,8 @@ func (db *DB) GetSnapshotHistory(machineID string, limit int) ([]InventorySnapsh
 	}
 
 	rows, err := db.conn.Query(`
-		SELECT id, machine_id, collected_at, hostname, os, os_version,
-		       disk_encrypted, disk_encryption_details, antivirus_enabled, antivirus_details,
-		       firewall_enabled, firewall_details, screen_lock_enabled, screen_lock_timeout, screen_lock_details,
-		       raw_data
-		FROM inventory_snapshots
+		SELECT `+snapshotColumns+`
+		FROM inventory_snapshots s
 		WHERE machine_id = ?
 		ORDER BY collected_at DESC
 		LIMIT ?
@@ -457,55 +692,109 @@ func (db *DB) GetSnapshotHistory(machineID string, limit int) ([]InventorySnapsh
 	}
 	defer rows.Close()
 
+	return scanSnapshots(rows)
+}
+
+// GetSnapshotsBefore returns up to limit of a machine's snapshots, newest
+// first, starting after the snapshot with ID beforeID (0 for the newest)
+func (db *DB) GetSnapshotsBefore(machineID string, beforeID int64, limit int) ([]InventorySnapshot, error) {
+	query := `
+		SELECT ` + snapshotColumns + `
+		FROM inventory_snapshots s
+		WHERE machine_id = ?
+	`
+	args := []interface{}{machineID}
+	if beforeID > 0 {
+		query += ` AND id < ?`
+		args = append(args, beforeID)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanSnapshots(rows)
+}
+
+const snapshotColumns = `id, machine_id, collected_at, hostname, os, os_version,
+		       disk_encrypted, disk_encryption_details, antivirus_enabled, antivirus_details,
+		       firewall_enabled, firewall_details, screen_lock_enabled, screen_lock_timeout, screen_lock_details,
+		       raw_data, signed, os_build, days_since_update, pending_security_updates,
+		       auto_update_enabled, auto_update_details, last_boot_at,
+		       disk_encryption_status, antivirus_status, firewall_status, screen_lock_status, ` + policyCountColumns
+
+func scanSnapshots(rows *sql.Rows) ([]InventorySnapshot, error) {
 	var snapshots []InventorySnapshot
 	for rows.Next() {
 		var s InventorySnapshot
-		var firewallEnabled, screenLockEnabled sql.NullBool
-		var screenLockTimeout sql.NullInt64
-		var firewallDetails, screenLockDetails sql.NullString
-		if err := rows.Scan(&s.ID, &s.MachineID, &s.CollectedAt, &s.Hostname, &s.OS, &s.OSVersion,
-			&s.DiskEncrypted, &s.DiskEncryptionDetails, &s.AntivirusEnabled, &s.AntivirusDetails,
-			&firewallEnabled, &firewallDetails, &screenLockEnabled, &screenLockTimeout, &screenLockDetails,
-			&s.RawData); err != nil {
+		if err := scanSnapshot(rows, &s); err != nil {
 			return nil, err
 		}
-		s.FirewallEnabled = firewallEnabled.Bool
-		s.FirewallDetails = firewallDetails.String
-		s.ScreenLockEnabled = screenLockEnabled.Bool
-		s.ScreenLockTimeout = int(screenLockTimeout.Int64)
-		s.ScreenLockDetails = screenLockDetails.String
 		snapshots = append(snapshots, s)
 	}
 	return snapshots, rows.Err()
 }
 
+// scanSnapshot scans one row selected with snapshotColumns
+func scanSnapshot(row interface{ Scan(...interface{}) error }, s *InventorySnapshot) error {
+	var firewallEnabled, screenLockEnabled sql.NullBool
+	var screenLockTimeout sql.NullInt64
+	var firewallDetails, screenLockDetails sql.NullString
+	var daysSinceUpdate, pendingUpdates sql.NullInt64
+	var lastBootAt sql.NullTime
+	if err := row.Scan(&s.ID, &s.MachineID, &s.CollectedAt, &s.Hostname, &s.OS, &s.OSVersion,
+		&s.DiskEncrypted, &s.DiskEncryptionDetails, &s.AntivirusEnabled, &s.AntivirusDetails,
+		&firewallEnabled, &firewallDetails, &screenLockEnabled, &screenLockTimeout, &screenLockDetails,
+		&s.RawData, &s.Signed, &s.OSBuild, &daysSinceUpdate, &pendingUpdates,
+		&s.AutoUpdateEnabled, &s.AutoUpdateDetails, &lastBootAt,
+		&s.DiskEncryptionStatus, &s.AntivirusStatus, &s.FirewallStatus, &s.ScreenLockStatus,
+		&s.PolicyPassed, &s.PolicyFailed); err != nil {
+		return err
+	}
+	s.DaysSinceUpdate = intPtr(daysSinceUpdate)
+	s.PendingSecurityUpdates = intPtr(pendingUpdates)
+	s.LastBootAt = timePtr(lastBootAt)
+	s.FirewallEnabled = firewallEnabled.Bool
+	s.FirewallDetails = firewallDetails.String
+	s.ScreenLockEnabled = screenLockEnabled.Bool
+	s.ScreenLockTimeout = int(screenLockTimeout.Int64)
+	s.ScreenLockDetails = screenLockDetails.String
+	return nil
+}
+
 // Dashboard stats
 type DashboardStats struct {
-	TotalMachines    int
-	EncryptedCount   int
-	UnencryptedCount int
-	ProtectedCount   int
-	UnprotectedCount int
-	LastChecked      *time.Time
+	TotalMachines          int
+	EncryptedCount         int
+	UnencryptedCount       int
+	EncryptionUnknownCount int // The agent couldn't check disk encryption
+	ProtectedCount         int
+	UnprotectedCount       int
+	ProtectionUnknownCount int // The agent couldn't check antivirus
+	LastChecked            *time.Time
 }
 
 func (db *DB) GetUserDashboardStats(userID string) (*DashboardStats, error) {
 	stats := &DashboardStats{}
 
 	// Get machine count
-	err := db.conn.QueryRow(`SELECT COUNT(*) FROM machines WHERE user_id = ?`, userID).Scan(&stats.TotalMachines)
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM machines WHERE user_id = ? AND archived_at IS NULL`, userID).Scan(&stats.TotalMachines)
 	if err != nil {
 		return nil, err
 	}
 
 	// Get encryption stats from latest snapshots
 	rows, err := db.conn.Query(`
-		SELECT DISTINCT m.id, s.disk_encrypted, s.antivirus_enabled, s.collected_at
+		SELECT DISTINCT m.id, s.disk_encryption_status, s.antivirus_status, s.collected_at
 		FROM machines m
 		LEFT JOIN inventory_snapshots s ON s.id = (
 			SELECT id FROM inventory_snapshots WHERE machine_id = m.id ORDER BY collected_at DESC LIMIT 1
 		)
-		WHERE m.user_id = ?
+		WHERE m.user_id = ? AND m.archived_at IS NULL
 	`, userID)
 	if err != nil {
 		return nil, err
@@ -514,28 +803,15 @@ func (db *DB) GetUserDashboardStats(userID string) (*DashboardStats, error) {
 
 	for rows.Next() {
 		var machineID string
-		var diskEncrypted, antivirusEnabled sql.NullBool
+		var diskEncryption, antivirus sql.NullString
 		var collectedAt sql.NullTime
 
-		if err := rows.Scan(&machineID, &diskEncrypted, &antivirusEnabled, &collectedAt); err != nil {
+		if err := rows.Scan(&machineID, &diskEncryption, &antivirus, &collectedAt); err != nil {
 			return nil, err
 		}
 
-		if diskEncrypted.Valid {
-			if diskEncrypted.Bool {
-				stats.EncryptedCount++
-			} else {
-				stats.UnencryptedCount++
-			}
-		}
-
-		if antivirusEnabled.Valid {
-			if antivirusEnabled.Bool {
-				stats.ProtectedCount++
-			} else {
-				stats.UnprotectedCount++
-			}
-		}
+		countStatus(ControlStatus(diskEncryption.String), &stats.EncryptedCount, &stats.UnencryptedCount, &stats.EncryptionUnknownCount)
+		countStatus(ControlStatus(antivirus.String), &stats.ProtectedCount, &stats.UnprotectedCount, &stats.ProtectionUnknownCount)
 
 		if collectedAt.Valid && (stats.LastChecked == nil || collectedAt.Time.After(*stats.LastChecked)) {
 			stats.LastChecked = &collectedAt.Time
@@ -545,17 +821,27 @@ func (db *DB) GetUserDashboardStats(userID string) (*DashboardStats, error) {
 	return stats, rows.Err()
 }
 
+// countStatus adds a control's status to the dashboard counts. Machines
+// without a snapshot, and controls that don't apply, aren't counted.
+func countStatus(status ControlStatus, passed, failed, unknown *int) {
+	switch status {
+	case StatusPass:
+		*passed++
+	case StatusFail:
+		*failed++
+	case StatusUnknown:
+		*unknown++
+	}
+}
+
 // Machine notes operations
 
 func (db *DB) CreateMachineNote(machineID, authorID, content string) (*MachineNote, error) {
-	result, err := db.conn.Exec(`
+	var id int64
+	err := db.conn.QueryRow(`
 		INSERT INTO machine_notes (machine_id, author_id, content) VALUES (?, ?, ?)
-	`, machineID, authorID, content)
-	if err != nil {
-		return nil, err
-	}
-
-	id, err := result.LastInsertId()
+		RETURNING id
+	`, machineID, authorID, content).Scan(&id)
 	if err != nil {
 		return nil, err
 	}
@@ -581,13 +867,25 @@ func (db *DB) GetMachineNote(id int64) (*MachineNote, error) {
 }
 
 func (db *DB) GetMachineNotes(machineID string) ([]MachineNote, error) {
+	return db.machineNotes(machineID, time.Time{})
+}
+
+// machineNotes returns a machine's notes, leaving out those written after a
+// non-zero asOf
+func (db *DB) machineNotes(machineID string, asOf time.Time) ([]MachineNote, error) {
+	cutoff := ""
+	args := []interface{}{machineID}
+	if !asOf.IsZero() {
+		cutoff = `AND n.created_at <= ?`
+		args = append(args, asOf.UTC())
+	}
 	rows, err := db.conn.Query(`
 		SELECT n.id, n.machine_id, n.author_id, u.name, n.content, n.created_at, n.updated_at
 		FROM machine_notes n
 		JOIN users u ON n.author_id = u.id
-		WHERE n.machine_id = ?
+		WHERE n.machine_id = ? `+cutoff+`
 		ORDER BY n.created_at DESC
-	`, machineID)
+	`, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -618,7 +916,11 @@ func (db *DB) DeleteMachineNote(id int64) error {
 
 // Share link operations
 
-func (db *DB) CreateShareLink(createdBy string, expiresAt time.Time) (*ShareLink, error) {
+// CreateShareLink creates a link from link's expiry, as-of time, label,
+// scope, display options and password hash, and returns it with its new ID.
+// A non-nil AsOf shows the fleet as it was at that time, see
+// GetAllMachinesWithOwners.
+func (db *DB) CreateShareLink(link *ShareLink) (*ShareLink, error) {
 	// Generate a large random ID for the share link
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -627,8 +929,11 @@ func (db *DB) CreateShareLink(createdBy string, expiresAt time.Time) (*ShareLink
 	id := base64.URLEncoding.EncodeToString(b)
 
 	_, err := db.conn.Exec(`
-		INSERT INTO share_links (id, created_by, expires_at) VALUES (?, ?, ?)
-	`, id, createdBy, expiresAt)
+		INSERT INTO share_links (id, created_by, expires_at, as_of, label, filter_owner, filter_machine, filter_os,
+			show_notes, show_owner_emails, password_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, link.CreatedBy, link.ExpiresAt, link.AsOf, link.Label, link.FilterOwner, link.FilterMachine, link.FilterOS,
+		link.ShowNotes, link.ShowOwnerEmails, link.PasswordHash)
 	if err != nil {
 		return nil, err
 	}
@@ -636,43 +941,75 @@ func (db *DB) CreateShareLink(createdBy string, expiresAt time.Time) (*ShareLink
 	return db.GetShareLink(id)
 }
 
-func (db *DB) GetShareLink(id string) (*ShareLink, error) {
+const shareLinkColumns = `l.id, l.created_by, l.expires_at, l.as_of, l.created_at, l.label,
+	l.filter_owner, l.filter_machine, l.filter_os, l.show_notes, l.show_owner_emails, l.password_hash,
+	l.revoked_at, l.revoked_by, l.revoke_reason`
+
+// scanShareLink reads shareLinkColumns followed by extra
+func scanShareLink(scan func(...interface{}) error, extra ...interface{}) (*ShareLink, error) {
 	var s ShareLink
-	err := db.conn.QueryRow(`
-		SELECT id, created_by, expires_at, created_at
-		FROM share_links
-		WHERE id = ?
-	`, id).Scan(&s.ID, &s.CreatedBy, &s.ExpiresAt, &s.CreatedAt)
+	var asOf, revokedAt sql.NullTime
+	dest := []interface{}{&s.ID, &s.CreatedBy, &s.ExpiresAt, &asOf, &s.CreatedAt, &s.Label,
+		&s.FilterOwner, &s.FilterMachine, &s.FilterOS, &s.ShowNotes, &s.ShowOwnerEmails, &s.PasswordHash,
+		&revokedAt, &s.RevokedBy, &s.RevokeReason}
+	if err := scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if asOf.Valid {
+		s.AsOf = &asOf.Time
+	}
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	return &s, nil
+}
+
+func (db *DB) GetShareLink(id string) (*ShareLink, error) {
+	s, err := scanShareLink(db.conn.QueryRow(`
+		SELECT `+shareLinkColumns+`
+		FROM share_links l
+		WHERE l.id = ?
+	`, id).Scan)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &s, nil
+	return s, nil
 }
 
+// GetValidShareLink returns a link that hasn't expired or been revoked, or nil
 func (db *DB) GetValidShareLink(id string) (*ShareLink, error) {
-	var s ShareLink
-	err := db.conn.QueryRow(`
-		SELECT id, created_by, expires_at, created_at
-		FROM share_links
-		WHERE id = ? AND expires_at > CURRENT_TIMESTAMP
-	`, id).Scan(&s.ID, &s.CreatedBy, &s.ExpiresAt, &s.CreatedAt)
+	s, err := scanShareLink(db.conn.QueryRow(`
+		SELECT `+shareLinkColumns+`
+		FROM share_links l
+		WHERE l.id = ? AND l.expires_at > CURRENT_TIMESTAMP AND l.revoked_at IS NULL
+	`, id).Scan)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &s, nil
+	return s, nil
 }
 
+// GetAllShareLinks returns every link, newest first, with its view count and
+// last view
 func (db *DB) GetAllShareLinks() ([]ShareLink, error) {
 	rows, err := db.conn.Query(`
-		SELECT id, created_by, expires_at, created_at
-		FROM share_links
-		ORDER BY created_at DESC
+		SELECT ` + shareLinkColumns + `,
+			(SELECT COUNT(*) FROM share_link_views c WHERE c.link_id = l.id AND c.failed = FALSE),
+			v.viewed_at
+		FROM share_links l
+		LEFT JOIN share_link_views v ON v.id = (
+			SELECT id FROM share_link_views
+			WHERE link_id = l.id AND failed = FALSE
+			ORDER BY viewed_at DESC
+			LIMIT 1
+		)
+		ORDER BY l.created_at DESC
 	`)
 	if err != nil {
 		return nil, err
@@ -681,24 +1018,126 @@ func (db *DB) GetAllShareLinks() ([]ShareLink, error) {
 
 	var links []ShareLink
 	for rows.Next() {
-		var s ShareLink
-		if err := rows.Scan(&s.ID, &s.CreatedBy, &s.ExpiresAt, &s.CreatedAt); err != nil {
+		var viewCount int
+		var lastViewed sql.NullTime
+		s, err := scanShareLink(rows.Scan, &viewCount, &lastViewed)
+		if err != nil {
 			return nil, err
 		}
-		links = append(links, s)
+		s.ViewCount = viewCount
+		if lastViewed.Valid {
+			s.LastViewedAt = &lastViewed.Time
+		}
+		links = append(links, *s)
 	}
 	return links, rows.Err()
 }
 
-func (db *DB) DeleteShareLink(id string) error {
-	_, err := db.conn.Exec(`DELETE FROM share_links WHERE id = ?`, id)
+// SetShareLinkExpiry changes when a link expires
+func (db *DB) SetShareLinkExpiry(id string, expiresAt time.Time) error {
+	_, err := db.conn.Exec(`UPDATE share_links SET expires_at = ? WHERE id = ?`, expiresAt, id)
+	return err
+}
+
+// RevokeShareLink stops a link from working, keeping it and its access log.
+// Revoking a revoked link does nothing.
+func (db *DB) RevokeShareLink(id, revokedBy, reason string) error {
+	_, err := db.conn.Exec(`
+		UPDATE share_links SET revoked_at = ?, revoked_by = ?, revoke_reason = ?
+		WHERE id = ? AND revoked_at IS NULL
+	`, time.Now().UTC(), revokedBy, reason, id)
 	return err
 }
 
+// RecordShareLinkView adds an entry to a link's access log
+func (db *DB) RecordShareLinkView(linkID, ipAddress, userAgent string) error {
+	return db.recordShareLinkAccess(linkID, ipAddress, userAgent, false)
+}
+
+// RecordFailedShareLinkUnlock logs a wrong password in a link's access log
+func (db *DB) RecordFailedShareLinkUnlock(linkID, ipAddress, userAgent string) error {
+	return db.recordShareLinkAccess(linkID, ipAddress, userAgent, true)
+}
+
+func (db *DB) recordShareLinkAccess(linkID, ipAddress, userAgent string, failed bool) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO share_link_views (link_id, viewed_at, ip_address, user_agent, failed) VALUES (?, ?, ?, ?, ?)
+	`, linkID, time.Now().UTC(), ipAddress, userAgent, failed)
+	return err
+}
+
+// CountFailedShareLinkUnlocks counts the wrong passwords entered since a
+// time for a link, from any address, and from an address, for any link
+func (db *DB) CountFailedShareLinkUnlocks(linkID, ipAddress string, since time.Time) (forLink, fromIP int, err error) {
+	err = db.conn.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM share_link_views WHERE link_id = ? AND failed = TRUE AND viewed_at >= ?),
+			(SELECT COUNT(*) FROM share_link_views WHERE ip_address = ? AND failed = TRUE AND viewed_at >= ?)
+	`, linkID, since.UTC(), ipAddress, since.UTC()).Scan(&forLink, &fromIP)
+	return forLink, fromIP, err
+}
+
+// GetShareLinkViews returns a link's most recent views and failed unlocks,
+// newest first
+func (db *DB) GetShareLinkViews(linkID string, limit int) ([]ShareLinkView, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, link_id, viewed_at, ip_address, user_agent, failed
+		FROM share_link_views
+		WHERE link_id = ?
+		ORDER BY viewed_at DESC, id DESC
+		LIMIT ?
+	`, linkID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var views []ShareLinkView
+	for rows.Next() {
+		var v ShareLinkView
+		if err := rows.Scan(&v.ID, &v.LinkID, &v.ViewedAt, &v.IPAddress, &v.UserAgent, &v.Failed); err != nil {
+			return nil, err
+		}
+		views = append(views, v)
+	}
+	return views, rows.Err()
+}
+
+// DeleteShareLink deletes a link and its access log
+func (db *DB) DeleteShareLink(id string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM share_link_views WHERE link_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM share_links WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteExpiredShareLinks deletes expired links and their access logs
 func (db *DB) DeleteExpiredShareLinks() (int64, error) {
-	result, err := db.conn.Exec(`DELETE FROM share_links WHERE expires_at <= CURRENT_TIMESTAMP`)
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM share_link_views WHERE link_id IN (SELECT id FROM share_links WHERE expires_at <= CURRENT_TIMESTAMP)`); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`DELETE FROM share_links WHERE expires_at <= CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
 	if err != nil {
 		return 0, err
 	}
-	return result.RowsAffected()
+	return n, tx.Commit()
 }
@@ -1,8 +1,14 @@
 package db
 
 import (
+	"bytes"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func setupTestDB(t *testing.T) *DB {
@@ -27,327 +33,712 @@ func setupTestDB(t *testing.T) *DB {
 	return db
 }
 
-func TestUserOperations(t *testing.T) {
+func TestTokenGeneration(t *testing.T) {
+	// Test that tokens are unique
+	tokens := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token, err := generateToken()
+		if err != nil {
+			t.Fatalf("Failed to generate token: %v", err)
+		}
+		if tokens[token] {
+			t.Errorf("Duplicate token generated: %s", token)
+		}
+		tokens[token] = true
+
+		// Check token length (32 bytes base64 encoded = ~43 chars)
+		if len(token) < 40 {
+			t.Errorf("Token too short: %d chars", len(token))
+		}
+	}
+}
+
+func TestPolicyOperations(t *testing.T) {
 	db := setupTestDB(t)
 
-	// Test creating a user
-	user, err := db.UpsertUser("test-id-123", "test@example.com", "Test User", false)
+	_, _ = db.UpsertUser("user-1", "user@example.com", "User", false)
+	m, _ := db.CreateMachine("user-1", "Machine 1")
+
+	rule, err := db.CreatePolicyRule(&PolicyRule{Name: "Disk", Field: "disk_encrypted", Operator: "==", Value: "true", Enabled: true})
 	if err != nil {
-		t.Fatalf("Failed to create user: %v", err)
+		t.Fatalf("Failed to create policy rule: %v", err)
 	}
-	if user.ID != "test-id-123" {
-		t.Errorf("Expected user ID 'test-id-123', got '%s'", user.ID)
+	if rule.ID == 0 || !rule.Enabled {
+		t.Errorf("Expected enabled rule with ID, got %+v", rule)
 	}
-	if user.Email != "test@example.com" {
-		t.Errorf("Expected email 'test@example.com', got '%s'", user.Email)
+
+	snapshot := &InventorySnapshot{Hostname: "host", DiskEncrypted: false}
+	if err := db.CreateSnapshot(m.ID, snapshot); err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
 	}
-	if user.IsAdmin {
-		t.Error("Expected user to not be admin")
+	if snapshot.ID == 0 {
+		t.Fatal("Expected CreateSnapshot to set the snapshot ID")
 	}
 
-	// Test updating a user
-	user, err = db.UpsertUser("test-id-123", "test@example.com", "Test User Updated", true)
+	err = db.SavePolicyResults(snapshot.ID, []PolicyResult{
+		{RuleID: rule.ID, RuleName: rule.Name, Expression: rule.Expression(), Passed: false, Actual: "false"},
+	})
 	if err != nil {
-		t.Fatalf("Failed to update user: %v", err)
-	}
-	if user.Name != "Test User Updated" {
-		t.Errorf("Expected name 'Test User Updated', got '%s'", user.Name)
-	}
-	if !user.IsAdmin {
-		t.Error("Expected user to be admin after update")
+		t.Fatalf("Failed to save policy results: %v", err)
 	}
 
-	// Test getting a user
-	user, err = db.GetUser("test-id-123")
+	latest, err := db.GetLatestSnapshot(m.ID)
 	if err != nil {
-		t.Fatalf("Failed to get user: %v", err)
+		t.Fatalf("Failed to get latest snapshot: %v", err)
+	}
+	if latest.PolicyFailed != 1 || latest.PolicyPassed != 0 {
+		t.Errorf("Expected 1 failed, 0 passed; got %d failed, %d passed", latest.PolicyFailed, latest.PolicyPassed)
 	}
-	if user == nil {
-		t.Fatal("Expected to find user")
+	if latest.Compliant() {
+		t.Error("Expected snapshot to be non-compliant")
 	}
-	if user.Email != "test@example.com" {
-		t.Errorf("Expected email 'test@example.com', got '%s'", user.Email)
+
+	machines, _ := db.GetAllMachinesWithOwners("", "", time.Time{})
+	if len(machines) != 1 || machines[0].Latest == nil || machines[0].Latest.PolicyFailed != 1 {
+		t.Error("Expected admin query to carry the policy verdict")
 	}
 
-	// Test getting non-existent user
-	user, err = db.GetUser("non-existent")
+	// Deleting the rule keeps the recorded verdict
+	if err := db.DeletePolicyRule(rule.ID); err != nil {
+		t.Fatalf("Failed to delete policy rule: %v", err)
+	}
+	results, err := db.GetPolicyResults(snapshot.ID)
 	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+		t.Fatalf("Failed to get policy results: %v", err)
 	}
-	if user != nil {
-		t.Error("Expected nil user for non-existent ID")
+	if len(results) != 1 || results[0].Expression != "disk_encrypted == true" {
+		t.Errorf("Expected recorded result to survive rule deletion, got %+v", results)
 	}
 }
 
-func TestMachineOperations(t *testing.T) {
+func TestBootstrapCodes(t *testing.T) {
 	db := setupTestDB(t)
 
-	// Create a user first
-	_, err := db.UpsertUser("user-1", "user@example.com", "User One", false)
-	if err != nil {
-		t.Fatalf("Failed to create user: %v", err)
-	}
+	_, _ = db.UpsertUser("user-1", "user@example.com", "User", false)
+	m1, _ := db.CreateMachine("user-1", "Machine 1")
+	m2, _ := db.CreateMachine("user-1", "Machine 2")
 
-	// Test creating a machine
-	machine, err := db.CreateMachine("user-1", "Test MacBook")
+	if active, _ := db.GetActiveBootstrapCode(m1.ID); active != nil {
+		t.Errorf("Expected no active code yet, got %+v", active)
+	}
+	code, err := db.CreateBootstrapCode(m1.ID, 30*time.Minute)
 	if err != nil {
-		t.Fatalf("Failed to create machine: %v", err)
+		t.Fatalf("Failed to create bootstrap code: %v", err)
 	}
-	if machine.Name != "Test MacBook" {
-		t.Errorf("Expected name 'Test MacBook', got '%s'", machine.Name)
+	if code.Code == "" || code.Code == m1.EnrollmentToken {
+		t.Fatalf("Expected a fresh code distinct from the token, got %q", code.Code)
 	}
-	if machine.UserID != "user-1" {
-		t.Errorf("Expected user ID 'user-1', got '%s'", machine.UserID)
+
+	if ok, _ := db.ValidBootstrapCode(m1.ID, code.Code); !ok {
+		t.Error("Expected code to be valid for its machine")
 	}
-	if machine.EnrollmentToken == "" {
-		t.Error("Expected enrollment token to be set")
+	if ok, _ := db.ValidBootstrapCode(m2.ID, code.Code); ok {
+		t.Error("Expected code to be invalid for another machine")
 	}
-	if len(machine.EnrollmentToken) < 32 {
-		t.Error("Expected enrollment token to be at least 32 characters")
+	if active, _ := db.GetActiveBootstrapCode(m1.ID); active == nil || active.Code != "" || !active.ExpiresAt.Equal(code.ExpiresAt) {
+		t.Errorf("Expected the new code to be active, without its text, got %+v", active)
 	}
 
-	// Test getting machine by ID
-	fetched, err := db.GetMachine(machine.ID)
+	machine, err := db.RedeemBootstrapCode(code.Code)
 	if err != nil {
-		t.Fatalf("Failed to get machine: %v", err)
+		t.Fatalf("Failed to redeem code: %v", err)
 	}
-	if fetched.Name != "Test MacBook" {
-		t.Errorf("Expected name 'Test MacBook', got '%s'", fetched.Name)
+	if machine == nil || machine.ID != m1.ID {
+		t.Fatalf("Expected redeem to return machine 1, got %+v", machine)
 	}
 
-	// Test getting machine by token
-	fetched, err = db.GetMachineByToken(machine.EnrollmentToken)
-	if err != nil {
-		t.Fatalf("Failed to get machine by token: %v", err)
+	// Single use
+	if machine, _ := db.RedeemBootstrapCode(code.Code); machine != nil {
+		t.Error("Expected second redeem to fail")
 	}
-	if fetched.ID != machine.ID {
-		t.Errorf("Expected machine ID '%s', got '%s'", machine.ID, fetched.ID)
+	if active, _ := db.GetActiveBootstrapCode(m1.ID); active != nil {
+		t.Errorf("Expected a redeemed code not to be active, got %+v", active)
+	}
+	// Still valid for fetching the script until it expires
+	if ok, _ := db.ValidBootstrapCode(m1.ID, code.Code); !ok {
+		t.Error("Expected redeemed code to stay valid for script downloads")
 	}
 
-	// Test getting machines by user
-	machines, err := db.GetMachinesByUser("user-1")
-	if err != nil {
-		t.Fatalf("Failed to get machines by user: %v", err)
+	expired, _ := db.CreateBootstrapCode(m1.ID, -time.Minute)
+	if ok, _ := db.ValidBootstrapCode(m1.ID, expired.Code); ok {
+		t.Error("Expected expired code to be invalid")
 	}
-	if len(machines) != 1 {
-		t.Errorf("Expected 1 machine, got %d", len(machines))
+	if machine, _ := db.RedeemBootstrapCode(expired.Code); machine != nil {
+		t.Error("Expected expired code to be rejected")
 	}
 
-	// Create another machine
-	_, err = db.CreateMachine("user-1", "Test Desktop")
-	if err != nil {
-		t.Fatalf("Failed to create second machine: %v", err)
+	if machine, _ := db.RedeemBootstrapCode("not-a-code"); machine != nil {
+		t.Error("Expected unknown code to be rejected")
 	}
+}
 
-	machines, err = db.GetMachinesByUser("user-1")
-	if err != nil {
-		t.Fatalf("Failed to get machines by user: %v", err)
+func TestMachineCheckIn(t *testing.T) {
+	db := setupTestDB(t)
+
+	_, _ = db.UpsertUser("user-1", "user@example.com", "User", false)
+	m, _ := db.CreateMachine("user-1", "Machine 1")
+
+	now := time.Now()
+	recent := now.Add(-2 * 24 * time.Hour)
+	stale := now.Add(-10 * 24 * time.Hour)
+
+	// Unknown mode uses the default interval
+	if got := m.CheckInState(nil, 8, now); got != CheckInNeverReported {
+		t.Errorf("Expected never_reported, got %s", got)
+	}
+	if got := m.CheckInState(&recent, 8, now); got != CheckInHealthy {
+		t.Errorf("Expected healthy, got %s", got)
 	}
-	if len(machines) != 2 {
-		t.Errorf("Expected 2 machines, got %d", len(machines))
+	if got := m.CheckInState(&stale, 8, now); got != CheckInOverdue {
+		t.Errorf("Expected overdue, got %s", got)
 	}
 
-	// Test deleting a machine
-	err = db.DeleteMachine(machine.ID)
-	if err != nil {
-		t.Fatalf("Failed to delete machine: %v", err)
+	// One-time installs are not expected to report again
+	if err := db.SetMachineMode(m.ID, ModeOneTime); err != nil {
+		t.Fatalf("Failed to set mode: %v", err)
+	}
+	m, _ = db.GetMachine(m.ID)
+	if m.Mode != ModeOneTime {
+		t.Fatalf("Expected onetime mode, got %q", m.Mode)
+	}
+	if got := m.CheckInState(&stale, 8, now); got != CheckInHealthy {
+		t.Errorf("Expected one-time machine to stay healthy, got %s", got)
 	}
 
-	fetched, err = db.GetMachine(machine.ID)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	// Monitor mode sticks once set
+	db.SetMachineMode(m.ID, ModeMonitor)
+	db.SetMachineMode(m.ID, ModeOneTime)
+	m, _ = db.GetMachine(m.ID)
+	if m.Mode != ModeMonitor {
+		t.Errorf("Expected monitor mode to stick, got %q", m.Mode)
+	}
+
+	// Admin override beats the default
+	if err := db.SetMachineCheckInDays(m.ID, 30); err != nil {
+		t.Fatalf("Failed to set check-in days: %v", err)
+	}
+	machines, _ := db.GetAllMachinesWithOwners("", "", time.Time{})
+	if len(machines) != 1 || machines[0].CheckInDays != 30 {
+		t.Fatalf("Expected override in admin query, got %+v", machines)
+	}
+	if got := machines[0].ExpectedCheckInDays(8); got != 30 {
+		t.Errorf("Expected 30 days, got %d", got)
 	}
-	if fetched != nil {
-		t.Error("Expected machine to be deleted")
+	if got := machines[0].CheckInState(&stale, 8, now); got != CheckInHealthy {
+		t.Errorf("Expected healthy under override, got %s", got)
 	}
 }
 
-func TestSnapshotOperations(t *testing.T) {
+func TestAddColumnIfMissing(t *testing.T) {
 	db := setupTestDB(t)
 
-	// Create user and machine
-	_, err := db.UpsertUser("user-1", "user@example.com", "User One", false)
-	if err != nil {
-		t.Fatalf("Failed to create user: %v", err)
+	// Simulate a database created before the check-in columns and
+	// schema_migrations existed
+	if _, err := db.conn.Exec(`ALTER TABLE machines DROP COLUMN checkin_days; DROP TABLE schema_migrations`); err != nil {
+		t.Fatalf("Failed to drop column: %v", err)
 	}
-	machine, err := db.CreateMachine("user-1", "Test MacBook")
-	if err != nil {
-		t.Fatalf("Failed to create machine: %v", err)
+	if _, err := db.Migrate(false); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if applied, err := db.Migrate(false); err != nil || len(applied) != 0 {
+		t.Fatalf("Expected nothing left to migrate, got %v, %v", applied, err)
 	}
 
-	// Test creating a snapshot
-	snapshot := &InventorySnapshot{
-		Hostname:              "test-macbook.local",
-		OS:                    "darwin",
-		OSVersion:             "14.0",
-		DiskEncrypted:         true,
-		DiskEncryptionDetails: "FileVault enabled",
-		AntivirusEnabled:      true,
-		AntivirusDetails:      "XProtect active",
-		RawData:               `{"test": "data"}`,
+	_, _ = db.UpsertUser("user-1", "user@example.com", "User", false)
+	m, err := db.CreateMachine("user-1", "Machine 1")
+	if err != nil || m.CheckInDays != 0 {
+		t.Fatalf("Expected machine with default check-in days, got %+v, %v", m, err)
 	}
+}
+
+func TestWebhookOperations(t *testing.T) {
+	db := setupTestDB(t)
 
-	err = db.CreateSnapshot(machine.ID, snapshot)
+	all, err := db.CreateWebhook("https://example.com/all", nil)
 	if err != nil {
-		t.Fatalf("Failed to create snapshot: %v", err)
+		t.Fatalf("Failed to create webhook: %v", err)
+	}
+	if all.Secret == "" || !all.Enabled || all.EventList() != nil {
+		t.Errorf("Unexpected webhook: %+v", all)
 	}
+	some, _ := db.CreateWebhook("https://example.com/some", []string{"machine.enrolled", "machine.deleted"})
+	if got := some.EventList(); len(got) != 2 || got[1] != "machine.deleted" {
+		t.Errorf("Expected two events, got %v", got)
+	}
+
+	db.EnqueueWebhookEvent("e1", "machine.enrolled", []byte(`{}`))
+	db.EnqueueWebhookEvent("e2", "snapshot.submitted", []byte(`{}`))
 
-	// Test getting latest snapshot
-	latest, err := db.GetLatestSnapshot(machine.ID)
+	due, err := db.DueWebhookDeliveries(time.Now(), 10)
 	if err != nil {
-		t.Fatalf("Failed to get latest snapshot: %v", err)
+		t.Fatalf("Failed to get due deliveries: %v", err)
 	}
-	if latest == nil {
-		t.Fatal("Expected to find snapshot")
+	if len(due) != 3 {
+		t.Fatalf("Expected 3 deliveries (2 + 1), got %d", len(due))
 	}
-	if latest.Hostname != "test-macbook.local" {
-		t.Errorf("Expected hostname 'test-macbook.local', got '%s'", latest.Hostname)
+	if due[0].Secret == "" || due[0].WebhookURL == "" {
+		t.Errorf("Expected delivery to carry webhook URL and secret: %+v", due[0])
 	}
-	if !latest.DiskEncrypted {
-		t.Error("Expected disk to be encrypted")
+
+	// Disabled webhooks get no new events and their queue is held
+	db.SetWebhookEnabled(some.ID, false)
+	db.EnqueueWebhookEvent("e3", "machine.deleted", []byte(`{}`))
+	due, _ = db.DueWebhookDeliveries(time.Now(), 10)
+	if len(due) != 3 {
+		t.Errorf("Expected 3 due deliveries for the enabled webhook, got %d", len(due))
 	}
 
-	// Wait a bit to ensure different timestamps then create another snapshot
-	snapshot2 := &InventorySnapshot{
-		Hostname:         "test-macbook.local",
-		OS:               "darwin",
-		OSVersion:        "14.1",
-		DiskEncrypted:    true,
-		AntivirusEnabled: true,
+	next := time.Now().Add(time.Hour)
+	if err := db.RecordWebhookAttempt(due[0].ID, DeliveryPending, 503, "unavailable", next); err != nil {
+		t.Fatalf("Failed to record attempt: %v", err)
 	}
-	err = db.CreateSnapshot(machine.ID, snapshot2)
-	if err != nil {
-		t.Fatalf("Failed to create second snapshot: %v", err)
+	if due, _ := db.DueWebhookDeliveries(time.Now(), 10); len(due) != 2 {
+		t.Errorf("Expected rescheduled delivery to wait, got %d due", len(due))
+	}
+	if due, _ := db.DueWebhookDeliveries(next.Add(time.Second), 10); len(due) != 3 {
+		t.Errorf("Expected rescheduled delivery to be due later, got %d due", len(due))
 	}
 
-	// Test getting history
-	history, err := db.GetSnapshotHistory(machine.ID, 10)
-	if err != nil {
-		t.Fatalf("Failed to get snapshot history: %v", err)
+	if err := db.DeleteWebhook(all.ID); err != nil {
+		t.Fatalf("Failed to delete webhook: %v", err)
 	}
-	if len(history) != 2 {
-		t.Errorf("Expected 2 snapshots in history, got %d", len(history))
+	recent, _ := db.RecentWebhookDeliveries(10)
+	if len(recent) != 1 || recent[0].WebhookID != some.ID {
+		t.Errorf("Expected only the remaining webhook's delivery, got %+v", recent)
 	}
+}
 
-	// Test that latest returns one of the snapshots (due to fast inserts, order may vary)
-	latest, err = db.GetLatestSnapshot(machine.ID)
-	if err != nil {
-		t.Fatalf("Failed to get latest snapshot: %v", err)
+func TestNotificationState(t *testing.T) {
+	db := setupTestDB(t)
+
+	_, _ = db.UpsertUser("user-1", "user@example.com", "User", false)
+	m, _ := db.CreateMachine("user-1", "Machine 1")
+
+	if err := db.SetUserEmailOptOut("user-1", true); err != nil {
+		t.Fatalf("Failed to opt out: %v", err)
 	}
-	if latest.OSVersion != "14.0" && latest.OSVersion != "14.1" {
-		t.Errorf("Expected OS version '14.0' or '14.1', got '%s'", latest.OSVersion)
+	// Logging in again must not reset the preference
+	u, _ := db.UpsertUser("user-1", "user@example.com", "User", false)
+	if !u.EmailOptOut {
+		t.Error("Expected opt-out to survive a login")
+	}
+
+	db.SetAlertedControls(m.ID, []string{"disk_encrypted", "firewall_enabled"})
+	db.SetAlertedControls(m.ID, []string{"firewall_enabled"})
+	alerted, err := db.GetAlertedControls(m.ID)
+	if err != nil || len(alerted) != 1 || alerted[0] != "firewall_enabled" {
+		t.Errorf("Expected only firewall_enabled, got %v (%v)", alerted, err)
+	}
+
+	if err := db.DeleteMachine(m.ID); err != nil {
+		t.Fatalf("Failed to delete machine: %v", err)
+	}
+	if alerted, _ := db.GetAlertedControls(m.ID); len(alerted) != 0 {
+		t.Errorf("Expected alerts removed with the machine, got %v", alerted)
 	}
 }
 
-func TestAdminMachineQuery(t *testing.T) {
+func TestAPIKeys(t *testing.T) {
 	db := setupTestDB(t)
+	db.UpsertUser("admin-1", "admin@example.com", "Admin", true)
 
-	// Create two users
-	_, _ = db.UpsertUser("user-1", "alice@example.com", "Alice Smith", false)
-	_, _ = db.UpsertUser("user-2", "bob@example.com", "Bob Jones", false)
+	key, err := db.CreateAPIKey("GRC export", "admin-1", []string{ScopeMachinesRead, ScopeUsersRead}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+	if !strings.HasPrefix(key.Key, "bck_") || !strings.HasPrefix(key.Key, key.Prefix) || key.Key == key.Prefix {
+		t.Errorf("Unexpected key %q with prefix %q", key.Key, key.Prefix)
+	}
+	if !key.HasScope(ScopeUsersRead) || key.HasScope(ScopeSnapshotsRead) {
+		t.Errorf("Unexpected scopes: %q", key.Scopes)
+	}
+	if key.CreatedByEmail != "admin@example.com" {
+		t.Errorf("Expected creator email, got %q", key.CreatedByEmail)
+	}
 
-	// Create machines
-	m1, _ := db.CreateMachine("user-1", "Alice MacBook")
-	m2, _ := db.CreateMachine("user-1", "Alice Desktop")
-	m3, _ := db.CreateMachine("user-2", "Bob Laptop")
+	got, err := db.AuthenticateAPIKey(key.Key)
+	if err != nil || got == nil || got.ID != key.ID {
+		t.Fatalf("Expected key to authenticate, got %+v (%v)", got, err)
+	}
+	if got.Key != "" {
+		t.Error("Authenticated key should not carry the plaintext key")
+	}
+	keys, _ := db.GetAPIKeys()
+	if len(keys) != 1 || keys[0].LastUsedAt == nil {
+		t.Errorf("Expected last use to be recorded: %+v", keys)
+	}
+
+	if got, _ := db.AuthenticateAPIKey(key.Key + "x"); got != nil {
+		t.Error("Expected unknown key to be rejected")
+	}
 
-	// Add snapshots
-	db.CreateSnapshot(m1.ID, &InventorySnapshot{Hostname: "alice-mb", OS: "darwin", DiskEncrypted: true})
-	db.CreateSnapshot(m2.ID, &InventorySnapshot{Hostname: "alice-dt", OS: "windows", DiskEncrypted: false})
-	db.CreateSnapshot(m3.ID, &InventorySnapshot{Hostname: "bob-lt", OS: "linux", DiskEncrypted: true})
+	past := time.Now().UTC().Add(-time.Minute)
+	expired, _ := db.CreateAPIKey("Old", "admin-1", []string{ScopeMachinesRead}, &past)
+	if got, _ := db.AuthenticateAPIKey(expired.Key); got != nil {
+		t.Error("Expected expired key to be rejected")
+	}
 
-	// Test getting all machines
-	machines, err := db.GetAllMachinesWithOwners("", "")
-	if err != nil {
-		t.Fatalf("Failed to get all machines: %v", err)
+	db.DeleteAPIKey(key.ID)
+	if got, _ := db.AuthenticateAPIKey(key.Key); got != nil {
+		t.Error("Expected revoked key to be rejected")
 	}
-	if len(machines) != 3 {
-		t.Errorf("Expected 3 machines, got %d", len(machines))
+}
+
+func TestDiffRawData(t *testing.T) {
+	changes := DiffRawData(
+		`{"os":"darwin","firewall":{"enabled":true,"mode":"on"},"apps":["a"],"gone":1}`,
+		`{"os":"darwin","firewall":{"enabled":false,"mode":"on"},"apps":["a","b"],"new":null}`,
+	)
+	want := []FieldChange{
+		{Field: "apps", From: `["a"]`, To: `["a","b"]`},
+		{Field: "firewall.enabled", From: "true", To: "false"},
+		{Field: "gone", From: "1", To: ""},
+		{Field: "new", From: "", To: "null"},
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("Expected %v, got %v", want, changes)
 	}
 
-	// Test filtering by owner
-	machines, err = db.GetAllMachinesWithOwners("alice", "")
-	if err != nil {
-		t.Fatalf("Failed to filter by owner: %v", err)
+	if changes := DiffRawData("", `{}`); changes != nil {
+		t.Errorf("Expected no changes between empty payloads, got %v", changes)
+	}
+	if changes := DiffRawData("not json", `{}`); len(changes) != 1 || changes[0].Field != "raw_data" {
+		t.Errorf("Expected a whole-payload change, got %v", changes)
 	}
-	if len(machines) != 2 {
-		t.Errorf("Expected 2 machines for alice, got %d", len(machines))
+}
+
+// openTestDB opens an unmigrated database
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "boxcheckr.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
 	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
 
-	// Test filtering by machine name
-	machines, err = db.GetAllMachinesWithOwners("", "MacBook")
+// schemaOf describes every table's columns and every index, for comparing
+// databases that took different paths to the same version
+func schemaOf(t *testing.T, db *DB) []string {
+	t.Helper()
+	rows, err := db.conn.Query(`
+		SELECT m.type || ' ' || m.name || ' ' || COALESCE(c.name, '') || ' ' || COALESCE(c.type, '') || ' ' ||
+		       COALESCE(c."notnull", '') || ' ' || COALESCE(c.dflt_value, '') || ' ' || COALESCE(c.pk, '')
+		FROM sqlite_master m
+		LEFT JOIN pragma_table_info(m.name) c ON m.type = 'table'
+		WHERE m.name NOT LIKE 'sqlite_%'
+		ORDER BY 1
+	`)
 	if err != nil {
-		t.Fatalf("Failed to filter by machine: %v", err)
+		t.Fatalf("Failed to read schema: %v", err)
 	}
-	if len(machines) != 1 {
-		t.Errorf("Expected 1 machine matching 'MacBook', got %d", len(machines))
+	defer rows.Close()
+
+	var schema []string
+	for rows.Next() {
+		var line string
+		rows.Scan(&line)
+		schema = append(schema, line)
 	}
+	return schema
+}
 
-	// Test combined filter
-	machines, err = db.GetAllMachinesWithOwners("bob", "Laptop")
+func TestMigrateFromEveryVersion(t *testing.T) {
+	fresh := openTestDB(t)
+	applied, err := fresh.Migrate(false)
 	if err != nil {
-		t.Fatalf("Failed combined filter: %v", err)
+		t.Fatalf("Failed to migrate a new database: %v", err)
+	}
+	if len(applied) != len(sqliteMigrations) || fresh.SchemaVersion() != len(sqliteMigrations) {
+		t.Fatalf("Expected all %d migrations to apply, got %d", len(sqliteMigrations), len(applied))
+	}
+	want := schemaOf(t, fresh)
+
+	for version := 0; version <= fresh.SchemaVersion(); version++ {
+		// Legacy databases were created before schema_migrations existed
+		for _, legacy := range []bool{false, true} {
+			t.Run(fmt.Sprintf("v%d legacy=%v", version, legacy), func(t *testing.T) {
+				db := openTestDB(t)
+
+				tx, err := db.beginMigration()
+				if err != nil {
+					t.Fatalf("Failed to begin: %v", err)
+				}
+				for _, m := range sqliteMigrations[:version] {
+					if err := m.up(tx); err != nil {
+						t.Fatalf("Failed to apply migration %d: %v", m.Version, err)
+					}
+					tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.Version, m.Name)
+				}
+				if legacy {
+					tx.Exec(`DROP TABLE schema_migrations`)
+				}
+				if err := tx.Commit(); err != nil {
+					t.Fatalf("Failed to build version %d: %v", version, err)
+				}
+				if version > 0 {
+					db.conn.Exec(`INSERT INTO users (id, email, name) VALUES ('user-1', 'user@example.com', 'User')`)
+				}
+
+				applied, err := db.Migrate(false)
+				if err != nil {
+					t.Fatalf("Failed to migrate from version %d: %v", version, err)
+				}
+				pending := fresh.SchemaVersion() - version
+				if legacy {
+					pending = fresh.SchemaVersion()
+				}
+				if len(applied) != pending {
+					t.Errorf("Expected %d migrations to apply, got %d", pending, len(applied))
+				}
+
+				status, _ := db.MigrationStatus()
+				for _, m := range status {
+					if m.AppliedAt == nil {
+						t.Errorf("Expected migration %d to be applied", m.Version)
+					}
+				}
+				if got := schemaOf(t, db); !slices.Equal(got, want) {
+					t.Errorf("Schema differs from a new database:\n got %v\nwant %v", got, want)
+				}
+				if version > 0 {
+					if u, _ := db.GetUser("user-1"); u == nil || u.EmailOptOut {
+						t.Errorf("Expected existing user to survive with defaults, got %+v", u)
+					}
+				}
+			})
+		}
 	}
-	if len(machines) != 1 {
-		t.Errorf("Expected 1 machine, got %d", len(machines))
+}
+
+func TestMigrateHashesMachineTokens(t *testing.T) {
+	db := openTestDB(t)
+
+	// Build the schema from before tokens were hashed
+	tx, err := db.beginMigration()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	for _, m := range sqliteMigrations[:13] {
+		if err := m.up(tx); err != nil {
+			t.Fatalf("Failed to apply migration %d: %v", m.Version, err)
+		}
+		tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.Version, m.Name)
+	}
+	tx.Exec(`INSERT INTO users (id, email, name) VALUES ('user-1', 'user@example.com', 'User')`)
+	tx.Exec(`INSERT INTO machines (id, user_id, name, enrollment_token) VALUES ('machine-1', 'user-1', 'Laptop', 'plaintext-token-1234')`)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to build the old schema: %v", err)
+	}
+
+	if _, err := db.Migrate(false); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
 	}
-	if machines[0].OwnerEmail != "bob@example.com" {
-		t.Errorf("Expected bob@example.com, got %s", machines[0].OwnerEmail)
+
+	var stored string
+	db.conn.QueryRow(`SELECT enrollment_token FROM machines WHERE id = 'machine-1'`).Scan(&stored)
+	if stored != hashSecret("plaintext-token-1234") {
+		t.Errorf("Expected the token to be hashed, got %q", stored)
+	}
+	m, _ := db.GetMachineByToken("plaintext-token-1234")
+	if m == nil || m.TokenPrefix != "plaintex" || m.TokenIssuedAt == nil {
+		t.Errorf("Expected the existing token to keep working, got %+v", m)
 	}
 }
 
-func TestDashboardStats(t *testing.T) {
-	db := setupTestDB(t)
+func TestMigrateBackfillsControlStatuses(t *testing.T) {
+	db := openTestDB(t)
 
-	// Create user and machines
-	_, _ = db.UpsertUser("user-1", "user@example.com", "User", false)
-	m1, _ := db.CreateMachine("user-1", "Machine 1")
-	m2, _ := db.CreateMachine("user-1", "Machine 2")
-	m3, _ := db.CreateMachine("user-1", "Machine 3")
+	// Build the schema from before controls had statuses
+	tx, err := db.beginMigration()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	for _, m := range sqliteMigrations[:17] {
+		if err := m.up(tx); err != nil {
+			t.Fatalf("Failed to apply migration %d: %v", m.Version, err)
+		}
+		tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.Version, m.Name)
+	}
+	tx.Exec(`INSERT INTO users (id, email, name) VALUES ('user-1', 'user@example.com', 'User')`)
+	tx.Exec(`INSERT INTO machines (id, user_id, name, enrollment_token) VALUES ('machine-1', 'user-1', 'Laptop', 'token')`)
+	tx.Exec(`INSERT INTO inventory_snapshots (machine_id, hostname, os, os_version, raw_data,
+		disk_encrypted, disk_encryption_details, antivirus_enabled, antivirus_details, firewall_enabled, screen_lock_enabled)
+		VALUES ('machine-1', 'laptop', 'linux', '24.04', '{}', TRUE, '', FALSE, '', TRUE, FALSE)`)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to build the old schema: %v", err)
+	}
 
-	// Add snapshots with various states
-	db.CreateSnapshot(m1.ID, &InventorySnapshot{DiskEncrypted: true, AntivirusEnabled: true})
-	db.CreateSnapshot(m2.ID, &InventorySnapshot{DiskEncrypted: true, AntivirusEnabled: false})
-	db.CreateSnapshot(m3.ID, &InventorySnapshot{DiskEncrypted: false, AntivirusEnabled: true})
+	if _, err := db.Migrate(false); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
 
-	stats, err := db.GetUserDashboardStats("user-1")
+	s, _ := db.GetLatestSnapshot("machine-1")
+	if s == nil || s.DiskEncryptionStatus != StatusPass || s.AntivirusStatus != StatusFail ||
+		s.FirewallStatus != StatusPass || s.ScreenLockStatus != StatusFail {
+		t.Errorf("Expected statuses from the booleans, got %+v", s)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	db := openTestDB(t)
+
+	pending, err := db.Migrate(true)
+	if err != nil || len(pending) != db.SchemaVersion() {
+		t.Fatalf("Expected a dry run of every migration, got %d, %v", len(pending), err)
+	}
+	status, err := db.MigrationStatus()
 	if err != nil {
-		t.Fatalf("Failed to get dashboard stats: %v", err)
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	for _, m := range status {
+		if m.AppliedAt != nil {
+			t.Errorf("Expected dry run to apply nothing, but %d was applied", m.Version)
+		}
+	}
+	if schema := schemaOf(t, db); len(schema) != 0 {
+		t.Errorf("Expected dry run to leave the database empty, got %v", schema)
 	}
 
-	if stats.TotalMachines != 3 {
-		t.Errorf("Expected 3 total machines, got %d", stats.TotalMachines)
+	if applied, _ := db.Migrate(false); len(applied) != db.SchemaVersion() {
+		t.Errorf("Expected every migration to apply, got %d", len(applied))
 	}
-	if stats.EncryptedCount != 2 {
-		t.Errorf("Expected 2 encrypted, got %d", stats.EncryptedCount)
+	if pending, _ := db.Migrate(true); len(pending) != 0 {
+		t.Errorf("Expected nothing pending, got %v", pending)
 	}
-	if stats.UnencryptedCount != 1 {
-		t.Errorf("Expected 1 unencrypted, got %d", stats.UnencryptedCount)
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	db := setupTestDB(t)
+
+	saved := sqliteMigrations
+	t.Cleanup(func() { sqliteMigrations = saved })
+	sqliteMigrations = append(slices.Clip(sqliteMigrations), Migration{
+		Version: 99,
+		Name:    "broken",
+		up:      execSQL(`CREATE TABLE half_done (id INTEGER); NOT VALID SQL`),
+	})
+
+	if _, err := db.Migrate(false); err == nil || !strings.Contains(err.Error(), "migration 99 (broken)") {
+		t.Fatalf("Expected the broken migration to fail, got %v", err)
 	}
-	if stats.ProtectedCount != 2 {
-		t.Errorf("Expected 2 protected, got %d", stats.ProtectedCount)
+	var tables int
+	db.conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'`).Scan(&tables)
+	if tables != 0 {
+		t.Error("Expected the failed migration to be rolled back")
 	}
-	if stats.UnprotectedCount != 1 {
-		t.Errorf("Expected 1 unprotected, got %d", stats.UnprotectedCount)
+	status, _ := db.MigrationStatus()
+	if last := status[len(status)-1]; last.AppliedAt != nil {
+		t.Error("Expected the failed migration not to be recorded")
 	}
 }
 
-func TestTokenGeneration(t *testing.T) {
-	// Test that tokens are unique
-	tokens := make(map[string]bool)
-	for i := 0; i < 100; i++ {
-		token, err := generateToken()
-		if err != nil {
-			t.Fatalf("Failed to generate token: %v", err)
+func TestExportCoversEveryColumn(t *testing.T) {
+	db := setupTestDB(t)
+	rows, err := db.conn.Query(`
+		SELECT m.name, c.name
+		FROM sqlite_master m
+		JOIN pragma_table_info(m.name) c
+		WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%' AND m.name != 'schema_migrations'
+	`)
+	if err != nil {
+		t.Fatalf("Failed to read schema: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table, column string
+		rows.Scan(&table, &column)
+		if slices.Contains(unexportedTables, table) {
+			continue
 		}
-		if tokens[token] {
-			t.Errorf("Duplicate token generated: %s", token)
+		i := slices.IndexFunc(exportTables, func(t exportTable) bool { return t.name == table })
+		if i < 0 {
+			t.Errorf("Table %s is not exported", table)
+			continue
 		}
-		tokens[token] = true
-
-		// Check token length (32 bytes base64 encoded = ~43 chars)
-		if len(token) < 40 {
-			t.Errorf("Token too short: %d chars", len(token))
+		if !slices.ContainsFunc(exportTables[i].columns, func(c exportColumn) bool { return c.name == column }) {
+			t.Errorf("Column %s.%s is not exported", table, column)
 		}
 	}
 }
+
+func TestBackup(t *testing.T) {
+	db := setupTestDB(t)
+	db.UpsertUser("user-1", "user@example.com", "User", false)
+	db.CreateMachine("user-1", "Laptop")
+	session, _ := db.CreateSession("user-1", false, "refresh-secret", "", "", time.Now().Add(time.Hour))
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if err := db.Backup(path); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := db.Backup(path); err == nil {
+		t.Error("Expected backing up over an existing file to fail")
+	}
+
+	version, err := CheckBackup(path)
+	if err != nil || version != db.SchemaVersion() {
+		t.Fatalf("Expected a valid backup at version %d, got %d, %v", db.SchemaVersion(), version, err)
+	}
+	backup, _ := Open(path)
+	defer backup.Close()
+	if machines, _ := backup.GetMachinesByUser("user-1"); len(machines) != 1 {
+		t.Errorf("Expected the backup to hold 1 machine, got %d", len(machines))
+	}
+	if s, _ := backup.GetSession(session.ID); s == nil || s.RefreshToken != "" {
+		t.Errorf("Expected the backup's session without its refresh token, got %+v", s)
+	}
+	if raw, _ := os.ReadFile(path); bytes.Contains(raw, []byte("refresh-secret")) {
+		t.Error("Expected the refresh token to be gone from the backup file")
+	}
+
+	// A backup from a newer build can't be restored
+	backup.conn.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, 'future')`, db.SchemaVersion()+1)
+	if _, err := CheckBackup(path); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Expected a newer schema to be rejected, got %v", err)
+	}
+
+	garbage := filepath.Join(t.TempDir(), "garbage.db")
+	os.WriteFile(garbage, []byte("not a database"), 0o600)
+	if _, err := CheckBackup(garbage); err == nil {
+		t.Error("Expected a non-database file to be rejected")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.db")
+	if _, err := CheckBackup(empty); err == nil {
+		t.Error("Expected a database without BoxCheckr tables to be rejected")
+	}
+}
+
+func TestAuditLogTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper string
+		broken int64
+	}{
+		{"edited", `UPDATE audit_events SET actor_email = 'someone@example.com' WHERE id = 2`, 2},
+		{"removed", `DELETE FROM audit_events WHERE id = 2`, 3},
+		{"latest removed", `DELETE FROM audit_events WHERE id = 3`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := setupTestDB(t)
+			for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				db.CreateAuditEvent(&AuditEvent{ActorEmail: email, Action: "user.signed_in"})
+			}
+
+			// Someone with direct access to the database can drop the triggers
+			db.conn.Exec(`DROP TRIGGER audit_events_no_update; DROP TRIGGER audit_events_no_delete`)
+			if _, err := db.conn.Exec(tt.tamper); err != nil {
+				t.Fatalf("Failed to tamper: %v", err)
+			}
+
+			v, err := db.VerifyAuditLog()
+			if err != nil || v.BrokenAt != tt.broken {
+				t.Errorf("Expected the chain to break at %d, got %+v, %v", tt.broken, v, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package db
+
+import "time"
+
+// Store is the storage the web server needs. *DB implements it on SQLite
+// (New) and on PostgreSQL (NewPostgres).
+type Store interface {
+	UserStore
+	MachineStore
+	SnapshotStore
+	NoteStore
+	ShareLinkStore
+	PolicyStore
+	BootstrapStore
+	WebhookStore
+	APIKeyStore
+	NotificationStore
+	RetentionStore
+	SessionStore
+	AuditStore
+	BackupStore
+	Close() error
+}
+
+var _ Store = (*DB)(nil)
+
+// UserStore manages users
+type UserStore interface {
+	UpsertUser(id, email, name string, isAdmin bool) (*User, error)
+	GetUser(id string) (*User, error)
+	GetUsers() ([]User, error)
+}
+
+// MachineStore manages enrolled machines
+type MachineStore interface {
+	CreateMachine(userID, name string) (*Machine, error)
+	GetMachine(id string) (*Machine, error)
+	GetMachineByToken(token string) (*Machine, error)
+	GetMachinesByUser(userID string) ([]Machine, error)
+	GetMachinesWithLatestByUser(userID string) ([]MachineWithLatest, error)
+	GetAllMachinesWithOwners(filterOwner, filterMachine string, asOf time.Time) ([]MachineWithOwner, error)
+	EachMachineWithOwner(filterOwner, filterMachine string, asOf time.Time, fn func(*MachineWithOwner) error) error
+	GetMachinesWithOwnersAfter(filterOwner, filterMachine, afterID string, limit int) ([]MachineWithOwner, error)
+	GetUserDashboardStats(userID string) (*DashboardStats, error)
+	SetMachineMode(id, mode string) error
+	SetMachineCheckInDays(id string, days int) error
+	GetArchivedMachines() ([]MachineWithOwner, error)
+	ArchiveMachine(id, archivedBy, reason string) error
+	RestoreMachine(id string) error
+	DeleteMachine(id string) error
+	RotateMachineToken(id string, grace time.Duration) (string, error)
+	SetMachineTokenDisabled(id string, disabled bool) error
+	RecordMachineTokenUse(id, ipAddress string) error
+	SetMachinePublicKey(id, publicKey string) error
+	UseInventoryNonce(machineID, nonce string, since time.Time) (bool, error)
+}
+
+// SnapshotStore manages inventory snapshots
+type SnapshotStore interface {
+	CreateSnapshot(machineID string, snapshot *InventorySnapshot) error
+	GetSnapshot(id int64) (*InventorySnapshot, error)
+	GetLatestSnapshot(machineID string) (*InventorySnapshot, error)
+	GetLatestSnapshots() ([]InventorySnapshot, error)
+	GetSnapshotHistory(machineID string, limit int) ([]InventorySnapshot, error)
+	GetSnapshotsBefore(machineID string, beforeID int64, limit int) ([]InventorySnapshot, error)
+	GetSnapshotTransitions(machineID string, limit int) ([]SnapshotTransition, error)
+	GetSnapshotChecks(snapshotID int64) ([]SnapshotCheck, error)
+}
+
+// NoteStore manages admin notes on machines
+type NoteStore interface {
+	CreateMachineNote(machineID, authorID, content string) (*MachineNote, error)
+	GetMachineNote(id int64) (*MachineNote, error)
+	GetMachineNotes(machineID string) ([]MachineNote, error)
+	UpdateMachineNote(id int64, content string) error
+	DeleteMachineNote(id int64) error
+}
+
+// ShareLinkStore manages public share links
+type ShareLinkStore interface {
+	CreateShareLink(link *ShareLink) (*ShareLink, error)
+	GetShareLink(id string) (*ShareLink, error)
+	GetValidShareLink(id string) (*ShareLink, error)
+	GetAllShareLinks() ([]ShareLink, error)
+	SetShareLinkExpiry(id string, expiresAt time.Time) error
+	RevokeShareLink(id, revokedBy, reason string) error
+	RecordShareLinkView(linkID, ipAddress, userAgent string) error
+	RecordFailedShareLinkUnlock(linkID, ipAddress, userAgent string) error
+	CountFailedShareLinkUnlocks(linkID, ipAddress string, since time.Time) (forLink, fromIP int, err error)
+	GetShareLinkViews(linkID string, limit int) ([]ShareLinkView, error)
+	DeleteShareLink(id string) error
+	DeleteExpiredShareLinks() (int64, error)
+}
+
+// PolicyStore manages compliance rules and their results
+type PolicyStore interface {
+	CreatePolicyRule(rule *PolicyRule) (*PolicyRule, error)
+	GetPolicyRule(id int64) (*PolicyRule, error)
+	GetPolicyRules(enabledOnly bool) ([]PolicyRule, error)
+	SetPolicyRuleEnabled(id int64, enabled bool) error
+	DeletePolicyRule(id int64) error
+	SavePolicyResults(snapshotID int64, results []PolicyResult) error
+	GetPolicyResults(snapshotID int64) ([]PolicyResult, error)
+}
+
+// BootstrapStore manages single-use install codes
+type BootstrapStore interface {
+	CreateBootstrapCode(machineID string, ttl time.Duration) (*BootstrapCode, error)
+	GetActiveBootstrapCode(machineID string) (*BootstrapCode, error)
+	ValidBootstrapCode(machineID, code string) (bool, error)
+	RedeemBootstrapCode(code string) (*Machine, error)
+}
+
+// WebhookStore manages webhooks and their delivery queue
+type WebhookStore interface {
+	CreateWebhook(url string, events []string) (*Webhook, error)
+	GetWebhook(id int64) (*Webhook, error)
+	GetWebhooks() ([]Webhook, error)
+	SetWebhookEnabled(id int64, enabled bool) error
+	DeleteWebhook(id int64) error
+	EnqueueWebhookEvent(eventID, event string, payload []byte) error
+	DueWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error)
+	RecentWebhookDeliveries(limit int) ([]WebhookDelivery, error)
+	RecordWebhookAttempt(id int64, status string, statusCode int, errMsg string, nextAttemptAt time.Time) error
+}
+
+// APIKeyStore manages REST API keys
+type APIKeyStore interface {
+	CreateAPIKey(name, createdBy string, scopes []string, expiresAt *time.Time) (*APIKey, error)
+	GetAPIKey(id int64) (*APIKey, error)
+	GetAPIKeys() ([]APIKey, error)
+	AuthenticateAPIKey(key string) (*APIKey, error)
+	DeleteAPIKey(id int64) error
+}
+
+// NotificationStore tracks email notification state
+type NotificationStore interface {
+	SetUserEmailOptOut(userID string, optOut bool) error
+	GetUsersDueDigest(since time.Time) ([]User, error)
+	MarkDigestSent(userID string, at time.Time) error
+	GetAlertedControls(machineID string) ([]string, error)
+	SetAlertedControls(machineID string, controls []string) error
+}
+
+// SessionStore manages server-side sessions
+type SessionStore interface {
+	CreateSession(userID string, isAdmin bool, refreshToken, userAgent, ipAddress string, expiresAt time.Time) (*Session, error)
+	GetSessionByToken(token string) (*Session, error)
+	GetSession(id string) (*Session, error)
+	GetSessions(idleSince, now time.Time) ([]Session, error)
+	TouchSession(id string, at time.Time) error
+	UpdateSessionRole(id string, isAdmin bool, refreshToken string, refreshedAt, at time.Time) (bool, error)
+	DeleteSession(id string) error
+	DeleteUserSessions(userID string) (int64, error)
+	DeleteExpiredSessions(idleSince, now time.Time) (int64, error)
+}
+
+// AuditStore keeps the append-only audit log
+type AuditStore interface {
+	CreateAuditEvent(e *AuditEvent) error
+	GetAuditEvents(filter AuditFilter) ([]AuditEvent, error)
+	EachAuditEvent(filter AuditFilter, fn func(*AuditEvent) error) error
+	GetAuditActions() ([]string, error)
+	VerifyAuditLog() (*AuditVerification, error)
+}
+
+// BackupStore writes backups of the database
+type BackupStore interface {
+	Backup(path string) error
+}
+
+// RetentionStore supports thinning out old snapshots
+type RetentionStore interface {
+	SetMachineLegalHold(id string, hold bool) error
+	EachRetentionSnapshot(fn func(*InventorySnapshot) error) error
+	DeleteSnapshots(ids []int64) (int64, error)
+}
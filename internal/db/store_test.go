@@ -0,0 +1,1329 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests in this file make up the storage conformance suite and run
+// against every backend. Set BOXCHECKR_TEST_POSTGRES to a connection string,
+// e.g. "postgres://postgres@localhost:5432/postgres", to include PostgreSQL.
+
+// forEachBackend runs fn against a fresh database on each backend
+func forEachBackend(t *testing.T, fn func(t *testing.T, db *DB)) {
+	t.Run("sqlite", func(t *testing.T) {
+		fn(t, setupTestDB(t))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		fn(t, setupPostgresTestDB(t))
+	})
+}
+
+// setupPostgresTestDB migrates a new schema in the test PostgreSQL database
+// and drops it afterwards
+func setupPostgresTestDB(t *testing.T) *DB {
+	t.Helper()
+	dsn := os.Getenv("BOXCHECKR_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("BOXCHECKR_TEST_POSTGRES is not set")
+	}
+
+	admin, err := OpenPostgres(dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	schema := fmt.Sprintf("boxcheckr_test_%d", time.Now().UnixNano())
+	if _, err := admin.conn.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		admin.Close()
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.conn.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		admin.Close()
+	})
+
+	db, err := NewPostgres(withSearchPath(dsn, schema))
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// withSearchPath adds a search_path setting to a URL or key=value DSN
+func withSearchPath(dsn, schema string) string {
+	if u, err := url.Parse(dsn); err == nil && strings.HasPrefix(u.Scheme, "postgres") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+func TestUserOperations(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+
+		// Test creating a user
+		user, err := db.UpsertUser("test-id-123", "test@example.com", "Test User", false)
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		if user.ID != "test-id-123" {
+			t.Errorf("Expected user ID 'test-id-123', got '%s'", user.ID)
+		}
+		if user.Email != "test@example.com" {
+			t.Errorf("Expected email 'test@example.com', got '%s'", user.Email)
+		}
+		if user.IsAdmin {
+			t.Error("Expected user to not be admin")
+		}
+
+		// Test updating a user
+		user, err = db.UpsertUser("test-id-123", "test@example.com", "Test User Updated", true)
+		if err != nil {
+			t.Fatalf("Failed to update user: %v", err)
+		}
+		if user.Name != "Test User Updated" {
+			t.Errorf("Expected name 'Test User Updated', got '%s'", user.Name)
+		}
+		if !user.IsAdmin {
+			t.Error("Expected user to be admin after update")
+		}
+
+		// Test getting a user
+		user, err = db.GetUser("test-id-123")
+		if err != nil {
+			t.Fatalf("Failed to get user: %v", err)
+		}
+		if user == nil {
+			t.Fatal("Expected to find user")
+		}
+		if user.Email != "test@example.com" {
+			t.Errorf("Expected email 'test@example.com', got '%s'", user.Email)
+		}
+
+		// Test getting non-existent user
+		user, err = db.GetUser("non-existent")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if user != nil {
+			t.Error("Expected nil user for non-existent ID")
+		}
+	})
+}
+
+func TestMachineOperations(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+
+		// Create a user first
+		_, err := db.UpsertUser("user-1", "user@example.com", "User One", false)
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+
+		// Test creating a machine
+		machine, err := db.CreateMachine("user-1", "Test MacBook")
+		if err != nil {
+			t.Fatalf("Failed to create machine: %v", err)
+		}
+		if machine.Name != "Test MacBook" {
+			t.Errorf("Expected name 'Test MacBook', got '%s'", machine.Name)
+		}
+		if machine.UserID != "user-1" {
+			t.Errorf("Expected user ID 'user-1', got '%s'", machine.UserID)
+		}
+		if machine.EnrollmentToken == "" {
+			t.Error("Expected enrollment token to be set")
+		}
+		if len(machine.EnrollmentToken) < 32 {
+			t.Error("Expected enrollment token to be at least 32 characters")
+		}
+
+		// Test getting machine by ID
+		fetched, err := db.GetMachine(machine.ID)
+		if err != nil {
+			t.Fatalf("Failed to get machine: %v", err)
+		}
+		if fetched.Name != "Test MacBook" {
+			t.Errorf("Expected name 'Test MacBook', got '%s'", fetched.Name)
+		}
+
+		// Test getting machine by token
+		fetched, err = db.GetMachineByToken(machine.EnrollmentToken)
+		if err != nil {
+			t.Fatalf("Failed to get machine by token: %v", err)
+		}
+		if fetched.ID != machine.ID {
+			t.Errorf("Expected machine ID '%s', got '%s'", machine.ID, fetched.ID)
+		}
+
+		// Test getting machines by user
+		machines, err := db.GetMachinesByUser("user-1")
+		if err != nil {
+			t.Fatalf("Failed to get machines by user: %v", err)
+		}
+		if len(machines) != 1 {
+			t.Errorf("Expected 1 machine, got %d", len(machines))
+		}
+
+		// Create another machine
+		_, err = db.CreateMachine("user-1", "Test Desktop")
+		if err != nil {
+			t.Fatalf("Failed to create second machine: %v", err)
+		}
+
+		machines, err = db.GetMachinesByUser("user-1")
+		if err != nil {
+			t.Fatalf("Failed to get machines by user: %v", err)
+		}
+		if len(machines) != 2 {
+			t.Errorf("Expected 2 machines, got %d", len(machines))
+		}
+
+		// Test deleting a machine
+		err = db.DeleteMachine(machine.ID)
+		if err != nil {
+			t.Fatalf("Failed to delete machine: %v", err)
+		}
+
+		fetched, err = db.GetMachine(machine.ID)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if fetched != nil {
+			t.Error("Expected machine to be deleted")
+		}
+	})
+}
+
+func TestSnapshotOperations(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+
+		// Create user and machine
+		_, err := db.UpsertUser("user-1", "user@example.com", "User One", false)
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		machine, err := db.CreateMachine("user-1", "Test MacBook")
+		if err != nil {
+			t.Fatalf("Failed to create machine: %v", err)
+		}
+
+		// Test creating a snapshot
+		snapshot := &InventorySnapshot{
+			Hostname:              "test-macbook.local",
+			OS:                    "darwin",
+			OSVersion:             "14.0",
+			DiskEncrypted:         true,
+			DiskEncryptionDetails: "FileVault enabled",
+			AntivirusEnabled:      true,
+			AntivirusDetails:      "XProtect active",
+			RawData:               `{"test": "data"}`,
+		}
+
+		err = db.CreateSnapshot(machine.ID, snapshot)
+		if err != nil {
+			t.Fatalf("Failed to create snapshot: %v", err)
+		}
+
+		// Test getting latest snapshot
+		latest, err := db.GetLatestSnapshot(machine.ID)
+		if err != nil {
+			t.Fatalf("Failed to get latest snapshot: %v", err)
+		}
+		if latest == nil {
+			t.Fatal("Expected to find snapshot")
+		}
+		if latest.Hostname != "test-macbook.local" {
+			t.Errorf("Expected hostname 'test-macbook.local', got '%s'", latest.Hostname)
+		}
+		if !latest.DiskEncrypted {
+			t.Error("Expected disk to be encrypted")
+		}
+
+		// Wait a bit to ensure different timestamps then create another snapshot
+		snapshot2 := &InventorySnapshot{
+			Hostname:         "test-macbook.local",
+			OS:               "darwin",
+			OSVersion:        "14.1",
+			DiskEncrypted:    true,
+			AntivirusEnabled: true,
+		}
+		err = db.CreateSnapshot(machine.ID, snapshot2)
+		if err != nil {
+			t.Fatalf("Failed to create second snapshot: %v", err)
+		}
+
+		// Test getting history
+		history, err := db.GetSnapshotHistory(machine.ID, 10)
+		if err != nil {
+			t.Fatalf("Failed to get snapshot history: %v", err)
+		}
+		if len(history) != 2 {
+			t.Errorf("Expected 2 snapshots in history, got %d", len(history))
+		}
+
+		// Test that latest returns one of the snapshots (due to fast inserts, order may vary)
+		latest, err = db.GetLatestSnapshot(machine.ID)
+		if err != nil {
+			t.Fatalf("Failed to get latest snapshot: %v", err)
+		}
+		if latest.OSVersion != "14.0" && latest.OSVersion != "14.1" {
+			t.Errorf("Expected OS version '14.0' or '14.1', got '%s'", latest.OSVersion)
+		}
+	})
+}
+
+func TestAdminMachineQuery(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+
+		// Create two users
+		_, _ = db.UpsertUser("user-1", "alice@example.com", "Alice Smith", false)
+		_, _ = db.UpsertUser("user-2", "bob@example.com", "Bob Jones", false)
+
+		// Create machines
+		m1, _ := db.CreateMachine("user-1", "Alice MacBook")
+		m2, _ := db.CreateMachine("user-1", "Alice Desktop")
+		m3, _ := db.CreateMachine("user-2", "Bob Laptop")
+
+		// Add snapshots
+		db.CreateSnapshot(m1.ID, &InventorySnapshot{Hostname: "alice-mb", OS: "darwin", DiskEncrypted: true})
+		db.CreateSnapshot(m2.ID, &InventorySnapshot{Hostname: "alice-dt", OS: "windows", DiskEncrypted: false})
+		db.CreateSnapshot(m3.ID, &InventorySnapshot{Hostname: "bob-lt", OS: "linux", DiskEncrypted: true})
+
+		// Test getting all machines
+		machines, err := db.GetAllMachinesWithOwners("", "", time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to get all machines: %v", err)
+		}
+		if len(machines) != 3 {
+			t.Errorf("Expected 3 machines, got %d", len(machines))
+		}
+
+		// Test filtering by owner
+		machines, err = db.GetAllMachinesWithOwners("alice", "", time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to filter by owner: %v", err)
+		}
+		if len(machines) != 2 {
+			t.Errorf("Expected 2 machines for alice, got %d", len(machines))
+		}
+
+		// Test filtering by machine name
+		machines, err = db.GetAllMachinesWithOwners("", "MacBook", time.Time{})
+		if err != nil {
+			t.Fatalf("Failed to filter by machine: %v", err)
+		}
+		if len(machines) != 1 {
+			t.Errorf("Expected 1 machine matching 'MacBook', got %d", len(machines))
+		}
+
+		// Test combined filter
+		machines, err = db.GetAllMachinesWithOwners("bob", "Laptop", time.Time{})
+		if err != nil {
+			t.Fatalf("Failed combined filter: %v", err)
+		}
+		if len(machines) != 1 {
+			t.Errorf("Expected 1 machine, got %d", len(machines))
+		}
+		if machines[0].OwnerEmail != "bob@example.com" {
+			t.Errorf("Expected bob@example.com, got %s", machines[0].OwnerEmail)
+		}
+	})
+}
+
+func TestDashboardStats(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+
+		// Create user and machines
+		_, _ = db.UpsertUser("user-1", "user@example.com", "User", false)
+		m1, _ := db.CreateMachine("user-1", "Machine 1")
+		m2, _ := db.CreateMachine("user-1", "Machine 2")
+		m3, _ := db.CreateMachine("user-1", "Machine 3")
+
+		// Add snapshots with various states
+		db.CreateSnapshot(m1.ID, &InventorySnapshot{DiskEncrypted: true, AntivirusEnabled: true})
+		db.CreateSnapshot(m2.ID, &InventorySnapshot{DiskEncrypted: true, AntivirusEnabled: false})
+		db.CreateSnapshot(m3.ID, &InventorySnapshot{DiskEncrypted: false, AntivirusEnabled: true})
+
+		stats, err := db.GetUserDashboardStats("user-1")
+		if err != nil {
+			t.Fatalf("Failed to get dashboard stats: %v", err)
+		}
+
+		if stats.TotalMachines != 3 {
+			t.Errorf("Expected 3 total machines, got %d", stats.TotalMachines)
+		}
+		if stats.EncryptedCount != 2 {
+			t.Errorf("Expected 2 encrypted, got %d", stats.EncryptedCount)
+		}
+		if stats.UnencryptedCount != 1 {
+			t.Errorf("Expected 1 unencrypted, got %d", stats.UnencryptedCount)
+		}
+		if stats.ProtectedCount != 2 {
+			t.Errorf("Expected 2 protected, got %d", stats.ProtectedCount)
+		}
+		if stats.UnprotectedCount != 1 {
+			t.Errorf("Expected 1 unprotected, got %d", stats.UnprotectedCount)
+		}
+		if stats.EncryptionUnknownCount != 0 || stats.ProtectionUnknownCount != 0 {
+			t.Errorf("Expected no unknowns, got %+v", stats)
+		}
+
+		// Controls the agent couldn't check are unknown rather than failing
+		m4, _ := db.CreateMachine("user-1", "Machine 4")
+		db.CreateSnapshot(m4.ID, &InventorySnapshot{DiskEncryptionStatus: StatusUnknown, AntivirusStatus: StatusNotApplicable})
+		stats, _ = db.GetUserDashboardStats("user-1")
+		if stats.UnencryptedCount != 1 || stats.EncryptionUnknownCount != 1 {
+			t.Errorf("Expected 1 unencrypted and 1 unknown, got %+v", stats)
+		}
+		if stats.ProtectedCount != 2 || stats.UnprotectedCount != 1 || stats.ProtectionUnknownCount != 0 {
+			t.Errorf("Expected antivirus that doesn't apply not to be counted, got %+v", stats)
+		}
+	})
+}
+
+func TestControlStatuses(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		machine, _ := db.CreateMachine("user-1", "Laptop")
+
+		snapshot := &InventorySnapshot{DiskEncrypted: true, FirewallEnabled: true, FirewallStatus: StatusUnknown}
+		if err := db.CreateSnapshot(machine.ID, snapshot); err != nil {
+			t.Fatalf("Failed to create snapshot: %v", err)
+		}
+
+		got, err := db.GetSnapshot(snapshot.ID)
+		if err != nil {
+			t.Fatalf("Failed to get snapshot: %v", err)
+		}
+		if got.DiskEncryptionStatus != StatusPass || got.AntivirusStatus != StatusFail ||
+			got.FirewallStatus != StatusUnknown || got.ScreenLockStatus != StatusFail {
+			t.Errorf("Unexpected statuses %+v", got)
+		}
+		if !got.DiskEncrypted || got.FirewallEnabled {
+			t.Errorf("Expected booleans to follow statuses, got %+v", got)
+		}
+
+		machines, _ := db.GetMachinesWithLatestByUser("user-1")
+		if len(machines) != 1 || machines[0].Latest.FirewallStatus != StatusUnknown {
+			t.Errorf("Expected the latest snapshot's statuses, got %+v", machines)
+		}
+	})
+}
+
+func TestGetSnapshotsBefore(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		machine, _ := db.CreateMachine("user-1", "Laptop")
+
+		for i := 0; i < 5; i++ {
+			db.CreateSnapshot(machine.ID, &InventorySnapshot{Hostname: "laptop"})
+		}
+
+		first, err := db.GetSnapshotsBefore(machine.ID, 0, 3)
+		if err != nil {
+			t.Fatalf("Failed to get snapshots: %v", err)
+		}
+		if len(first) != 3 || first[0].ID < first[2].ID {
+			t.Fatalf("Expected the 3 newest snapshots, got %+v", first)
+		}
+
+		rest, _ := db.GetSnapshotsBefore(machine.ID, first[2].ID, 3)
+		if len(rest) != 2 || rest[0].ID >= first[2].ID {
+			t.Errorf("Expected the 2 remaining snapshots, got %+v", rest)
+		}
+	})
+}
+
+func TestGetMachinesWithOwnersAfter(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		for _, name := range []string{"Laptop", "Desktop", "Server", "Spare"} {
+			m, _ := db.CreateMachine("user-1", name)
+			db.CreateSnapshot(m.ID, &InventorySnapshot{Hostname: name})
+		}
+		archived, _ := db.CreateMachine("user-1", "Old")
+		db.ArchiveMachine(archived.ID, "user@example.com", "Retired")
+
+		var ids []string
+		for after := ""; ; {
+			page, err := db.GetMachinesWithOwnersAfter("", "", after, 3)
+			if err != nil {
+				t.Fatalf("Failed to get machines: %v", err)
+			}
+			for _, m := range page {
+				if m.Latest == nil || m.OwnerEmail != "user@example.com" {
+					t.Errorf("Expected the owner and latest snapshot, got %+v", m)
+				}
+				ids = append(ids, m.ID)
+			}
+			if len(page) < 3 {
+				break
+			}
+			after = page[len(page)-1].ID
+		}
+		if len(ids) != 4 || !slices.IsSorted(ids) {
+			t.Errorf("Expected the 4 active machines by ID, got %v", ids)
+		}
+
+		if page, _ := db.GetMachinesWithOwnersAfter("", "serv", "", 10); len(page) != 1 || page[0].Name != "Server" {
+			t.Errorf("Expected only the server, got %+v", page)
+		}
+	})
+}
+
+func TestMachinesAsOf(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+
+		day := func(d int) time.Time { return time.Date(2026, 3, d, 12, 0, 0, 0, time.UTC) }
+
+		old, _ := db.CreateMachine("user-1", "Old Laptop")
+		db.conn.Exec(`UPDATE machines SET created_at = ? WHERE id = ?`, day(1), old.ID)
+		db.CreateSnapshot(old.ID, &InventorySnapshot{Hostname: "march-5", DiskEncrypted: true})
+		db.CreateSnapshot(old.ID, &InventorySnapshot{Hostname: "march-20"})
+		snapshots, _ := db.GetSnapshotsBefore(old.ID, 0, 10) // Newest first
+		db.conn.Exec(`UPDATE inventory_snapshots SET collected_at = ? WHERE id = ?`, day(20), snapshots[0].ID)
+		db.conn.Exec(`UPDATE inventory_snapshots SET collected_at = ? WHERE id = ?`, day(5), snapshots[1].ID)
+
+		newer, _ := db.CreateMachine("user-1", "New Laptop")
+		db.conn.Exec(`UPDATE machines SET created_at = ? WHERE id = ?`, day(15), newer.ID)
+
+		db.CreateMachineNote(old.ID, "user-1", "Before")
+		db.CreateMachineNote(old.ID, "user-1", "After")
+		db.conn.Exec(`UPDATE machine_notes SET created_at = ? WHERE content = ?`, day(3), "Before")
+		db.conn.Exec(`UPDATE machine_notes SET created_at = ? WHERE content = ?`, day(12), "After")
+
+		machines, err := db.GetAllMachinesWithOwners("", "", day(10))
+		if err != nil {
+			t.Fatalf("Failed to get machines: %v", err)
+		}
+		if len(machines) != 1 || machines[0].ID != old.ID {
+			t.Fatalf("Expected only the machine enrolled by then, got %+v", machines)
+		}
+		if m := machines[0]; m.NoteCount != 1 || len(m.Notes) != 1 || m.Notes[0].Content != "Before" {
+			t.Errorf("Expected only the note written by then, got %d: %+v", m.NoteCount, m.Notes)
+		}
+		if machines[0].Latest == nil || machines[0].Latest.Hostname != "march-5" || !machines[0].Latest.DiskEncrypted {
+			t.Errorf("Expected the snapshot from March 5, got %+v", machines[0].Latest)
+		}
+
+		if machines, _ := db.GetAllMachinesWithOwners("", "", day(2)); len(machines) != 1 || machines[0].Latest != nil {
+			t.Errorf("Expected the machine without a report before March 5, got %+v", machines)
+		}
+
+		machines, _ = db.GetAllMachinesWithOwners("", "", time.Time{})
+		if len(machines) != 2 {
+			t.Fatalf("Expected both machines now, got %d", len(machines))
+		}
+		for _, m := range machines {
+			if m.ID == old.ID && (m.Latest.Hostname != "march-20" || m.NoteCount != 2 || len(m.Notes) != 2) {
+				t.Errorf("Expected the latest snapshot and both notes now, got %s and %d notes", m.Latest.Hostname, m.NoteCount)
+			}
+		}
+
+		asOf := day(10)
+		link, err := db.CreateShareLink(&ShareLink{CreatedBy: "user-1", ExpiresAt: time.Now().Add(time.Hour), AsOf: &asOf})
+		if err != nil {
+			t.Fatalf("Failed to create share link: %v", err)
+		}
+		if link.AsOf == nil || !link.AsOf.Equal(asOf) {
+			t.Errorf("Expected share link as of %v, got %v", asOf, link.AsOf)
+		}
+		current, _ := db.CreateShareLink(&ShareLink{CreatedBy: "user-1", ExpiresAt: time.Now().Add(time.Hour)})
+		if current.AsOf != nil {
+			t.Errorf("Expected no as-of time, got %v", current.AsOf)
+		}
+	})
+}
+
+func TestArchiveMachine(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		kept, _ := db.CreateMachine("user-1", "Laptop")
+		old, _ := db.CreateMachine("user-1", "Old Laptop")
+		db.CreateSnapshot(old.ID, &InventorySnapshot{Hostname: "old"})
+		before := time.Now()
+
+		if err := db.ArchiveMachine(old.ID, "admin@example.com", "Returned to IT"); err != nil {
+			t.Fatalf("Failed to archive machine: %v", err)
+		}
+
+		m, err := db.GetMachine(old.ID)
+		if err != nil || m == nil {
+			t.Fatalf("Expected the archived machine to be kept, got %v", err)
+		}
+		if !m.Archived() || m.ArchivedBy != "admin@example.com" || m.ArchiveReason != "Returned to IT" {
+			t.Errorf("Expected the machine to be archived with its reason, got %+v", m)
+		}
+		if history, _ := db.GetSnapshotHistory(old.ID, 10); len(history) != 1 {
+			t.Errorf("Expected the snapshot to be kept, got %d", len(history))
+		}
+
+		// Hidden from default views
+		if machines, _ := db.GetMachinesByUser("user-1"); len(machines) != 1 || machines[0].ID != kept.ID {
+			t.Errorf("Expected only the active machine, got %+v", machines)
+		}
+		if machines, _ := db.GetMachinesWithLatestByUser("user-1"); len(machines) != 1 {
+			t.Errorf("Expected 1 active machine, got %d", len(machines))
+		}
+		if machines, _ := db.GetAllMachinesWithOwners("", "", time.Time{}); len(machines) != 1 {
+			t.Errorf("Expected 1 active machine, got %d", len(machines))
+		}
+		if stats, _ := db.GetUserDashboardStats("user-1"); stats.TotalMachines != 1 {
+			t.Errorf("Expected 1 machine in stats, got %d", stats.TotalMachines)
+		}
+		if snapshots, _ := db.GetLatestSnapshots(); len(snapshots) != 0 {
+			t.Errorf("Expected no snapshots of active machines, got %d", len(snapshots))
+		}
+
+		// Still shown as of a time before it was archived
+		if machines, _ := db.GetAllMachinesWithOwners("", "", before); len(machines) != 2 {
+			t.Errorf("Expected both machines before archiving, got %d", len(machines))
+		}
+
+		archived, err := db.GetArchivedMachines()
+		if err != nil || len(archived) != 1 || archived[0].ID != old.ID || archived[0].Latest == nil || archived[0].ArchivedAt == nil {
+			t.Fatalf("Expected the archived machine with its snapshot, got %+v, %v", archived, err)
+		}
+
+		if err := db.RestoreMachine(old.ID); err != nil {
+			t.Fatalf("Failed to restore machine: %v", err)
+		}
+		if m, _ := db.GetMachine(old.ID); m.Archived() || m.ArchiveReason != "" {
+			t.Errorf("Expected the machine to be restored, got %+v", m)
+		}
+		if machines, _ := db.GetMachinesByUser("user-1"); len(machines) != 2 {
+			t.Errorf("Expected both machines after restoring, got %d", len(machines))
+		}
+	})
+}
+
+func TestMachineTokens(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		machine, _ := db.CreateMachine("user-1", "Laptop")
+		original := machine.EnrollmentToken
+
+		// Only the hash is stored
+		var stored string
+		db.conn.QueryRow(`SELECT enrollment_token FROM machines WHERE id = ?`, machine.ID).Scan(&stored)
+		if stored == original || stored != hashSecret(original) {
+			t.Errorf("Expected the token's hash to be stored, got %q", stored)
+		}
+		fetched, _ := db.GetMachine(machine.ID)
+		if fetched.EnrollmentToken != "" || fetched.TokenPrefix != tokenPrefix(original) || fetched.TokenIssuedAt == nil {
+			t.Errorf("Expected only the token's prefix and issue time, got %+v", fetched)
+		}
+
+		// Rotating with a grace period keeps the old token working
+		rotated, err := db.RotateMachineToken(machine.ID, time.Hour)
+		if err != nil || rotated == "" || rotated == original {
+			t.Fatalf("Expected a new token, got %q, %v", rotated, err)
+		}
+		for _, token := range []string{original, rotated} {
+			if m, _ := db.GetMachineByToken(token); m == nil || m.ID != machine.ID {
+				t.Errorf("Expected token %q to identify the machine, got %+v", tokenPrefix(token), m)
+			}
+		}
+		if m, _ := db.GetMachine(machine.ID); !m.InTokenGrace(time.Now()) || m.TokenPrefix != tokenPrefix(rotated) {
+			t.Errorf("Expected the old token to be in its grace period, got %+v", m)
+		}
+
+		// Rotating without one stops it at once
+		latest, _ := db.RotateMachineToken(machine.ID, 0)
+		if m, _ := db.GetMachineByToken(rotated); m != nil {
+			t.Error("Expected the replaced token to stop working")
+		}
+		if m, _ := db.GetMachineByToken(original); m != nil {
+			t.Error("Expected the original token to stop working")
+		}
+
+		// Disabled tokens still resolve, so reports can be rejected with a reason
+		if err := db.SetMachineTokenDisabled(machine.ID, true); err != nil {
+			t.Fatalf("Failed to disable token: %v", err)
+		}
+		if m, _ := db.GetMachineByToken(latest); m == nil || !m.TokenDisabled() {
+			t.Errorf("Expected the machine with its token disabled, got %+v", m)
+		}
+
+		// Rotating a disabled token re-enables it, without a grace period
+		newest, _ := db.RotateMachineToken(machine.ID, time.Hour)
+		if m, _ := db.GetMachineByToken(latest); m != nil {
+			t.Error("Expected the disabled token not to get a grace period")
+		}
+		if m, _ := db.GetMachineByToken(newest); m == nil || m.TokenDisabled() {
+			t.Errorf("Expected the new token to work, got %+v", m)
+		}
+
+		if err := db.RecordMachineTokenUse(machine.ID, "203.0.113.7"); err != nil {
+			t.Fatalf("Failed to record token use: %v", err)
+		}
+		if m, _ := db.GetMachine(machine.ID); m.TokenLastUsedAt == nil || m.TokenLastUsedIP != "203.0.113.7" {
+			t.Errorf("Expected the last use to be recorded, got %+v", m)
+		}
+	})
+}
+
+func TestSignedInventory(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		machine, _ := db.CreateMachine("user-1", "Laptop")
+
+		if err := db.SetMachinePublicKey(machine.ID, "public-key"); err != nil {
+			t.Fatalf("Failed to set public key: %v", err)
+		}
+		if m, _ := db.GetMachineByToken(machine.EnrollmentToken); m.PublicKey != "public-key" || m.PublicKeyRegisteredAt == nil {
+			t.Errorf("Expected the key to be registered, got %+v", m)
+		}
+
+		db.CreateSnapshot(machine.ID, &InventorySnapshot{Hostname: "laptop", Signed: true})
+		if s, _ := db.GetLatestSnapshot(machine.ID); s == nil || !s.Signed {
+			t.Errorf("Expected a signed snapshot, got %+v", s)
+		}
+		if machines, _ := db.GetAllMachinesWithOwners("", "", time.Time{}); len(machines) != 1 || !machines[0].Latest.Signed {
+			t.Errorf("Expected the latest snapshot to be signed, got %+v", machines)
+		}
+
+		// Nonces can only be used once, and are forgotten after since
+		now := time.Now()
+		if fresh, err := db.UseInventoryNonce(machine.ID, "nonce-1", now.Add(-time.Minute)); err != nil || !fresh {
+			t.Fatalf("Expected a new nonce to be accepted, got %v, %v", fresh, err)
+		}
+		if fresh, _ := db.UseInventoryNonce(machine.ID, "nonce-1", now.Add(-time.Minute)); fresh {
+			t.Error("Expected a used nonce to be rejected")
+		}
+		if fresh, _ := db.UseInventoryNonce(machine.ID, "nonce-1", now.Add(time.Minute)); !fresh {
+			t.Error("Expected an expired nonce to be dropped")
+		}
+
+		if err := db.SetMachinePublicKey(machine.ID, ""); err != nil {
+			t.Fatalf("Failed to clear public key: %v", err)
+		}
+		if m, _ := db.GetMachine(machine.ID); m.PublicKey != "" || m.PublicKeyRegisteredAt != nil {
+			t.Errorf("Expected the key to be cleared, got %+v", m)
+		}
+
+		if err := db.DeleteMachine(machine.ID); err != nil {
+			t.Errorf("Failed to delete a machine with nonces: %v", err)
+		}
+	})
+}
+
+func TestPatchLevel(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		machine, _ := db.CreateMachine("user-1", "Laptop")
+
+		// Older scripts don't report patch level
+		unknown := &InventorySnapshot{Hostname: "laptop"}
+		db.CreateSnapshot(machine.ID, unknown)
+		if unknown.CollectedAt.IsZero() {
+			t.Error("Expected CreateSnapshot to fill in the collection time")
+		}
+		if s, _ := db.GetLatestSnapshot(machine.ID); s.DaysSinceUpdate != nil || s.PendingSecurityUpdates != nil || s.LastBootAt != nil {
+			t.Errorf("Expected unreported values to stay unknown, got %+v", s)
+		}
+		db.DeleteSnapshots([]int64{unknown.ID})
+
+		days, pending := 3, 0
+		booted := time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC)
+		db.CreateSnapshot(machine.ID, &InventorySnapshot{
+			Hostname:               "laptop",
+			OSBuild:                "23E224",
+			DaysSinceUpdate:        &days,
+			PendingSecurityUpdates: &pending,
+			AutoUpdateEnabled:      true,
+			AutoUpdateDetails:      "macOS updates install automatically",
+			LastBootAt:             &booted,
+		})
+
+		check := func(name string, s *InventorySnapshot) {
+			t.Helper()
+			if s == nil || s.OSBuild != "23E224" || !s.AutoUpdateEnabled || s.AutoUpdateDetails != "macOS updates install automatically" {
+				t.Fatalf("%s: unexpected patch level %+v", name, s)
+			}
+			if s.DaysSinceUpdate == nil || *s.DaysSinceUpdate != 3 || s.PendingSecurityUpdates == nil || *s.PendingSecurityUpdates != 0 {
+				t.Errorf("%s: expected 3 days and 0 pending, got %v and %v", name, s.DaysSinceUpdate, s.PendingSecurityUpdates)
+			}
+			if s.LastBootAt == nil || !s.LastBootAt.Equal(booted) {
+				t.Errorf("%s: expected last boot %v, got %v", name, booted, s.LastBootAt)
+			}
+		}
+
+		latest, _ := db.GetLatestSnapshot(machine.ID)
+		check("GetLatestSnapshot", latest)
+		history, _ := db.GetSnapshotHistory(machine.ID, 1)
+		check("GetSnapshotHistory", &history[0])
+		machines, _ := db.GetAllMachinesWithOwners("", "", time.Time{})
+		check("GetAllMachinesWithOwners", machines[0].Latest)
+		owned, _ := db.GetMachinesWithLatestByUser("user-1")
+		check("GetMachinesWithLatestByUser", owned[0].Latest)
+		snapshots, _ := db.GetLatestSnapshots()
+		check("GetLatestSnapshots", &snapshots[0])
+	})
+}
+
+func TestSnapshotChecks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		machine, _ := db.CreateMachine("user-1", "Server")
+		other, _ := db.CreateMachine("user-1", "Laptop")
+
+		old := &InventorySnapshot{Hostname: "server", Checks: []SnapshotCheck{{CheckID: "ssh_root_login_disabled", Status: "fail", Value: "yes"}}}
+		if err := db.CreateSnapshot(machine.ID, old); err != nil {
+			t.Fatalf("Failed to create snapshot: %v", err)
+		}
+		db.DeleteSnapshots([]int64{old.ID})
+		if checks, _ := db.GetSnapshotChecks(old.ID); len(checks) != 0 {
+			t.Errorf("Expected checks to be deleted with their snapshot, got %+v", checks)
+		}
+
+		want := []SnapshotCheck{
+			{CheckID: "ssh_root_login_disabled", Status: "pass", Value: "no", Details: "PermitRootLogin no"},
+			{CheckID: "acme.vpn_connected", Status: "unknown"},
+		}
+		snapshot := &InventorySnapshot{Hostname: "server", Checks: want}
+		if err := db.CreateSnapshot(machine.ID, snapshot); err != nil {
+			t.Fatalf("Failed to create snapshot: %v", err)
+		}
+		db.CreateSnapshot(other.ID, &InventorySnapshot{Hostname: "laptop"})
+
+		check := func(name string, got []SnapshotCheck) {
+			t.Helper()
+			if len(got) != 2 || got[0].CheckID != "acme.vpn_connected" || got[1] != (SnapshotCheck{SnapshotID: snapshot.ID, CheckID: "ssh_root_login_disabled", Status: "pass", Value: "no", Details: "PermitRootLogin no"}) {
+				t.Errorf("%s: unexpected checks %+v", name, got)
+			}
+		}
+		checks, _ := db.GetSnapshotChecks(snapshot.ID)
+		check("GetSnapshotChecks", checks)
+		latest, _ := db.GetLatestSnapshot(machine.ID)
+		check("GetLatestSnapshot", latest.Checks)
+		byID, _ := db.GetSnapshot(snapshot.ID)
+		check("GetSnapshot", byID.Checks)
+
+		snapshots, _ := db.GetLatestSnapshots()
+		for _, s := range snapshots {
+			if s.MachineID == machine.ID {
+				check("GetLatestSnapshots", s.Checks)
+			} else if len(s.Checks) != 0 {
+				t.Errorf("Expected no checks for the other machine, got %+v", s.Checks)
+			}
+		}
+
+		if err := db.DeleteMachine(machine.ID); err != nil {
+			t.Fatalf("Failed to delete machine: %v", err)
+		}
+		if checks, _ := db.GetSnapshotChecks(snapshot.ID); len(checks) != 0 {
+			t.Errorf("Expected checks to be deleted with their machine, got %+v", checks)
+		}
+	})
+}
+
+func TestSnapshotTransitions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		machine, _ := db.CreateMachine("user-1", "Laptop")
+
+		for _, s := range []InventorySnapshot{
+			{Hostname: "laptop", FirewallEnabled: true, RawData: `{"a":1}`},
+			{Hostname: "laptop", FirewallEnabled: true, RawData: `{"a":2}`},
+			{Hostname: "laptop", FirewallEnabled: false},
+			{Hostname: "laptop", FirewallEnabled: false},
+			{Hostname: "laptop", FirewallEnabled: false},
+			{Hostname: "laptop-2", FirewallEnabled: true},
+		} {
+			db.CreateSnapshot(machine.ID, &s)
+		}
+
+		// Only a named check changes
+		other, _ := db.CreateMachine("user-1", "Server")
+		for _, status := range []string{"pass", "pass", "fail"} {
+			db.CreateSnapshot(other.ID, &InventorySnapshot{Hostname: "server", OS: "linux",
+				Checks: []SnapshotCheck{{CheckID: "acme.vpn", Status: "pass"}, {CheckID: "ssh_root_login_disabled", Status: status}}})
+		}
+		checkRuns, err := db.GetSnapshotTransitions(other.ID, 10)
+		if err != nil || len(checkRuns) != 2 || checkRuns[1].Count != 2 {
+			t.Fatalf("Expected a run of 2 snapshots, then the check's change, got %+v, %v", checkRuns, err)
+		}
+		if want := []FieldChange{{Field: "check.ssh_root_login_disabled", From: "pass", To: "fail"}}; !slices.Equal(checkRuns[0].Changes, want) {
+			t.Errorf("Expected %v, got %v", want, checkRuns[0].Changes)
+		}
+
+		transitions, err := db.GetSnapshotTransitions(machine.ID, 10)
+		if err != nil {
+			t.Fatalf("Failed to get transitions: %v", err)
+		}
+		if len(transitions) != 3 {
+			t.Fatalf("Expected 3 transitions, got %d", len(transitions))
+		}
+
+		// Newest first
+		newest, middle, first := transitions[0], transitions[1], transitions[2]
+		if !first.First() || first.Count != 2 || first.Changes != nil {
+			t.Errorf("Expected a first run of 2 snapshots, got %+v", first)
+		}
+		if middle.Count != 3 || middle.PreviousID != first.LastID || middle.LastID != middle.Snapshot.ID+2 {
+			t.Errorf("Expected a run of 3 snapshots after the first, got %+v", middle)
+		}
+		want := []FieldChange{{Field: "firewall_enabled", From: "true", To: "false"}}
+		if !slices.Equal(middle.Changes, want) {
+			t.Errorf("Expected %v, got %v", want, middle.Changes)
+		}
+		if len(newest.Changes) != 2 || newest.Changes[0].Field != "hostname" || newest.Count != 1 {
+			t.Errorf("Expected hostname and firewall changes, got %+v", newest)
+		}
+		if middle.Snapshot.RawData != "" {
+			t.Error("Expected transitions without raw data")
+		}
+
+		limited, _ := db.GetSnapshotTransitions(machine.ID, 2)
+		if len(limited) != 2 || limited[0].Snapshot.ID != newest.Snapshot.ID || limited[1].Snapshot.ID != middle.Snapshot.ID {
+			t.Errorf("Expected the 2 newest transitions, got %+v", limited)
+		}
+
+		if s, _ := db.GetSnapshot(first.Snapshot.ID); s == nil || s.RawData != `{"a":1}` {
+			t.Errorf("Expected the first snapshot with its raw data, got %+v", s)
+		}
+		if s, _ := db.GetSnapshot(0); s != nil {
+			t.Error("Expected nil for a missing snapshot")
+		}
+	})
+}
+
+func TestMachineNotes(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("admin-1", "admin@example.com", "Admin", true)
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		machine, _ := db.CreateMachine("user-1", "Laptop")
+
+		note, err := db.CreateMachineNote(machine.ID, "admin-1", "Replaced the **disk**")
+		if err != nil {
+			t.Fatalf("Failed to create note: %v", err)
+		}
+		if note.ID == 0 || note.Author != "Admin" || note.MachineID != machine.ID {
+			t.Errorf("Unexpected note: %+v", note)
+		}
+
+		if err := db.UpdateMachineNote(note.ID, "Replaced the disk again"); err != nil {
+			t.Fatalf("Failed to update note: %v", err)
+		}
+		notes, err := db.GetMachineNotes(machine.ID)
+		if err != nil {
+			t.Fatalf("Failed to get notes: %v", err)
+		}
+		if len(notes) != 1 || notes[0].Content != "Replaced the disk again" {
+			t.Errorf("Expected the updated note, got %+v", notes)
+		}
+
+		if err := db.DeleteMachineNote(note.ID); err != nil {
+			t.Fatalf("Failed to delete note: %v", err)
+		}
+		if n, err := db.GetMachineNote(note.ID); err != nil || n != nil {
+			t.Errorf("Expected the note to be deleted, got %+v, %v", n, err)
+		}
+	})
+}
+
+func TestShareLinks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("admin-1", "admin@example.com", "Admin", true)
+
+		valid, err := db.CreateShareLink(&ShareLink{CreatedBy: "admin-1", ExpiresAt: time.Now().UTC().Add(time.Hour)})
+		if err != nil {
+			t.Fatalf("Failed to create share link: %v", err)
+		}
+		if len(valid.ID) < 32 || valid.CreatedBy != "admin-1" {
+			t.Errorf("Unexpected share link: %+v", valid)
+		}
+		expired, _ := db.CreateShareLink(&ShareLink{CreatedBy: "admin-1", ExpiresAt: time.Now().UTC().Add(-24 * time.Hour)})
+
+		if s, _ := db.GetValidShareLink(valid.ID); s == nil {
+			t.Error("Expected the unexpired link to be valid")
+		}
+		if s, _ := db.GetValidShareLink(expired.ID); s != nil {
+			t.Error("Expected the expired link to be invalid")
+		}
+		if s, _ := db.GetShareLink(expired.ID); s == nil {
+			t.Error("Expected to find the expired link")
+		}
+		if links, _ := db.GetAllShareLinks(); len(links) != 2 {
+			t.Errorf("Expected 2 share links, got %d", len(links))
+		}
+
+		if n, err := db.DeleteExpiredShareLinks(); err != nil || n != 1 {
+			t.Errorf("Expected 1 expired link deleted, got %d, %v", n, err)
+		}
+
+		// Scope, display options and password round-trip
+		hash, _ := HashSharePassword("s3cret")
+		scoped, err := db.CreateShareLink(&ShareLink{
+			CreatedBy: "admin-1", ExpiresAt: time.Now().UTC().Add(time.Hour), Label: "Auditor",
+			FilterOwner: "alice", FilterMachine: "laptop", FilterOS: "darwin",
+			ShowNotes: true, PasswordHash: hash,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create scoped share link: %v", err)
+		}
+		if scoped.Label != "Auditor" || scoped.FilterOwner != "alice" || scoped.FilterMachine != "laptop" || scoped.FilterOS != "darwin" ||
+			!scoped.ShowNotes || scoped.ShowOwnerEmails {
+			t.Errorf("Unexpected scoped share link: %+v", scoped)
+		}
+		if !scoped.CheckPassword("s3cret") || scoped.CheckPassword("wrong") {
+			t.Error("Expected only the right password to unlock the link")
+		}
+
+		// Views and wrong passwords are logged; only views are summarized
+		db.RecordShareLinkView(scoped.ID, "192.0.2.1", "curl/8")
+		db.RecordShareLinkView(scoped.ID, "192.0.2.2", "Mozilla/5.0")
+		db.RecordFailedShareLinkUnlock(scoped.ID, "192.0.2.3", "curl/8")
+		db.RecordFailedShareLinkUnlock(valid.ID, "192.0.2.3", "curl/8")
+		views, err := db.GetShareLinkViews(scoped.ID, 10)
+		if err != nil || len(views) != 3 || !views[0].Failed || views[1].IPAddress != "192.0.2.2" || views[1].Failed {
+			t.Errorf("Expected a failed unlock and 2 views, newest first, got %+v, %v", views, err)
+		}
+		if forLink, fromIP, err := db.CountFailedShareLinkUnlocks(scoped.ID, "192.0.2.3", time.Now().Add(-time.Minute)); err != nil || forLink != 1 || fromIP != 2 {
+			t.Errorf("Expected 1 failure for the link and 2 from the address, got %d, %d, %v", forLink, fromIP, err)
+		}
+		if forLink, fromIP, _ := db.CountFailedShareLinkUnlocks(scoped.ID, "192.0.2.3", time.Now().Add(time.Minute)); forLink != 0 || fromIP != 0 {
+			t.Errorf("Expected no failures since later, got %d, %d", forLink, fromIP)
+		}
+		links, err := db.GetAllShareLinks()
+		if err != nil {
+			t.Fatalf("Failed to get share links: %v", err)
+		}
+		for _, l := range links {
+			if l.ID == scoped.ID && (l.ViewCount != 2 || l.LastViewedAt == nil) {
+				t.Errorf("Expected 2 views and a last view, got %d, %v", l.ViewCount, l.LastViewedAt)
+			}
+			if l.ID == valid.ID && (l.ViewCount != 0 || l.LastViewedAt != nil) {
+				t.Errorf("Expected no views, got %d, %v", l.ViewCount, l.LastViewedAt)
+			}
+		}
+
+		// Revoked links stop working but are kept
+		if err := db.RevokeShareLink(scoped.ID, "admin@example.com", "Audit finished"); err != nil {
+			t.Fatalf("Failed to revoke share link: %v", err)
+		}
+		if s, _ := db.GetValidShareLink(scoped.ID); s != nil {
+			t.Error("Expected the revoked link to be invalid")
+		}
+		revoked, _ := db.GetShareLink(scoped.ID)
+		if revoked == nil || !revoked.Revoked() || revoked.RevokedBy != "admin@example.com" || revoked.RevokeReason != "Audit finished" {
+			t.Errorf("Unexpected revoked link: %+v", revoked)
+		}
+
+		// Expiry can be changed
+		extended := time.Now().UTC().Add(48 * time.Hour).Truncate(time.Second)
+		db.SetShareLinkExpiry(valid.ID, extended)
+		if s, _ := db.GetShareLink(valid.ID); s == nil || !s.ExpiresAt.Equal(extended) {
+			t.Errorf("Expected expiry %v, got %+v", extended, s)
+		}
+
+		db.DeleteShareLink(valid.ID)
+		db.DeleteShareLink(scoped.ID)
+		if views, _ := db.GetShareLinkViews(scoped.ID, 10); len(views) != 0 {
+			t.Errorf("Expected views deleted with the link, got %d", len(views))
+		}
+		if links, _ := db.GetAllShareLinks(); len(links) != 0 {
+			t.Errorf("Expected no share links, got %d", len(links))
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", true)
+		db.UpsertUser("user-2", "other@example.com", "Other", false)
+		now := time.Now().UTC().Truncate(time.Second)
+
+		session, err := db.CreateSession("user-1", true, "refresh", "curl/8", "192.0.2.1", now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		if session.Token == "" || session.ID == session.Token {
+			t.Errorf("Expected a token distinct from the stored ID, got %+v", session)
+		}
+
+		got, err := db.GetSessionByToken(session.Token)
+		if err != nil || got == nil {
+			t.Fatalf("Failed to get session: %v", err)
+		}
+		if got.ID != session.ID || got.UserEmail != "user@example.com" || !got.IsAdmin || got.RefreshToken != "refresh" || got.IPAddress != "192.0.2.1" {
+			t.Errorf("Unexpected session: %+v", got)
+		}
+		if s, _ := db.GetSessionByToken(session.ID); s != nil {
+			t.Error("Expected the stored ID not to work as a token")
+		}
+
+		db.TouchSession(session.ID, now.Add(time.Minute))
+		if ok, err := db.UpdateSessionRole(session.ID, false, "refresh-2", got.RefreshedAt, now.Add(2*time.Minute)); !ok || err != nil {
+			t.Errorf("Expected the session role to be updated, got %v, %v", ok, err)
+		}
+		if ok, _ := db.UpdateSessionRole(session.ID, true, "refresh-3", got.RefreshedAt, now.Add(3*time.Minute)); ok {
+			t.Error("Expected a stale re-evaluation to be ignored")
+		}
+		got, _ = db.GetSession(session.ID)
+		if got.IsAdmin || got.RefreshToken != "refresh-2" || !got.LastSeenAt.Equal(now.Add(time.Minute)) || !got.RefreshedAt.Equal(now.Add(2*time.Minute)) {
+			t.Errorf("Expected the session to be touched and demoted, got %+v", got)
+		}
+
+		idle, _ := db.CreateSession("user-1", true, "", "", "", now.Add(time.Hour))
+		db.TouchSession(idle.ID, now.Add(-2*time.Hour))
+		expired, _ := db.CreateSession("user-2", false, "", "", "", now.Add(-time.Minute))
+		other, _ := db.CreateSession("user-2", false, "", "", "", now.Add(time.Hour))
+
+		active, err := db.GetSessions(now.Add(-time.Hour), now)
+		if err != nil {
+			t.Fatalf("Failed to get sessions: %v", err)
+		}
+		if len(active) != 2 || active[0].ID != session.ID || active[1].ID != other.ID {
+			t.Errorf("Expected the two active sessions, most recent first, got %+v", active)
+		}
+
+		if n, err := db.DeleteExpiredSessions(now.Add(-time.Hour), now); err != nil || n != 2 {
+			t.Errorf("Expected 2 expired sessions deleted, got %d, %v", n, err)
+		}
+		if s, _ := db.GetSessionByToken(idle.Token); s != nil {
+			t.Error("Expected the idle session to be deleted")
+		}
+		if s, _ := db.GetSessionByToken(expired.Token); s != nil {
+			t.Error("Expected the expired session to be deleted")
+		}
+
+		if n, err := db.DeleteUserSessions("user-2"); err != nil || n != 1 {
+			t.Errorf("Expected 1 session deleted, got %d, %v", n, err)
+		}
+		db.DeleteSession(session.ID)
+		if active, _ := db.GetSessions(now.Add(-time.Hour), now); len(active) != 0 {
+			t.Errorf("Expected no sessions, got %d", len(active))
+		}
+	})
+}
+
+func TestRetentionSnapshots(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", false)
+		held, _ := db.CreateMachine("user-1", "Held")
+		machine, _ := db.CreateMachine("user-1", "Laptop")
+		db.CreateSnapshot(held.ID, &InventorySnapshot{Hostname: "held", Checks: []SnapshotCheck{{CheckID: "uac_enabled", Status: "pass"}}})
+		var ids []int64
+		for i := 0; i < 3; i++ {
+			s := &InventorySnapshot{Hostname: "laptop", FirewallEnabled: i > 0}
+			if i != 1 {
+				s.Checks = []SnapshotCheck{{CheckID: "ssh_root_login_disabled", Status: "pass"}, {CheckID: "acme.vpn", Status: "fail"}}
+			}
+			db.CreateSnapshot(machine.ID, s)
+			ids = append(ids, s.ID)
+		}
+		db.SavePolicyResults(ids[0], []PolicyResult{{RuleID: 1, RuleName: "Firewall", Expression: "firewall_enabled == true", Passed: false}})
+
+		if err := db.SetMachineLegalHold(held.ID, true); err != nil {
+			t.Fatalf("Failed to set legal hold: %v", err)
+		}
+		if m, _ := db.GetMachine(held.ID); !m.LegalHold {
+			t.Error("Expected the machine to be on legal hold")
+		}
+
+		var seen []int64
+		err := db.EachRetentionSnapshot(func(s *InventorySnapshot) error {
+			if s.MachineID != machine.ID {
+				t.Errorf("Expected only snapshots of machines not on hold, got %s", s.MachineID)
+			}
+			if s.ID == ids[1] && !s.FirewallEnabled {
+				t.Error("Expected controls to be set")
+			}
+			if want := map[bool]int{true: 0, false: 2}[s.ID == ids[1]]; len(s.Checks) != want {
+				t.Errorf("Expected %d checks on snapshot %d, got %+v", want, s.ID, s.Checks)
+			}
+			seen = append(seen, s.ID)
+			return nil
+		})
+		if err != nil || !slices.Equal(seen, ids) {
+			t.Errorf("Expected snapshots %v oldest first, got %v, %v", ids, seen, err)
+		}
+
+		n, err := db.DeleteSnapshots(ids[:2])
+		if err != nil || n != 2 {
+			t.Fatalf("Expected 2 snapshots deleted, got %d, %v", n, err)
+		}
+		if history, _ := db.GetSnapshotHistory(machine.ID, 10); len(history) != 1 || history[0].ID != ids[2] {
+			t.Errorf("Expected only the latest snapshot left, got %+v", history)
+		}
+		if results, _ := db.GetPolicyResults(ids[0]); len(results) != 0 {
+			t.Errorf("Expected policy results to be deleted, got %+v", results)
+		}
+	})
+}
+
+// exportedTables exports the database and returns its tables as JSON
+func exportedTables(t *testing.T, db *DB) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	var export struct {
+		Format int             `json:"format"`
+		Tables json.RawMessage `json:"tables"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &export); err != nil {
+		t.Fatalf("Export is not valid JSON: %v", err)
+	}
+	if export.Format != ExportFormat {
+		t.Errorf("Expected format %d, got %d", ExportFormat, export.Format)
+	}
+	return string(export.Tables)
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if v, err := db.VerifyAuditLog(); err != nil || v.Events != 0 || v.Head != "" {
+			t.Errorf("Expected an empty log, got %+v, %v", v, err)
+		}
+
+		events := []*AuditEvent{
+			{ActorID: "admin-1", ActorEmail: "admin@example.com", Action: "machine.deleted", TargetType: "machine", TargetID: "m-1", IPAddress: "192.0.2.1", Before: `{"name":"Laptop"}`},
+			{Action: "share_link.viewed", TargetType: "share_link", TargetID: "abcd1234", IPAddress: "198.51.100.7"},
+			{ActorID: "user-1", ActorEmail: "user@example.com", Action: "user.signed_in", TargetType: "user", TargetID: "user-1"},
+		}
+		for _, e := range events {
+			if err := db.CreateAuditEvent(e); err != nil {
+				t.Fatalf("Failed to create audit event: %v", err)
+			}
+		}
+		if events[0].PrevHash != "" || events[1].PrevHash != events[0].Hash || events[2].PrevHash != events[1].Hash {
+			t.Error("Expected each entry to chain to the one before")
+		}
+
+		all, err := db.GetAuditEvents(AuditFilter{})
+		if err != nil || len(all) != 3 || all[0].ID != events[2].ID {
+			t.Fatalf("Expected 3 events, newest first, got %d, %v", len(all), err)
+		}
+		if all[2].Before != `{"name":"Laptop"}` || all[2].Hash != events[0].Hash {
+			t.Errorf("Unexpected event: %+v", all[2])
+		}
+
+		filters := []struct {
+			filter AuditFilter
+			want   int
+		}{
+			{AuditFilter{Query: "ADMIN@"}, 1},
+			{AuditFilter{Query: "198.51"}, 1},
+			{AuditFilter{Query: "m-1"}, 1},
+			{AuditFilter{Action: "user.signed_in"}, 1},
+			{AuditFilter{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)}, 3},
+			{AuditFilter{To: time.Now().Add(-time.Hour)}, 0},
+			{AuditFilter{Limit: 2}, 2},
+		}
+		for _, f := range filters {
+			if got, _ := db.GetAuditEvents(f.filter); len(got) != f.want {
+				t.Errorf("Filter %+v: expected %d events, got %d", f.filter, f.want, len(got))
+			}
+		}
+
+		if actions, _ := db.GetAuditActions(); len(actions) != 3 || actions[0] != "machine.deleted" {
+			t.Errorf("Unexpected actions: %v", actions)
+		}
+
+		v, err := db.VerifyAuditLog()
+		if err != nil || v.Events != 3 || v.BrokenAt != 0 || v.Head != events[2].Hash {
+			t.Errorf("Expected an intact chain, got %+v, %v", v, err)
+		}
+
+		if _, err := db.conn.Exec(`UPDATE audit_events SET actor_email = 'someone@example.com'`); err == nil {
+			t.Error("Expected updating the audit log to fail")
+		}
+		if _, err := db.conn.Exec(`DELETE FROM audit_events`); err == nil {
+			t.Error("Expected deleting from the audit log to fail")
+		}
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		db.UpsertUser("user-1", "user@example.com", "User", true)
+		db.MarkDigestSent("user-1", time.Now())
+		machine, _ := db.CreateMachine("user-1", "Laptop")
+		db.SetMachineLegalHold(machine.ID, true)
+		archived, _ := db.CreateMachine("user-1", "Old Laptop")
+		db.ArchiveMachine(archived.ID, "user@example.com", "Retired")
+		snapshot := &InventorySnapshot{Hostname: "laptop", OS: "darwin", DiskEncrypted: true, ScreenLockTimeout: 300, RawData: `{"a":1}`,
+			Checks: []SnapshotCheck{{CheckID: "gatekeeper_enabled", Status: "pass", Details: "assessments enabled"}}}
+		db.CreateSnapshot(machine.ID, snapshot)
+		db.CreateMachineNote(machine.ID, "user-1", "Issued to Alice")
+		asOf := time.Now().Add(-time.Hour)
+		link, _ := db.CreateShareLink(&ShareLink{CreatedBy: "user-1", ExpiresAt: time.Now().Add(time.Hour), AsOf: &asOf, Label: "Auditor", FilterOS: "darwin", ShowOwnerEmails: true})
+		db.RecordShareLinkView(link.ID, "192.0.2.1", "curl/8")
+		rule, _ := db.CreatePolicyRule(&PolicyRule{Name: "Disk", Field: "disk_encrypted", Operator: "==", Value: "true", Enabled: true})
+		db.SavePolicyResults(snapshot.ID, []PolicyResult{{RuleID: rule.ID, RuleName: "Disk", Expression: rule.Expression(), Passed: true, Actual: "true"}})
+		db.CreateBootstrapCode(machine.ID, time.Hour)
+		db.CreateWebhook("https://example.com/hook", []string{"snapshot.received"})
+		db.EnqueueWebhookEvent("event-1", "snapshot.received", []byte(`{}`))
+		db.SetAlertedControls(machine.ID, []string{"firewall"})
+		db.CreateAPIKey("Reports", "user-1", []string{"machines:read"}, nil)
+		db.CreateAuditEvent(&AuditEvent{ActorID: "user-1", ActorEmail: "user@example.com", Action: "machine.enrolled", TargetType: "machine", TargetID: machine.ID, After: `{"name":"Laptop"}`})
+
+		want := exportedTables(t, db)
+		var tables []struct {
+			Name string            `json:"name"`
+			Rows []json.RawMessage `json:"rows"`
+		}
+		json.Unmarshal([]byte(want), &tables)
+		if len(tables) != len(exportTables) {
+			t.Fatalf("Expected %d tables, got %d", len(exportTables), len(tables))
+		}
+		for _, table := range tables {
+			if len(table.Rows) == 0 {
+				t.Errorf("Expected %s to be exported with rows", table.Name)
+			}
+		}
+
+		var buf bytes.Buffer
+		db.Export(&buf)
+
+		target := setupTestDB(t)
+		if err := target.Import(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if got := exportedTables(t, target); got != want {
+			t.Errorf("Expected the import to round trip\nwant %s\ngot  %s", want, got)
+		}
+		if m, _ := target.GetMachine(machine.ID); m == nil || !m.LegalHold {
+			t.Errorf("Expected the machine to be imported, got %+v", m)
+		}
+		if m, _ := target.GetMachine(archived.ID); m == nil || !m.Archived() || m.ArchiveReason != "Retired" {
+			t.Errorf("Expected the archived machine to be imported, got %+v", m)
+		}
+		if v, _ := target.VerifyAuditLog(); v == nil || v.Events != 1 || v.BrokenAt != 0 {
+			t.Errorf("Expected the imported audit log to verify, got %+v", v)
+		}
+
+		// New rows get IDs after the imported ones
+		next := &InventorySnapshot{Hostname: "laptop"}
+		if err := target.CreateSnapshot(machine.ID, next); err != nil || next.ID <= snapshot.ID {
+			t.Errorf("Expected a snapshot ID after %d, got %d, %v", snapshot.ID, next.ID, err)
+		}
+
+		if err := target.Import(bytes.NewReader(buf.Bytes())); err == nil || !strings.Contains(err.Error(), "not empty") {
+			t.Errorf("Expected importing into a non-empty database to fail, got %v", err)
+		}
+		if err := setupTestDB(t).Import(strings.NewReader(`{"format":1,"tables":[{"name":"secrets","columns":[],"rows":[]}]}`)); err == nil {
+			t.Error("Expected an unknown table to be rejected")
+		}
+		if err := setupTestDB(t).Import(strings.NewReader(`{"tables":[]}`)); err == nil {
+			t.Error("Expected a file without a format to be rejected")
+		}
+	})
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// SnapshotField is a snapshot field compared by the change timeline, named
+// by its agent JSON key
+type SnapshotField struct {
+	Name string
+	Get  func(*InventorySnapshot) string
+}
+
+// SnapshotFields are the fields compared between snapshots, in display order
+var SnapshotFields = []SnapshotField{
+	{"hostname", func(s *InventorySnapshot) string { return s.Hostname }},
+	{"os", func(s *InventorySnapshot) string { return s.OS }},
+	{"os_version", func(s *InventorySnapshot) string { return s.OSVersion }},
+	{"disk_encrypted", func(s *InventorySnapshot) string { return s.DiskEncryptionStatus.Or(s.DiskEncrypted).Value() }},
+	{"disk_encryption_details", func(s *InventorySnapshot) string { return s.DiskEncryptionDetails }},
+	{"antivirus_enabled", func(s *InventorySnapshot) string { return s.AntivirusStatus.Or(s.AntivirusEnabled).Value() }},
+	{"antivirus_details", func(s *InventorySnapshot) string { return s.AntivirusDetails }},
+	{"firewall_enabled", func(s *InventorySnapshot) string { return s.FirewallStatus.Or(s.FirewallEnabled).Value() }},
+	{"firewall_details", func(s *InventorySnapshot) string { return s.FirewallDetails }},
+	{"screen_lock_enabled", func(s *InventorySnapshot) string { return s.ScreenLockStatus.Or(s.ScreenLockEnabled).Value() }},
+	{"screen_lock_timeout", func(s *InventorySnapshot) string { return strconv.Itoa(s.ScreenLockTimeout) }},
+	{"screen_lock_details", func(s *InventorySnapshot) string { return s.ScreenLockDetails }},
+	{"os_build", func(s *InventorySnapshot) string { return s.OSBuild }},
+	{"auto_update_enabled", func(s *InventorySnapshot) string { return strconv.FormatBool(s.AutoUpdateEnabled) }},
+	{"auto_update_details", func(s *InventorySnapshot) string { return s.AutoUpdateDetails }},
+}
+
+// FieldChange is a field whose value differs between two snapshots
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// DiffSnapshots returns the SnapshotFields that differ from a to b, then the
+// named checks whose status differs, as check.<id>
+func DiffSnapshots(a, b *InventorySnapshot) []FieldChange {
+	var changes []FieldChange
+	for _, f := range SnapshotFields {
+		if from, to := f.Get(a), f.Get(b); from != to {
+			changes = append(changes, FieldChange{Field: f.Name, From: from, To: to})
+		}
+	}
+	for _, id := range SnapshotCheckIDs(a, b) {
+		if from, to := a.checkStatus(id), b.checkStatus(id); from != to {
+			changes = append(changes, FieldChange{Field: "check." + id, From: from, To: to})
+		}
+	}
+	return changes
+}
+
+// DiffRawData compares two raw agent payloads key by key. Nested objects are
+// flattened to dotted keys and values are shown as JSON, so a key missing on
+// one side has an empty value there. Payloads that aren't JSON objects are
+// compared whole.
+func DiffRawData(a, b string) []FieldChange {
+	from, okA := flattenJSON(a)
+	to, okB := flattenJSON(b)
+	if !okA || !okB {
+		if a == b {
+			return nil
+		}
+		return []FieldChange{{Field: "raw_data", From: a, To: b}}
+	}
+
+	keys := make([]string, 0, len(from)+len(to))
+	for k := range from {
+		keys = append(keys, k)
+	}
+	for k := range to {
+		if _, ok := from[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	var changes []FieldChange
+	for _, k := range keys {
+		if from[k] != to[k] {
+			changes = append(changes, FieldChange{Field: k, From: from[k], To: to[k]})
+		}
+	}
+	return changes
+}
+
+// flattenJSON maps each leaf of a JSON object to its JSON encoding. Arrays
+// are leaves. An empty payload is an empty object.
+func flattenJSON(raw string) (map[string]string, bool) {
+	flat := make(map[string]string)
+	if raw == "" {
+		return flat, true
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+		return nil, false
+	}
+
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+			for k, child := range m {
+				walk(prefix+k+".", child)
+			}
+			return
+		}
+		b, _ := json.Marshal(v)
+		flat[prefix[:len(prefix)-1]] = string(b)
+	}
+	for k, v := range obj {
+		walk(k+".", v)
+	}
+	return flat, true
+}
+
+// SnapshotTransition is a run of consecutive snapshots with identical
+// SnapshotFields and named check statuses, and how the run differs from the one before it
+type SnapshotTransition struct {
+	Snapshot   InventorySnapshot // First snapshot of the run, without RawData
+	Changes    []FieldChange     // Versus the previous run; nil for the first
+	PreviousID int64             // Last snapshot of the previous run; 0 for the first
+	LastID     int64             // Last snapshot of the run
+	LastSeen   time.Time         // When the last snapshot of the run was collected
+	Count      int               // Number of snapshots in the run
+}
+
+// First reports whether this is the machine's first run of snapshots
+func (t *SnapshotTransition) First() bool {
+	return t.PreviousID == 0
+}
+
+// snapshotSummaryColumns is snapshotColumns with an empty raw_data, which the
+// timeline doesn't need
+const snapshotSummaryColumns = `id, machine_id, collected_at, hostname, os, os_version,
+		       disk_encrypted, disk_encryption_details, antivirus_enabled, antivirus_details,
+		       firewall_enabled, firewall_details, screen_lock_enabled, screen_lock_timeout, screen_lock_details,
+		       '', signed, os_build, days_since_update, pending_security_updates,
+		       auto_update_enabled, auto_update_details, last_boot_at,
+		       disk_encryption_status, antivirus_status, firewall_status, screen_lock_status, ` + policyCountColumns
+
+// GetSnapshotTransitions returns up to limit of a machine's most recent
+// transitions, newest first. Snapshots and their checks are streamed oldest
+// first and only the previous one is kept for comparison, so long histories
+// aren't loaded into memory.
+func (db *DB) GetSnapshotTransitions(machineID string, limit int) ([]SnapshotTransition, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT `+snapshotSummaryColumns+`
+		FROM inventory_snapshots s
+		WHERE machine_id = ?
+		ORDER BY collected_at, id
+	`, machineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks, err := db.checkCursor(`
+		SELECT c.snapshot_id, c.check_id, c.status, c.value, c.details
+		FROM inventory_snapshots s
+		JOIN snapshot_checks c ON c.snapshot_id = s.id
+		WHERE s.machine_id = ?
+		ORDER BY s.collected_at, s.id, c.check_id
+	`, machineID)
+	if err != nil {
+		return nil, err
+	}
+	defer checks.Close()
+
+	var transitions []SnapshotTransition
+	var prev InventorySnapshot
+	for rows.Next() {
+		var s InventorySnapshot
+		if err := scanSnapshot(rows, &s); err != nil {
+			return nil, err
+		}
+		if err := checks.fill(&s); err != nil {
+			return nil, err
+		}
+
+		if n := len(transitions); n > 0 {
+			changes := DiffSnapshots(&prev, &s)
+			if len(changes) == 0 {
+				last := &transitions[n-1]
+				last.LastID = s.ID
+				last.LastSeen = s.CollectedAt
+				last.Count++
+				prev = s
+				continue
+			}
+			transitions = append(transitions, SnapshotTransition{Snapshot: s, Changes: changes, PreviousID: prev.ID})
+		} else {
+			transitions = append(transitions, SnapshotTransition{Snapshot: s})
+		}
+
+		t := &transitions[len(transitions)-1]
+		t.LastID = s.ID
+		t.LastSeen = s.CollectedAt
+		t.Count = 1
+
+		// Only the newest runs are returned
+		if len(transitions) > limit {
+			transitions = slices.Delete(transitions, 0, 1)
+		}
+		prev = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(transitions)
+	return transitions, nil
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Webhook operations
+//
+// Events are queued in webhook_deliveries, one row per subscribed webhook, so
+// they survive a restart. The webhook package drains the queue.
+
+// CreateWebhook registers a URL with a freshly generated signing secret
+func (db *DB) CreateWebhook(url string, events []string) (*Webhook, error) {
+	secret, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var id int64
+	err = db.conn.QueryRow(`
+		INSERT INTO webhooks (url, secret, events) VALUES (?, ?, ?)
+		RETURNING id
+	`, url, secret, strings.Join(events, ",")).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.GetWebhook(id)
+}
+
+func (db *DB) GetWebhook(id int64) (*Webhook, error) {
+	var w Webhook
+	err := db.conn.QueryRow(`
+		SELECT id, url, secret, events, enabled, created_at FROM webhooks WHERE id = ?
+	`, id).Scan(&w.ID, &w.URL, &w.Secret, &w.Events, &w.Enabled, &w.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (db *DB) GetWebhooks() ([]Webhook, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, url, secret, events, enabled, created_at FROM webhooks ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.URL, &w.Secret, &w.Events, &w.Enabled, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+func (db *DB) SetWebhookEnabled(id int64, enabled bool) error {
+	_, err := db.conn.Exec(`UPDATE webhooks SET enabled = ? WHERE id = ?`, enabled, id)
+	return err
+}
+
+// DeleteWebhook removes a webhook and its delivery history
+func (db *DB) DeleteWebhook(id int64) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM webhooks WHERE id = ?`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// EnqueueWebhookEvent queues a payload for every enabled webhook subscribed to the event
+func (db *DB) EnqueueWebhookEvent(eventID, event string, payload []byte) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, events FROM webhooks WHERE enabled = TRUE`)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.Events); err != nil {
+			rows.Close()
+			return err
+		}
+		if w.Events == "" || slices.Contains(w.EventList(), event) {
+			ids = append(ids, w.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, id := range ids {
+		if _, err := tx.Exec(`
+			INSERT INTO webhook_deliveries (webhook_id, event_id, event, payload, next_attempt_at) VALUES (?, ?, ?, ?, ?)
+		`, id, eventID, event, string(payload), now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const webhookDeliveryColumns = `d.id, d.webhook_id, w.url, w.secret, d.event_id, d.event, d.payload, d.status,
+		d.attempts, d.next_attempt_at, d.last_attempt_at, d.last_status_code, d.last_error, d.created_at`
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var lastAttemptAt sql.NullTime
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.WebhookURL, &d.Secret, &d.EventID, &d.Event, &d.Payload, &d.Status,
+			&d.Attempts, &d.NextAttemptAt, &lastAttemptAt, &d.LastStatusCode, &d.LastError, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		if lastAttemptAt.Valid {
+			d.LastAttemptAt = &lastAttemptAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// DueWebhookDeliveries returns pending deliveries whose next attempt is due by
+// now, oldest first. Deliveries for disabled webhooks wait until they are re-enabled.
+func (db *DB) DueWebhookDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	rows, err := db.conn.Query(`
+		SELECT `+webhookDeliveryColumns+`
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ? AND w.enabled = TRUE
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT ?
+	`, DeliveryPending, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+// RecentWebhookDeliveries returns the latest deliveries across all webhooks, newest first
+func (db *DB) RecentWebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	rows, err := db.conn.Query(`
+		SELECT `+webhookDeliveryColumns+`
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		ORDER BY d.id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+// RecordWebhookAttempt stores the outcome of a delivery attempt. status is the
+// delivery's new state and nextAttemptAt when a pending delivery is retried.
+func (db *DB) RecordWebhookAttempt(id int64, status string, statusCode int, errMsg string, nextAttemptAt time.Time) error {
+	_, err := db.conn.Exec(`
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = attempts + 1, last_attempt_at = ?, last_status_code = ?, last_error = ?, next_attempt_at = ?
+		WHERE id = ?
+	`, status, time.Now().UTC(), statusCode, errMsg, nextAttemptAt.UTC(), id)
+	return err
+}
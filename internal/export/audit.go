@@ -0,0 +1,49 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+// AuditColumns are the audit log CSV header
+var AuditColumns = []string{
+	"ID", "Time", "Actor ID", "Actor Email", "Action", "Target Type", "Target ID",
+	"IP Address", "User Agent", "Before", "After", "Previous Hash", "Hash",
+}
+
+// AuditFilename returns the download name for an audit log export made at t
+func AuditFilename(t time.Time) string {
+	return "boxcheckr-audit-" + t.UTC().Format("2006-01-02") + ".csv"
+}
+
+// AuditCSVWriter writes audit events as CSV, starting with a header row
+type AuditCSVWriter struct {
+	w *csv.Writer
+}
+
+func NewAuditCSV(w io.Writer) *AuditCSVWriter {
+	c := &AuditCSVWriter{w: csv.NewWriter(w)}
+	c.w.Write(AuditColumns)
+	return c
+}
+
+func (c *AuditCSVWriter) WriteEvent(e *db.AuditEvent) error {
+	record := []string{
+		strconv.FormatInt(e.ID, 10), e.CreatedAt.UTC().Format(time.RFC3339Nano), e.ActorID, e.ActorEmail,
+		e.Action, e.TargetType, e.TargetID, e.IPAddress, e.UserAgent, e.Before, e.After, e.PrevHash, e.Hash,
+	}
+	for i := range record {
+		record[i] = escapeFormula(record[i])
+	}
+	return c.w.Write(record)
+}
+
+// Close flushes the output
+func (c *AuditCSVWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
@@ -0,0 +1,208 @@
+// Package export writes the machine inventory as a spreadsheet, one row per
+// machine. Rows are written as they are produced so large inventories are
+// never held in memory.
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+// Formats
+const (
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+// timeFormat is used for every timestamp, which are all in UTC
+const timeFormat = "2006-01-02 15:04:05"
+
+// Columns is the header row
+var Columns = []string{
+	"Owner",
+	"Owner Email",
+	"Machine",
+	"Hostname",
+	"OS",
+	"OS Version",
+	"Disk Encrypted",
+	"Disk Encryption Details",
+	"Antivirus",
+	"Antivirus Details",
+	"Firewall",
+	"Firewall Details",
+	"Screen Lock",
+	"Screen Lock Timeout (min)",
+	"Screen Lock Details",
+	"OS Build",
+	"Days Since Update",
+	"Pending Security Updates",
+	"Auto Updates",
+	"Auto Update Details",
+	"Last Boot (UTC)",
+	"Policy",
+	"Signed",
+	"Check-in",
+	"Last Check-in (UTC)",
+	"Enrolled (UTC)",
+	"Notes",
+}
+
+// Writer writes one machine per row. Close must be called to finish the file.
+type Writer interface {
+	WriteMachine(m *db.MachineWithOwner) error
+	Close() error
+}
+
+// row returns the cells for a machine, matching Columns. Counts are ints so
+// spreadsheets treat them as numbers; everything else is a string.
+func row(m *db.MachineWithOwner) []interface{} {
+	cells := []interface{}{m.OwnerName, m.OwnerEmail, m.Name}
+
+	s := m.Latest
+	if s == nil {
+		// Never reported: leave the snapshot columns blank
+		cells = append(cells, "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "", "")
+	} else {
+		cells = append(cells,
+			s.Hostname,
+			s.OS,
+			s.OSVersion,
+			control(s.DiskEncryptionStatus.Or(s.DiskEncrypted)), s.DiskEncryptionDetails,
+			control(s.AntivirusStatus.Or(s.AntivirusEnabled)), s.AntivirusDetails,
+			control(s.FirewallStatus.Or(s.FirewallEnabled)), s.FirewallDetails,
+			control(s.ScreenLockStatus.Or(s.ScreenLockEnabled)), s.ScreenLockTimeout, s.ScreenLockDetails,
+			s.OSBuild, optionalCount(s.DaysSinceUpdate), optionalCount(s.PendingSecurityUpdates),
+			yesNo(s.AutoUpdateEnabled), s.AutoUpdateDetails, lastBoot(s),
+			policy(s),
+			yesNo(s.Signed),
+		)
+	}
+
+	lastReport := ""
+	if t := m.LastReport(); t != nil {
+		lastReport = t.UTC().Format(timeFormat)
+	}
+
+	return append(cells,
+		checkIn(m.CheckIn),
+		lastReport,
+		m.CreatedAt.UTC().Format(timeFormat),
+		m.NoteCount,
+	)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "Yes"
+	}
+	return "No"
+}
+
+// control is Yes or No for a control that was checked, otherwise its status
+func control(status db.ControlStatus) string {
+	switch status {
+	case db.StatusPass:
+		return "Yes"
+	case db.StatusFail:
+		return "No"
+	}
+	return status.Label()
+}
+
+// optionalCount leaves a count the machine didn't report blank
+func optionalCount(n *int) interface{} {
+	if n == nil {
+		return ""
+	}
+	return *n
+}
+
+func lastBoot(s *db.InventorySnapshot) string {
+	if s.LastBootAt == nil {
+		return ""
+	}
+	return s.LastBootAt.UTC().Format(timeFormat)
+}
+
+func policy(s *db.InventorySnapshot) string {
+	switch {
+	case !s.PolicyEvaluated():
+		return "Not evaluated"
+	case s.Compliant():
+		return "Compliant"
+	default:
+		return fmt.Sprintf("Non-compliant (%d failed)", s.PolicyFailed)
+	}
+}
+
+func checkIn(state string) string {
+	switch state {
+	case db.CheckInHealthy:
+		return "Healthy"
+	case db.CheckInOverdue:
+		return "Overdue"
+	case db.CheckInNeverReported:
+		return "Never reported"
+	}
+	return state
+}
+
+// Filename returns the download name for an export made at t
+func Filename(format string, t time.Time) string {
+	return "boxcheckr-machines-" + t.UTC().Format("2006-01-02") + "." + format
+}
+
+// CSVWriter writes a CSV file with a header row
+type CSVWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func NewCSV(w io.Writer) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w)}
+}
+
+func (c *CSVWriter) WriteMachine(m *db.MachineWithOwner) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(Columns); err != nil {
+			return err
+		}
+	}
+
+	cells := row(m)
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		if s, ok := cell.(string); ok {
+			record[i] = escapeFormula(s)
+		} else {
+			record[i] = fmt.Sprint(cell)
+		}
+	}
+	return c.w.Write(record)
+}
+
+// Close writes the header if no machines were written and flushes the output
+func (c *CSVWriter) Close() error {
+	if !c.header {
+		c.header = true
+		c.w.Write(Columns)
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// escapeFormula stops spreadsheet applications from evaluating user-chosen
+// text, such as machine names, as a formula
+func escapeFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,209 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+func testMachines() []db.MachineWithOwner {
+	daysSinceUpdate := 12
+	return []db.MachineWithOwner{
+		{
+			Machine:    db.Machine{Name: "=HYPERLINK(\"http://evil\")", CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+			OwnerName:  "Alice",
+			OwnerEmail: "alice@example.com",
+			NoteCount:  2,
+			CheckIn:    db.CheckInHealthy,
+			Latest: &db.InventorySnapshot{
+				CollectedAt:           time.Date(2026, 2, 3, 4, 5, 6, 0, time.UTC),
+				Hostname:              "alice-mbp",
+				OS:                    "darwin",
+				DiskEncrypted:         true,
+				DiskEncryptionDetails: "FileVault enabled",
+				AntivirusStatus:       db.StatusUnknown,
+				ScreenLockEnabled:     true,
+				ScreenLockTimeout:     5,
+				PolicyPassed:          2,
+				PolicyFailed:          1,
+				Signed:                true,
+				OSBuild:               "23E224",
+				DaysSinceUpdate:       &daysSinceUpdate,
+				AutoUpdateEnabled:     true,
+			},
+		},
+		{
+			Machine:    db.Machine{Name: "Bob <PC> & co", CreatedAt: time.Now()},
+			OwnerName:  "Bob",
+			OwnerEmail: "bob@example.com",
+			CheckIn:    db.CheckInNeverReported,
+		},
+	}
+}
+
+func TestCSV(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCSV(&buf)
+	for _, m := range testMachines() {
+		if err := w.WriteMachine(&m); err != nil {
+			t.Fatalf("Failed to write machine: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %v", err)
+	}
+	if len(records) != 3 || len(records[0]) != len(Columns) || len(records[1]) != len(Columns) {
+		t.Fatalf("Expected a header and 2 rows of %d columns, got %v", len(Columns), records)
+	}
+
+	alice := records[1]
+	if !strings.HasPrefix(alice[2], "'=") {
+		t.Errorf("Expected formula-like machine name to be escaped, got %q", alice[2])
+	}
+	for col, want := range map[string]string{
+		"Disk Encrypted":            "Yes",
+		"Disk Encryption Details":   "FileVault enabled",
+		"Antivirus":                 "Unknown",
+		"Firewall":                  "No",
+		"Screen Lock Timeout (min)": "5",
+		"Policy":                    "Non-compliant (1 failed)",
+		"Signed":                    "Yes",
+		"OS Build":                  "23E224",
+		"Days Since Update":         "12",
+		"Pending Security Updates":  "",
+		"Auto Updates":              "Yes",
+		"Last Boot (UTC)":           "",
+		"Check-in":                  "Healthy",
+		"Last Check-in (UTC)":       "2026-02-03 04:05:06",
+		"Notes":                     "2",
+	} {
+		i := slices.Index(Columns, col)
+		if alice[i] != want {
+			t.Errorf("%s: expected %q, got %q", col, want, alice[i])
+		}
+	}
+
+	bob := records[2]
+	if bob[slices.Index(Columns, "Disk Encrypted")] != "" || bob[slices.Index(Columns, "Check-in")] != "Never reported" {
+		t.Errorf("Unexpected row for machine without snapshots: %v", bob)
+	}
+}
+
+func TestCSVEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCSV(&buf)
+	w.Close()
+	if !strings.HasPrefix(buf.String(), "Owner,Owner Email,Machine,") {
+		t.Errorf("Expected just the header, got %q", buf.String())
+	}
+}
+
+func TestAuditCSV(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewAuditCSV(&buf)
+	w.WriteEvent(&db.AuditEvent{
+		ID:         7,
+		CreatedAt:  time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC),
+		ActorEmail: "admin@example.com",
+		Action:     "machine.deleted",
+		UserAgent:  "=cmd|' /C calc'!A0",
+		Before:     `{"name":"Laptop"}`,
+		Hash:       "abc",
+	})
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %v", err)
+	}
+	if len(records) != 2 || !slices.Equal(records[0], AuditColumns) {
+		t.Fatalf("Expected a header and 1 row, got %v", records)
+	}
+	row := records[1]
+	if row[0] != "7" || row[1] != "2026-03-04T05:06:07Z" || row[4] != "machine.deleted" || row[9] != `{"name":"Laptop"}` || row[12] != "abc" {
+		t.Errorf("Unexpected row %v", row)
+	}
+	if !strings.HasPrefix(row[8], "'=") {
+		t.Errorf("Expected formula-like user agent to be escaped, got %q", row[8])
+	}
+}
+
+func TestXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewXLSX(&buf, time.Now(), []string{`Owner contains "a"`})
+	for _, m := range testMachines() {
+		if err := w.WriteMachine(&m); err != nil {
+			t.Fatalf("Failed to write machine: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+
+	parts := make(map[string]string)
+	for _, f := range zr.File {
+		rc, _ := f.Open()
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		parts[f.Name] = string(b)
+
+		// Every part must be well-formed XML
+		d := xml.NewDecoder(bytes.NewReader(b))
+		for {
+			if _, err := d.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s is not well-formed: %v", f.Name, err)
+			}
+		}
+	}
+
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml", "xl/worksheets/sheet2.xml"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("Missing part %s", name)
+		}
+	}
+
+	machines := parts["xl/worksheets/sheet1.xml"]
+	if !strings.Contains(machines, "Bob &lt;PC&gt; &amp; co") || !strings.Contains(machines, `<row r="3">`) {
+		t.Errorf("Expected escaped machine rows, got %s", machines)
+	}
+	if !strings.Contains(machines, `<c r="AA2"><v>2</v></c>`) {
+		t.Error("Expected the note count as a number in column AA")
+	}
+
+	summary := parts["xl/worksheets/sheet2.xml"]
+	for _, want := range []string{"Owner contains &#34;a&#34;", "Never reported"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("Expected summary to contain %q", want)
+		}
+	}
+}
+
+func TestColumnName(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 19: "T", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"} {
+		if got := columnName(i); got != want {
+			t.Errorf("columnName(%d) = %q, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+// XLSXWriter writes an Excel workbook with a Machines sheet, streamed row by
+// row, and a Summary sheet of totals written when it is closed.
+//
+// The workbook is written directly as SpreadsheetML: inline strings, no
+// shared string table, and a single bold style for headings.
+type XLSXWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+	err   error
+
+	generatedAt time.Time
+	filters     []string
+	summary     summary
+}
+
+// summary counts machines for the Summary sheet
+type summary struct {
+	machines, reporting                   int
+	disk, antivirus, firewall, screenLock int
+	diskUnknown, antivirusUnknown         int
+	firewallUnknown, screenLockUnknown    int
+	compliant, nonCompliant               int
+	healthy, overdue, neverReported       int
+}
+
+func (s *summary) add(m *db.MachineWithOwner) {
+	s.machines++
+	switch m.CheckIn {
+	case db.CheckInHealthy:
+		s.healthy++
+	case db.CheckInOverdue:
+		s.overdue++
+	case db.CheckInNeverReported:
+		s.neverReported++
+	}
+
+	l := m.Latest
+	if l == nil {
+		return
+	}
+	s.reporting++
+	s.disk += count(l.DiskEncrypted)
+	s.antivirus += count(l.AntivirusEnabled)
+	s.firewall += count(l.FirewallEnabled)
+	s.screenLock += count(l.ScreenLockEnabled)
+	s.diskUnknown += count(l.DiskEncryptionStatus.Unknown())
+	s.antivirusUnknown += count(l.AntivirusStatus.Unknown())
+	s.firewallUnknown += count(l.FirewallStatus.Unknown())
+	s.screenLockUnknown += count(l.ScreenLockStatus.Unknown())
+	if l.PolicyEvaluated() {
+		if l.Compliant() {
+			s.compliant++
+		} else {
+			s.nonCompliant++
+		}
+	}
+}
+
+func count(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// NewXLSX starts a workbook. filters describes how the machines were
+// selected and is listed on the Summary sheet.
+func NewXLSX(w io.Writer, generatedAt time.Time, filters []string) *XLSXWriter {
+	x := &XLSXWriter{
+		zw:          zip.NewWriter(w),
+		generatedAt: generatedAt,
+		filters:     filters,
+	}
+
+	f, err := x.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		x.err = err
+		return x
+	}
+	x.sheet = bufio.NewWriter(f)
+	x.sheet.WriteString(xml.Header)
+	x.sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	x.sheet.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	x.sheet.WriteString(`<sheetData>`)
+	x.writeRow(x.sheet, stringCells(Columns), true)
+	return x
+}
+
+func (x *XLSXWriter) WriteMachine(m *db.MachineWithOwner) error {
+	if x.err != nil {
+		return x.err
+	}
+	x.summary.add(m)
+	x.writeRow(x.sheet, row(m), false)
+
+	// Keep the buffer bounded; the zip writer streams to the response
+	if x.sheet.Buffered() > 32<<10 {
+		x.err = x.sheet.Flush()
+	}
+	return x.err
+}
+
+// writeRow appends a row to a sheet, numbering rows per writer
+func (x *XLSXWriter) writeRow(w *bufio.Writer, cells []interface{}, bold bool) {
+	x.rows++
+	fmt.Fprintf(w, `<row r="%d">`, x.rows)
+	for i, cell := range cells {
+		ref := columnName(i) + strconv.Itoa(x.rows)
+		style := ""
+		if bold {
+			style = ` s="1"`
+		}
+		switch v := cell.(type) {
+		case int:
+			fmt.Fprintf(w, `<c r="%s"%s><v>%d</v></c>`, ref, style, v)
+		default:
+			fmt.Fprintf(w, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">`, ref, style)
+			xml.EscapeText(w, []byte(fmt.Sprint(v)))
+			w.WriteString(`</t></is></c>`)
+		}
+	}
+	w.WriteString(`</row>`)
+}
+
+// Close finishes the Machines sheet and writes the Summary sheet and the
+// rest of the workbook
+func (x *XLSXWriter) Close() error {
+	if x.err != nil {
+		return x.err
+	}
+
+	x.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+
+	if err := x.writeSummary(); err != nil {
+		return err
+	}
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", contentTypesXML},
+		{"_rels/.rels", rootRelsXML},
+		{"xl/workbook.xml", workbookXML},
+		{"xl/_rels/workbook.xml.rels", workbookRelsXML},
+		{"xl/styles.xml", stylesXML},
+	}
+	for _, p := range parts {
+		f, err := x.zw.Create(p.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, xml.Header+p.content); err != nil {
+			return err
+		}
+	}
+
+	return x.zw.Close()
+}
+
+func (x *XLSXWriter) writeSummary() error {
+	f, err := x.zw.Create("xl/worksheets/sheet2.xml")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	s := x.summary
+	filters := "None"
+	if len(x.filters) > 0 {
+		filters = strings.Join(x.filters, "; ")
+	}
+
+	w.WriteString(xml.Header)
+	w.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	w.WriteString(`<cols><col min="1" max="1" width="28" customWidth="1"/><col min="2" max="2" width="24" customWidth="1"/><col min="3" max="3" width="12" customWidth="1"/></cols>`)
+	w.WriteString(`<sheetData>`)
+
+	x.rows = 0
+	x.writeRow(w, []interface{}{"BoxCheckr Machine Inventory"}, true)
+	x.writeRow(w, []interface{}{"Generated (UTC)", x.generatedAt.UTC().Format(timeFormat)}, false)
+	x.writeRow(w, []interface{}{"Filters", filters}, false)
+	x.writeRow(w, nil, false)
+	x.writeRow(w, []interface{}{"Machines", s.machines}, true)
+	x.writeRow(w, []interface{}{"Reporting", s.reporting}, false)
+	x.writeRow(w, nil, false)
+	x.writeRow(w, []interface{}{"Control", "Passing (of reporting)", "Unknown"}, true)
+	x.writeRow(w, []interface{}{"Disk encryption", s.disk, s.diskUnknown}, false)
+	x.writeRow(w, []interface{}{"Antivirus", s.antivirus, s.antivirusUnknown}, false)
+	x.writeRow(w, []interface{}{"Firewall", s.firewall, s.firewallUnknown}, false)
+	x.writeRow(w, []interface{}{"Screen lock", s.screenLock, s.screenLockUnknown}, false)
+	x.writeRow(w, nil, false)
+	x.writeRow(w, []interface{}{"Policy", "Machines"}, true)
+	x.writeRow(w, []interface{}{"Compliant", s.compliant}, false)
+	x.writeRow(w, []interface{}{"Non-compliant", s.nonCompliant}, false)
+	x.writeRow(w, []interface{}{"Not evaluated", s.machines - s.compliant - s.nonCompliant}, false)
+	x.writeRow(w, nil, false)
+	x.writeRow(w, []interface{}{"Check-in", "Machines"}, true)
+	x.writeRow(w, []interface{}{"Healthy", s.healthy}, false)
+	x.writeRow(w, []interface{}{"Overdue", s.overdue}, false)
+	x.writeRow(w, []interface{}{"Never reported", s.neverReported}, false)
+
+	w.WriteString(`</sheetData></worksheet>`)
+	return w.Flush()
+}
+
+// columnName converts a zero-based column index to its letters: A, B, ... Z, AA
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func stringCells(values []string) []interface{} {
+	cells := make([]interface{}, len(values))
+	for i, v := range values {
+		cells[i] = v
+	}
+	return cells
+}
+
+const contentTypesXML = `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+	`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+	`<Override PartName="/xl/worksheets/sheet2.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+	`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+	`</Types>`
+
+const rootRelsXML = `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+const workbookXML = `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+	`<sheets>` +
+	`<sheet name="Machines" sheetId="1" r:id="rId1"/>` +
+	`<sheet name="Summary" sheetId="2" r:id="rId2"/>` +
+	`</sheets>` +
+	`</workbook>`
+
+const workbookRelsXML = `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+	`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet2.xml"/>` +
+	`<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+	`</Relationships>`
+
+// stylesXML defines style 0 (default) and style 1 (bold)
+const stylesXML = `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+	`</styleSheet>`
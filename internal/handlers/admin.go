@@ -1,18 +1,34 @@
 package handlers
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/export"
 )
 
 func (h *Handlers) AdminMachines(w http.ResponseWriter, r *http.Request) {
 	filterOwner := r.URL.Query().Get("owner")
 	filterMachine := r.URL.Query().Get("machine")
+	filterCheckIn := r.URL.Query().Get("checkin")
+	filterAsOf := r.URL.Query().Get("asof")
+
+	asOf, err := parseAsOf(filterAsOf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	machines, err := h.db.GetAllMachinesWithOwners(filterOwner, filterMachine)
+	machines, err := h.db.GetAllMachinesWithOwners(filterOwner, filterMachine, asOf)
 	if err != nil {
 		http.Error(w, "Failed to load machines", http.StatusInternalServerError)
 		return
 	}
+	machines = h.withCheckIns(machines, filterCheckIn, asOf)
 
 	data := &PageData{
 		Title:         "All Machines",
@@ -20,6 +36,9 @@ func (h *Handlers) AdminMachines(w http.ResponseWriter, r *http.Request) {
 		Machines:      machines,
 		FilterOwner:   filterOwner,
 		FilterMachine: filterMachine,
+		FilterCheckIn: filterCheckIn,
+		FilterAsOf:    filterAsOf,
+		AsOf:          asOf,
 	}
 
 	// HTMX request: return just the table partial
@@ -31,32 +50,127 @@ func (h *Handlers) AdminMachines(w http.ResponseWriter, r *http.Request) {
 	h.render(w, r, "machines.html", data)
 }
 
-func (h *Handlers) AdminDeleteMachine(w http.ResponseWriter, r *http.Request) {
-	machineID := r.PathValue("id")
-	if machineID == "" {
-		http.Error(w, "Machine ID required", http.StatusBadRequest)
+// parseAsOf parses a point in time to report on: a date, meaning the end of
+// that day in UTC, or an RFC 3339 timestamp. An empty value returns the zero
+// time, meaning now.
+func parseAsOf(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.New("asof must be a date (YYYY-MM-DD) or an RFC 3339 timestamp")
+}
+
+// AdminExportMachines downloads the machine inventory as CSV or XLSX, using the
+// same filters as AdminMachines (admin only). Rows are streamed as they are
+// read from the database.
+func (h *Handlers) AdminExportMachines(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filterOwner := query.Get("owner")
+	filterMachine := query.Get("machine")
+	filterCheckIn := query.Get("checkin")
+
+	asOf, err := parseAsOf(query.Get("asof"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Verify machine exists
+	now := time.Now()
+	var out export.Writer
+	switch format := query.Get("format"); format {
+	case export.FormatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		out = export.NewCSV(w)
+	case export.FormatXLSX:
+		var filters []string
+		if filterOwner != "" {
+			filters = append(filters, "Owner contains "+strconv.Quote(filterOwner))
+		}
+		if filterMachine != "" {
+			filters = append(filters, "Machine contains "+strconv.Quote(filterMachine))
+		}
+		if filterCheckIn != "" {
+			filters = append(filters, "Check-in is "+filterCheckIn)
+		}
+		if !asOf.IsZero() {
+			filters = append(filters, "As of "+asOf.UTC().Format(time.RFC3339))
+		}
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		out = export.NewXLSX(w, now, filters)
+	default:
+		http.Error(w, "format must be csv or xlsx", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+export.Filename(query.Get("format"), now)+`"`)
+
+	checkInTime := now
+	if !asOf.IsZero() {
+		checkInTime = asOf
+	}
+	err = h.db.EachMachineWithOwner(filterOwner, filterMachine, asOf, func(m *db.MachineWithOwner) error {
+		m.CheckIn = m.CheckInState(m.LastReport(), h.checkInDays, checkInTime)
+		if filterCheckIn != "" && m.CheckIn != filterCheckIn {
+			return nil
+		}
+		return out.WriteMachine(m)
+	})
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		// The response has already started, so the download is left truncated
+		log.Printf("Failed to export machines: %v", err)
+	}
+}
+
+// withCheckIns fills in each machine's check-in state as of asOf (zero for
+// now) and, if state is set, keeps only the machines in that state
+func (h *Handlers) withCheckIns(machines []db.MachineWithOwner, state string, asOf time.Time) []db.MachineWithOwner {
+	now := asOf
+	if now.IsZero() {
+		now = time.Now()
+	}
+	filtered := machines[:0]
+	for _, m := range machines {
+		m.CheckIn = m.CheckInState(m.LastReport(), h.checkInDays, now)
+		if state == "" || m.CheckIn == state {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// SetMachineCheckIn overrides a machine's expected check-in interval (admin only).
+// A blank or zero value restores the default for its install mode.
+func (h *Handlers) SetMachineCheckIn(w http.ResponseWriter, r *http.Request) {
+	machineID := r.PathValue("id")
 	machine, err := h.db.GetMachine(machineID)
 	if err != nil || machine == nil {
-		http.Error(w, "Machine not found", http.StatusNotFound)
+		h.renderError(w, r, http.StatusNotFound, "Machine not found")
 		return
 	}
 
-	// Delete the machine and all its snapshots
-	if err := h.db.DeleteMachine(machineID); err != nil {
-		http.Error(w, "Failed to delete machine", http.StatusInternalServerError)
-		return
+	days := 0
+	if v := r.FormValue("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < 0 || days > 365 {
+			http.Error(w, "Check-in interval must be between 0 and 365 days", http.StatusBadRequest)
+			return
+		}
 	}
 
-	// HTMX request: return empty response (row will be removed via hx-swap)
-	if r.Header.Get("HX-Request") == "true" {
-		w.WriteHeader(http.StatusOK)
+	if err := h.db.SetMachineCheckInDays(machineID, days); err != nil {
+		http.Error(w, "Failed to update check-in interval", http.StatusInternalServerError)
 		return
 	}
+	h.audit(r, auditMachineCheckInChanged, "machine", machineID,
+		map[string]int{"checkin_days": machine.CheckInDays}, map[string]int{"checkin_days": days})
 
-	// Redirect back to admin machines list
-	http.Redirect(w, r, "/admin/machines", http.StatusSeeOther)
+	http.Redirect(w, r, "/machines/"+machineID, http.StatusSeeOther)
 }
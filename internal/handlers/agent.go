@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// agentPlatforms lists the OS/architecture pairs the compiled agent is released for
+var agentPlatforms = map[string][]string{
+	"darwin":  {"amd64", "arm64"},
+	"linux":   {"amd64", "arm64"},
+	"windows": {"amd64", "arm64"},
+}
+
+// agentBinaryName is the file name of a compiled agent inside the agent directory
+func agentBinaryName(goos, goarch string) string {
+	name := fmt.Sprintf("boxcheckr-agent_%s_%s", goos, goarch)
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// AgentBinary serves a compiled agent - NO AUTH REQUIRED
+// The binary holds no secrets; the token is passed on the command line
+func (h *Handlers) AgentBinary(w http.ResponseWriter, r *http.Request) {
+	goos := r.PathValue("os")
+	goarch := r.PathValue("arch")
+
+	supported := false
+	for _, arch := range agentPlatforms[goos] {
+		if arch == goarch {
+			supported = true
+		}
+	}
+	if !supported {
+		http.Error(w, "Unsupported platform", http.StatusNotFound)
+		return
+	}
+
+	name := agentBinaryName(goos, goarch)
+	path := filepath.Join(h.agentDir, name)
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "Agent binary not available on this server", http.StatusNotFound)
+		return
+	}
+
+	download := "boxcheckr-agent"
+	if goos == "windows" {
+		download += ".exe"
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename="+download)
+	http.ServeFile(w, r, path)
+}
@@ -3,26 +3,20 @@ package handlers
 import (
 	"encoding/json"
 	"io"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/jclement/boxcheckr/internal/checks"
 	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/inventory"
+	"github.com/jclement/boxcheckr/internal/middleware"
+	"github.com/jclement/boxcheckr/internal/webhook"
 )
 
-type InventoryPayload struct {
-	Hostname              string `json:"hostname"`
-	OS                    string `json:"os"`
-	OSVersion             string `json:"os_version"`
-	DiskEncrypted         bool   `json:"disk_encrypted"`
-	DiskEncryptionDetails string `json:"disk_encryption_details"`
-	AntivirusEnabled      bool   `json:"antivirus_enabled"`
-	AntivirusDetails      string `json:"antivirus_details"`
-	FirewallEnabled       bool   `json:"firewall_enabled"`
-	FirewallDetails       string `json:"firewall_details"`
-	ScreenLockEnabled     bool   `json:"screen_lock_enabled"`
-	ScreenLockTimeout     int    `json:"screen_lock_timeout"`
-	ScreenLockDetails     string `json:"screen_lock_details"`
-}
+// InventoryPayload is the agent submission contract, shared with the compiled agent
+type InventoryPayload = inventory.Payload
 
 func (h *Handlers) SubmitInventory(w http.ResponseWriter, r *http.Request) {
 	// Extract token from Authorization header
@@ -48,7 +42,14 @@ func (h *Handlers) SubmitInventory(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
-
+	if machine.Archived() {
+		http.Error(w, "Machine has been archived", http.StatusGone)
+		return
+	}
+	if machine.TokenDisabled() {
+		http.Error(w, "Token has been disabled", http.StatusForbidden)
+		return
+	}
 	// Parse payload
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -56,27 +57,92 @@ func (h *Handlers) SubmitInventory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Machines that registered a key must sign every report
+	signed := false
+	if machine.PublicKey != "" {
+		key, err := inventory.ParsePublicKey(machine.PublicKey)
+		if err != nil {
+			http.Error(w, "Invalid public key", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		nonce, err := inventory.Verify(r.Header, key, body, now)
+		if err != nil {
+			log.Printf("Rejected report for machine %s: %v", machine.ID, err)
+			http.Error(w, "Invalid signature: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		fresh, err := h.db.UseInventoryNonce(machine.ID, nonce, now.Add(-2*inventory.MaxClockSkew))
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !fresh {
+			log.Printf("Rejected replayed report for machine %s", machine.ID)
+			http.Error(w, "Report has already been submitted", http.StatusUnauthorized)
+			return
+		}
+		signed = true
+	}
+	if err := h.db.RecordMachineTokenUse(machine.ID, middleware.ClientIP(r)); err != nil {
+		log.Printf("Failed to record token use for machine %s: %v", machine.ID, err)
+	}
+
 	var payload InventoryPayload
 	if err := json.Unmarshal(body, &payload); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	if err := checks.Validate(payload.Checks); err != nil {
+		http.Error(w, "Invalid checks: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, status := range []string{payload.DiskEncryptionStatus, payload.AntivirusStatus, payload.FirewallStatus, payload.ScreenLockStatus} {
+		if status != "" && !checks.ValidStatus(status) {
+			http.Error(w, "Invalid control status: "+status, http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Create snapshot
 	snapshot := &db.InventorySnapshot{
-		Hostname:              payload.Hostname,
-		OS:                    payload.OS,
-		OSVersion:             payload.OSVersion,
-		DiskEncrypted:         payload.DiskEncrypted,
-		DiskEncryptionDetails: payload.DiskEncryptionDetails,
-		AntivirusEnabled:      payload.AntivirusEnabled,
-		AntivirusDetails:      payload.AntivirusDetails,
-		FirewallEnabled:       payload.FirewallEnabled,
-		FirewallDetails:       payload.FirewallDetails,
-		ScreenLockEnabled:     payload.ScreenLockEnabled,
-		ScreenLockTimeout:     payload.ScreenLockTimeout,
-		ScreenLockDetails:     payload.ScreenLockDetails,
-		RawData:               string(body),
+		Hostname:               payload.Hostname,
+		OS:                     payload.OS,
+		OSVersion:              payload.OSVersion,
+		DiskEncrypted:          payload.DiskEncrypted,
+		DiskEncryptionDetails:  payload.DiskEncryptionDetails,
+		AntivirusEnabled:       payload.AntivirusEnabled,
+		AntivirusDetails:       payload.AntivirusDetails,
+		FirewallEnabled:        payload.FirewallEnabled,
+		FirewallDetails:        payload.FirewallDetails,
+		ScreenLockEnabled:      payload.ScreenLockEnabled,
+		ScreenLockTimeout:      payload.ScreenLockTimeout,
+		ScreenLockDetails:      payload.ScreenLockDetails,
+		DiskEncryptionStatus:   db.ControlStatus(payload.DiskEncryptionStatus),
+		AntivirusStatus:        db.ControlStatus(payload.AntivirusStatus),
+		FirewallStatus:         db.ControlStatus(payload.FirewallStatus),
+		ScreenLockStatus:       db.ControlStatus(payload.ScreenLockStatus),
+		RawData:                string(body),
+		Signed:                 signed,
+		OSBuild:                payload.OSBuild,
+		DaysSinceUpdate:        payload.DaysSinceUpdate,
+		PendingSecurityUpdates: payload.PendingSecurityUpdates,
+		AutoUpdateEnabled:      payload.AutoUpdateEnabled,
+		AutoUpdateDetails:      payload.AutoUpdateDetails,
+	}
+	if lastBoot, err := time.Parse(time.RFC3339, payload.LastBootAt); err == nil {
+		lastBoot = lastBoot.UTC()
+		snapshot.LastBootAt = &lastBoot
+	}
+	for _, c := range payload.Checks {
+		snapshot.Checks = append(snapshot.Checks, db.SnapshotCheck{CheckID: c.ID, Status: c.Status, Value: c.Value, Details: c.Details})
+	}
+
+	// Keep the previous snapshot to spot controls that just started failing
+	previous, err := h.db.GetLatestSnapshot(machine.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
 
 	if err := h.db.CreateSnapshot(machine.ID, snapshot); err != nil {
@@ -84,6 +150,32 @@ func (h *Handlers) SubmitInventory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := h.evaluatePolicies(snapshot); err != nil {
+		log.Printf("Failed to evaluate policies for snapshot %d: %v", snapshot.ID, err)
+	}
+
+	// Email the owner in the background; a failed send is retried on the next report
+	if h.notifier != nil {
+		go func() {
+			if err := h.notifier.SnapshotSubmitted(machine, snapshot); err != nil {
+				log.Printf("Failed to notify owner of machine %s: %v", machine.ID, err)
+			}
+		}()
+	}
+
+	wm := h.webhookMachine(machine)
+	h.emit(webhook.EventSnapshotSubmitted, map[string]interface{}{
+		"machine":  wm,
+		"snapshot": snapshot,
+	})
+	if failed := webhook.FailedControls(previous, snapshot); len(failed) > 0 {
+		h.emit(webhook.EventControlFailed, map[string]interface{}{
+			"machine":  wm,
+			"controls": failed,
+			"snapshot": snapshot,
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -91,3 +183,76 @@ func (h *Handlers) SubmitInventory(w http.ResponseWriter, r *http.Request) {
 		"machine": machine.Name,
 	})
 }
+
+// BootstrapExchange trades a single-use bootstrap code for a new enrollment
+// token, which replaces the machine's current one at once. Scripts and the
+// compiled agent call it on first run and keep the token locally. Scripts
+// also report their install mode, which sets how often the machine is
+// expected to check in. The compiled agent registers the public key it
+// signs reports with; installs without one send unsigned reports.
+func (h *Handlers) BootstrapExchange(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code      string `json:"code"`
+		Mode      string `json:"mode"`
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.PublicKey != "" {
+		if _, err := inventory.ParsePublicKey(req.PublicKey); err != nil {
+			http.Error(w, "Invalid public key", http.StatusBadRequest)
+			return
+		}
+	}
+
+	machine, err := h.db.RedeemBootstrapCode(req.Code)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if machine == nil {
+		http.Error(w, "Invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	if machine.Archived() {
+		http.Error(w, "Machine has been archived", http.StatusGone)
+		return
+	}
+
+	if req.Mode == db.ModeOneTime || req.Mode == db.ModeMonitor {
+		if err := h.db.SetMachineMode(machine.ID, req.Mode); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// A code can't remove a machine's key; its owner clears it instead
+	if req.PublicKey != "" {
+		if err := h.db.SetMachinePublicKey(machine.ID, req.PublicKey); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Only token hashes are stored, so the installer gets a fresh token
+	token, err := h.db.RotateMachineToken(machine.ID, 0)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Install scripts run without a user; the code stands in for one
+	h.auditAs(r, nil, auditMachineBootstrapped, "machine", machine.ID, nil, map[string]interface{}{
+		"mode":   req.Mode,
+		"signed": req.PublicKey != "",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{
+		"token":   token,
+		"machine": machine.Name,
+	})
+}
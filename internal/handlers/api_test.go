@@ -2,13 +2,22 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"html/template"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/inventory"
 	"github.com/jclement/boxcheckr/internal/middleware"
 )
 
@@ -27,7 +36,7 @@ func setupTestHandlers(t *testing.T) (*Handlers, *db.DB, func()) {
 		t.Fatalf("Failed to create database: %v", err)
 	}
 
-	sessions := middleware.NewSessionStore()
+	sessions := middleware.NewSessionStore(database, middleware.DefaultSessionConfig, nil)
 
 	// Create handlers without OIDC (we'll test API endpoints that don't need it)
 	h := &Handlers{
@@ -194,3 +203,1121 @@ func TestSubmitInventoryMultipleSnapshots(t *testing.T) {
 		t.Errorf("Expected 3 snapshots, got %d", len(history))
 	}
 }
+
+func TestSubmitInventoryEvaluatesPolicy(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	_, _ = database.UpsertUser("test-user", "test@example.com", "Test User", false)
+	machine, _ := database.CreateMachine("test-user", "Test Machine")
+	_, _ = database.CreatePolicyRule(&db.PolicyRule{Name: "Disk", Field: "disk_encrypted", Operator: "==", Value: "true", Enabled: true})
+	_, _ = database.CreatePolicyRule(&db.PolicyRule{Name: "Firewall", Field: "firewall_enabled", Operator: "==", Value: "true", Enabled: true})
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"hostname":         "test-host",
+		"os":               "linux",
+		"disk_encrypted":   true,
+		"firewall_enabled": false,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/inventory", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+machine.EnrollmentToken)
+	rr := httptest.NewRecorder()
+	h.SubmitInventory(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	latest, err := database.GetLatestSnapshot(machine.ID)
+	if err != nil || latest == nil {
+		t.Fatalf("Failed to get snapshot: %v", err)
+	}
+	if latest.PolicyPassed != 1 || latest.PolicyFailed != 1 {
+		t.Errorf("Expected 1 passed and 1 failed, got %d passed and %d failed", latest.PolicyPassed, latest.PolicyFailed)
+	}
+}
+
+func TestSubmitInventoryPatchLevel(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	_, _ = database.UpsertUser("test-user", "test@example.com", "Test User", false)
+	machine, _ := database.CreateMachine("test-user", "Test Machine")
+	_, _ = database.CreatePolicyRule(&db.PolicyRule{Name: "Reboot", Field: "uptime_days", Operator: "<=", Value: "7", Enabled: true})
+	_, _ = database.CreatePolicyRule(&db.PolicyRule{Name: "Patched", Field: "pending_security_updates", Operator: "==", Value: "0", Enabled: true})
+
+	// Scripts send null for values they couldn't collect
+	booted := time.Now().UTC().Add(-3 * 24 * time.Hour).Truncate(time.Second)
+	body := []byte(`{"hostname": "test-host", "os": "linux", "os_build": "6.8.0-31-generic",
+		"days_since_update": 2, "pending_security_updates": null, "auto_update_enabled": true,
+		"auto_update_details": "unattended-upgrades enabled", "last_boot_at": "` + booted.Format(time.RFC3339) + `"}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/inventory", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+machine.EnrollmentToken)
+	rr := httptest.NewRecorder()
+	h.SubmitInventory(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	latest, _ := database.GetLatestSnapshot(machine.ID)
+	if latest.OSBuild != "6.8.0-31-generic" || !latest.AutoUpdateEnabled || latest.AutoUpdateDetails != "unattended-upgrades enabled" {
+		t.Errorf("Unexpected patch level %+v", latest)
+	}
+	if latest.DaysSinceUpdate == nil || *latest.DaysSinceUpdate != 2 || latest.PendingSecurityUpdates != nil {
+		t.Errorf("Expected 2 days since update and unknown pending updates, got %v and %v", latest.DaysSinceUpdate, latest.PendingSecurityUpdates)
+	}
+	if latest.LastBootAt == nil || !latest.LastBootAt.Equal(booted) {
+		t.Errorf("Expected last boot %v, got %v", booted, latest.LastBootAt)
+	}
+	// Uptime passes; the unreported pending count fails
+	if latest.PolicyPassed != 1 || latest.PolicyFailed != 1 {
+		t.Errorf("Expected 1 passed and 1 failed, got %d passed and %d failed", latest.PolicyPassed, latest.PolicyFailed)
+	}
+}
+
+func TestSubmitInventoryChecks(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	_, _ = database.UpsertUser("test-user", "test@example.com", "Test User", false)
+	machine, _ := database.CreateMachine("test-user", "Test Machine")
+	_, _ = database.CreatePolicyRule(&db.PolicyRule{Name: "SSH", Field: "check.ssh_root_login_disabled", Operator: "==", Value: "pass", Enabled: true})
+
+	submit := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/inventory", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+machine.EnrollmentToken)
+		rr := httptest.NewRecorder()
+		h.SubmitInventory(rr, req)
+		return rr
+	}
+
+	rr := submit(`{"hostname": "test-host", "os": "linux", "checks": [
+		{"id": "ssh_root_login_disabled", "status": "pass", "value": "no", "details": "PermitRootLogin no"},
+		{"id": "acme.vpn_connected", "status": "unknown"}]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	latest, _ := database.GetLatestSnapshot(machine.ID)
+	if len(latest.Checks) != 2 || latest.Checks[1].CheckID != "ssh_root_login_disabled" || latest.Checks[1].Value != "no" {
+		t.Errorf("Unexpected checks %+v", latest.Checks)
+	}
+	if latest.PolicyPassed != 1 || latest.PolicyFailed != 0 {
+		t.Errorf("Expected the SSH rule to pass, got %d passed and %d failed", latest.PolicyPassed, latest.PolicyFailed)
+	}
+
+	invalid := []string{
+		`{"hostname": "test-host", "checks": [{"id": "ssh_root_login_disabled", "status": "ok"}]}`,
+		`{"hostname": "test-host", "checks": [{"id": "disk_encrypted", "status": "pass"}]}`,
+		`{"hostname": "test-host", "checks": [{"id": "Not An ID", "status": "pass"}]}`,
+	}
+	for _, body := range invalid {
+		if rr := submit(body); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, body, rr.Code)
+		}
+	}
+}
+
+func TestSubmitInventoryControlStatuses(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	_, _ = database.UpsertUser("test-user", "test@example.com", "Test User", false)
+	machine, _ := database.CreateMachine("test-user", "Test Machine")
+	_, _ = database.CreatePolicyRule(&db.PolicyRule{Name: "Firewall", Field: "firewall_enabled", Operator: "==", Value: "true", Enabled: true})
+	_, _ = database.CreatePolicyRule(&db.PolicyRule{Name: "Antivirus", Field: "antivirus_enabled", Operator: "==", Value: "true", Enabled: true})
+
+	submit := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/inventory", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+machine.EnrollmentToken)
+		rr := httptest.NewRecorder()
+		h.SubmitInventory(rr, req)
+		return rr
+	}
+
+	// A status overrides its boolean, and controls without one use the boolean
+	rr := submit(`{"hostname": "test-host", "disk_encrypted": true, "firewall_enabled": true,
+		"firewall_status": "unknown", "antivirus_status": "not_applicable"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	latest, _ := database.GetLatestSnapshot(machine.ID)
+	if latest.DiskEncryptionStatus != db.StatusPass || latest.FirewallStatus != db.StatusUnknown ||
+		latest.AntivirusStatus != db.StatusNotApplicable || latest.ScreenLockStatus != db.StatusFail {
+		t.Errorf("Unexpected statuses %+v", latest)
+	}
+	if latest.FirewallEnabled {
+		t.Error("Expected an unknown firewall not to count as enabled")
+	}
+	if latest.PolicyPassed != 0 || latest.PolicyFailed != 1 {
+		t.Errorf("Expected only the firewall rule to apply and fail, got %d passed and %d failed", latest.PolicyPassed, latest.PolicyFailed)
+	}
+
+	if rr := submit(`{"hostname": "test-host", "firewall_status": "maybe"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid status, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestAgentBinary(t *testing.T) {
+	h, _, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	h.agentDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(h.agentDir, "boxcheckr-agent_windows_amd64.exe"), []byte("MZ"), 0o644); err != nil {
+		t.Fatalf("Failed to write agent: %v", err)
+	}
+
+	tests := []struct {
+		os, arch string
+		want     int
+	}{
+		{"windows", "amd64", http.StatusOK},
+		{"linux", "arm64", http.StatusNotFound}, // supported but not built
+		{"plan9", "amd64", http.StatusNotFound},
+		{"windows", "..", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/agent/"+tt.os+"/"+tt.arch, nil)
+		req.SetPathValue("os", tt.os)
+		req.SetPathValue("arch", tt.arch)
+		w := httptest.NewRecorder()
+
+		h.AgentBinary(w, req)
+
+		if w.Code != tt.want {
+			t.Errorf("%s/%s: expected status %d, got %d", tt.os, tt.arch, tt.want, w.Code)
+		}
+	}
+}
+
+func TestMachineScriptRequiresBootstrapCode(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	database.UpsertUser("test-user", "test@example.com", "Test User", false)
+	machine, _ := database.CreateMachine("test-user", "Test Machine")
+	code, err := database.CreateBootstrapCode(machine.ID, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create bootstrap code: %v", err)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/machines/"+machine.ID+"/script?os=linux"+query, nil)
+		req.SetPathValue("id", machine.ID)
+		w := httptest.NewRecorder()
+		h.MachineScript(w, req)
+		return w
+	}
+
+	if w := get(""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without code, got %d", w.Code)
+	}
+	if w := get("&code=wrong"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 with wrong code, got %d", w.Code)
+	}
+
+	w := get("&code=" + url.QueryEscape(code.Code))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 with valid code, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, machine.EnrollmentToken) {
+		t.Error("Script must not contain the enrollment token")
+	}
+	if !strings.Contains(body, code.Code) {
+		t.Error("Expected script to contain the bootstrap code")
+	}
+}
+
+func TestBootstrapExchange(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	database.UpsertUser("test-user", "test@example.com", "Test User", false)
+	machine, _ := database.CreateMachine("test-user", "Test Machine")
+	code, _ := database.CreateBootstrapCode(machine.ID, time.Hour)
+
+	exchange := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/bootstrap", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.BootstrapExchange(w, req)
+		return w
+	}
+
+	w := exchange(`{"code":"` + code.Code + `"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp["token"] == "" || resp["token"] == machine.EnrollmentToken {
+		t.Errorf("Expected a new enrollment token, got %q", resp["token"])
+	}
+	if m, _ := database.GetMachineByToken(resp["token"]); m == nil || m.ID != machine.ID {
+		t.Errorf("Expected the new token to identify the machine, got %+v", m)
+	}
+	if m, _ := database.GetMachineByToken(machine.EnrollmentToken); m != nil {
+		t.Error("Expected the replaced token to stop working")
+	}
+
+	if w := exchange(`{"code":"` + code.Code + `"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 on reuse, got %d", w.Code)
+	}
+	if w := exchange(`not json`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid body, got %d", w.Code)
+	}
+}
+
+func TestBootstrapExchangeRecordsMode(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	database.UpsertUser("test-user", "test@example.com", "Test User", false)
+	machine, _ := database.CreateMachine("test-user", "Test Machine")
+	code, _ := database.CreateBootstrapCode(machine.ID, time.Hour)
+
+	req := httptest.NewRequest("POST", "/api/v1/bootstrap", strings.NewReader(`{"code":"`+code.Code+`","mode":"monitor"}`))
+	w := httptest.NewRecorder()
+	h.BootstrapExchange(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	machine, _ = database.GetMachine(machine.ID)
+	if machine.Mode != db.ModeMonitor {
+		t.Errorf("Expected monitor mode, got %q", machine.Mode)
+	}
+}
+
+func TestAdminMachinesCheckInFilter(t *testing.T) {
+	h, _, cleanup := setupTestHandlers(t)
+	defer cleanup()
+	h.checkInDays = 8
+
+	machines := []db.MachineWithOwner{
+		{Machine: db.Machine{Name: "Fresh"}, Latest: &db.InventorySnapshot{CollectedAt: time.Now()}},
+		{Machine: db.Machine{Name: "Stale"}, Latest: &db.InventorySnapshot{CollectedAt: time.Now().Add(-30 * 24 * time.Hour)}},
+		{Machine: db.Machine{Name: "Silent"}},
+	}
+	for state, want := range map[string]string{
+		db.CheckInHealthy:       "Fresh",
+		db.CheckInOverdue:       "Stale",
+		db.CheckInNeverReported: "Silent",
+	} {
+		got := h.withCheckIns(append([]db.MachineWithOwner(nil), machines...), state, time.Time{})
+		if len(got) != 1 || got[0].Name != want {
+			t.Errorf("Filter %s: expected only %s, got %+v", state, want, got)
+		}
+	}
+
+	if got := h.withCheckIns(machines, "", time.Time{}); len(got) != 3 {
+		t.Errorf("Expected all 3 machines without a filter, got %d", len(got))
+	}
+}
+
+func TestSubmitInventoryEmitsWebhookEvents(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	database.UpsertUser("test-user", "test@example.com", "Test User", false)
+	machine, _ := database.CreateMachine("test-user", "Test Machine")
+	database.CreateWebhook("https://example.com/hook", nil)
+
+	submit := func(diskEncrypted bool) {
+		body, _ := json.Marshal(InventoryPayload{Hostname: "test-host", OS: "linux", DiskEncrypted: diskEncrypted, FirewallEnabled: true})
+		req := httptest.NewRequest("POST", "/api/v1/inventory", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+machine.EnrollmentToken)
+		w := httptest.NewRecorder()
+		h.SubmitInventory(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	submit(true)
+	submit(false)
+
+	deliveries, _ := database.RecentWebhookDeliveries(10)
+	var events []string
+	for _, d := range deliveries {
+		events = append(events, d.Event)
+		if strings.Contains(d.Payload, machine.EnrollmentToken) {
+			t.Errorf("%s payload must not contain the enrollment token", d.Event)
+		}
+	}
+	// Newest first: the second report flags the disk, the first is a plain submission
+	want := []string{"machine.control_failed", "snapshot.submitted", "snapshot.submitted"}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected events %v, got %v", want, events)
+	}
+	if !strings.Contains(deliveries[0].Payload, `"controls":["disk_encrypted"]`) {
+		t.Errorf("Expected failed control in payload, got %s", deliveries[0].Payload)
+	}
+}
+
+func TestRESTAPIKeyAuth(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	database.UpsertUser("admin", "admin@example.com", "Admin", true)
+	machinesKey, _ := database.CreateAPIKey("machines", "admin", []string{db.ScopeMachinesRead}, nil)
+	past := time.Now().UTC().Add(-time.Hour)
+	expiredKey, _ := database.CreateAPIKey("expired", "admin", []string{db.ScopeUsersRead}, &past)
+
+	get := func(handler http.HandlerFunc, key string) int {
+		req := httptest.NewRequest("GET", "/api/v1/users", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	if code := get(h.APIListUsers, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a key, got %d", code)
+	}
+	if code := get(h.APIListUsers, "bck_unknown"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown key, got %d", code)
+	}
+	if code := get(h.APIListUsers, expiredKey.Key); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an expired key, got %d", code)
+	}
+	if code := get(h.APIListUsers, machinesKey.Key); code != http.StatusForbidden {
+		t.Errorf("Expected 403 without the users:read scope, got %d", code)
+	}
+	if code := get(h.APIListMachines, machinesKey.Key); code != http.StatusOK {
+		t.Errorf("Expected 200 with the machines:read scope, got %d", code)
+	}
+}
+
+func TestRESTAPIListMachines(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	database.UpsertUser("admin", "admin@example.com", "Admin", true)
+	database.UpsertUser("alice", "alice@example.com", "Alice", false)
+	database.UpsertUser("bob", "bob@example.com", "Bob", false)
+	key, _ := database.CreateAPIKey("grc", "admin", db.APIScopes, nil)
+
+	var tokens []string
+	for _, owner := range []string{"alice", "alice", "alice", "bob"} {
+		m, _ := database.CreateMachine(owner, owner+"-laptop")
+		tokens = append(tokens, m.EnrollmentToken)
+		database.CreateSnapshot(m.ID, &db.InventorySnapshot{Hostname: owner, RawData: `{"hostname":"` + owner + `"}`})
+	}
+
+	list := func(query string) (apiPage, []apiMachine, string) {
+		req := httptest.NewRequest("GET", "/api/v1/machines?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+key.Key)
+		w := httptest.NewRecorder()
+		h.APIListMachines(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %q, got %d: %s", query, w.Code, w.Body.String())
+		}
+		var page apiPage
+		var machines []apiMachine
+		page.Data = &machines
+		body := w.Body.String()
+		json.Unmarshal([]byte(body), &page)
+		return page, machines, body
+	}
+
+	// Walk every page of alice's machines, two at a time
+	var seen []string
+	cursor := ""
+	for {
+		page, machines, body := list("owner=alice&limit=2&cursor=" + cursor)
+		for _, token := range tokens {
+			if strings.Contains(body, token) {
+				t.Fatal("Response must not contain enrollment tokens")
+			}
+		}
+		for _, m := range machines {
+			if m.OwnerEmail != "alice@example.com" || m.Latest == nil || m.Latest.RawData != "" {
+				t.Errorf("Unexpected machine: %+v", m)
+			}
+			seen = append(seen, m.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 3 || seen[0] == seen[1] || seen[1] == seen[2] {
+		t.Errorf("Expected alice's 3 machines across pages, got %v", seen)
+	}
+
+	if _, machines, _ := list("machine=bob"); len(machines) != 1 {
+		t.Errorf("Expected 1 machine matching bob, got %d", len(machines))
+	}
+
+	// The check-in filter applies across pages
+	database.CreateMachine("bob", "spare-1")
+	database.CreateMachine("bob", "spare-2")
+	seen = nil
+	for cursor = ""; ; {
+		page, machines, _ := list("checkin=never_reported&limit=1&cursor=" + cursor)
+		for _, m := range machines {
+			seen = append(seen, m.Name)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if slices.Sort(seen); !slices.Equal(seen, []string{"spare-1", "spare-2"}) {
+		t.Errorf("Expected the 2 machines that never reported, got %v", seen)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/machines?limit=1000", nil)
+	req.Header.Set("Authorization", "Bearer "+key.Key)
+	w := httptest.NewRecorder()
+	h.APIListMachines(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an oversized limit, got %d", w.Code)
+	}
+}
+
+func TestRESTAPIMachineAndSnapshots(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	database.UpsertUser("admin", "admin@example.com", "Admin", true)
+	key, _ := database.CreateAPIKey("grc", "admin", db.APIScopes, nil)
+	machine, _ := database.CreateMachine("admin", "Laptop")
+	for i := 0; i < 3; i++ {
+		database.CreateSnapshot(machine.ID, &db.InventorySnapshot{Hostname: "laptop"})
+	}
+
+	get := func(handler http.HandlerFunc, id, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/machines/"+id+"?"+query, nil)
+		req.SetPathValue("id", id)
+		req.Header.Set("Authorization", "Bearer "+key.Key)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	w := get(h.APIGetMachine, machine.ID, "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), machine.EnrollmentToken) {
+		t.Fatalf("Expected machine without its token, got %d: %s", w.Code, w.Body.String())
+	}
+	var m apiMachine
+	json.NewDecoder(w.Body).Decode(&m)
+	if m.Name != "Laptop" || m.OwnerEmail != "admin@example.com" || m.Latest == nil || m.CheckIn != db.CheckInHealthy {
+		t.Errorf("Unexpected machine: %+v", m)
+	}
+
+	if w := get(h.APIGetMachine, "missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown machine, got %d", w.Code)
+	}
+
+	var ids []int64
+	cursor := ""
+	for {
+		w := get(h.APIListSnapshots, machine.ID, "limit=2&cursor="+cursor)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var snapshots []db.InventorySnapshot
+		page := apiPage{Data: &snapshots}
+		json.NewDecoder(w.Body).Decode(&page)
+		for _, s := range snapshots {
+			ids = append(ids, s.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(ids) != 3 || ids[0] <= ids[1] || ids[1] <= ids[2] {
+		t.Errorf("Expected 3 snapshots newest first, got %v", ids)
+	}
+
+	if w := get(h.APIListSnapshots, machine.ID, "cursor=!!"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a malformed cursor, got %d", w.Code)
+	}
+}
+
+func TestAdminExportMachines(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+	h.checkInDays = 8
+
+	database.UpsertUser("alice", "alice@example.com", "Alice", false)
+	database.UpsertUser("bob", "bob@example.com", "Bob", false)
+	reporting, _ := database.CreateMachine("alice", "Alice Laptop")
+	database.CreateSnapshot(reporting.ID, &db.InventorySnapshot{Hostname: "alice-laptop", DiskEncrypted: true})
+	database.CreateMachine("alice", "Alice Desktop")
+	database.CreateMachine("bob", "Bob Laptop")
+
+	export := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/machines/export?"+query, nil)
+		w := httptest.NewRecorder()
+		h.AdminExportMachines(w, req)
+		return w
+	}
+
+	w := export("format=csv&owner=alice&checkin=healthy")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), ".csv") {
+		t.Errorf("Expected a CSV attachment, got %q", w.Header().Get("Content-Disposition"))
+	}
+	body := w.Body.String()
+	if lines := strings.Count(body, "\n"); lines != 2 {
+		t.Errorf("Expected a header and 1 row, got %d lines: %s", lines, body)
+	}
+	if !strings.Contains(body, "Alice Laptop") || strings.Contains(body, reporting.EnrollmentToken) {
+		t.Errorf("Unexpected export: %s", body)
+	}
+
+	w = export("format=xlsx")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "PK") {
+		t.Errorf("Expected an XLSX file, got %d", w.Code)
+	}
+
+	if w := export("format=pdf"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %d", w.Code)
+	}
+}
+
+func TestParseAsOf(t *testing.T) {
+	if asOf, err := parseAsOf(""); err != nil || !asOf.IsZero() {
+		t.Errorf("Expected zero time for an empty value, got %v (%v)", asOf, err)
+	}
+
+	asOf, err := parseAsOf("2026-03-31")
+	if err != nil {
+		t.Fatalf("Failed to parse date: %v", err)
+	}
+	endOfDay := time.Date(2026, 3, 31, 23, 59, 59, 0, time.UTC)
+	if asOf.Before(endOfDay) || !asOf.Before(endOfDay.Add(time.Second)) {
+		t.Errorf("Expected the end of March 31 UTC, got %v", asOf)
+	}
+
+	asOf, err = parseAsOf("2026-03-31T09:30:00-06:00")
+	if err != nil || !asOf.Equal(time.Date(2026, 3, 31, 15, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected the exact timestamp, got %v (%v)", asOf, err)
+	}
+
+	if _, err := parseAsOf("last tuesday"); err == nil {
+		t.Error("Expected an error for an unparseable value")
+	}
+}
+
+func TestDevLogin(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth/dev", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		h.DevLoginSubmit(rr, req)
+		return rr
+	}
+
+	h.templates = map[string]*template.Template{"error.html": template.Must(template.New("base.html").Parse(`{{.ErrorMessage}}`))}
+	if rr := post(url.Values{"email": {"dev@example.com"}}); rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 without DEV_AUTH, got %d", rr.Code)
+	}
+
+	h.devAuth = true
+	rr := post(url.Values{"email": {"Dev.User@example.com"}, "name": {"Dev User"}, "admin": {"true"}})
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect, got %d: %s", rr.Code, rr.Body.String())
+	}
+	user, _ := database.GetUser("dev-dev-user-example-com")
+	if user == nil || user.Email != "Dev.User@example.com" || !user.IsAdmin {
+		t.Fatalf("Expected an admin user to be created, got %+v", user)
+	}
+
+	// The session cookie signs the user in
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	if id, isAdmin, ok := h.sessions.GetUser(req); !ok || id != user.ID || !isAdmin {
+		t.Errorf("Expected an admin session for %s, got %q, %v, %v", user.ID, id, isAdmin, ok)
+	}
+
+	// Signing in as an existing user can drop admin
+	if rr := post(url.Values{"user_id": {user.ID}}); rr.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect, got %d", rr.Code)
+	}
+	if user, _ := database.GetUser(user.ID); user.IsAdmin || user.Name != "Dev User" {
+		t.Errorf("Expected a non-admin with the same name, got %+v", user)
+	}
+
+	if rr := post(url.Values{"user_id": {"missing"}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown user, got %d", rr.Code)
+	}
+	if rr := post(url.Values{}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without an email, got %d", rr.Code)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	admin, _ := database.UpsertUser("admin", "admin@example.com", "Admin", true)
+	machine, _ := database.CreateMachine("admin", "Old Laptop")
+
+	req := httptest.NewRequest("POST", "/admin/machines/"+machine.ID+"/archive", nil)
+	req.SetPathValue("id", machine.ID)
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.1")
+	req = req.WithContext(context.WithValue(req.Context(), middleware.ContextKeyUser, admin))
+	h.AdminArchiveMachine(httptest.NewRecorder(), req)
+
+	events, _ := database.GetAuditEvents(db.AuditFilter{})
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 audit event, got %d", len(events))
+	}
+	e := events[0]
+	// X-Forwarded-For is ignored without trusted proxies
+	if e.Action != auditMachineArchived || e.ActorEmail != "admin@example.com" || e.TargetID != machine.ID || e.IPAddress != "192.0.2.1" {
+		t.Errorf("Unexpected audit event: %+v", e)
+	}
+	if !strings.Contains(e.Before, "Old Laptop") || strings.Contains(e.Before, machine.EnrollmentToken) {
+		t.Errorf("Expected the machine without its token before archiving, got %s", e.Before)
+	}
+
+	req = httptest.NewRequest("GET", "/admin/audit/export?action="+auditMachineArchived, nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.ContextKeyUser, admin))
+	w := httptest.NewRecorder()
+	h.AdminExportAudit(w, req)
+	if body := w.Body.String(); strings.Count(body, "\n") != 2 || !strings.Contains(body, machine.ID) {
+		t.Errorf("Expected a header and the archiving, got %s", body)
+	}
+
+	// The export is itself recorded
+	if v, _ := database.VerifyAuditLog(); v.Events != 2 || v.BrokenAt != 0 {
+		t.Errorf("Expected 2 chained events, got %+v", v)
+	}
+}
+
+func TestArchiveMachine(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+	h.archivePurgeDays = 30
+
+	owner, _ := database.UpsertUser("owner", "owner@example.com", "Owner", false)
+	admin, _ := database.UpsertUser("admin", "admin@example.com", "Admin", true)
+	machine, _ := database.CreateMachine("owner", "Old Laptop")
+	database.CreateSnapshot(machine.ID, &db.InventorySnapshot{Hostname: "old"})
+
+	call := func(handler http.HandlerFunc, user *db.User, isAdmin bool, prompt string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/machines/"+machine.ID, nil)
+		req.SetPathValue("id", machine.ID)
+		req.Header.Set("HX-Request", "true")
+		if prompt != "" {
+			req.Header.Set("HX-Prompt", prompt)
+		}
+		ctx := context.WithValue(req.Context(), middleware.ContextKeyUser, user)
+		ctx = context.WithValue(ctx, middleware.ContextKeyAdmin, isAdmin)
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctx))
+		return w
+	}
+
+	if w := call(h.ArchiveMachine, owner, false, "Replaced"); w.Code != http.StatusOK {
+		t.Fatalf("Expected the owner to archive the machine, got %d: %s", w.Code, w.Body.String())
+	}
+	if m, _ := database.GetMachine(machine.ID); !m.Archived() || m.ArchivedBy != "owner@example.com" || m.ArchiveReason != "Replaced" {
+		t.Errorf("Expected the machine to be archived with its reason, got %+v", m)
+	}
+	if w := call(h.ArchiveMachine, owner, false, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 archiving twice, got %d", w.Code)
+	}
+
+	// Archived machines stop accepting reports
+	req := httptest.NewRequest("POST", "/api/v1/inventory", strings.NewReader(`{"hostname":"old"}`))
+	req.Header.Set("Authorization", "Bearer "+machine.EnrollmentToken)
+	w := httptest.NewRecorder()
+	h.SubmitInventory(w, req)
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected 410 for an archived machine, got %d", w.Code)
+	}
+
+	// Purging waits for the retention period and a lifted legal hold
+	if w := call(h.AdminPurgeMachine, admin, true, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 purging a recently archived machine, got %d", w.Code)
+	}
+	h.archivePurgeDays = 0
+	database.SetMachineLegalHold(machine.ID, true)
+	if w := call(h.AdminPurgeMachine, admin, true, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 purging a machine on legal hold, got %d", w.Code)
+	}
+	database.SetMachineLegalHold(machine.ID, false)
+
+	if w := call(h.AdminRestoreMachine, admin, true, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected the machine to be restored, got %d", w.Code)
+	}
+	if w := call(h.AdminPurgeMachine, admin, true, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 purging an active machine, got %d", w.Code)
+	}
+
+	call(h.AdminArchiveMachine, admin, true, "")
+	if w := call(h.AdminPurgeMachine, admin, true, ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected the machine to be purged, got %d: %s", w.Code, w.Body.String())
+	}
+	if m, _ := database.GetMachine(machine.ID); m != nil {
+		t.Errorf("Expected the machine to be deleted, got %+v", m)
+	}
+
+	var actions []string
+	events, _ := database.GetAuditEvents(db.AuditFilter{})
+	for i := len(events) - 1; i >= 0; i-- {
+		actions = append(actions, events[i].Action)
+	}
+	want := []string{auditMachineArchived, auditMachineRestored, auditMachineArchived, auditMachineDeleted}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected audit events %v, got %v", want, actions)
+	}
+}
+
+func TestSharedInventoryScope(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+	h.templates = map[string]*template.Template{
+		"error.html":          template.Must(template.New("base.html").Parse(`{{.ErrorMessage}}`)),
+		"share_password.html": template.Must(template.New("base.html").Parse(`password:{{.FormError}}`)),
+		"shared.html":         template.Must(template.New("base.html").Parse(`{{range .Machines}}{{.Name}}|{{.OwnerEmail}}|{{len .Notes}};{{end}}`)),
+	}
+
+	admin, _ := database.UpsertUser("admin", "admin@example.com", "Admin", true)
+	database.UpsertUser("alice", "alice@example.com", "Alice", false)
+	database.UpsertUser("bob", "bob@example.com", "Bob", false)
+	mac, _ := database.CreateMachine("alice", "Mac")
+	database.CreateSnapshot(mac.ID, &db.InventorySnapshot{Hostname: "mac", OS: "darwin"})
+	database.CreateMachineNote(mac.ID, "admin", "Internal note")
+	pc, _ := database.CreateMachine("alice", "PC")
+	database.CreateSnapshot(pc.ID, &db.InventorySnapshot{Hostname: "pc", OS: "windows"})
+	bobMac, _ := database.CreateMachine("bob", "Bob Mac")
+	database.CreateSnapshot(bobMac.ID, &db.InventorySnapshot{Hostname: "bob", OS: "darwin"})
+
+	hash, _ := db.HashSharePassword("s3cret")
+	link, _ := database.CreateShareLink(&db.ShareLink{
+		CreatedBy: admin.ID, ExpiresAt: time.Now().Add(time.Hour),
+		FilterOwner: "alice", FilterOS: "darwin", PasswordHash: hash,
+	})
+
+	view := func(method, password string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		body := strings.NewReader(url.Values{"password": {password}}.Encode())
+		req := httptest.NewRequest(method, "/share/"+link.ID, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetPathValue("id", link.ID)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		if method == "POST" {
+			h.UnlockSharedInventory(w, req)
+		} else {
+			h.ViewSharedInventory(w, req)
+		}
+		return w
+	}
+
+	if w := view("GET", ""); w.Body.String() != "password:" {
+		t.Errorf("Expected the password form, got %q", w.Body.String())
+	}
+	if w := view("POST", "wrong"); w.Body.String() != "password:Incorrect password" {
+		t.Errorf("Expected a wrong password to be rejected, got %q", w.Body.String())
+	}
+	if views, _ := database.GetShareLinkViews(link.ID, 10); len(views) != 1 || !views[0].Failed {
+		t.Errorf("Expected the wrong password in the access log, got %+v", views)
+	}
+
+	w := view("POST", "s3cret")
+	if w.Code != http.StatusSeeOther || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("Expected a redirect with an unlock cookie, got %d", w.Code)
+	}
+	unlock := w.Result().Cookies()[0]
+	if unlock.Path != "/share/"+link.ID || !unlock.HttpOnly {
+		t.Errorf("Expected an HttpOnly cookie scoped to the link, got %+v", unlock)
+	}
+
+	// Only Alice's Mac is in scope, without her email or the admin's note
+	if w := view("GET", "", unlock); w.Body.String() != "Mac||0;" {
+		t.Errorf("Expected only the scoped machine without email or notes, got %q", w.Body.String())
+	}
+	if views, _ := database.GetShareLinkViews(link.ID, 10); len(views) != 2 || views[0].Failed || views[0].IPAddress == "" {
+		t.Errorf("Expected one logged view, got %+v", views)
+	}
+
+	// Too many wrong passwords from an address lock it out, even with the right one
+	for i := 1; i < maxShareUnlockFromIP; i++ {
+		view("POST", "wrong")
+	}
+	if w := view("POST", "s3cret"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 after %d wrong passwords, got %d", maxShareUnlockFromIP, w.Code)
+	}
+
+	// Revoked links stop working
+	req := httptest.NewRequest("POST", "/admin/share/"+link.ID+"/revoke", nil)
+	req.SetPathValue("id", link.ID)
+	req.Header.Set("HX-Request", "true")
+	req.Header.Set("HX-Prompt", "Audit finished")
+	req = req.WithContext(context.WithValue(req.Context(), middleware.ContextKeyUser, admin))
+	w = httptest.NewRecorder()
+	h.RevokeShareLink(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the link to be revoked, got %d: %s", w.Code, w.Body.String())
+	}
+	if l, _ := database.GetShareLink(link.ID); l.RevokeReason != "Audit finished" || l.RevokedBy != "admin@example.com" {
+		t.Errorf("Expected the revocation to be recorded, got %+v", l)
+	}
+	if w := view("GET", "", unlock); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a revoked link, got %d", w.Code)
+	}
+}
+
+func TestGenerateInstallCommand(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+	h.templates = map[string]*template.Template{
+		"error.html":   template.Must(template.New("base.html").Parse(`{{.ErrorMessage}}`)),
+		"machine.html": template.Must(template.New("base.html").Parse(`{{with .BootstrapCode}}code:{{.Code}}{{end}}`)),
+	}
+
+	owner, _ := database.UpsertUser("owner", "owner@example.com", "Owner", false)
+	other, _ := database.UpsertUser("other", "other@example.com", "Other", false)
+	machine, _ := database.CreateMachine("owner", "Laptop")
+
+	call := func(method string, handler http.HandlerFunc, user *db.User) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/machines/"+machine.ID, nil)
+		req.SetPathValue("id", machine.ID)
+		ctx := context.WithValue(req.Context(), middleware.ContextKeyUser, user)
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctx))
+		return w
+	}
+
+	// Viewing the page doesn't issue codes
+	if w := call("GET", h.MachineDetail, owner); w.Code != http.StatusOK || w.Body.String() != "" {
+		t.Errorf("Expected the page without a code, got %d: %q", w.Code, w.Body.String())
+	}
+	if active, _ := database.GetActiveBootstrapCode(machine.ID); active != nil {
+		t.Errorf("Expected viewing the page not to issue a code, got %+v", active)
+	}
+
+	if w := call("POST", h.GenerateInstallCommand, other); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 generating another user's install command, got %d", w.Code)
+	}
+	w := call("POST", h.GenerateInstallCommand, owner)
+	code := strings.TrimPrefix(w.Body.String(), "code:")
+	if w.Code != http.StatusOK || code == "" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Expected a new code, got %d: %q", w.Code, w.Body.String())
+	}
+	if ok, _ := database.ValidBootstrapCode(machine.ID, code); !ok {
+		t.Error("Expected the shown code to be valid")
+	}
+	events, _ := database.GetAuditEvents(db.AuditFilter{Action: auditInstallCodeIssued})
+	if len(events) != 1 || events[0].ActorEmail != "owner@example.com" || events[0].TargetID != machine.ID || strings.Contains(events[0].After, code) {
+		t.Errorf("Expected the code to be audited without its text, got %+v", events)
+	}
+
+	// Later views know a code is active but can't show it again
+	if w := call("GET", h.MachineDetail, owner); w.Body.String() != "code:" {
+		t.Errorf("Expected the active code without its text, got %q", w.Body.String())
+	}
+}
+
+func TestMachineTokenRotation(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+	h.templates = map[string]*template.Template{
+		"error.html":   template.Must(template.New("base.html").Parse(`{{.ErrorMessage}}`)),
+		"machine.html": template.Must(template.New("base.html").Parse(`token:{{.NewMachineToken}}`)),
+	}
+
+	owner, _ := database.UpsertUser("owner", "owner@example.com", "Owner", false)
+	other, _ := database.UpsertUser("other", "other@example.com", "Other", false)
+	machine, _ := database.CreateMachine("owner", "Laptop")
+
+	call := func(handler http.HandlerFunc, user *db.User, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/machines/"+machine.ID, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetPathValue("id", machine.ID)
+		ctx := context.WithValue(req.Context(), middleware.ContextKeyUser, user)
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctx))
+		return w
+	}
+	submit := func(token string) int {
+		req := httptest.NewRequest("POST", "/api/v1/inventory", strings.NewReader(`{"hostname":"laptop"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = "203.0.113.7:5000"
+		w := httptest.NewRecorder()
+		h.SubmitInventory(w, req)
+		return w.Code
+	}
+
+	if code := submit(machine.EnrollmentToken); code != http.StatusOK {
+		t.Fatalf("Expected the report to be accepted, got %d", code)
+	}
+	if m, _ := database.GetMachine(machine.ID); m.TokenLastUsedAt == nil || m.TokenLastUsedIP != "203.0.113.7" {
+		t.Errorf("Expected the token's last use to be recorded, got %+v", m)
+	}
+
+	if w := call(h.RotateMachineToken, other, url.Values{}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 rotating another user's token, got %d", w.Code)
+	}
+	if w := call(h.RotateMachineToken, owner, url.Values{"grace_hours": {"1000"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for too long a grace period, got %d", w.Code)
+	}
+
+	w := call(h.RotateMachineToken, owner, url.Values{"grace_hours": {"24"}})
+	token := strings.TrimPrefix(w.Body.String(), "token:")
+	if w.Code != http.StatusOK || token == "" || token == machine.EnrollmentToken {
+		t.Fatalf("Expected the new token to be shown, got %d: %s", w.Code, w.Body.String())
+	}
+	if code := submit(machine.EnrollmentToken); code != http.StatusOK {
+		t.Errorf("Expected the old token to work during its grace period, got %d", code)
+	}
+	if code := submit(token); code != http.StatusOK {
+		t.Errorf("Expected the new token to work, got %d", code)
+	}
+
+	if w := call(h.DisableMachineToken, owner, nil); w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected the token to be disabled, got %d", w.Code)
+	}
+	if code := submit(token); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a disabled token, got %d", code)
+	}
+	call(h.EnableMachineToken, owner, nil)
+	if code := submit(token); code != http.StatusOK {
+		t.Errorf("Expected the re-enabled token to work, got %d", code)
+	}
+
+	var actions []string
+	events, _ := database.GetAuditEvents(db.AuditFilter{})
+	for i := len(events) - 1; i >= 0; i-- {
+		actions = append(actions, events[i].Action)
+	}
+	want := []string{auditMachineTokenRotated, auditMachineTokenDisabled, auditMachineTokenEnabled}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected audit events %v, got %v", want, actions)
+	}
+}
+
+func TestSignedInventory(t *testing.T) {
+	h, database, cleanup := setupTestHandlers(t)
+	defer cleanup()
+
+	database.UpsertUser("test-user", "test@example.com", "Test User", false)
+	machine, _ := database.CreateMachine("test-user", "Test Machine")
+	code, _ := database.CreateBootstrapCode(machine.ID, time.Hour)
+	publicKey, key, _ := ed25519.GenerateKey(nil)
+
+	exchange := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/bootstrap", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		h.BootstrapExchange(w, req)
+		return w
+	}
+	if w := exchange(`{"code":"` + code.Code + `","public_key":"not-a-key"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid key, got %d", w.Code)
+	}
+	w := exchange(`{"code":"` + code.Code + `","public_key":"` + inventory.EncodePublicKey(publicKey) + `"}`)
+	var resp map[string]string
+	json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || resp["token"] == "" {
+		t.Fatalf("Expected the code to be exchanged, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body := `{"hostname":"signed-host"}`
+	submit := func(sign func(http.Header)) int {
+		req := httptest.NewRequest("POST", "/api/v1/inventory", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+resp["token"])
+		sign(req.Header)
+		w := httptest.NewRecorder()
+		h.SubmitInventory(w, req)
+		return w.Code
+	}
+
+	if code := submit(func(http.Header) {}); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unsigned report, got %d", code)
+	}
+	if m, _ := database.GetMachine(machine.ID); m.TokenLastUsedAt != nil {
+		t.Errorf("Expected a rejected report not to count as a use of the token, got %v", m.TokenLastUsedAt)
+	}
+	var signed http.Header
+	if code := submit(func(hdr http.Header) {
+		inventory.Sign(hdr, key, []byte(body), time.Now())
+		signed = hdr.Clone()
+	}); code != http.StatusOK {
+		t.Fatalf("Expected a signed report to be accepted, got %d", code)
+	}
+	if s, _ := database.GetLatestSnapshot(machine.ID); s == nil || !s.Signed {
+		t.Errorf("Expected the snapshot to be marked signed, got %+v", s)
+	}
+
+	// Replayed, stale, tampered and forged reports are rejected
+	if code := submit(func(hdr http.Header) {
+		for k, v := range signed {
+			hdr[k] = v
+		}
+	}); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a replayed report, got %d", code)
+	}
+	if code := submit(func(hdr http.Header) {
+		inventory.Sign(hdr, key, []byte(body), time.Now().Add(-time.Hour))
+	}); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a stale report, got %d", code)
+	}
+	if code := submit(func(hdr http.Header) {
+		inventory.Sign(hdr, key, []byte(`{"hostname":"other-host"}`), time.Now())
+	}); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a tampered report, got %d", code)
+	}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	if code := submit(func(hdr http.Header) {
+		inventory.Sign(hdr, otherKey, []byte(body), time.Now())
+	}); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a report signed with another key, got %d", code)
+	}
+
+	// Reinstalling without a key keeps the registered one
+	code, _ = database.CreateBootstrapCode(machine.ID, time.Hour)
+	w = exchange(`{"code":"` + code.Code + `"}`)
+	json.NewDecoder(w.Body).Decode(&resp)
+	if m, _ := database.GetMachine(machine.ID); w.Code != http.StatusOK || m.PublicKey == "" {
+		t.Fatalf("Expected the key to be kept, got %d: %+v", w.Code, m)
+	}
+	if code := submit(func(http.Header) {}); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unsigned report after reinstalling, got %d", code)
+	}
+
+	// Only the owner or an admin can clear it
+	owner, _ := database.GetUser("test-user")
+	other, _ := database.UpsertUser("other", "other@example.com", "Other", false)
+	clearKey := func(user *db.User) int {
+		req := httptest.NewRequest("POST", "/machines/"+machine.ID+"/signing-key/clear", nil)
+		req.SetPathValue("id", machine.ID)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.ContextKeyUser, user))
+		w := httptest.NewRecorder()
+		h.ClearMachineSigningKey(w, req)
+		return w.Code
+	}
+	if code := clearKey(other); code != http.StatusForbidden {
+		t.Errorf("Expected 403 clearing another user's key, got %d", code)
+	}
+	if code := clearKey(owner); code != http.StatusSeeOther {
+		t.Fatalf("Expected the key to be cleared, got %d", code)
+	}
+	if code := submit(func(http.Header) {}); code != http.StatusOK {
+		t.Errorf("Expected an unsigned report to be accepted once the key is cleared, got %d", code)
+	}
+	if events, _ := database.GetAuditEvents(db.AuditFilter{Action: auditMachineKeyCleared}); len(events) != 1 || events[0].ActorEmail != "test@example.com" {
+		t.Errorf("Expected the key clearing to be audited, got %+v", events)
+	}
+}
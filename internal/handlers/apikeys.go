@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/middleware"
+)
+
+// AdminAPIKeys lists the REST API keys (admin only)
+func (h *Handlers) AdminAPIKeys(w http.ResponseWriter, r *http.Request) {
+	h.renderAPIKeys(w, r, nil, "")
+}
+
+// renderAPIKeys shows the API keys page. newKey is set just after a key is
+// created, the only time its plaintext is available.
+func (h *Handlers) renderAPIKeys(w http.ResponseWriter, r *http.Request, newKey *db.APIKey, formError string) {
+	keys, err := h.db.GetAPIKeys()
+	if err != nil {
+		http.Error(w, "Failed to load API keys", http.StatusInternalServerError)
+		return
+	}
+
+	if formError != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	h.render(w, r, "apikeys.html", &PageData{
+		Title:     "API Keys",
+		Active:    "apikeys",
+		APIKeys:   keys,
+		APIKey:    newKey,
+		APIScopes: db.APIScopes,
+		FormError: formError,
+	})
+}
+
+// CreateAPIKey issues a new API key and shows it once (admin only)
+func (h *Handlers) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		h.renderAPIKeys(w, r, nil, "Name is required")
+		return
+	}
+
+	r.ParseForm()
+	scopes := r.Form["scopes"]
+	if len(scopes) == 0 {
+		h.renderAPIKeys(w, r, nil, "Select at least one scope")
+		return
+	}
+	for _, s := range scopes {
+		if !slices.Contains(db.APIScopes, s) {
+			h.renderAPIKeys(w, r, nil, "Unknown scope: "+s)
+			return
+		}
+	}
+
+	// Expiry in days; 0 creates a key that never expires
+	var expiresAt *time.Time
+	days, err := strconv.Atoi(r.FormValue("expires_days"))
+	if err != nil || days < 0 || days > 365 {
+		h.renderAPIKeys(w, r, nil, "Expiry must be between 0 and 365 days")
+		return
+	}
+	if days > 0 {
+		t := time.Now().UTC().AddDate(0, 0, days)
+		expiresAt = &t
+	}
+
+	user := middleware.GetUser(r.Context())
+	key, err := h.db.CreateAPIKey(name, user.ID, scopes, expiresAt)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditAPIKeyCreated, "api_key", strconv.FormatInt(key.ID, 10), nil, key)
+
+	h.renderAPIKeys(w, r, key, "")
+}
+
+// DeleteAPIKey revokes an API key (admin only)
+func (h *Handlers) DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.db.GetAPIKey(id)
+	if err != nil || key == nil {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.DeleteAPIKey(id); err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditAPIKeyDeleted, "api_key", strconv.FormatInt(id, 10), key, nil)
+
+	// HTMX request: return empty response (row will be removed via hx-swap)
+	if r.Header.Get("HX-Request") == "true" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/api-keys", http.StatusSeeOther)
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/middleware"
+	"github.com/jclement/boxcheckr/internal/webhook"
+)
+
+// maxArchiveReason limits the length of an archive reason
+const maxArchiveReason = 500
+
+// ArchiveMachine archives a machine for its owner or an admin. It disappears
+// from default views and stops accepting reports, but keeps its history.
+func (h *Handlers) ArchiveMachine(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+
+	machine, err := h.db.GetMachine(r.PathValue("id"))
+	if err != nil || machine == nil {
+		h.renderError(w, r, http.StatusNotFound, "Machine not found")
+		return
+	}
+
+	// Check ownership (unless admin)
+	if machine.UserID != user.ID && !middleware.IsAdmin(r.Context()) {
+		h.renderError(w, r, http.StatusForbidden, "You don't have permission to archive this machine")
+		return
+	}
+
+	if !h.archiveMachine(w, r, machine) {
+		return
+	}
+
+	// HTMX request: return empty response (row will be removed via hx-swap)
+	if r.Header.Get("HX-Request") == "true" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// AdminArchiveMachine archives any machine from the admin list (admin only)
+func (h *Handlers) AdminArchiveMachine(w http.ResponseWriter, r *http.Request) {
+	machine, err := h.db.GetMachine(r.PathValue("id"))
+	if err != nil || machine == nil {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	}
+
+	if !h.archiveMachine(w, r, machine) {
+		return
+	}
+
+	// HTMX request: return empty response (row will be removed via hx-swap)
+	if r.Header.Get("HX-Request") == "true" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/machines", http.StatusSeeOther)
+}
+
+// archiveMachine archives machine with the reason from the form or an
+// hx-prompt, writing an error response and returning false if it can't
+func (h *Handlers) archiveMachine(w http.ResponseWriter, r *http.Request, machine *db.Machine) bool {
+	if machine.Archived() {
+		http.Error(w, "Machine is already archived", http.StatusConflict)
+		return false
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		reason = strings.TrimSpace(r.Header.Get("HX-Prompt"))
+	}
+	if len(reason) > maxArchiveReason {
+		http.Error(w, "Reason is too long", http.StatusBadRequest)
+		return false
+	}
+
+	archivedBy := ""
+	if user := middleware.GetUser(r.Context()); user != nil {
+		archivedBy = user.Email
+	}
+	if err := h.db.ArchiveMachine(machine.ID, archivedBy, reason); err != nil {
+		http.Error(w, "Failed to archive machine", http.StatusInternalServerError)
+		return false
+	}
+
+	h.emit(webhook.EventMachineArchived, map[string]interface{}{
+		"machine":     h.webhookMachine(machine),
+		"archived_by": archivedBy,
+		"reason":      reason,
+	})
+	h.audit(r, auditMachineArchived, "machine", machine.ID, auditMachine(machine), map[string]string{"reason": reason})
+	return true
+}
+
+// AdminArchivedMachines lists archived machines, most recently archived
+// first (admin only)
+func (h *Handlers) AdminArchivedMachines(w http.ResponseWriter, r *http.Request) {
+	machines, err := h.db.GetArchivedMachines()
+	if err != nil {
+		http.Error(w, "Failed to load machines", http.StatusInternalServerError)
+		return
+	}
+
+	h.render(w, r, "archived.html", &PageData{
+		Title:            "Archived Machines",
+		Active:           "admin",
+		Machines:         machines,
+		ArchivePurgeDays: h.archivePurgeDays,
+	})
+}
+
+// AdminRestoreMachine returns an archived machine to service (admin only)
+func (h *Handlers) AdminRestoreMachine(w http.ResponseWriter, r *http.Request) {
+	machine, err := h.db.GetMachine(r.PathValue("id"))
+	if err != nil || machine == nil {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	}
+	if !machine.Archived() {
+		http.Error(w, "Machine is not archived", http.StatusConflict)
+		return
+	}
+
+	if err := h.db.RestoreMachine(machine.ID); err != nil {
+		http.Error(w, "Failed to restore machine", http.StatusInternalServerError)
+		return
+	}
+
+	restoredBy := ""
+	if user := middleware.GetUser(r.Context()); user != nil {
+		restoredBy = user.Email
+	}
+	h.emit(webhook.EventMachineRestored, map[string]interface{}{
+		"machine":     h.webhookMachine(machine),
+		"restored_by": restoredBy,
+	})
+	h.audit(r, auditMachineRestored, "machine", machine.ID, auditArchivedMachine(machine), auditMachine(machine))
+
+	// HTMX request: return empty response (row will be removed via hx-swap)
+	if r.Header.Get("HX-Request") == "true" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Redirect(w, r, "/machines/"+machine.ID, http.StatusSeeOther)
+}
+
+// AdminPurgeMachine permanently deletes an archived machine and its history
+// once it has been archived for ARCHIVE_PURGE_DAYS, unless it is on legal
+// hold (admin only)
+func (h *Handlers) AdminPurgeMachine(w http.ResponseWriter, r *http.Request) {
+	machine, err := h.db.GetMachine(r.PathValue("id"))
+	if err != nil || machine == nil {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case !machine.Archived():
+		http.Error(w, "Only archived machines can be purged", http.StatusConflict)
+		return
+	case machine.LegalHold:
+		http.Error(w, "Machine is on legal hold", http.StatusConflict)
+		return
+	case !machine.CanPurge(h.archivePurgeDays, time.Now()):
+		http.Error(w, "Machine can't be purged until "+machine.PurgeableAt(h.archivePurgeDays).Format("January 2, 2006"), http.StatusConflict)
+		return
+	}
+
+	if err := h.db.DeleteMachine(machine.ID); err != nil {
+		http.Error(w, "Failed to purge machine", http.StatusInternalServerError)
+		return
+	}
+
+	deletedBy := ""
+	if user := middleware.GetUser(r.Context()); user != nil {
+		deletedBy = user.Email
+	}
+	h.emit(webhook.EventMachineDeleted, map[string]interface{}{
+		"machine":    h.webhookMachine(machine),
+		"deleted_by": deletedBy,
+	})
+	h.audit(r, auditMachineDeleted, "machine", machine.ID, auditArchivedMachine(machine), nil)
+
+	// HTMX request: return empty response (row will be removed via hx-swap)
+	if r.Header.Get("HX-Request") == "true" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/machines/archived", http.StatusSeeOther)
+}
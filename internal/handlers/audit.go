@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/export"
+	"github.com/jclement/boxcheckr/internal/middleware"
+)
+
+// Audit log actions
+const (
+	auditSignedIn              = "user.signed_in"
+	auditSignedOut             = "user.signed_out"
+	auditSignedOutEverywhere   = "user.signed_out_everywhere"
+	auditNotificationsChanged  = "user.notifications_changed"
+	auditSessionRevoked        = "session.revoked"
+	auditUserSessionsRevoked   = "user.sessions_revoked"
+	auditMachineEnrolled       = "machine.enrolled"
+	auditMachineBootstrapped   = "machine.bootstrapped"
+	auditInstallCodeIssued     = "machine.install_code_issued"
+	auditMachineArchived       = "machine.archived"
+	auditMachineRestored       = "machine.restored"
+	auditMachineDeleted        = "machine.deleted"
+	auditMachineCheckInChanged = "machine.checkin_changed"
+	auditMachineTokenRotated   = "machine.token_rotated"
+	auditMachineTokenDisabled  = "machine.token_disabled"
+	auditMachineTokenEnabled   = "machine.token_enabled"
+	auditMachineKeyCleared     = "machine.signing_key_cleared"
+	auditMachineLegalHold      = "machine.legal_hold_changed"
+	auditNoteAdded             = "note.added"
+	auditNoteDeleted           = "note.deleted"
+	auditShareLinkCreated      = "share_link.created"
+	auditShareLinkUpdated      = "share_link.updated"
+	auditShareLinkRevoked      = "share_link.revoked"
+	auditShareLinkDeleted      = "share_link.deleted"
+	auditShareLinkViewed       = "share_link.viewed"
+	auditPolicyRuleCreated     = "policy_rule.created"
+	auditPolicyRuleUpdated     = "policy_rule.updated"
+	auditPolicyRuleDeleted     = "policy_rule.deleted"
+	auditWebhookCreated        = "webhook.created"
+	auditWebhookUpdated        = "webhook.updated"
+	auditWebhookDeleted        = "webhook.deleted"
+	auditAPIKeyCreated         = "api_key.created"
+	auditAPIKeyDeleted         = "api_key.deleted"
+	auditRetentionRun          = "retention.run"
+	auditBackupCreated         = "backup.created"
+	auditBackupDownloaded      = "backup.downloaded"
+	auditLogExported           = "audit_log.exported"
+)
+
+// audit records an action by the signed-in user, if any, in the audit log.
+// before and after describe the target and are stored as JSON; either may
+// be nil. Failures are logged rather than failing the request.
+func (h *Handlers) audit(r *http.Request, action, targetType, targetID string, before, after interface{}) {
+	h.auditAs(r, middleware.GetUser(r.Context()), action, targetType, targetID, before, after)
+}
+
+// auditAs records an action by actor, for requests outside the auth
+// middleware such as sign-in
+func (h *Handlers) auditAs(r *http.Request, actor *db.User, action, targetType, targetID string, before, after interface{}) {
+	e := &db.AuditEvent{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IPAddress:  middleware.ClientIP(r),
+		UserAgent:  r.UserAgent(),
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+	}
+	if actor != nil {
+		e.ActorID, e.ActorEmail = actor.ID, actor.Email
+	}
+	if err := h.db.CreateAuditEvent(e); err != nil {
+		log.Printf("Failed to record %s audit event: %v", action, err)
+	}
+}
+
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// auditUser describes a user for the audit log, or is nil if there is none
+func auditUser(u *db.User) interface{} {
+	if u == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"email":    u.Email,
+		"name":     u.Name,
+		"is_admin": u.IsAdmin,
+	}
+}
+
+// auditMachine describes a machine for the audit log, leaving out its
+// enrollment token
+func auditMachine(m *db.Machine) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           m.ID,
+		"name":         m.Name,
+		"user_id":      m.UserID,
+		"mode":         m.Mode,
+		"checkin_days": m.CheckInDays,
+		"legal_hold":   m.LegalHold,
+	}
+}
+
+// auditArchivedMachine describes an archived machine, including when, by
+// whom and why it was archived
+func auditArchivedMachine(m *db.Machine) map[string]interface{} {
+	a := auditMachine(m)
+	a["archived_at"] = m.ArchivedAt
+	a["archived_by"] = m.ArchivedBy
+	a["archive_reason"] = m.ArchiveReason
+	return a
+}
+
+// auditMachineToken describes a machine's token state, identifying the
+// token by its prefix
+func auditMachineToken(m *db.Machine) map[string]interface{} {
+	a := auditMachine(m)
+	a["token_prefix"] = m.TokenPrefix
+	a["token_issued_at"] = m.TokenIssuedAt
+	a["token_disabled_at"] = m.TokenDisabledAt
+	return a
+}
+
+// auditShareLink describes a share link for the audit log, leaving out its ID
+func auditShareLink(l *db.ShareLink) map[string]interface{} {
+	return map[string]interface{}{
+		"created_by":        l.CreatedBy,
+		"expires_at":        l.ExpiresAt,
+		"as_of":             l.AsOf,
+		"label":             l.Label,
+		"filter_owner":      l.FilterOwner,
+		"filter_machine":    l.FilterMachine,
+		"filter_os":         l.FilterOS,
+		"show_notes":        l.ShowNotes,
+		"show_owner_emails": l.ShowOwnerEmails,
+		"has_password":      l.HasPassword(),
+		"revoked_at":        l.RevokedAt,
+		"revoked_by":        l.RevokedBy,
+		"revoke_reason":     l.RevokeReason,
+	}
+}
+
+// auditShareLinkID identifies a share link without recording the ID, which
+// is also its secret
+func auditShareLinkID(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// auditFilter reads the audit log filters from the query string. Dates are
+// inclusive days in UTC.
+func auditFilter(r *http.Request) db.AuditFilter {
+	q := r.URL.Query()
+	filter := db.AuditFilter{
+		Query:  q.Get("q"),
+		Action: q.Get("action"),
+	}
+	if t, err := time.Parse("2006-01-02", q.Get("from")); err == nil {
+		filter.From = t
+	}
+	if t, err := time.Parse("2006-01-02", q.Get("to")); err == nil {
+		filter.To = t.AddDate(0, 0, 1)
+	}
+	return filter
+}
+
+// auditPageSize limits how many entries the audit page shows; the CSV
+// export has them all
+const auditPageSize = 200
+
+// AdminAudit shows the audit log, newest first (admin only)
+func (h *Handlers) AdminAudit(w http.ResponseWriter, r *http.Request) {
+	filter := auditFilter(r)
+	filter.Limit = auditPageSize
+	events, err := h.db.GetAuditEvents(filter)
+	if err != nil {
+		http.Error(w, "Failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+	actions, err := h.db.GetAuditActions()
+	if err != nil {
+		http.Error(w, "Failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+	verification, err := h.db.VerifyAuditLog()
+	if err != nil {
+		http.Error(w, "Failed to verify audit log", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	h.render(w, r, "audit.html", &PageData{
+		Title:             "Audit Log",
+		Active:            "audit",
+		AuditEvents:       events,
+		AuditActions:      actions,
+		AuditVerification: verification,
+		AuditTruncated:    len(events) == auditPageSize,
+		FilterQuery:       q.Get("q"),
+		FilterAction:      q.Get("action"),
+		FilterFrom:        q.Get("from"),
+		FilterTo:          q.Get("to"),
+	})
+}
+
+// AdminExportAudit streams the filtered audit log as CSV (admin only)
+func (h *Handlers) AdminExportAudit(w http.ResponseWriter, r *http.Request) {
+	filter := auditFilter(r)
+	h.audit(r, auditLogExported, "", "", nil, r.URL.Query())
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+export.AuditFilename(time.Now())+`"`)
+
+	out := export.NewAuditCSV(w)
+	err := h.db.EachAuditEvent(filter, out.WriteEvent)
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		// The response has already started, so the download is left truncated
+		log.Printf("Failed to export audit log: %v", err)
+	}
+}
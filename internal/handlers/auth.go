@@ -13,6 +13,11 @@ func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.devAuth {
+		http.Redirect(w, r, "/auth/dev", http.StatusSeeOther)
+		return
+	}
+
 	state := middleware.GenerateState()
 	session, _ := h.sessions.Get(r)
 	session.Values["oauth_state"] = state
@@ -23,6 +28,11 @@ func (h *Handlers) Login(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handlers) Callback(w http.ResponseWriter, r *http.Request) {
+	if h.oidc == nil {
+		h.renderError(w, r, http.StatusNotFound, "Page not found")
+		return
+	}
+
 	session, _ := h.sessions.Get(r)
 	expectedState, ok := session.Values["oauth_state"].(string)
 	if !ok {
@@ -51,26 +61,37 @@ func (h *Handlers) Callback(w http.ResponseWriter, r *http.Request) {
 	isAdmin := h.oidc.IsAdmin(claims)
 
 	// Upsert user in database
-	_, err = h.db.UpsertUser(claims.Subject, claims.Email, claims.Name, isAdmin)
+	before, _ := h.db.GetUser(claims.Subject)
+	user, err := h.db.UpsertUser(claims.Subject, claims.Email, claims.Name, isAdmin)
 	if err != nil {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
 
 	// Set session
-	if err := h.sessions.SetUser(r, w, claims.Subject, isAdmin); err != nil {
+	if err := h.sessions.SetUser(r, w, claims.Subject, isAdmin, claims.RefreshToken); err != nil {
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
+	h.auditAs(r, user, auditSignedIn, "user", user.ID, auditUser(before), auditUser(user))
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (h *Handlers) Logout(w http.ResponseWriter, r *http.Request) {
+	if userID, _, ok := h.sessions.GetUser(r); ok {
+		if user, _ := h.db.GetUser(userID); user != nil {
+			h.auditAs(r, user, auditSignedOut, "user", user.ID, nil, nil)
+		}
+	}
 	h.sessions.Clear(r, w)
 	h.render(w, r, "logout.html", &PageData{Title: "Signed Out"})
 }
 
 func (h *Handlers) LoginPage(w http.ResponseWriter, r *http.Request) {
-	h.render(w, r, "login.html", &PageData{Title: "Sign In"})
+	if h.devAuth {
+		http.Redirect(w, r, "/auth/dev", http.StatusSeeOther)
+		return
+	}
+	h.render(w, r, "login.html", &PageData{Title: "Sign In", LoginProvider: h.oidc.Name()})
 }
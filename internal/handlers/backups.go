@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/backup"
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+// AdminBackups lists the backups in BACKUP_DIR (admin only)
+func (h *Handlers) AdminBackups(w http.ResponseWriter, r *http.Request) {
+	h.renderBackups(w, r, "")
+}
+
+// renderBackups shows the backups page, with formError if the last backup failed
+func (h *Handlers) renderBackups(w http.ResponseWriter, r *http.Request, formError string) {
+	files, err := backup.List(h.backupDir)
+	if err != nil {
+		http.Error(w, "Failed to list backups", http.StatusInternalServerError)
+		return
+	}
+
+	if formError != "" {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	h.render(w, r, "backups.html", &PageData{
+		Title:     "Backups",
+		Active:    "backups",
+		Backups:   files,
+		BackupDir: h.backupDir,
+		FormError: formError,
+	})
+}
+
+// CreateBackup backs up the database into BACKUP_DIR now and rotates old
+// backups (admin only)
+func (h *Handlers) CreateBackup(w http.ResponseWriter, r *http.Request) {
+	if h.backupDir == "" {
+		http.Error(w, "Backups are not enabled", http.StatusBadRequest)
+		return
+	}
+
+	path, err := backup.Create(h.db, h.backupDir, time.Now())
+	if errors.Is(err, db.ErrBackupUnsupported) {
+		h.renderBackups(w, r, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Backup failed: %v", err)
+		h.renderBackups(w, r, "Backup failed")
+		return
+	}
+	log.Printf("Backed up database to %s", path)
+	h.audit(r, auditBackupCreated, "backup", filepath.Base(path), nil, nil)
+
+	if _, err := backup.Rotate(h.backupDir, h.backupKeep); err != nil {
+		log.Printf("Failed to rotate backups: %v", err)
+	}
+
+	http.Redirect(w, r, "/admin/backups", http.StatusSeeOther)
+}
+
+// DownloadBackup serves a backup file (admin only)
+func (h *Handlers) DownloadBackup(w http.ResponseWriter, r *http.Request) {
+	path, ok := backup.Path(h.backupDir, r.PathValue("name"))
+	if h.backupDir == "" || !ok {
+		h.renderError(w, r, http.StatusNotFound, "Backup not found")
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		h.renderError(w, r, http.StatusNotFound, "Backup not found")
+		return
+	}
+
+	h.audit(r, auditBackupDownloaded, "backup", r.PathValue("name"), nil, nil)
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+r.PathValue("name")+`"`)
+	http.ServeFile(w, r, path)
+}
@@ -23,9 +23,29 @@ func (h *Handlers) Dashboard(w http.ResponseWriter, r *http.Request) {
 	stats, _ := h.db.GetUserDashboardStats(user.ID)
 
 	h.render(w, r, "dashboard.html", &PageData{
-		Title:    "Dashboard",
-		Active:   "dashboard",
-		Stats:    stats,
-		Machines: machines,
+		Title:              "Dashboard",
+		Active:             "dashboard",
+		Stats:              stats,
+		Machines:           machines,
+		EmailNotifications: h.notifier != nil,
 	})
 }
+
+// UpdateNotificationSettings turns the current user's notification emails on or off
+func (h *Handlers) UpdateNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+
+	optOut := r.FormValue("email") != "on"
+	if err := h.db.SetUserEmailOptOut(user.ID, optOut); err != nil {
+		http.Error(w, "Failed to update notification settings", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditNotificationsChanged, "user", user.ID,
+		map[string]bool{"email_opt_out": user.EmailOptOut}, map[string]bool{"email_opt_out": optOut})
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// devUserIDChars matches the runs of an email replaced by a dash in a user ID
+var devUserIDChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// devUserID derives a stable user ID for a development sign-in from an email
+func devUserID(email string) string {
+	return "dev-" + strings.Trim(devUserIDChars.ReplaceAllString(strings.ToLower(email), "-"), "-")
+}
+
+// DevLogin shows the development user picker. Only routed when DEV_AUTH is set.
+func (h *Handlers) DevLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.devAuth {
+		h.renderError(w, r, http.StatusNotFound, "Page not found")
+		return
+	}
+
+	users, err := h.db.GetUsers()
+	if err != nil {
+		http.Error(w, "Failed to load users", http.StatusInternalServerError)
+		return
+	}
+
+	h.render(w, r, "dev_login.html", &PageData{
+		Title:    "Development Sign In",
+		DevUsers: users,
+	})
+}
+
+// DevLoginSubmit signs in as an existing user, or a new one with the given
+// email and name, as an admin or not. Only routed when DEV_AUTH is set.
+func (h *Handlers) DevLoginSubmit(w http.ResponseWriter, r *http.Request) {
+	if !h.devAuth {
+		h.renderError(w, r, http.StatusNotFound, "Page not found")
+		return
+	}
+
+	isAdmin := r.FormValue("admin") == "true"
+	id := r.FormValue("user_id")
+	email := strings.TrimSpace(r.FormValue("email"))
+	name := strings.TrimSpace(r.FormValue("name"))
+
+	if id != "" {
+		user, err := h.db.GetUser(id)
+		if err != nil || user == nil {
+			http.Error(w, "User not found", http.StatusBadRequest)
+			return
+		}
+		email, name = user.Email, user.Name
+	} else {
+		if email == "" {
+			http.Error(w, "Email is required", http.StatusBadRequest)
+			return
+		}
+		if name == "" {
+			name = email
+		}
+		id = devUserID(email)
+	}
+
+	// The same path as an OIDC callback
+	before, _ := h.db.GetUser(id)
+	user, err := h.db.UpsertUser(id, email, name, isAdmin)
+	if err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+	if err := h.sessions.SetUser(r, w, id, isAdmin, ""); err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	h.auditAs(r, user, auditSignedIn, "user", user.ID, auditUser(before), auditUser(user))
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
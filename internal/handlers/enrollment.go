@@ -4,7 +4,10 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/jclement/boxcheckr/internal/checks"
+	"github.com/jclement/boxcheckr/internal/db"
 	"github.com/jclement/boxcheckr/internal/middleware"
+	"github.com/jclement/boxcheckr/internal/webhook"
 )
 
 func (h *Handlers) EnrollPage(w http.ResponseWriter, r *http.Request) {
@@ -33,6 +36,11 @@ func (h *Handlers) EnrollMachine(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.emit(webhook.EventMachineEnrolled, map[string]interface{}{
+		"machine": h.webhookMachine(machine),
+	})
+	h.audit(r, auditMachineEnrolled, "machine", machine.ID, nil, auditMachine(machine))
+
 	// Redirect to machine detail page to show script download
 	http.Redirect(w, r, "/machines/"+machine.ID, http.StatusSeeOther)
 }
@@ -57,52 +65,50 @@ func (h *Handlers) MachineDetail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	h.renderMachine(w, r, machine, "", nil)
+}
+
+// renderMachine shows the machine page. newToken is a token just issued by a
+// rotation, and code a bootstrap code just generated; each is shown once.
+func (h *Handlers) renderMachine(w http.ResponseWriter, r *http.Request, machine *db.Machine, newToken string, code *db.BootstrapCode) {
+	machineID := machine.ID
 	latest, _ := h.db.GetLatestSnapshot(machineID)
 	history, _ := h.db.GetSnapshotHistory(machineID, 20)
+	timeline, _ := h.db.GetSnapshotTransitions(machineID, timelineLength)
 	notes, _ := h.db.GetMachineNotes(machineID)
 
-	h.render(w, r, "machine.html", &PageData{
-		Title:   machine.Name,
-		Active:  "dashboard",
-		Machine: machine,
-		Latest:  latest,
-		History: history,
-		Notes:   notes,
-	})
-}
-
-func (h *Handlers) DeleteMachine(w http.ResponseWriter, r *http.Request) {
-	user := middleware.GetUser(r.Context())
-	if user == nil {
-		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
-		return
-	}
-
-	machineID := r.PathValue("id")
-	machine, err := h.db.GetMachine(machineID)
-	if err != nil || machine == nil {
-		h.renderError(w, r, http.StatusNotFound, "Machine not found")
-		return
-	}
-
-	// Check ownership (unless admin)
-	if machine.UserID != user.ID && !middleware.IsAdmin(r.Context()) {
-		h.renderError(w, r, http.StatusForbidden, "You don't have permission to delete this machine")
-		return
-	}
-
-	if err := h.db.DeleteMachine(machineID); err != nil {
-		http.Error(w, "Failed to delete machine", http.StatusInternalServerError)
-		return
+	var results []db.PolicyResult
+	var named []checks.Result
+	if latest != nil {
+		results, _ = h.db.GetPolicyResults(latest.ID)
+		for _, c := range checks.Results(latest) {
+			if !c.Legacy {
+				named = append(named, c)
+			}
+		}
 	}
 
-	// HTMX request: return empty response (row will be removed via hx-swap)
-	if r.Header.Get("HX-Request") == "true" {
-		w.WriteHeader(http.StatusOK)
-		return
+	// Without a new code, say whether an earlier one still works. Archived
+	// machines can't report, so they get none.
+	if code == nil && !machine.Archived() {
+		code, _ = h.db.GetActiveBootstrapCode(machineID)
 	}
 
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	h.render(w, r, "machine.html", &PageData{
+		Title:            machine.Name,
+		Active:           "dashboard",
+		Machine:          machine,
+		Latest:           latest,
+		History:          history,
+		Timeline:         timeline,
+		Notes:            notes,
+		Checks:           named,
+		PolicyResults:    results,
+		CheckInDays:      machine.ExpectedCheckInDays(h.checkInDays),
+		BootstrapCode:    code,
+		NewMachineToken:  newToken,
+		ArchivePurgeDays: h.archivePurgeDays,
+	})
 }
 
 // notePartialTemplate is the HTML template for a single note (used by HTMX)
@@ -153,6 +159,7 @@ func (h *Handlers) AddMachineNote(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to add note", http.StatusInternalServerError)
 		return
 	}
+	h.audit(r, auditNoteAdded, "note", strconv.FormatInt(note.ID, 10), nil, note)
 
 	// HTMX request: return just the note HTML fragment
 	if r.Header.Get("HX-Request") == "true" {
@@ -190,6 +197,7 @@ func (h *Handlers) DeleteMachineNote(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to delete note", http.StatusInternalServerError)
 		return
 	}
+	h.audit(r, auditNoteDeleted, "note", noteIDStr, note, nil)
 
 	// HTMX request: return empty response (note will be removed via hx-swap)
 	if r.Header.Get("HX-Request") == "true" {
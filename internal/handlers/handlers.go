@@ -2,31 +2,95 @@ package handlers
 
 import (
 	"bytes"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/jclement/boxcheckr/internal/auth"
+	"github.com/jclement/boxcheckr/internal/backup"
+	"github.com/jclement/boxcheckr/internal/checks"
 	"github.com/jclement/boxcheckr/internal/db"
 	"github.com/jclement/boxcheckr/internal/middleware"
+	"github.com/jclement/boxcheckr/internal/notify"
+	"github.com/jclement/boxcheckr/internal/retention"
 )
 
 var funcMap = template.FuncMap{
-	"now": time.Now,
+	"now":      time.Now,
+	"duration": formatDuration,
+}
+
+// formatDuration renders a configured duration briefly, e.g. "7 days" or "15m"
+func formatDuration(d time.Duration) string {
+	if d >= 48*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// Config holds what the handlers need from the server's setup
+type Config struct {
+	DB       db.Store
+	OIDC     *auth.OIDCProvider // nil when DevAuth is on
+	Sessions *middleware.SessionStore
+	BaseURL  string
+	Version  string
+	AgentDir string
+
+	// CheckInDays is the default number of days a machine may go without
+	// reporting before it is overdue
+	CheckInDays int
+
+	// ArchivePurgeDays is how long a machine must be archived before it can
+	// be purged
+	ArchivePurgeDays int
+
+	// Notifier emails owners about failing controls; nil when SMTP isn't configured
+	Notifier *notify.Notifier
+
+	// Retention thins out old snapshots on a schedule
+	Retention *retention.Job
+
+	// BackupDir holds backups taken from the admin page; empty disables them.
+	// BackupKeep is how many are kept.
+	BackupDir  string
+	BackupKeep int
+
+	// DevAuth replaces OIDC with a user picker, for local development only
+	DevAuth bool
 }
 
 type Handlers struct {
-	db        *db.DB
+	db        db.Store
 	oidc      *auth.OIDCProvider
 	sessions  *middleware.SessionStore
 	baseURL   string
 	version   string
+	agentDir  string
 	templates map[string]*template.Template
+
+	// These are described on Config
+	checkInDays      int
+	archivePurgeDays int
+	notifier         *notify.Notifier
+	retention        *retention.Job
+	backupDir        string
+	backupKeep       int
+	devAuth          bool
 }
 
-func New(database *db.DB, oidc *auth.OIDCProvider, sessions *middleware.SessionStore, baseURL string, version string) *Handlers {
+func New(cfg Config) *Handlers {
 	templates := make(map[string]*template.Template)
 	basePath := filepath.Join("web", "templates", "base.html")
 
@@ -35,7 +99,9 @@ func New(database *db.DB, oidc *auth.OIDCProvider, sessions *middleware.SessionS
 		"dashboard.html",
 		"enroll.html",
 		"machine.html",
+		"snapshot_diff.html",
 		"login.html",
+		"dev_login.html",
 		"logout.html",
 		"error.html",
 	}
@@ -50,6 +116,15 @@ func New(database *db.DB, oidc *auth.OIDCProvider, sessions *middleware.SessionS
 	adminTemplates := []string{
 		"machines.html",
 		"share.html",
+		"share_link.html",
+		"policies.html",
+		"webhooks.html",
+		"apikeys.html",
+		"retention.html",
+		"backups.html",
+		"sessions.html",
+		"audit.html",
+		"archived.html",
 	}
 
 	for _, page := range adminTemplates {
@@ -66,6 +141,7 @@ func New(database *db.DB, oidc *auth.OIDCProvider, sessions *middleware.SessionS
 	publicBasePath := filepath.Join("web", "templates", "public_base.html")
 	publicTemplates := []string{
 		"shared.html",
+		"share_password.html",
 	}
 
 	for _, page := range publicTemplates {
@@ -75,12 +151,21 @@ func New(database *db.DB, oidc *auth.OIDCProvider, sessions *middleware.SessionS
 	}
 
 	return &Handlers{
-		db:        database,
-		oidc:      oidc,
-		sessions:  sessions,
-		baseURL:   baseURL,
-		version:   version,
+		db:        cfg.DB,
+		oidc:      cfg.OIDC,
+		sessions:  cfg.Sessions,
+		baseURL:   cfg.BaseURL,
+		version:   cfg.Version,
+		agentDir:  cfg.AgentDir,
 		templates: templates,
+
+		checkInDays:      cfg.CheckInDays,
+		archivePurgeDays: cfg.ArchivePurgeDays,
+		notifier:         cfg.Notifier,
+		retention:        cfg.Retention,
+		backupDir:        cfg.BackupDir,
+		backupKeep:       cfg.BackupKeep,
+		devAuth:          cfg.DevAuth,
 	}
 }
 
@@ -93,20 +178,77 @@ type PageData struct {
 	Version string
 
 	// Page-specific data
-	Stats         *db.DashboardStats
-	Machines      interface{}
-	Machine       *db.Machine
-	Latest        *db.InventorySnapshot
-	History       []db.InventorySnapshot
-	Notes         []db.MachineNote
-	Success       bool
-	FilterOwner   string
-	FilterMachine string
+	Stats              *db.DashboardStats
+	EmailNotifications bool // SMTP is configured, so the opt-out setting applies
+	Machines           interface{}
+	Machine            *db.Machine
+	Latest             *db.InventorySnapshot
+	History            []db.InventorySnapshot
+	Timeline           []db.SnapshotTransition
+	Diff               *SnapshotDiff
+	Notes              []db.MachineNote
+	Checks             []checks.Result // Named checks for Latest, beyond the original four
+	Success            bool
+	FilterOwner        string
+	FilterMachine      string
+	FilterCheckIn      string
+	FilterAsOf         string    // asof as entered, see parseAsOf
+	AsOf               time.Time // Point in time shown; zero for the current state
+	CheckInDays        int       // Effective check-in interval for Machine; 0 if none applies
+	BootstrapCode      *db.BootstrapCode
+	NewMachineToken    string // Token just issued by a rotation, shown once
+	ArchivePurgeDays   int    // Days a machine must be archived before it can be purged
+
+	// Compliance policy
+	PolicyRules     []db.PolicyRule
+	PolicyResults   []db.PolicyResult
+	PolicyFields    []string
+	PolicyOperators []string
+	PolicyPlatforms []string
+	FormError       string
+
+	// Webhooks
+	Webhooks          []db.Webhook
+	WebhookDeliveries []db.WebhookDelivery
+	WebhookEvents     []string
+
+	// API keys
+	APIKeys   []db.APIKey
+	APIKey    *db.APIKey // Just created, with its plaintext key
+	APIScopes []string
+
+	// Snapshot retention
+	Retention *RetentionPreview
+
+	// Sessions
+	Sessions         []db.Session
+	CurrentSessionID string
+	SessionConfig    middleware.SessionConfig
+
+	// Audit log
+	AuditEvents       []db.AuditEvent
+	AuditActions      []string
+	AuditVerification *db.AuditVerification
+	AuditTruncated    bool // More entries match than are shown
+	FilterQuery       string
+	FilterAction      string
+	FilterFrom        string
+	FilterTo          string
+
+	// Backups
+	Backups   []backup.File
+	BackupDir string
 
 	// Share links
-	ShareLinks []db.ShareLink
-	ShareLink  *db.ShareLink
-	NewLinkID  string
+	ShareLinks     []db.ShareLink
+	ShareLink      *db.ShareLink
+	ShareLinkViews []db.ShareLinkView
+	NewLinkID      string
+
+	// Name of the OIDC provider on the sign-in button
+	LoginProvider string
+	DevAuth       bool      // Development sign-in is enabled
+	DevUsers      []db.User // Users offered by the development sign-in
 
 	// Error page data
 	ErrorCode    int
@@ -125,6 +267,7 @@ func (h *Handlers) render(w http.ResponseWriter, r *http.Request, name string, d
 	}
 	data.BaseURL = h.baseURL
 	data.Version = h.version
+	data.DevAuth = h.devAuth
 
 	// Get the template for this page
 	tmpl, ok := h.templates[name]
@@ -161,6 +304,7 @@ func (h *Handlers) renderPublic(w http.ResponseWriter, name string, data *PageDa
 	}
 	data.BaseURL = h.baseURL
 	data.Version = h.version
+	data.DevAuth = h.devAuth
 
 	tmpl, ok := h.templates[name]
 	if !ok {
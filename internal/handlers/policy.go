@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/policy"
+)
+
+// evaluatePolicies runs the enabled policy rules against a saved snapshot and
+// persists the verdict so every view reads the same result
+func (h *Handlers) evaluatePolicies(snapshot *db.InventorySnapshot) error {
+	rules, err := h.db.GetPolicyRules(true)
+	if err != nil {
+		return err
+	}
+
+	results := policy.Evaluate(rules, snapshot)
+	if err := h.db.SavePolicyResults(snapshot.ID, results); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		if r.Passed {
+			snapshot.PolicyPassed++
+		} else {
+			snapshot.PolicyFailed++
+		}
+	}
+	return nil
+}
+
+// reevaluateLatestSnapshots refreshes the verdict on each machine's current
+// snapshot after the rule set changes. Older snapshots keep the verdict they
+// were given at the time.
+func (h *Handlers) reevaluateLatestSnapshots() error {
+	snapshots, err := h.db.GetLatestSnapshots()
+	if err != nil {
+		return err
+	}
+
+	for i := range snapshots {
+		if err := h.evaluatePolicies(&snapshots[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AdminPolicies shows the compliance policy rules (admin only)
+func (h *Handlers) AdminPolicies(w http.ResponseWriter, r *http.Request) {
+	h.renderPolicies(w, r, "")
+}
+
+func (h *Handlers) renderPolicies(w http.ResponseWriter, r *http.Request, formError string) {
+	rules, err := h.db.GetPolicyRules(false)
+	if err != nil {
+		http.Error(w, "Failed to load policy rules", http.StatusInternalServerError)
+		return
+	}
+
+	if formError != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	h.render(w, r, "policies.html", &PageData{
+		Title:           "Compliance Policy",
+		Active:          "policies",
+		PolicyRules:     rules,
+		PolicyFields:    policy.Fields(),
+		PolicyOperators: policy.Operators,
+		PolicyPlatforms: policy.Platforms,
+		FormError:       formError,
+	})
+}
+
+// CreatePolicyRule adds a new rule and re-evaluates current snapshots (admin only)
+func (h *Handlers) CreatePolicyRule(w http.ResponseWriter, r *http.Request) {
+	rule := db.PolicyRule{
+		Name:     strings.TrimSpace(r.FormValue("name")),
+		Field:    r.FormValue("field"),
+		Operator: r.FormValue("operator"),
+		Value:    strings.TrimSpace(r.FormValue("value")),
+		OS:       r.FormValue("os"),
+		Enabled:  true,
+	}
+
+	if err := policy.Validate(rule); err != nil {
+		h.renderPolicies(w, r, err.Error())
+		return
+	}
+
+	created, err := h.db.CreatePolicyRule(&rule)
+	if err != nil {
+		http.Error(w, "Failed to create policy rule", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditPolicyRuleCreated, "policy_rule", strconv.FormatInt(created.ID, 10), nil, created)
+
+	if err := h.reevaluateLatestSnapshots(); err != nil {
+		http.Error(w, "Failed to re-evaluate snapshots", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/policies", http.StatusSeeOther)
+}
+
+// TogglePolicyRule enables or disables a rule (admin only)
+func (h *Handlers) TogglePolicyRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.policyRuleFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.SetPolicyRuleEnabled(rule.ID, !rule.Enabled); err != nil {
+		http.Error(w, "Failed to update policy rule", http.StatusInternalServerError)
+		return
+	}
+	updated := *rule
+	updated.Enabled = !rule.Enabled
+	h.audit(r, auditPolicyRuleUpdated, "policy_rule", strconv.FormatInt(rule.ID, 10), rule, updated)
+
+	if err := h.reevaluateLatestSnapshots(); err != nil {
+		http.Error(w, "Failed to re-evaluate snapshots", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/policies", http.StatusSeeOther)
+}
+
+// DeletePolicyRule removes a rule (admin only)
+func (h *Handlers) DeletePolicyRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := h.policyRuleFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeletePolicyRule(rule.ID); err != nil {
+		http.Error(w, "Failed to delete policy rule", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditPolicyRuleDeleted, "policy_rule", strconv.FormatInt(rule.ID, 10), rule, nil)
+
+	if err := h.reevaluateLatestSnapshots(); err != nil {
+		http.Error(w, "Failed to re-evaluate snapshots", http.StatusInternalServerError)
+		return
+	}
+
+	// HTMX request: return empty response (row will be removed via hx-swap)
+	if r.Header.Get("HX-Request") == "true" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/policies", http.StatusSeeOther)
+}
+
+func (h *Handlers) policyRuleFromPath(w http.ResponseWriter, r *http.Request) (*db.PolicyRule, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid rule ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	rule, err := h.db.GetPolicyRule(id)
+	if err != nil || rule == nil {
+		http.Error(w, "Policy rule not found", http.StatusNotFound)
+		return nil, false
+	}
+	return rule, true
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+// Read-only REST API for integrations, authenticated with admin-issued API
+// keys. List responses are paginated:
+//
+//	{"data": [...], "next_cursor": "..."}
+//
+// next_cursor is left out on the last page; pass it back as ?cursor= to get
+// the next one.
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// apiMachine is a machine as returned by the REST API. It deliberately
+// leaves out the enrollment token.
+type apiMachine struct {
+	ID          string                `json:"id"`
+	Name        string                `json:"name"`
+	OwnerID     string                `json:"owner_id"`
+	OwnerEmail  string                `json:"owner_email"`
+	OwnerName   string                `json:"owner_name"`
+	Mode        string                `json:"mode"`
+	CheckInDays int                   `json:"checkin_days"` // Effective check-in interval; 0 if none applies
+	CheckIn     string                `json:"check_in"`
+	CreatedAt   time.Time             `json:"created_at"`
+	ArchivedAt  *time.Time            `json:"archived_at,omitempty"` // Archived machines are only returned by ID
+	Latest      *db.InventorySnapshot `json:"latest,omitempty"`      // Without raw_data; see the snapshots endpoint
+}
+
+type apiPage struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func (h *Handlers) apiMachine(m db.MachineWithOwner) apiMachine {
+	am := apiMachine{
+		ID:          m.ID,
+		Name:        m.Name,
+		OwnerID:     m.UserID,
+		OwnerEmail:  m.OwnerEmail,
+		OwnerName:   m.OwnerName,
+		Mode:        m.Mode,
+		CheckInDays: m.ExpectedCheckInDays(h.checkInDays),
+		CheckIn:     m.CheckIn,
+		CreatedAt:   m.CreatedAt,
+		ArchivedAt:  m.ArchivedAt,
+	}
+	if m.Latest != nil {
+		latest := *m.Latest
+		latest.RawData = ""
+		am.Latest = &latest
+	}
+	return am
+}
+
+// authorizeAPIKey checks the request's bearer API key for scope, writing an
+// error response if it is missing, unknown, expired or lacks the scope
+func (h *Handlers) authorizeAPIKey(w http.ResponseWriter, r *http.Request, scope string) bool {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Missing API key", http.StatusUnauthorized)
+		return false
+	}
+
+	apiKey, err := h.db.AuthenticateAPIKey(key)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if apiKey == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Invalid or expired API key", http.StatusUnauthorized)
+		return false
+	}
+	if !apiKey.HasScope(scope) {
+		http.Error(w, "API key lacks the "+scope+" scope", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// pageParams reads ?limit= and ?cursor=, writing an error response if either is invalid
+func pageParams(w http.ResponseWriter, r *http.Request) (limit int, cursor string, ok bool) {
+	limit = defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxPageSize), http.StatusBadRequest)
+			return 0, "", false
+		}
+		limit = n
+	}
+
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil || len(b) == 0 {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return 0, "", false
+		}
+		cursor = string(b)
+	}
+	return limit, cursor, true
+}
+
+func encodeCursor(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// paginate returns the page of items, sorted by ID, that follows the item
+// with ID after, and the cursor for the next page
+func paginate[T any](items []T, id func(T) string, after string, limit int) ([]T, string) {
+	slices.SortFunc(items, func(a, b T) int { return strings.Compare(id(a), id(b)) })
+	start, _ := slices.BinarySearchFunc(items, after, func(item T, after string) int {
+		if id(item) <= after {
+			return -1
+		}
+		return 1
+	})
+	items = items[start:]
+
+	if len(items) <= limit {
+		return items, ""
+	}
+	return items[:limit], encodeCursor(id(items[limit-1]))
+}
+
+func writeAPIJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+// APIListMachines lists machines, filtered like the admin machines page by
+// ?owner=, ?machine= and ?checkin=
+func (h *Handlers) APIListMachines(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAPIKey(w, r, db.ScopeMachinesRead) {
+		return
+	}
+	limit, cursor, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	// Check-in state isn't stored, so filter on it batch by batch until
+	// there is one more machine than a page, to tell whether there is another
+	query := r.URL.Query()
+	var machines []db.MachineWithOwner
+	for after := cursor; len(machines) <= limit; {
+		batch, err := h.db.GetMachinesWithOwnersAfter(query.Get("owner"), query.Get("machine"), after, limit+1)
+		if err != nil {
+			http.Error(w, "Failed to load machines", http.StatusInternalServerError)
+			return
+		}
+		more := len(batch) > limit
+		if more {
+			after = batch[len(batch)-1].ID
+		}
+		machines = append(machines, h.withCheckIns(batch, query.Get("checkin"), time.Time{})...)
+		if !more {
+			break
+		}
+	}
+
+	next := ""
+	if len(machines) > limit {
+		machines = machines[:limit]
+		next = encodeCursor(machines[limit-1].ID)
+	}
+	data := make([]apiMachine, 0, len(machines))
+	for _, m := range machines {
+		data = append(data, h.apiMachine(m))
+	}
+
+	writeAPIJSON(w, apiPage{Data: data, NextCursor: next})
+}
+
+// APIGetMachine returns one machine with its latest snapshot
+func (h *Handlers) APIGetMachine(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAPIKey(w, r, db.ScopeMachinesRead) {
+		return
+	}
+
+	machine, err := h.db.GetMachine(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if machine == nil {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	}
+
+	m := db.MachineWithOwner{Machine: *machine}
+	if owner, err := h.db.GetUser(machine.UserID); err == nil && owner != nil {
+		m.OwnerEmail = owner.Email
+		m.OwnerName = owner.Name
+	}
+	m.Latest, err = h.db.GetLatestSnapshot(machine.ID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	m.CheckIn = m.CheckInState(m.LastReport(), h.checkInDays, time.Now())
+
+	writeAPIJSON(w, h.apiMachine(m))
+}
+
+// APIListSnapshots lists a machine's snapshots, newest first
+func (h *Handlers) APIListSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAPIKey(w, r, db.ScopeSnapshotsRead) {
+		return
+	}
+	limit, cursor, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	var before int64
+	if cursor != "" {
+		var err error
+		before, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	machine, err := h.db.GetMachine(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if machine == nil {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	}
+
+	// Fetch one extra to tell whether there is another page
+	snapshots, err := h.db.GetSnapshotsBefore(machine.ID, before, limit+1)
+	if err != nil {
+		http.Error(w, "Failed to load snapshots", http.StatusInternalServerError)
+		return
+	}
+
+	next := ""
+	if len(snapshots) > limit {
+		snapshots = snapshots[:limit]
+		next = encodeCursor(strconv.FormatInt(snapshots[limit-1].ID, 10))
+	}
+	if snapshots == nil {
+		snapshots = []db.InventorySnapshot{}
+	}
+
+	writeAPIJSON(w, apiPage{Data: snapshots, NextCursor: next})
+}
+
+// APIListUsers lists users
+func (h *Handlers) APIListUsers(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAPIKey(w, r, db.ScopeUsersRead) {
+		return
+	}
+	limit, cursor, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	users, err := h.db.GetUsers()
+	if err != nil {
+		http.Error(w, "Failed to load users", http.StatusInternalServerError)
+		return
+	}
+
+	page, next := paginate(users, func(u db.User) string { return u.ID }, cursor, limit)
+	if page == nil {
+		page = []db.User{}
+	}
+
+	writeAPIJSON(w, apiPage{Data: page, NextCursor: next})
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/retention"
+)
+
+// RetentionPreview is what a retention run would delete
+type RetentionPreview struct {
+	Policy     retention.Policy // Policy being previewed
+	Configured retention.Policy // Policy the scheduled job applies
+	Plan       *retention.Plan
+	Machines   []RetentionMachine // Machines losing snapshots
+	Held       []db.MachineWithOwner
+	LastRun    *retention.Result
+	Periods    []string
+}
+
+// RetentionMachine is a machine losing snapshots
+type RetentionMachine struct {
+	db.MachineWithOwner
+	Plan retention.MachinePlan
+}
+
+// Previewing reports whether the preview is of a policy other than the configured one
+func (p *RetentionPreview) Previewing() bool {
+	return p.Policy != p.Configured
+}
+
+// retentionPolicy returns the configured retention policy
+func (h *Handlers) retentionPolicy() retention.Policy {
+	if h.retention == nil {
+		return retention.Policy{Period: retention.PeriodWeek}
+	}
+	return h.retention.Policy()
+}
+
+// AdminRetention shows what the retention job would delete (admin only).
+// days and period preview a different policy.
+func (h *Handlers) AdminRetention(w http.ResponseWriter, r *http.Request) {
+	configured := h.retentionPolicy()
+	policy := configured
+	query := r.URL.Query()
+	if query.Has("days") || query.Has("period") {
+		var err error
+		policy, err = retention.ParsePolicy(query.Get("days"), query.Get("period"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	plan, err := retention.NewPlan(h.db, policy, time.Now())
+	if err != nil {
+		http.Error(w, "Failed to plan retention", http.StatusInternalServerError)
+		return
+	}
+
+	preview := &RetentionPreview{
+		Policy:     policy,
+		Configured: configured,
+		Plan:       plan,
+		Periods:    retention.Periods,
+	}
+	if h.retention != nil {
+		preview.LastRun = h.retention.LastRun()
+	}
+
+	plans := make(map[string]retention.MachinePlan, len(plan.Machines))
+	for _, mp := range plan.Machines {
+		plans[mp.MachineID] = mp
+	}
+	err = h.db.EachMachineWithOwner("", "", time.Time{}, func(m *db.MachineWithOwner) error {
+		if m.LegalHold {
+			preview.Held = append(preview.Held, *m)
+		} else if mp, ok := plans[m.ID]; ok {
+			preview.Machines = append(preview.Machines, RetentionMachine{MachineWithOwner: *m, Plan: mp})
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to load machines", http.StatusInternalServerError)
+		return
+	}
+
+	h.render(w, r, "retention.html", &PageData{
+		Title:     "Retention",
+		Active:    "retention",
+		Retention: preview,
+	})
+}
+
+// RunRetention applies the configured retention policy now (admin only)
+func (h *Handlers) RunRetention(w http.ResponseWriter, r *http.Request) {
+	if h.retention == nil || !h.retention.Policy().Enabled() {
+		http.Error(w, "Retention is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	// The outcome is shown on the retention page
+	deleted, err := h.retention.RunOnce()
+	result := map[string]interface{}{"deleted_snapshots": deleted}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	h.audit(r, auditRetentionRun, "", "", nil, result)
+
+	http.Redirect(w, r, "/admin/retention", http.StatusSeeOther)
+}
+
+// SetMachineLegalHold places a machine on legal hold, exempting its
+// snapshots from retention, or lifts the hold (admin only)
+func (h *Handlers) SetMachineLegalHold(w http.ResponseWriter, r *http.Request) {
+	machineID := r.PathValue("id")
+	machine, err := h.db.GetMachine(machineID)
+	if err != nil || machine == nil {
+		h.renderError(w, r, http.StatusNotFound, "Machine not found")
+		return
+	}
+
+	hold := r.FormValue("hold") == "true"
+	if err := h.db.SetMachineLegalHold(machineID, hold); err != nil {
+		http.Error(w, "Failed to update legal hold", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditMachineLegalHold, "machine", machineID,
+		map[string]bool{"legal_hold": machine.LegalHold}, map[string]bool{"legal_hold": hold})
+
+	http.Redirect(w, r, "/machines/"+machineID, http.StatusSeeOther)
+}
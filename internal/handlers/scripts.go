@@ -2,12 +2,40 @@ package handlers
 
 import (
 	"net/http"
+	"time"
 
+	"github.com/jclement/boxcheckr/internal/db"
 	"github.com/jclement/boxcheckr/internal/scripts"
 )
 
+// bootstrapCodeTTL is how long the install commands on a machine page stay valid
+const bootstrapCodeTTL = 30 * time.Minute
+
+// GenerateInstallCommand issues a bootstrap code and shows the machine page
+// with install commands that carry it. The code is only shown this once.
+func (h *Handlers) GenerateInstallCommand(w http.ResponseWriter, r *http.Request) {
+	machine := h.tokenMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	code, err := h.db.CreateBootstrapCode(machine.ID, bootstrapCodeTTL)
+	if err != nil {
+		http.Error(w, "Failed to prepare install commands", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditInstallCodeIssued, "machine", machine.ID, auditMachine(machine), map[string]interface{}{
+		"code_expires_at": code.ExpiresAt,
+	})
+
+	w.Header().Set("Cache-Control", "no-store")
+	h.renderMachine(w, r, machine, "", code)
+}
+
 // MachineScript serves the agent script - NO AUTH REQUIRED
-// This endpoint is called by curl/wget from the user's terminal
+// This endpoint is called by curl/wget from the user's terminal. It only
+// renders for a valid bootstrap code, and the script holds that code rather
+// than the enrollment token.
 func (h *Handlers) MachineScript(w http.ResponseWriter, r *http.Request) {
 	machineID := r.PathValue("id")
 	machine, err := h.db.GetMachine(machineID)
@@ -15,6 +43,25 @@ func (h *Handlers) MachineScript(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Machine not found", http.StatusNotFound)
 		return
 	}
+	if machine.Archived() {
+		http.Error(w, "Machine has been archived", http.StatusGone)
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "Script link expired; generate a new command on the machine page", http.StatusForbidden)
+		return
+	}
+	valid, err := h.db.ValidBootstrapCode(machine.ID, code)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Script link expired; generate a new command on the machine page", http.StatusForbidden)
+		return
+	}
 
 	// Get machine owner for email in script comments
 	owner, _ := h.db.GetUser(machine.UserID)
@@ -23,9 +70,10 @@ func (h *Handlers) MachineScript(w http.ResponseWriter, r *http.Request) {
 		email = owner.Email
 	}
 
-	mode := r.URL.Query().Get("mode")
-	if mode == "" {
-		mode = "onetime"
+	// Mode ends up in the script text, so only the known values pass through
+	mode := db.ModeOneTime
+	if r.URL.Query().Get("mode") == db.ModeMonitor {
+		mode = db.ModeMonitor
 	}
 
 	// Use OS from query param if provided, otherwise detect from User-Agent
@@ -44,7 +92,7 @@ func (h *Handlers) MachineScript(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data := scripts.ScriptData{
-		Token:     machine.EnrollmentToken,
+		Code:      code,
 		ServerURL: h.baseURL,
 		Email:     email,
 		Mode:      mode,
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/jclement/boxcheckr/internal/middleware"
+)
+
+// LogoutEverywhere ends all of the user's sessions, on every device
+func (h *Handlers) LogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r.Context())
+	n, err := h.sessions.ClearUser(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to sign out", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditSignedOutEverywhere, "user", user.ID, nil, map[string]int64{"sessions_ended": n})
+	h.sessions.Clear(r, w)
+	h.render(w, r, "logout.html", &PageData{Title: "Signed Out"})
+}
+
+// AdminSessions lists active sessions (admin only)
+func (h *Handlers) AdminSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := h.sessions.Active()
+	if err != nil {
+		http.Error(w, "Failed to load sessions", http.StatusInternalServerError)
+		return
+	}
+
+	current := ""
+	if session, _ := h.sessions.Session(r); session != nil {
+		current = session.ID
+	}
+
+	h.render(w, r, "sessions.html", &PageData{
+		Title:            "Sessions",
+		Active:           "sessions",
+		Sessions:         sessions,
+		CurrentSessionID: current,
+		SessionConfig:    h.sessions.Config(),
+	})
+}
+
+// RevokeSession ends a session (admin only)
+func (h *Handlers) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := h.sessions.Revoke(id); err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditSessionRevoked, "session", id, nil, nil)
+
+	http.Redirect(w, r, "/admin/sessions", http.StatusSeeOther)
+}
+
+// RevokeUserSessions ends all of a user's sessions (admin only)
+func (h *Handlers) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("id")
+	n, err := h.sessions.ClearUser(userID)
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%s revoked %d sessions of user %s", middleware.GetUser(r.Context()).Email, n, userID)
+	h.audit(r, auditUserSessionsRevoked, "user", userID, nil, map[string]int64{"sessions_ended": n})
+
+	http.Redirect(w, r, "/admin/sessions", http.StatusSeeOther)
+}
@@ -1,11 +1,32 @@
 package handlers
 
 import (
+	"crypto/subtle"
+	"errors"
+	"log"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jclement/boxcheckr/internal/db"
 	"github.com/jclement/boxcheckr/internal/middleware"
+	"github.com/jclement/boxcheckr/internal/policy"
+	"github.com/jclement/boxcheckr/internal/webhook"
+)
+
+const (
+	maxShareLinkLabel  = 200 // Characters in a share link label
+	maxRevokeReason    = 500 // Characters in a revocation reason
+	shareLinkViewLimit = 200 // Access log entries shown per link
+	shareUnlockCookie  = "share_unlock"
+
+	// Wrong passwords allowed per shareUnlockWindow, for one link from
+	// anywhere and from one address for any link
+	shareUnlockWindow      = 15 * time.Minute
+	maxShareUnlockFailures = 20
+	maxShareUnlockFromIP   = 5
 )
 
 // CreateShareLink creates a new time-limited share link (admin only)
@@ -16,28 +37,178 @@ func (h *Handlers) CreateShareLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	expiresAt, err := shareLinkExpiry(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Optionally show the fleet as it was on a past date, e.g. an audit sample date
+	var asOf *time.Time
+	if v := r.FormValue("asof"); v != "" {
+		t, err := parseAsOf(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		asOf = &t
+	}
+
+	link := &db.ShareLink{
+		CreatedBy:       user.ID,
+		ExpiresAt:       expiresAt,
+		AsOf:            asOf,
+		Label:           strings.TrimSpace(r.FormValue("label")),
+		FilterOwner:     strings.TrimSpace(r.FormValue("owner")),
+		FilterMachine:   strings.TrimSpace(r.FormValue("machine")),
+		FilterOS:        r.FormValue("os"),
+		ShowNotes:       r.FormValue("show_notes") != "",
+		ShowOwnerEmails: r.FormValue("show_owner_emails") != "",
+	}
+	if len(link.Label) > maxShareLinkLabel {
+		http.Error(w, "Label is too long", http.StatusBadRequest)
+		return
+	}
+	if link.FilterOS != "" && !slices.Contains(policy.Platforms, link.FilterOS) {
+		http.Error(w, "Unknown OS: "+link.FilterOS, http.StatusBadRequest)
+		return
+	}
+	if password := r.FormValue("password"); password != "" {
+		if link.PasswordHash, err = db.HashSharePassword(password); err != nil {
+			http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	link, err = h.db.CreateShareLink(link)
+	if err != nil {
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+
+	// The link ID is the credential, so it stays out of the event
+	h.emit(webhook.EventShareLinkCreated, map[string]interface{}{
+		"created_by":        user.Email,
+		"expires_at":        link.ExpiresAt,
+		"as_of":             link.AsOf,
+		"label":             link.Label,
+		"filter_owner":      link.FilterOwner,
+		"filter_machine":    link.FilterMachine,
+		"filter_os":         link.FilterOS,
+		"show_notes":        link.ShowNotes,
+		"show_owner_emails": link.ShowOwnerEmails,
+		"has_password":      link.HasPassword(),
+	})
+	h.audit(r, auditShareLinkCreated, "share_link", auditShareLinkID(link.ID), nil, auditShareLink(link))
+
+	// Redirect to admin page with the new link highlighted
+	http.Redirect(w, r, "/admin/share?new="+link.ID, http.StatusSeeOther)
+}
+
+// shareLinkExpiry reads when a link should expire: the end of the "expires"
+// date (UTC) if given, otherwise "hours" from now, defaulting to a day
+func shareLinkExpiry(r *http.Request) (time.Time, error) {
+	now := time.Now()
+	if v := r.FormValue("expires"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return time.Time{}, errors.New("expires must be a date (YYYY-MM-DD)")
+		}
+		t = t.AddDate(0, 0, 1)
+		if !t.After(now) || t.After(now.AddDate(1, 0, 1)) {
+			return time.Time{}, errors.New("expires must be within the next year")
+		}
+		return t, nil
+	}
+
 	// Parse duration from form (in hours)
-	hoursStr := r.FormValue("hours")
 	hours := 24 // default 1 day
-	if hoursStr != "" {
+	if hoursStr := r.FormValue("hours"); hoursStr != "" {
 		if h, err := strconv.Atoi(hoursStr); err == nil && h > 0 && h <= 8760 { // max 1 year
 			hours = h
 		}
 	}
+	return now.Add(time.Duration(hours) * time.Hour), nil
+}
 
-	expiresAt := time.Now().Add(time.Duration(hours) * time.Hour)
+// UpdateShareLinkExpiry extends or shortens a link that hasn't been revoked
+// (admin only)
+func (h *Handlers) UpdateShareLinkExpiry(w http.ResponseWriter, r *http.Request) {
+	link, err := h.db.GetShareLink(r.PathValue("id"))
+	if err != nil || link == nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if link.Revoked() {
+		http.Error(w, "Share link is revoked", http.StatusConflict)
+		return
+	}
 
-	link, err := h.db.CreateShareLink(user.ID, expiresAt)
+	expiresAt, err := shareLinkExpiry(r)
 	if err != nil {
-		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db.SetShareLinkExpiry(link.ID, expiresAt); err != nil {
+		http.Error(w, "Failed to update share link", http.StatusInternalServerError)
 		return
 	}
 
-	// Redirect to admin page with the new link highlighted
-	http.Redirect(w, r, "/admin/share?new="+link.ID, http.StatusSeeOther)
+	before := auditShareLink(link)
+	link.ExpiresAt = expiresAt
+	h.audit(r, auditShareLinkUpdated, "share_link", auditShareLinkID(link.ID), before, auditShareLink(link))
+
+	http.Redirect(w, r, "/admin/share/"+link.ID, http.StatusSeeOther)
 }
 
-// DeleteShareLink deletes a share link (admin only)
+// RevokeShareLink stops a link from working, keeping it and its access log
+// (admin only)
+func (h *Handlers) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	link, err := h.db.GetShareLink(r.PathValue("id"))
+	if err != nil || link == nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if link.Revoked() {
+		http.Error(w, "Share link is already revoked", http.StatusConflict)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		reason = strings.TrimSpace(r.Header.Get("HX-Prompt"))
+	}
+	if len(reason) > maxRevokeReason {
+		http.Error(w, "Reason is too long", http.StatusBadRequest)
+		return
+	}
+
+	revokedBy := ""
+	if user := middleware.GetUser(r.Context()); user != nil {
+		revokedBy = user.Email
+	}
+	if err := h.db.RevokeShareLink(link.ID, revokedBy, reason); err != nil {
+		http.Error(w, "Failed to revoke share link", http.StatusInternalServerError)
+		return
+	}
+
+	revoked, _ := h.db.GetShareLink(link.ID)
+	if revoked == nil {
+		revoked = link
+	}
+	h.audit(r, auditShareLinkRevoked, "share_link", auditShareLinkID(link.ID), auditShareLink(link), auditShareLink(revoked))
+
+	// HTMX request: reload so the link shows as revoked
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Refresh", "true")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/share/"+link.ID, http.StatusSeeOther)
+}
+
+// DeleteShareLink deletes a share link and its access log (admin only)
 func (h *Handlers) DeleteShareLink(w http.ResponseWriter, r *http.Request) {
 	linkID := r.PathValue("id")
 	if linkID == "" {
@@ -45,10 +216,17 @@ func (h *Handlers) DeleteShareLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	link, err := h.db.GetShareLink(linkID)
+	if err != nil || link == nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+
 	if err := h.db.DeleteShareLink(linkID); err != nil {
 		http.Error(w, "Failed to delete share link", http.StatusInternalServerError)
 		return
 	}
+	h.audit(r, auditShareLinkDeleted, "share_link", auditShareLinkID(link.ID), auditShareLink(link), nil)
 
 	// HTMX request: return empty response (row will be removed via hx-swap)
 	if r.Header.Get("HX-Request") == "true" {
@@ -70,14 +248,38 @@ func (h *Handlers) AdminShareLinks(w http.ResponseWriter, r *http.Request) {
 	newLinkID := r.URL.Query().Get("new")
 
 	h.render(w, r, "share.html", &PageData{
-		Title:      "Share Links",
-		Active:     "share",
-		ShareLinks: links,
-		NewLinkID:  newLinkID,
+		Title:           "Share Links",
+		Active:          "share",
+		ShareLinks:      links,
+		NewLinkID:       newLinkID,
+		PolicyPlatforms: policy.Platforms,
+	})
+}
+
+// AdminShareLink shows a link's settings and access log (admin only)
+func (h *Handlers) AdminShareLink(w http.ResponseWriter, r *http.Request) {
+	link, err := h.db.GetShareLink(r.PathValue("id"))
+	if err != nil || link == nil {
+		h.renderError(w, r, http.StatusNotFound, "Share link not found")
+		return
+	}
+
+	views, err := h.db.GetShareLinkViews(link.ID, shareLinkViewLimit)
+	if err != nil {
+		http.Error(w, "Failed to load access log", http.StatusInternalServerError)
+		return
+	}
+
+	h.render(w, r, "share_link.html", &PageData{
+		Title:          "Share Link",
+		Active:         "share",
+		ShareLink:      link,
+		ShareLinkViews: views,
 	})
 }
 
-// ViewSharedInventory displays the public shared view (no auth required)
+// ViewSharedInventory displays the public shared view (no auth required).
+// Links with a password show a password form until it has been entered.
 func (h *Handlers) ViewSharedInventory(w http.ResponseWriter, r *http.Request) {
 	linkID := r.PathValue("id")
 	if linkID == "" {
@@ -96,16 +298,117 @@ func (h *Handlers) ViewSharedInventory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all machines with their latest snapshots and notes
-	machines, err := h.db.GetAllMachinesWithOwners("", "")
+	if link.HasPassword() && !shareLinkUnlocked(r, link) {
+		h.renderPublic(w, "share_password.html", &PageData{
+			Title:     "Shared Inventory",
+			ShareLink: link,
+		})
+		return
+	}
+
+	// Views are anonymous; the link is the only credential
+	if err := h.db.RecordShareLinkView(link.ID, middleware.ClientIP(r), r.UserAgent()); err != nil {
+		log.Printf("Failed to record share link view: %v", err)
+	}
+	h.auditAs(r, nil, auditShareLinkViewed, "share_link", auditShareLinkID(link.ID), nil, nil)
+
+	var asOf time.Time
+	if link.AsOf != nil {
+		asOf = *link.AsOf
+	}
+
+	// Get the machines in the link's scope with their latest snapshots and notes
+	machines, err := h.db.GetAllMachinesWithOwners(link.FilterOwner, link.FilterMachine, asOf)
 	if err != nil {
 		h.renderError(w, r, http.StatusInternalServerError, "Failed to load inventory")
 		return
 	}
+	machines = scopeSharedMachines(machines, link)
+	machines = h.withCheckIns(machines, "", asOf)
 
 	h.renderPublic(w, "shared.html", &PageData{
 		Title:     "Shared Inventory",
 		Machines:  machines,
 		ShareLink: link,
+		AsOf:      asOf,
 	})
 }
+
+// UnlockSharedInventory checks the password of a share link and, if right,
+// remembers it in a cookie scoped to the link
+func (h *Handlers) UnlockSharedInventory(w http.ResponseWriter, r *http.Request) {
+	link, err := h.db.GetValidShareLink(r.PathValue("id"))
+	if err != nil {
+		h.renderError(w, r, http.StatusInternalServerError, "Failed to validate share link")
+		return
+	}
+	if link == nil {
+		h.renderError(w, r, http.StatusNotFound, "Share link not found or has expired")
+		return
+	}
+
+	ip := middleware.ClientIP(r)
+	forLink, fromIP, err := h.db.CountFailedShareLinkUnlocks(link.ID, ip, time.Now().Add(-shareUnlockWindow))
+	if err != nil {
+		h.renderError(w, r, http.StatusInternalServerError, "Failed to check share link")
+		return
+	}
+	if forLink >= maxShareUnlockFailures || fromIP >= maxShareUnlockFromIP {
+		w.Header().Set("Retry-After", strconv.Itoa(int(shareUnlockWindow/time.Second)))
+		h.renderError(w, r, http.StatusTooManyRequests, "Too many incorrect passwords; try again later")
+		return
+	}
+
+	if !link.CheckPassword(r.FormValue("password")) {
+		if err := h.db.RecordFailedShareLinkUnlock(link.ID, ip, r.UserAgent()); err != nil {
+			log.Printf("Failed to record share link unlock: %v", err)
+		}
+		h.renderPublic(w, "share_password.html", &PageData{
+			Title:     "Shared Inventory",
+			ShareLink: link,
+			FormError: "Incorrect password",
+		})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareUnlockCookie,
+		Value:    link.UnlockToken(),
+		Path:     "/share/" + link.ID,
+		Expires:  link.ExpiresAt,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.baseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/share/"+link.ID, http.StatusSeeOther)
+}
+
+// shareLinkUnlocked reports whether the request carries the link's unlock
+// cookie
+func shareLinkUnlocked(r *http.Request, link *db.ShareLink) bool {
+	c, err := r.Cookie(shareUnlockCookie)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(link.UnlockToken())) == 1
+}
+
+// scopeSharedMachines applies the parts of a link's scope and display
+// options the database query doesn't
+func scopeSharedMachines(machines []db.MachineWithOwner, link *db.ShareLink) []db.MachineWithOwner {
+	scoped := machines[:0]
+	for _, m := range machines {
+		if link.FilterOS != "" && (m.Latest == nil || !strings.EqualFold(m.Latest.OS, link.FilterOS)) {
+			continue
+		}
+		if !link.ShowNotes {
+			m.Notes = nil
+			m.NoteCount = 0
+		}
+		if !link.ShowOwnerEmails {
+			m.OwnerEmail = ""
+		}
+		scoped = append(scoped, m)
+	}
+	return scoped
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/jclement/boxcheckr/internal/checks"
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/middleware"
+)
+
+// timelineLength is how many transitions the machine page shows
+const timelineLength = 20
+
+// SnapshotDiff compares two snapshots
+type SnapshotDiff struct {
+	From, To *db.InventorySnapshot
+	Fields   []FieldDiff      // Every compared field, changed or not
+	Changed  int              // Number of Fields that changed
+	RawData  []db.FieldChange // Changed keys of the raw agent payload
+}
+
+// FieldDiff is one field's value in both snapshots
+type FieldDiff struct {
+	db.FieldChange
+	Changed bool
+}
+
+func diffSnapshots(from, to *db.InventorySnapshot) *SnapshotDiff {
+	d := &SnapshotDiff{From: from, To: to, RawData: db.DiffRawData(from.RawData, to.RawData)}
+	for _, f := range db.SnapshotFields {
+		fd := FieldDiff{FieldChange: db.FieldChange{Field: f.Name, From: f.Get(from), To: f.Get(to)}}
+		fd.Changed = fd.From != fd.To
+		if fd.Changed {
+			d.Changed++
+		}
+		d.Fields = append(d.Fields, fd)
+	}
+
+	// Named checks reported by either snapshot, by rule field name
+	for _, id := range db.SnapshotCheckIDs(from, to) {
+		fd := FieldDiff{FieldChange: db.FieldChange{Field: "check." + id, From: checks.Status(from, id), To: checks.Status(to, id)}}
+		fd.Changed = fd.From != fd.To
+		if fd.Changed {
+			d.Changed++
+		}
+		d.Fields = append(d.Fields, fd)
+	}
+	return d
+}
+
+// SnapshotDiffPage compares any two of a machine's snapshots, including
+// their raw agent payloads
+func (h *Handlers) SnapshotDiffPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return
+	}
+
+	machine, err := h.db.GetMachine(r.PathValue("id"))
+	if err != nil || machine == nil {
+		h.renderError(w, r, http.StatusNotFound, "Machine not found")
+		return
+	}
+
+	// Check ownership (unless admin)
+	if machine.UserID != user.ID && !middleware.IsAdmin(r.Context()) {
+		h.renderError(w, r, http.StatusForbidden, "You don't have permission to view this machine")
+		return
+	}
+
+	from := h.machineSnapshot(machine.ID, r.PathValue("a"))
+	to := h.machineSnapshot(machine.ID, r.PathValue("b"))
+	if from == nil || to == nil {
+		h.renderError(w, r, http.StatusNotFound, "Snapshot not found")
+		return
+	}
+
+	h.render(w, r, "snapshot_diff.html", &PageData{
+		Title:   machine.Name + " - Compare Snapshots",
+		Active:  "dashboard",
+		Machine: machine,
+		Diff:    diffSnapshots(from, to),
+	})
+}
+
+// machineSnapshot returns the snapshot with the given ID if it belongs to
+// the machine, or nil
+func (h *Handlers) machineSnapshot(machineID, id string) *db.InventorySnapshot {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil
+	}
+	s, err := h.db.GetSnapshot(n)
+	if err != nil || s == nil || s.MachineID != machineID {
+		return nil
+	}
+	return s
+}
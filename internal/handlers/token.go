@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/middleware"
+)
+
+// maxTokenGrace limits how long a rotated token keeps working
+const maxTokenGrace = 30 * 24 * time.Hour
+
+// tokenMachine loads the machine in the path for its owner or an admin,
+// writing an error response and returning nil if it can't be changed
+func (h *Handlers) tokenMachine(w http.ResponseWriter, r *http.Request) *db.Machine {
+	user := middleware.GetUser(r.Context())
+	if user == nil {
+		http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+		return nil
+	}
+
+	machine, err := h.db.GetMachine(r.PathValue("id"))
+	if err != nil || machine == nil {
+		h.renderError(w, r, http.StatusNotFound, "Machine not found")
+		return nil
+	}
+
+	// Check ownership (unless admin)
+	if machine.UserID != user.ID && !middleware.IsAdmin(r.Context()) {
+		h.renderError(w, r, http.StatusForbidden, "You don't have permission to change this machine")
+		return nil
+	}
+	if machine.Archived() {
+		http.Error(w, "Machine has been archived", http.StatusConflict)
+		return nil
+	}
+	return machine
+}
+
+// RotateMachineToken issues a new enrollment token and shows it once. The
+// old token keeps working for grace_hours, so the machine can switch over.
+func (h *Handlers) RotateMachineToken(w http.ResponseWriter, r *http.Request) {
+	machine := h.tokenMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	var grace time.Duration
+	if v := r.FormValue("grace_hours"); v != "" {
+		hours, err := strconv.Atoi(v)
+		grace = time.Duration(hours) * time.Hour
+		if err != nil || hours < 0 || grace > maxTokenGrace {
+			http.Error(w, "grace_hours must be between 0 and 720", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, err := h.db.RotateMachineToken(machine.ID, grace)
+	if err != nil {
+		http.Error(w, "Failed to rotate token", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditMachineTokenRotated, "machine", machine.ID, auditMachineToken(machine), map[string]interface{}{
+		"grace_hours": int(grace / time.Hour),
+	})
+
+	rotated, err := h.db.GetMachine(machine.ID)
+	if err != nil || rotated == nil {
+		http.Error(w, "Failed to load machine", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	h.renderMachine(w, r, rotated, token, nil)
+}
+
+// DisableMachineToken stops the machine's tokens working without deleting
+// the machine. Rotating the token, or reinstalling, issues a working one.
+func (h *Handlers) DisableMachineToken(w http.ResponseWriter, r *http.Request) {
+	h.setMachineTokenDisabled(w, r, true)
+}
+
+// EnableMachineToken lets a machine's disabled tokens work again
+func (h *Handlers) EnableMachineToken(w http.ResponseWriter, r *http.Request) {
+	h.setMachineTokenDisabled(w, r, false)
+}
+
+// ClearMachineSigningKey removes the machine's report signing key, so it can
+// report unsigned again, e.g. after reinstalling without the compiled agent
+func (h *Handlers) ClearMachineSigningKey(w http.ResponseWriter, r *http.Request) {
+	machine := h.tokenMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	if machine.PublicKey != "" {
+		if err := h.db.SetMachinePublicKey(machine.ID, ""); err != nil {
+			http.Error(w, "Failed to clear signing key", http.StatusInternalServerError)
+			return
+		}
+		before := auditMachine(machine)
+		before["public_key_registered_at"] = machine.PublicKeyRegisteredAt
+		after := auditMachine(machine)
+		after["public_key_registered_at"] = nil
+		h.audit(r, auditMachineKeyCleared, "machine", machine.ID, before, after)
+	}
+
+	http.Redirect(w, r, "/machines/"+machine.ID, http.StatusSeeOther)
+}
+
+func (h *Handlers) setMachineTokenDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	machine := h.tokenMachine(w, r)
+	if machine == nil {
+		return
+	}
+
+	if err := h.db.SetMachineTokenDisabled(machine.ID, disabled); err != nil {
+		http.Error(w, "Failed to update token", http.StatusInternalServerError)
+		return
+	}
+
+	action := auditMachineTokenEnabled
+	if disabled {
+		action = auditMachineTokenDisabled
+	}
+	h.audit(r, action, "machine", machine.ID, auditMachineToken(machine), map[string]bool{"disabled": disabled})
+
+	http.Redirect(w, r, "/machines/"+machine.ID, http.StatusSeeOther)
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/webhook"
+)
+
+// emit queues a webhook event. Failures are logged rather than failing the
+// request that caused the event.
+func (h *Handlers) emit(eventType string, data interface{}) {
+	if err := webhook.Emit(h.db, eventType, data); err != nil {
+		log.Printf("Failed to queue %s webhook event: %v", eventType, err)
+	}
+}
+
+// webhookMachine describes a machine for event data
+func (h *Handlers) webhookMachine(m *db.Machine) webhook.Machine {
+	wm := webhook.Machine{
+		ID:      m.ID,
+		Name:    m.Name,
+		OwnerID: m.UserID,
+		URL:     h.baseURL + "/machines/" + m.ID,
+	}
+	if owner, err := h.db.GetUser(m.UserID); err == nil && owner != nil {
+		wm.OwnerEmail = owner.Email
+	}
+	return wm
+}
+
+// AdminWebhooks shows the configured webhooks and recent deliveries (admin only)
+func (h *Handlers) AdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	h.renderWebhooks(w, r, "")
+}
+
+func (h *Handlers) renderWebhooks(w http.ResponseWriter, r *http.Request, formError string) {
+	webhooks, err := h.db.GetWebhooks()
+	if err != nil {
+		http.Error(w, "Failed to load webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := h.db.RecentWebhookDeliveries(50)
+	if err != nil {
+		http.Error(w, "Failed to load webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	if formError != "" {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	h.render(w, r, "webhooks.html", &PageData{
+		Title:             "Webhooks",
+		Active:            "webhooks",
+		Webhooks:          webhooks,
+		WebhookDeliveries: deliveries,
+		WebhookEvents:     webhook.Events,
+		FormError:         formError,
+	})
+}
+
+// CreateWebhook registers a new webhook URL (admin only)
+func (h *Handlers) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	rawURL := strings.TrimSpace(r.FormValue("url"))
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		h.renderWebhooks(w, r, "Enter an http:// or https:// URL")
+		return
+	}
+
+	r.ParseForm()
+	events := r.Form["events"]
+	for _, e := range events {
+		if !slices.Contains(webhook.Events, e) {
+			h.renderWebhooks(w, r, "Unknown event type: "+e)
+			return
+		}
+	}
+	// Subscribing to every event is stored as no filter, so new event types are included
+	if len(events) == len(webhook.Events) {
+		events = nil
+	}
+
+	hook, err := h.db.CreateWebhook(rawURL, events)
+	if err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditWebhookCreated, "webhook", strconv.FormatInt(hook.ID, 10), nil, hook)
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// ToggleWebhook enables or disables a webhook (admin only)
+func (h *Handlers) ToggleWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, ok := h.webhookFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.SetWebhookEnabled(hook.ID, !hook.Enabled); err != nil {
+		http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+		return
+	}
+	updated := *hook
+	updated.Enabled = !hook.Enabled
+	h.audit(r, auditWebhookUpdated, "webhook", strconv.FormatInt(hook.ID, 10), hook, updated)
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// DeleteWebhook removes a webhook and its delivery history (admin only)
+func (h *Handlers) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, ok := h.webhookFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteWebhook(hook.ID); err != nil {
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	h.audit(r, auditWebhookDeleted, "webhook", strconv.FormatInt(hook.ID, 10), hook, nil)
+
+	// HTMX request: return empty response (row will be removed via hx-swap)
+	if r.Header.Get("HX-Request") == "true" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+func (h *Handlers) webhookFromPath(w http.ResponseWriter, r *http.Request) (*db.Webhook, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	hook, err := h.db.GetWebhook(id)
+	if err != nil || hook == nil {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+	return hook, true
+}
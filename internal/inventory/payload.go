@@ -0,0 +1,58 @@
+// Package inventory defines the JSON document agents submit to POST /api/v1/inventory.
+//
+// It lives in its own package so the compiled agent can share the contract
+// with the server without linking the server's dependencies.
+package inventory
+
+type Payload struct {
+	Hostname              string `json:"hostname"`
+	OS                    string `json:"os"`
+	OSVersion             string `json:"os_version"`
+	DiskEncrypted         bool   `json:"disk_encrypted"`
+	DiskEncryptionDetails string `json:"disk_encryption_details"`
+	AntivirusEnabled      bool   `json:"antivirus_enabled"`
+	AntivirusDetails      string `json:"antivirus_details"`
+	FirewallEnabled       bool   `json:"firewall_enabled"`
+	FirewallDetails       string `json:"firewall_details"`
+	ScreenLockEnabled     bool   `json:"screen_lock_enabled"`
+	ScreenLockTimeout     int    `json:"screen_lock_timeout"`
+	ScreenLockDetails     string `json:"screen_lock_details"`
+
+	// Control statuses: pass, fail, unknown (the agent couldn't tell) or
+	// not_applicable. A status that isn't sent comes from the boolean, as
+	// older scripts only send those.
+	DiskEncryptionStatus string `json:"disk_encryption_status"`
+	AntivirusStatus      string `json:"antivirus_status"`
+	FirewallStatus       string `json:"firewall_status"`
+	ScreenLockStatus     string `json:"screen_lock_status"`
+
+	// Patch level. Counts are null when the agent can't tell, and
+	// last_boot_at is an RFC 3339 time or empty.
+	OSBuild                string `json:"os_build"`
+	DaysSinceUpdate        *int   `json:"days_since_update"`
+	PendingSecurityUpdates *int   `json:"pending_security_updates"`
+	AutoUpdateEnabled      bool   `json:"auto_update_enabled"`
+	AutoUpdateDetails      string `json:"auto_update_details"`
+	LastBootAt             string `json:"last_boot_at"`
+
+	// Named checks beyond the fields above, such as
+	// "ssh_root_login_disabled"
+	Checks []Check `json:"checks,omitempty"`
+}
+
+// Statuses of controls and named checks
+const (
+	CheckPass          = "pass"
+	CheckFail          = "fail"
+	CheckUnknown       = "unknown"
+	CheckNotApplicable = "not_applicable"
+)
+
+// Check is the result of one named check. Value is what the check found,
+// such as a setting, and Details explains it.
+type Check struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Value   string `json:"value,omitempty"`
+	Details string `json:"details,omitempty"`
+}
@@ -0,0 +1,102 @@
+package inventory
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Signed reports carry these headers. The signature is an Ed25519 signature,
+// base64 encoded, over SignedMessage.
+const (
+	TimestampHeader = "X-BoxCheckr-Timestamp"
+	NonceHeader     = "X-BoxCheckr-Nonce"
+	SignatureHeader = "X-BoxCheckr-Signature"
+)
+
+// MaxClockSkew is how far a signed report's timestamp may be from the
+// server's clock
+const MaxClockSkew = 5 * time.Minute
+
+// maxNonceLength bounds the nonces the server has to remember
+const maxNonceLength = 64
+
+// ErrUnsigned is returned by Verify for a report without a signature
+var ErrUnsigned = errors.New("report is not signed")
+
+// SignedMessage is what a report's signature covers: the timestamp (Unix
+// seconds), the nonce and the body, separated by newlines
+func SignedMessage(timestamp, nonce string, body []byte) []byte {
+	msg := make([]byte, 0, len(timestamp)+len(nonce)+len(body)+2)
+	msg = append(msg, timestamp...)
+	msg = append(msg, '\n')
+	msg = append(msg, nonce...)
+	msg = append(msg, '\n')
+	return append(msg, body...)
+}
+
+// Sign adds the signature headers for body, sent at now, to h
+func Sign(h http.Header, key ed25519.PrivateKey, body []byte, now time.Time) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonce := hex.EncodeToString(b)
+
+	h.Set(TimestampHeader, timestamp)
+	h.Set(NonceHeader, nonce)
+	h.Set(SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedMessage(timestamp, nonce, body))))
+	return nil
+}
+
+// Verify checks the signature headers on a report received at now and
+// returns its nonce. Callers must reject nonces they have seen within
+// MaxClockSkew.
+func Verify(h http.Header, key ed25519.PublicKey, body []byte, now time.Time) (string, error) {
+	signature := h.Get(SignatureHeader)
+	if signature == "" {
+		return "", ErrUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+
+	timestamp, nonce := h.Get(TimestampHeader), h.Get(NonceHeader)
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return "", errors.New("missing or overlong nonce")
+	}
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("malformed timestamp")
+	}
+	if skew := now.Sub(time.Unix(secs, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return "", fmt.Errorf("timestamp is %s from the server's clock", skew.Round(time.Second))
+	}
+
+	if !ed25519.Verify(key, SignedMessage(timestamp, nonce, body), sig) {
+		return "", errors.New("signature does not match")
+	}
+	return nonce, nil
+}
+
+// EncodePublicKey encodes a public key for registration
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// ParsePublicKey decodes a key encoded with EncodePublicKey
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("public key must be a base64 encoded Ed25519 key")
+	}
+	return ed25519.PublicKey(b), nil
+}
@@ -16,10 +16,10 @@ const (
 
 type AuthMiddleware struct {
 	sessions *SessionStore
-	db       *db.DB
+	db       db.UserStore
 }
 
-func NewAuthMiddleware(sessions *SessionStore, database *db.DB) *AuthMiddleware {
+func NewAuthMiddleware(sessions *SessionStore, database db.UserStore) *AuthMiddleware {
 	return &AuthMiddleware{
 		sessions: sessions,
 		db:       database,
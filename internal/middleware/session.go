@@ -1,26 +1,101 @@
 package middleware
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
+	"github.com/jclement/boxcheckr/internal/auth"
+	"github.com/jclement/boxcheckr/internal/db"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
-	SessionName    = "boxcheckr"
-	SessionUserID  = "user_id"
-	SessionIsAdmin = "is_admin"
+	SessionName = "boxcheckr"
+
+	// sessionToken is the cookie value naming the server-side session
+	sessionToken = "token"
+
+	// touchInterval limits how often a session's last-seen time is written
+	touchInterval = time.Minute
 )
 
+// SessionConfig sets how long sessions last
+type SessionConfig struct {
+	IdleTimeout time.Duration // Sessions unused this long end
+	MaxAge      time.Duration // Sessions end this long after sign-in, however active
+	RoleRefresh time.Duration // How often a session's admin role is re-evaluated
+}
+
+// DefaultSessionConfig is used for settings that aren't configured
+var DefaultSessionConfig = SessionConfig{
+	IdleTimeout: 24 * time.Hour,
+	MaxAge:      7 * 24 * time.Hour,
+	RoleRefresh: 15 * time.Minute,
+}
+
+// SessionConfigFromEnv reads SESSION_IDLE_TIMEOUT, SESSION_MAX_AGE and
+// SESSION_ROLE_REFRESH, e.g. "8h"
+func SessionConfigFromEnv() (SessionConfig, error) {
+	cfg := DefaultSessionConfig
+	for _, setting := range []struct {
+		name string
+		dest *time.Duration
+	}{
+		{"SESSION_IDLE_TIMEOUT", &cfg.IdleTimeout},
+		{"SESSION_MAX_AGE", &cfg.MaxAge},
+		{"SESSION_ROLE_REFRESH", &cfg.RoleRefresh},
+	} {
+		v := os.Getenv(setting.name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid %s: %q", setting.name, v)
+		}
+		*setting.dest = d
+	}
+	return cfg, nil
+}
+
+// Revalidator re-checks a user with the identity provider. auth.OIDCProvider
+// implements it.
+type Revalidator interface {
+	Refresh(ctx context.Context, refreshToken string) (*auth.Claims, string, error)
+	IsAdmin(claims *auth.Claims) bool
+}
+
+// sessionDB is the storage sessions need
+type sessionDB interface {
+	db.UserStore
+	db.SessionStore
+}
+
+// SessionStore keeps sessions in the database. The cookie only holds a
+// random token naming the session, and the OAuth state during sign-in.
 type SessionStore struct {
-	store *sessions.CookieStore
+	store       *sessions.CookieStore
+	db          sessionDB
+	cfg         SessionConfig
+	revalidator Revalidator
+	refreshes   singleflight.Group // Role refreshes in progress, by session ID
+	now         func() time.Time
 }
 
-func NewSessionStore() *SessionStore {
+// NewSessionStore creates a session store. revalidator may be nil, in which
+// case admin roles are re-evaluated from the stored users.is_admin only.
+func NewSessionStore(database sessionDB, cfg SessionConfig, revalidator Revalidator) *SessionStore {
 	secret := os.Getenv("SESSION_SECRET")
 	if secret == "" {
 		// Generate a random secret for development
@@ -32,13 +107,24 @@ func NewSessionStore() *SessionStore {
 	store := sessions.NewCookieStore([]byte(secret))
 	store.Options = &sessions.Options{
 		Path:     "/",
-		MaxAge:   86400 * 7, // 7 days
+		MaxAge:   int(cfg.MaxAge / time.Second),
 		HttpOnly: true,
 		Secure:   strings.HasPrefix(os.Getenv("BASE_URL"), "https://"),
 		SameSite: http.SameSiteLaxMode,
 	}
 
-	return &SessionStore{store: store}
+	return &SessionStore{
+		store:       store,
+		db:          database,
+		cfg:         cfg,
+		revalidator: revalidator,
+		now:         time.Now,
+	}
+}
+
+// Config returns the session timeouts
+func (s *SessionStore) Config() SessionConfig {
+	return s.cfg
 }
 
 func (s *SessionStore) Get(r *http.Request) (*sessions.Session, error) {
@@ -49,45 +135,267 @@ func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *ses
 	return session.Save(r, w)
 }
 
-func (s *SessionStore) SetUser(r *http.Request, w http.ResponseWriter, userID string, isAdmin bool) error {
-	session, err := s.Get(r)
+// SetUser signs a user in, replacing any session the request already has.
+// refreshToken, if set, is used to re-validate the user with the identity
+// provider.
+func (s *SessionStore) SetUser(r *http.Request, w http.ResponseWriter, userID string, isAdmin bool, refreshToken string) error {
+	cookie, err := s.Get(r)
 	if err != nil {
 		return err
 	}
-	session.Values[SessionUserID] = userID
-	session.Values[SessionIsAdmin] = isAdmin
-	return s.Save(r, w, session)
+	if token, _ := cookie.Values[sessionToken].(string); token != "" {
+		if old, _ := s.db.GetSessionByToken(token); old != nil {
+			s.db.DeleteSession(old.ID)
+		}
+	}
+
+	session, err := s.db.CreateSession(userID, isAdmin, refreshToken, r.UserAgent(), ClientIP(r), s.now().Add(s.cfg.MaxAge))
+	if err != nil {
+		return err
+	}
+	cookie.Values[sessionToken] = session.Token
+	return s.Save(r, w, cookie)
 }
 
 func (s *SessionStore) GetUser(r *http.Request) (userID string, isAdmin bool, ok bool) {
-	session, err := s.Get(r)
+	session, err := s.Session(r)
 	if err != nil {
+		log.Printf("Failed to load session: %v", err)
 		return "", false, false
 	}
-
-	userIDVal, ok := session.Values[SessionUserID]
-	if !ok {
+	if session == nil {
 		return "", false, false
 	}
+	return session.UserID, session.IsAdmin, true
+}
 
-	userID, ok = userIDVal.(string)
-	if !ok || userID == "" {
-		return "", false, false
+// Session returns the request's session, or nil if it has none or it has
+// timed out. The admin role is re-evaluated every RoleRefresh, and the
+// session ends if the user is gone or the identity provider rejects them.
+func (s *SessionStore) Session(r *http.Request) (*db.Session, error) {
+	cookie, err := s.Get(r)
+	if err != nil {
+		return nil, nil
+	}
+	token, _ := cookie.Values[sessionToken].(string)
+	if token == "" {
+		return nil, nil
 	}
 
-	isAdmin, _ = session.Values[SessionIsAdmin].(bool)
-	return userID, isAdmin, true
+	session, err := s.db.GetSessionByToken(token)
+	if err != nil || session == nil {
+		return nil, err
+	}
+
+	now := s.now()
+	if !now.Before(session.ExpiresAt) || now.Sub(session.LastSeenAt) >= s.cfg.IdleTimeout {
+		return nil, s.db.DeleteSession(session.ID)
+	}
+
+	if now.Sub(session.RefreshedAt) >= s.cfg.RoleRefresh {
+		// Concurrent requests share one refresh, since providers that rotate
+		// refresh tokens reject a token once it has been used
+		ctx := context.WithoutCancel(r.Context())
+		result, err, _ := s.refreshes.Do(session.ID, func() (interface{}, error) {
+			return s.refreshRole(ctx, *session, now)
+		})
+		if err != nil {
+			return nil, err
+		}
+		refreshed, _ := result.(*db.Session)
+		if refreshed == nil {
+			return nil, s.db.DeleteSession(session.ID)
+		}
+		copy := *refreshed
+		session = &copy
+	}
+
+	if now.Sub(session.LastSeenAt) >= touchInterval {
+		if err := s.db.TouchSession(session.ID, now); err != nil {
+			return nil, err
+		}
+		session.LastSeenAt = now
+	}
+	return session, nil
 }
 
+// refreshRole re-evaluates a session's admin role, from the identity
+// provider if the session has a refresh token and otherwise from the stored
+// user. It returns the refreshed session, or nil if the session should end.
+func (s *SessionStore) refreshRole(ctx context.Context, session db.Session, now time.Time) (*db.Session, error) {
+	user, err := s.db.GetUser(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, nil
+	}
+	isAdmin, refreshToken := user.IsAdmin, session.RefreshToken
+
+	if s.revalidator != nil && session.RefreshToken != "" {
+		claims, token, err := s.revalidator.Refresh(ctx, session.RefreshToken)
+		switch {
+		case errors.Is(err, auth.ErrRefreshRejected):
+			// Another request, perhaps to another server, may have used the
+			// token first and been given a new one
+			current, dbErr := s.db.GetSession(session.ID)
+			if dbErr != nil {
+				return nil, dbErr
+			}
+			if current != nil && !current.RefreshedAt.Equal(session.RefreshedAt) {
+				return current, nil
+			}
+			log.Printf("Ending session for %s: %v", user.Email, err)
+			return nil, nil
+		case err != nil:
+			// The provider may be unreachable; don't sign everyone out
+			log.Printf("Failed to re-validate %s, using the stored role: %v", user.Email, err)
+		default:
+			refreshToken = token
+			if claims != nil {
+				if claims.Subject != user.ID {
+					return nil, nil
+				}
+				isAdmin = s.revalidator.IsAdmin(claims)
+				if _, err := s.db.UpsertUser(claims.Subject, claims.Email, claims.Name, isAdmin); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	updated, err := s.db.UpdateSessionRole(session.ID, isAdmin, refreshToken, session.RefreshedAt, now)
+	if err != nil {
+		return nil, err
+	}
+	if !updated {
+		// Another server refreshed the session first; use its result
+		return s.db.GetSession(session.ID)
+	}
+	if isAdmin != session.IsAdmin {
+		log.Printf("Admin role for %s changed to %v", user.Email, isAdmin)
+	}
+	session.IsAdmin, session.RefreshToken, session.RefreshedAt = isAdmin, refreshToken, now
+	return &session, nil
+}
+
+// Clear signs the request's session out
 func (s *SessionStore) Clear(r *http.Request, w http.ResponseWriter) error {
 	session, err := s.Get(r)
 	if err != nil {
 		return err
 	}
+	if token, _ := session.Values[sessionToken].(string); token != "" {
+		if old, _ := s.db.GetSessionByToken(token); old != nil {
+			s.db.DeleteSession(old.ID)
+		}
+	}
 	session.Options.MaxAge = -1
 	return s.Save(r, w, session)
 }
 
+// ClearUser signs a user out everywhere and returns how many sessions ended
+func (s *SessionStore) ClearUser(userID string) (int64, error) {
+	return s.db.DeleteUserSessions(userID)
+}
+
+// Revoke ends a session by ID
+func (s *SessionStore) Revoke(id string) error {
+	return s.db.DeleteSession(id)
+}
+
+// Active returns the sessions that haven't timed out, most recently seen first
+func (s *SessionStore) Active() ([]db.Session, error) {
+	now := s.now()
+	return s.db.GetSessions(now.Add(-s.cfg.IdleTimeout), now)
+}
+
+// Run deletes timed out sessions every hour until ctx is cancelled
+func (s *SessionStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := s.now()
+		if _, err := s.db.DeleteExpiredSessions(now.Add(-s.cfg.IdleTimeout), now); err != nil {
+			log.Printf("Failed to delete expired sessions: %v", err)
+		}
+	}
+}
+
+// trustedProxies are the proxies whose X-Forwarded-For ClientIP believes
+var trustedProxies []netip.Prefix
+
+// SetTrustedProxies sets the proxies from a comma separated list of
+// addresses and CIDR ranges, as in TRUSTED_PROXIES. An empty list trusts none.
+func SetTrustedProxies(list string) error {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				return fmt.Errorf("invalid TRUSTED_PROXIES entry: %q", item)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	trustedProxies = prefixes
+	return nil
+}
+
+// isTrustedProxy reports whether ip is one of the trusted proxies
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address a request came from. X-Forwarded-For is only
+// believed when the request came through a trusted proxy, and then only up to
+// the right-most address a trusted proxy didn't add, since clients can put
+// anything before that.
+func ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
 func GenerateState() string {
 	b := make([]byte, 16)
 	rand.Read(b)
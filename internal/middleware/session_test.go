@@ -0,0 +1,324 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/auth"
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+// fakeRevalidator answers refreshes with claims, or fails with err
+type fakeRevalidator struct {
+	claims *auth.Claims
+	err    error
+	calls  int
+}
+
+func (f *fakeRevalidator) Refresh(ctx context.Context, refreshToken string) (*auth.Claims, string, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, "", f.err
+	}
+	return f.claims, refreshToken + "+", nil
+}
+
+func (f *fakeRevalidator) IsAdmin(claims *auth.Claims) bool {
+	return len(claims.Roles) > 0
+}
+
+// rotatingRevalidator accepts only the refresh token it last issued, like
+// providers that rotate refresh tokens
+type rotatingRevalidator struct {
+	current string
+	calls   int
+}
+
+func (f *rotatingRevalidator) Refresh(ctx context.Context, refreshToken string) (*auth.Claims, string, error) {
+	f.calls++
+	if refreshToken != f.current {
+		return nil, "", fmt.Errorf("%w: invalid_grant", auth.ErrRefreshRejected)
+	}
+	f.current += "+"
+	return nil, f.current, nil
+}
+
+func (f *rotatingRevalidator) IsAdmin(claims *auth.Claims) bool {
+	return false
+}
+
+// testSessions creates a session store over a new database with a clock the
+// test can move
+func testSessions(t *testing.T, revalidator Revalidator) (*SessionStore, *db.DB, *time.Time) {
+	t.Helper()
+	f, err := os.CreateTemp("", "boxcheckr-session-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	database, err := db.New(f.Name())
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	now := time.Now().UTC()
+	s := NewSessionStore(database, DefaultSessionConfig, revalidator)
+	s.now = func() time.Time { return now }
+	return s, database, &now
+}
+
+// signIn starts a session and returns a request carrying its cookie
+func signIn(t *testing.T, s *SessionStore, userID string, isAdmin bool, refreshToken string) *http.Request {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := s.SetUser(httptest.NewRequest("GET", "/", nil), rec, userID, isAdmin, refreshToken); err != nil {
+		t.Fatalf("SetUser failed: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed []time.Duration // Time between requests
+		want    bool
+	}{
+		{"active", []time.Duration{time.Hour}, true},
+		{"idle", []time.Duration{25 * time.Hour}, false},
+		{"kept alive", []time.Duration{20 * time.Hour, 20 * time.Hour}, true},
+		{"past max age", []time.Duration{20 * time.Hour, 20 * time.Hour, 20 * time.Hour, 20 * time.Hour, 20 * time.Hour, 20 * time.Hour, 20 * time.Hour, 20 * time.Hour, 20 * time.Hour}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, database, now := testSessions(t, nil)
+			database.UpsertUser("user-1", "user@example.com", "User", false)
+			req := signIn(t, s, "user-1", false, "")
+
+			ok := true
+			for _, d := range tt.elapsed {
+				*now = now.Add(d)
+				_, _, ok = s.GetUser(req)
+			}
+			if ok != tt.want {
+				t.Errorf("Expected signed in = %v, got %v", tt.want, ok)
+			}
+		})
+	}
+}
+
+func TestSessionRoleRefresh(t *testing.T) {
+	t.Run("stored role", func(t *testing.T) {
+		s, database, now := testSessions(t, nil)
+		database.UpsertUser("user-1", "user@example.com", "User", true)
+		req := signIn(t, s, "user-1", true, "")
+
+		database.UpsertUser("user-1", "user@example.com", "User", false)
+		if _, isAdmin, _ := s.GetUser(req); !isAdmin {
+			t.Error("Expected the role to be kept until the next refresh")
+		}
+		*now = now.Add(DefaultSessionConfig.RoleRefresh + time.Second)
+		if _, isAdmin, ok := s.GetUser(req); !ok || isAdmin {
+			t.Errorf("Expected a signed in non-admin, got admin = %v, ok = %v", isAdmin, ok)
+		}
+	})
+
+	tests := []struct {
+		name      string
+		claims    *auth.Claims
+		err       error
+		wantOK    bool
+		wantAdmin bool
+	}{
+		{"still admin", &auth.Claims{Subject: "user-1", Email: "user@example.com", Roles: []string{"InventoryAdmin"}}, nil, true, true},
+		{"demoted", &auth.Claims{Subject: "user-1", Email: "user@example.com"}, nil, true, false},
+		{"no id token", nil, nil, true, true},
+		{"another user", &auth.Claims{Subject: "user-2", Roles: []string{"InventoryAdmin"}}, nil, false, false},
+		{"rejected", nil, fmt.Errorf("%w: invalid_grant", auth.ErrRefreshRejected), false, false},
+		{"unreachable", nil, errors.New("connection refused"), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revalidator := &fakeRevalidator{claims: tt.claims, err: tt.err}
+			s, database, now := testSessions(t, revalidator)
+			database.UpsertUser("user-1", "user@example.com", "User", true)
+			req := signIn(t, s, "user-1", true, "refresh")
+
+			*now = now.Add(DefaultSessionConfig.RoleRefresh + time.Second)
+			_, isAdmin, ok := s.GetUser(req)
+			if revalidator.calls != 1 {
+				t.Errorf("Expected 1 refresh, got %d", revalidator.calls)
+			}
+			if ok != tt.wantOK || isAdmin != tt.wantAdmin {
+				t.Errorf("Expected ok = %v, admin = %v, got %v, %v", tt.wantOK, tt.wantAdmin, ok, isAdmin)
+			}
+			if !ok {
+				return
+			}
+			if user, _ := database.GetUser("user-1"); user.IsAdmin != tt.wantAdmin {
+				t.Errorf("Expected the stored role to be %v", tt.wantAdmin)
+			}
+			if session, _ := s.Session(req); tt.err == nil && session.RefreshToken != "refresh+" {
+				t.Errorf("Expected the new refresh token to be kept, got %q", session.RefreshToken)
+			}
+		})
+	}
+}
+
+func TestSessionConcurrentRefresh(t *testing.T) {
+	revalidator := &rotatingRevalidator{current: "refresh"}
+	s, database, now := testSessions(t, revalidator)
+	database.UpsertUser("user-1", "user@example.com", "User", true)
+	req := signIn(t, s, "user-1", true, "refresh")
+
+	// A request that loaded the session before another one refreshed it
+	stale, _ := s.Session(req)
+	*now = now.Add(DefaultSessionConfig.RoleRefresh + time.Second)
+	if _, _, ok := s.GetUser(req); !ok {
+		t.Fatal("Expected the first refresh to keep the session")
+	}
+
+	// Its refresh token has been used, but the session lives on
+	session, err := s.refreshRole(context.Background(), *stale, *now)
+	if err != nil || session == nil {
+		t.Fatalf("Expected the stale refresh to keep the session, got %v, %v", session, err)
+	}
+	if revalidator.calls != 2 || session.RefreshToken != "refresh+" {
+		t.Errorf("Expected the first refresh's token to be kept, got %q after %d refreshes", session.RefreshToken, revalidator.calls)
+	}
+	if _, _, ok := s.GetUser(req); !ok {
+		t.Error("Expected the session to survive the stale refresh")
+	}
+}
+
+func TestSessionProviderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		wantOK bool
+	}{
+		{"unavailable", http.StatusServiceUnavailable, "", true},
+		{"rate limited", http.StatusTooManyRequests, `{"error":"slow_down"}`, true},
+		{"invalid client", http.StatusUnauthorized, `{"error":"invalid_client"}`, true},
+		{"invalid grant", http.StatusBadRequest, `{"error":"invalid_grant"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var issuer *httptest.Server
+			issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Path == "/.well-known/openid-configuration" {
+					fmt.Fprintf(w, `{"issuer":%q,"authorization_endpoint":"%[1]s/authorize","token_endpoint":"%[1]s/token","jwks_uri":"%[1]s/keys"}`, issuer.URL)
+					return
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer issuer.Close()
+
+			provider, err := auth.NewOIDCProvider("http://localhost:8080", auth.Config{IssuerURL: issuer.URL, ClientID: "boxcheckr", ClientSecret: "secret"})
+			if err != nil {
+				t.Fatalf("NewOIDCProvider failed: %v", err)
+			}
+			s, database, now := testSessions(t, provider)
+			database.UpsertUser("user-1", "user@example.com", "User", true)
+			req := signIn(t, s, "user-1", true, "refresh")
+
+			*now = now.Add(DefaultSessionConfig.RoleRefresh + time.Second)
+			if _, isAdmin, ok := s.GetUser(req); ok != tt.wantOK || isAdmin != tt.wantOK {
+				t.Errorf("Expected ok = %v, got ok = %v, admin = %v", tt.wantOK, ok, isAdmin)
+			}
+		})
+	}
+}
+
+func TestSessionRevocation(t *testing.T) {
+	s, database, _ := testSessions(t, nil)
+	database.UpsertUser("user-1", "user@example.com", "User", false)
+	database.UpsertUser("user-2", "other@example.com", "Other", false)
+
+	first := signIn(t, s, "user-1", false, "")
+	second := signIn(t, s, "user-1", false, "")
+	other := signIn(t, s, "user-2", false, "")
+	if active, _ := s.Active(); len(active) != 3 {
+		t.Fatalf("Expected 3 sessions, got %d", len(active))
+	}
+
+	// Signing in again replaces the request's session
+	s.SetUser(other, httptest.NewRecorder(), "user-2", false, "")
+	stale := httptest.NewRequest("GET", "/", nil)
+	for _, c := range other.Cookies() {
+		stale.AddCookie(c)
+	}
+	if _, _, ok := s.GetUser(stale); ok {
+		t.Error("Expected the replaced session to end")
+	}
+
+	if n, err := s.ClearUser("user-1"); err != nil || n != 2 {
+		t.Errorf("Expected 2 sessions ended, got %d, %v", n, err)
+	}
+	for _, req := range []*http.Request{first, second} {
+		if _, _, ok := s.GetUser(req); ok {
+			t.Error("Expected user-1 to be signed out everywhere")
+		}
+	}
+
+	active, _ := s.Active()
+	if len(active) != 1 || active[0].UserID != "user-2" {
+		t.Fatalf("Expected only the new user-2 session, got %+v", active)
+	}
+	s.Revoke(active[0].ID)
+	if active, _ := s.Active(); len(active) != 0 {
+		t.Errorf("Expected no sessions, got %d", len(active))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	if err := SetTrustedProxies("10.0.0.0/8, 192.0.2.1"); err != nil {
+		t.Fatalf("SetTrustedProxies failed: %v", err)
+	}
+	defer SetTrustedProxies("")
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		// Clients connecting directly can't choose their address
+		{"198.51.100.7:5000", []string{"203.0.113.9"}, "198.51.100.7"},
+		{"192.0.2.1:443", nil, "192.0.2.1"},
+		{"192.0.2.1:443", []string{"203.0.113.9"}, "203.0.113.9"},
+		// A spoofed address ahead of the real one is skipped, as are trusted hops
+		{"192.0.2.1:443", []string{"1.2.3.4, 203.0.113.9, 10.0.0.5"}, "203.0.113.9"},
+		{"192.0.2.1:443", []string{"1.2.3.4", "203.0.113.9, 10.0.0.5"}, "203.0.113.9"},
+		{"[::ffff:10.1.2.3]:443", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"192.0.2.1:443", []string{"10.0.0.6, 10.0.0.5"}, "10.0.0.6"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := ClientIP(r); got != tt.want {
+			t.Errorf("ClientIP(%s, %v) = %q, want %q", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+
+	if err := SetTrustedProxies("10.0.0.0/8, proxy"); err == nil {
+		t.Error("Expected an invalid entry to be rejected")
+	}
+}
@@ -0,0 +1,277 @@
+// Package notify emails machine owners when a security control fails and
+// sends each owner a weekly digest of their machines.
+//
+// Messages are rendered from text templates that define a "subject" and a
+// "body" block. The defaults are embedded; a file with the same name in the
+// override directory replaces one.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+//go:embed templates/*.tmpl
+var defaultTemplates embed.FS
+
+// Template file names
+const (
+	ControlFailedTemplate = "control_failed.tmpl"
+	DigestTemplate        = "digest.tmpl"
+)
+
+// digestInterval is how often each owner is sent a digest
+const digestInterval = 7 * 24 * time.Hour
+
+// Control is a check that emails the owner when it fails
+type Control struct {
+	Key         string // Agent JSON key, as used by policy rules and webhooks
+	Label       string
+	Remediation string
+	status      func(*db.InventorySnapshot) db.ControlStatus
+	details     func(*db.InventorySnapshot) string
+}
+
+// Controls lists the checks that trigger an email
+var Controls = []Control{
+	{
+		Key:         "disk_encrypted",
+		Label:       "Disk encryption",
+		Remediation: "Turn on FileVault (macOS), BitLocker (Windows) or LUKS (Linux).",
+		status:      func(s *db.InventorySnapshot) db.ControlStatus { return s.DiskEncryptionStatus.Or(s.DiskEncrypted) },
+		details:     func(s *db.InventorySnapshot) string { return s.DiskEncryptionDetails },
+	},
+	{
+		Key:         "firewall_enabled",
+		Label:       "Firewall",
+		Remediation: "Turn on the built-in firewall in your system security settings.",
+		status:      func(s *db.InventorySnapshot) db.ControlStatus { return s.FirewallStatus.Or(s.FirewallEnabled) },
+		details:     func(s *db.InventorySnapshot) string { return s.FirewallDetails },
+	},
+}
+
+// FailedControl is a failing control as passed to the control_failed template
+type FailedControl struct {
+	Key         string
+	Label       string
+	Details     string
+	Remediation string
+}
+
+// Sender delivers a plain-text email
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPConfig configures an SMTPSender. Username may be empty for relays
+// that don't require authentication.
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// SMTPSender sends mail through an SMTP server, using STARTTLS when offered
+type SMTPSender struct {
+	cfg SMTPConfig
+}
+
+func NewSMTPSender(cfg SMTPConfig) *SMTPSender {
+	return &SMTPSender{cfg: cfg}
+}
+
+func (s *SMTPSender) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if s.cfg.Username != "" {
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)
+	}
+	msg := buildMessage(s.cfg.From, to, subject, body)
+	return smtp.SendMail(s.cfg.Host+":"+s.cfg.Port, auth, s.cfg.From, []string{to}, msg)
+}
+
+// buildMessage formats a plain-text message. The subject is folded onto one
+// line and encoded, since it includes user-chosen machine names.
+func buildMessage(from, to, subject, body string) []byte {
+	subject = strings.Join(strings.Fields(subject), " ")
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.TrimLeft(body, "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// Notifier decides who to email and renders the messages
+type Notifier struct {
+	db        db.Store
+	sender    Sender
+	baseURL   string
+	templates map[string]*template.Template
+	now       func() time.Time
+}
+
+// New loads the templates, preferring files in templateDir when it is set
+func New(database db.Store, sender Sender, baseURL, templateDir string) (*Notifier, error) {
+	n := &Notifier{
+		db:        database,
+		sender:    sender,
+		baseURL:   baseURL,
+		templates: make(map[string]*template.Template),
+		now:       time.Now,
+	}
+
+	for _, name := range []string{ControlFailedTemplate, DigestTemplate} {
+		var tmpl *template.Template
+		var err error
+		override := filepath.Join(templateDir, name)
+		if _, statErr := os.Stat(override); templateDir != "" && statErr == nil {
+			tmpl, err = template.ParseFiles(override)
+		} else {
+			tmpl, err = template.ParseFS(defaultTemplates, "templates/"+name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		n.templates[name] = tmpl
+	}
+
+	return n, nil
+}
+
+func (n *Notifier) send(to, name string, data interface{}) error {
+	tmpl := n.templates[name]
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return err
+	}
+	return n.sender.Send(to, subject.String(), body.String())
+}
+
+// SnapshotSubmitted emails the machine's owner about controls that started
+// failing since they were last told. A control is mailed once per failure:
+// it has to pass again before a later failure is reported. A control the
+// agent couldn't check keeps its previous state.
+func (n *Notifier) SnapshotSubmitted(machine *db.Machine, snapshot *db.InventorySnapshot) error {
+	alerted, err := n.db.GetAlertedControls(machine.ID)
+	if err != nil {
+		return err
+	}
+
+	var failing []string
+	var newlyFailed []FailedControl
+	for _, c := range Controls {
+		status := c.status(snapshot)
+		if status.Unknown() && slices.Contains(alerted, c.Key) {
+			failing = append(failing, c.Key)
+			continue
+		}
+		if !status.Failed() {
+			continue
+		}
+		failing = append(failing, c.Key)
+		if !slices.Contains(alerted, c.Key) {
+			newlyFailed = append(newlyFailed, FailedControl{
+				Key:         c.Key,
+				Label:       c.Label,
+				Details:     c.details(snapshot),
+				Remediation: c.Remediation,
+			})
+		}
+	}
+
+	if len(newlyFailed) > 0 {
+		owner, err := n.db.GetUser(machine.UserID)
+		if err != nil {
+			return err
+		}
+		// Opted-out owners are still recorded as alerted, so opting back in
+		// doesn't mail them about old failures
+		if owner != nil && !owner.EmailOptOut {
+			err := n.send(owner.Email, ControlFailedTemplate, map[string]interface{}{
+				"User":       owner,
+				"Machine":    machine,
+				"Snapshot":   snapshot,
+				"Failed":     newlyFailed,
+				"MachineURL": n.baseURL + "/machines/" + machine.ID,
+				"BaseURL":    n.baseURL,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return n.db.SetAlertedControls(machine.ID, failing)
+}
+
+// SendDigests emails each owner who is due a weekly digest
+func (n *Notifier) SendDigests() error {
+	now := n.now()
+	users, err := n.db.GetUsersDueDigest(now.Add(-digestInterval))
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		machines, err := n.db.GetMachinesWithLatestByUser(u.ID)
+		if err != nil {
+			return err
+		}
+
+		err = n.send(u.Email, DigestTemplate, map[string]interface{}{
+			"User":     u,
+			"Machines": machines,
+			"BaseURL":  n.baseURL,
+		})
+		if err != nil {
+			log.Printf("Failed to send digest to %s: %v", u.Email, err)
+			continue
+		}
+
+		if err := n.db.MarkDigestSent(u.ID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run sends digests as they fall due until ctx is cancelled
+func (n *Notifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := n.SendDigests(); err != nil {
+			log.Printf("Failed to send digests: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package notify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+type sentMail struct {
+	to, subject, body string
+}
+
+type fakeSender struct {
+	sent []sentMail
+}
+
+func (f *fakeSender) Send(to, subject, body string) error {
+	f.sent = append(f.sent, sentMail{to, subject, body})
+	return nil
+}
+
+func setupTest(t *testing.T, templateDir string) (*Notifier, *fakeSender, *db.DB) {
+	t.Helper()
+	tmpFile, err := os.CreateTemp("", "boxcheckr-notify-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	tmpFile.Close()
+
+	database, err := db.New(tmpFile.Name())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Close()
+		os.Remove(tmpFile.Name())
+	})
+
+	sender := &fakeSender{}
+	n, err := New(database, sender, "https://boxcheckr.example.com", templateDir)
+	if err != nil {
+		t.Fatalf("Failed to create notifier: %v", err)
+	}
+	return n, sender, database
+}
+
+func TestSnapshotSubmittedDedup(t *testing.T) {
+	n, sender, database := setupTest(t, "")
+
+	database.UpsertUser("user-1", "owner@example.com", "Owner", false)
+	machine, _ := database.CreateMachine("user-1", "Laptop")
+
+	report := func(disk, firewall bool) {
+		t.Helper()
+		snapshot := &db.InventorySnapshot{Hostname: "laptop", DiskEncrypted: disk, FirewallEnabled: firewall, FirewallDetails: "ufw inactive"}
+		if err := n.SnapshotSubmitted(machine, snapshot); err != nil {
+			t.Fatalf("SnapshotSubmitted failed: %v", err)
+		}
+	}
+
+	report(true, true)
+	if len(sender.sent) != 0 {
+		t.Fatalf("Expected no mail for a healthy machine, got %d", len(sender.sent))
+	}
+
+	report(true, false)
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected 1 mail, got %d", len(sender.sent))
+	}
+	mail := sender.sent[0]
+	if mail.to != "owner@example.com" || !strings.Contains(mail.subject, "Firewall") || !strings.Contains(mail.subject, "Laptop") {
+		t.Errorf("Unexpected mail: %+v", mail)
+	}
+	if !strings.Contains(mail.body, "https://boxcheckr.example.com/machines/"+machine.ID) || !strings.Contains(mail.body, "ufw inactive") {
+		t.Errorf("Expected machine link and details in body:\n%s", mail.body)
+	}
+
+	// Same failure again: no new mail. A second control failing is mailed on its own.
+	report(true, false)
+	report(false, false)
+	if len(sender.sent) != 2 || strings.Contains(sender.sent[1].subject, "Firewall") {
+		t.Fatalf("Expected one more mail about disk encryption only, got %+v", sender.sent)
+	}
+
+	// Recovering re-arms the alert
+	report(true, true)
+	report(true, false)
+	if len(sender.sent) != 3 {
+		t.Errorf("Expected a new mail after the firewall recovered and failed again, got %d", len(sender.sent))
+	}
+}
+
+func TestSnapshotSubmittedOptOut(t *testing.T) {
+	n, sender, database := setupTest(t, "")
+
+	database.UpsertUser("user-1", "owner@example.com", "Owner", false)
+	database.SetUserEmailOptOut("user-1", true)
+	machine, _ := database.CreateMachine("user-1", "Laptop")
+
+	n.SnapshotSubmitted(machine, &db.InventorySnapshot{DiskEncrypted: false, FirewallEnabled: true})
+	if len(sender.sent) != 0 {
+		t.Fatalf("Expected no mail for an opted-out owner, got %d", len(sender.sent))
+	}
+
+	// Opting back in doesn't resend the old failure
+	database.SetUserEmailOptOut("user-1", false)
+	n.SnapshotSubmitted(machine, &db.InventorySnapshot{DiskEncrypted: false, FirewallEnabled: true})
+	if len(sender.sent) != 0 {
+		t.Errorf("Expected no mail for an already recorded failure, got %d", len(sender.sent))
+	}
+}
+
+func TestSendDigests(t *testing.T) {
+	n, sender, database := setupTest(t, "")
+
+	database.UpsertUser("user-1", "owner@example.com", "Owner", false)
+	database.UpsertUser("user-2", "optout@example.com", "Opted Out", false)
+	database.UpsertUser("user-3", "nomachines@example.com", "No Machines", false)
+	database.SetUserEmailOptOut("user-2", true)
+	m1, _ := database.CreateMachine("user-1", "Laptop")
+	database.CreateMachine("user-1", "Desktop")
+	database.CreateMachine("user-2", "Other")
+	database.CreateSnapshot(m1.ID, &db.InventorySnapshot{Hostname: "laptop", DiskEncrypted: true})
+
+	now := time.Now()
+	n.now = func() time.Time { return now }
+	if err := n.SendDigests(); err != nil {
+		t.Fatalf("SendDigests failed: %v", err)
+	}
+	if len(sender.sent) != 1 || sender.sent[0].to != "owner@example.com" {
+		t.Fatalf("Expected one digest to owner@example.com, got %+v", sender.sent)
+	}
+	body := sender.sent[0].body
+	if !strings.Contains(body, "Laptop") || !strings.Contains(body, "Desktop") || !strings.Contains(body, "Has not reported yet") {
+		t.Errorf("Unexpected digest body:\n%s", body)
+	}
+
+	// Not again until a week has passed
+	n.SendDigests()
+	if len(sender.sent) != 1 {
+		t.Fatalf("Expected no second digest within the week, got %d", len(sender.sent))
+	}
+	now = now.Add(digestInterval + time.Minute)
+	n.SendDigests()
+	if len(sender.sent) != 2 {
+		t.Errorf("Expected a digest after a week, got %d", len(sender.sent))
+	}
+}
+
+func TestTemplateOverride(t *testing.T) {
+	dir := t.TempDir()
+	custom := `{{define "subject"}}Custom {{.Machine.Name}}{{end}}{{define "body"}}Fix it{{end}}`
+	if err := os.WriteFile(filepath.Join(dir, ControlFailedTemplate), []byte(custom), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, sender, database := setupTest(t, dir)
+	database.UpsertUser("user-1", "owner@example.com", "Owner", false)
+	machine, _ := database.CreateMachine("user-1", "Laptop")
+
+	n.SnapshotSubmitted(machine, &db.InventorySnapshot{DiskEncrypted: false})
+	if len(sender.sent) != 1 || sender.sent[0].subject != "Custom Laptop" || sender.sent[0].body != "Fix it" {
+		t.Errorf("Expected the override template, got %+v", sender.sent)
+	}
+}
+
+func TestBuildMessage(t *testing.T) {
+	msg := string(buildMessage("boxcheckr@example.com", "owner@example.com", "Disk off on\r\nBcc: evil@example.com", "Line 1\nLine 2\n"))
+
+	if strings.Contains(msg, "\r\nBcc:") {
+		t.Errorf("Subject must not inject headers:\n%s", msg)
+	}
+	if !strings.Contains(msg, "Subject: Disk off on Bcc: evil@example.com\r\n") {
+		t.Errorf("Expected folded subject:\n%s", msg)
+	}
+	if !strings.HasSuffix(msg, "\r\n\r\nLine 1\r\nLine 2\r\n") {
+		t.Errorf("Expected CRLF body:\n%q", msg)
+	}
+}
@@ -0,0 +1,318 @@
+// Package policy evaluates admin-defined compliance rules against inventory snapshots.
+//
+// A rule compares one inventory field with a literal value, for example
+// "disk_encrypted == true", "screen_lock_timeout <= 15" or
+// "os_version >= 14.0" restricted to darwin. Named checks are fields too:
+// "check.gatekeeper_enabled == pass".
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jclement/boxcheckr/internal/checks"
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+type kind int
+
+const (
+	kindBool kind = iota
+	kindInt
+	kindString
+	kindVersion
+	kindStatus
+)
+
+// checkPrefix starts the field name of a named check
+const checkPrefix = "check."
+
+type field struct {
+	kind kind
+	get  func(s *db.InventorySnapshot) string
+}
+
+// fields maps rule field names (the agent JSON keys) to snapshot values
+var fields = map[string]field{
+	"hostname":                 {kindString, func(s *db.InventorySnapshot) string { return s.Hostname }},
+	"os":                       {kindString, func(s *db.InventorySnapshot) string { return s.OS }},
+	"os_version":               {kindVersion, func(s *db.InventorySnapshot) string { return s.OSVersion }},
+	"disk_encrypted":           {kindBool, func(s *db.InventorySnapshot) string { return s.DiskEncryptionStatus.Or(s.DiskEncrypted).Value() }},
+	"antivirus_enabled":        {kindBool, func(s *db.InventorySnapshot) string { return s.AntivirusStatus.Or(s.AntivirusEnabled).Value() }},
+	"firewall_enabled":         {kindBool, func(s *db.InventorySnapshot) string { return s.FirewallStatus.Or(s.FirewallEnabled).Value() }},
+	"screen_lock_enabled":      {kindBool, func(s *db.InventorySnapshot) string { return s.ScreenLockStatus.Or(s.ScreenLockEnabled).Value() }},
+	"disk_encryption_status":   {kindStatus, func(s *db.InventorySnapshot) string { return string(s.DiskEncryptionStatus.Or(s.DiskEncrypted)) }},
+	"antivirus_status":         {kindStatus, func(s *db.InventorySnapshot) string { return string(s.AntivirusStatus.Or(s.AntivirusEnabled)) }},
+	"firewall_status":          {kindStatus, func(s *db.InventorySnapshot) string { return string(s.FirewallStatus.Or(s.FirewallEnabled)) }},
+	"screen_lock_status":       {kindStatus, func(s *db.InventorySnapshot) string { return string(s.ScreenLockStatus.Or(s.ScreenLockEnabled)) }},
+	"screen_lock_timeout":      {kindInt, func(s *db.InventorySnapshot) string { return strconv.Itoa(s.ScreenLockTimeout) }},
+	"os_build":                 {kindVersion, func(s *db.InventorySnapshot) string { return s.OSBuild }},
+	"days_since_update":        {kindInt, func(s *db.InventorySnapshot) string { return optionalInt(s.DaysSinceUpdate) }},
+	"auto_update_enabled":      {kindBool, func(s *db.InventorySnapshot) string { return strconv.FormatBool(s.AutoUpdateEnabled) }},
+	"uptime_days":              {kindInt, uptimeDays},
+	"pending_security_updates": {kindInt, func(s *db.InventorySnapshot) string { return optionalInt(s.PendingSecurityUpdates) }},
+}
+
+// lookupField finds a rule field, including "check.<id>" for any valid check
+// ID. Checks a machine didn't report are empty, which fails every comparison.
+func lookupField(name string) (field, bool) {
+	if id, ok := strings.CutPrefix(name, checkPrefix); ok {
+		if !checks.ValidID(id) {
+			return field{}, false
+		}
+		return field{kindStatus, func(s *db.InventorySnapshot) string { return checks.Status(s, id) }}, true
+	}
+	f, ok := fields[name]
+	return f, ok
+}
+
+// optionalInt formats a value the agent may not have reported. Unreported
+// values are empty, which fails every comparison.
+func optionalInt(n *int) string {
+	if n == nil {
+		return ""
+	}
+	return strconv.Itoa(*n)
+}
+
+// uptimeDays is how many whole days the machine had been up when the
+// snapshot was collected
+func uptimeDays(s *db.InventorySnapshot) string {
+	if s.LastBootAt == nil || s.CollectedAt.IsZero() {
+		return ""
+	}
+	return strconv.Itoa(s.UptimeDays())
+}
+
+// Operators lists the supported comparison operators
+var Operators = []string{"==", "!=", "<", "<=", ">", ">="}
+
+// Platforms lists the values accepted for a rule's OS restriction
+var Platforms = []string{"darwin", "linux", "windows"}
+
+// Fields returns the names of the fields a rule can test, sorted, followed by
+// the registered named checks. Unregistered checks can be tested too.
+func Fields() []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, c := range checks.All() {
+		if !c.Legacy() {
+			names = append(names, checkPrefix+c.ID)
+		}
+	}
+	return names
+}
+
+// Validate checks that a rule refers to a known field and that its operator
+// and value make sense for that field's type
+func Validate(rule db.PolicyRule) error {
+	if strings.TrimSpace(rule.Name) == "" {
+		return fmt.Errorf("rule name is required")
+	}
+
+	f, ok := lookupField(rule.Field)
+	if !ok {
+		return fmt.Errorf("unknown field %q", rule.Field)
+	}
+
+	if !validOperator(rule.Operator) {
+		return fmt.Errorf("unknown operator %q", rule.Operator)
+	}
+
+	if rule.OS != "" && !validPlatform(rule.OS) {
+		return fmt.Errorf("unknown platform %q", rule.OS)
+	}
+
+	switch f.kind {
+	case kindBool:
+		if rule.Operator != "==" && rule.Operator != "!=" {
+			return fmt.Errorf("%s only supports == and !=", rule.Field)
+		}
+		if _, err := strconv.ParseBool(rule.Value); err != nil {
+			return fmt.Errorf("%s must be compared with true or false", rule.Field)
+		}
+	case kindInt:
+		if _, err := strconv.Atoi(rule.Value); err != nil {
+			return fmt.Errorf("%s must be compared with a whole number", rule.Field)
+		}
+	case kindVersion:
+		if _, ok := parseVersion(rule.Value); !ok {
+			return fmt.Errorf("%s must be compared with a version such as 14.0", rule.Field)
+		}
+	case kindStatus:
+		if rule.Operator != "==" && rule.Operator != "!=" {
+			return fmt.Errorf("%s only supports == and !=", rule.Field)
+		}
+		// Controls and checks that don't apply are skipped, so a
+		// not_applicable rule would never produce a result
+		if !checks.ValidStatus(rule.Value) || rule.Value == string(db.StatusNotApplicable) {
+			return fmt.Errorf("%s must be compared with pass, fail or unknown", rule.Field)
+		}
+	}
+
+	return nil
+}
+
+// Applies reports whether a rule should be evaluated against a snapshot
+func Applies(rule db.PolicyRule, s *db.InventorySnapshot) bool {
+	return rule.Enabled && (rule.OS == "" || strings.EqualFold(rule.OS, s.OS))
+}
+
+// Evaluate runs every applicable rule against a snapshot. Rules restricted to
+// another platform, disabled rules and controls that don't apply to the
+// machine produce no result. Controls the agent couldn't check fail.
+func Evaluate(rules []db.PolicyRule, s *db.InventorySnapshot) []db.PolicyResult {
+	var results []db.PolicyResult
+	for _, rule := range rules {
+		if !Applies(rule, s) {
+			continue
+		}
+
+		f, ok := lookupField(rule.Field)
+		if !ok {
+			continue
+		}
+
+		actual := f.get(s)
+		if actual == string(db.StatusNotApplicable) && (f.kind == kindBool || f.kind == kindStatus) {
+			continue
+		}
+		results = append(results, db.PolicyResult{
+			SnapshotID: s.ID,
+			RuleID:     rule.ID,
+			RuleName:   rule.Name,
+			Expression: rule.Expression(),
+			Passed:     compare(f.kind, actual, rule.Operator, rule.Value),
+			Actual:     actual,
+		})
+	}
+	return results
+}
+
+// compare applies op to actual and expected, interpreting both as the field's kind.
+// Values that cannot be interpreted fail the rule.
+func compare(k kind, actual, op, expected string) bool {
+	var cmp int
+	switch k {
+	case kindBool:
+		a, errA := strconv.ParseBool(actual)
+		b, errB := strconv.ParseBool(expected)
+		if errA != nil || errB != nil {
+			return false
+		}
+		if a != b {
+			cmp = 1
+		}
+	case kindInt:
+		a, errA := strconv.Atoi(actual)
+		b, errB := strconv.Atoi(expected)
+		if errA != nil || errB != nil {
+			return false
+		}
+		cmp = compareInts(a, b)
+	case kindVersion:
+		a, okA := parseVersion(actual)
+		b, okB := parseVersion(expected)
+		if !okA || !okB {
+			return false
+		}
+		cmp = compareVersions(a, b)
+	case kindStatus:
+		if actual == "" {
+			return false
+		}
+		cmp = strings.Compare(actual, expected)
+	default:
+		cmp = strings.Compare(strings.ToLower(actual), strings.ToLower(expected))
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// parseVersion extracts the leading dotted number from strings like "14.2.1",
+// "10.0.22631 (Build 22631)" or "22.04"
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimSpace(v)
+	end := 0
+	for end < len(v) && (v[end] == '.' || (v[end] >= '0' && v[end] <= '9')) {
+		end++
+	}
+	v = strings.Trim(v[:end], ".")
+	if v == "" {
+		return nil, false
+	}
+
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+// compareVersions compares segment by segment, treating missing segments as zero
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if c := compareInts(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func validOperator(op string) bool {
+	for _, o := range Operators {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func validPlatform(os string) bool {
+	for _, p := range Platforms {
+		if p == os {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    db.PolicyRule
+		wantErr bool
+	}{
+		{"bool rule", db.PolicyRule{Name: "Disk", Field: "disk_encrypted", Operator: "==", Value: "true"}, false},
+		{"int rule", db.PolicyRule{Name: "Lock", Field: "screen_lock_timeout", Operator: "<=", Value: "15"}, false},
+		{"version rule", db.PolicyRule{Name: "macOS", Field: "os_version", Operator: ">=", Value: "14.0", OS: "darwin"}, false},
+		{"missing name", db.PolicyRule{Field: "disk_encrypted", Operator: "==", Value: "true"}, true},
+		{"unknown field", db.PolicyRule{Name: "X", Field: "tpm_enabled", Operator: "==", Value: "true"}, true},
+		{"unknown operator", db.PolicyRule{Name: "X", Field: "disk_encrypted", Operator: "=~", Value: "true"}, true},
+		{"ordering on bool", db.PolicyRule{Name: "X", Field: "disk_encrypted", Operator: "<", Value: "true"}, true},
+		{"bad bool value", db.PolicyRule{Name: "X", Field: "disk_encrypted", Operator: "==", Value: "yes please"}, true},
+		{"bad int value", db.PolicyRule{Name: "X", Field: "screen_lock_timeout", Operator: "<=", Value: "soon"}, true},
+		{"bad platform", db.PolicyRule{Name: "X", Field: "os_version", Operator: ">=", Value: "14", OS: "beos"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	snapshot := &db.InventorySnapshot{
+		ID:                7,
+		OS:                "darwin",
+		OSVersion:         "14.2.1",
+		DiskEncrypted:     true,
+		FirewallEnabled:   false,
+		ScreenLockTimeout: 10,
+	}
+
+	rules := []db.PolicyRule{
+		{ID: 1, Name: "Disk", Field: "disk_encrypted", Operator: "==", Value: "true", Enabled: true},
+		{ID: 2, Name: "Firewall", Field: "firewall_enabled", Operator: "==", Value: "true", Enabled: true},
+		{ID: 3, Name: "Lock", Field: "screen_lock_timeout", Operator: "<=", Value: "15", Enabled: true},
+		{ID: 4, Name: "macOS", Field: "os_version", Operator: ">=", Value: "14.0", OS: "darwin", Enabled: true},
+		{ID: 5, Name: "Windows", Field: "os_version", Operator: ">=", Value: "10.0", OS: "windows", Enabled: true},
+		{ID: 6, Name: "Disabled", Field: "disk_encrypted", Operator: "==", Value: "false", Enabled: false},
+	}
+
+	results := Evaluate(rules, snapshot)
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+
+	want := map[int64]bool{1: true, 2: false, 3: true, 4: true}
+	for _, r := range results {
+		if r.SnapshotID != 7 {
+			t.Errorf("Rule %d: expected snapshot ID 7, got %d", r.RuleID, r.SnapshotID)
+		}
+		if r.Passed != want[r.RuleID] {
+			t.Errorf("Rule %d (%s): expected passed=%v, got %v (actual %q)", r.RuleID, r.Expression, want[r.RuleID], r.Passed, r.Actual)
+		}
+	}
+}
+
+func TestEvaluatePatchLevel(t *testing.T) {
+	days, pending := 45, 0
+	collected := time.Date(2024, 5, 20, 9, 0, 0, 0, time.UTC)
+	booted := collected.Add(-10*24*time.Hour - time.Hour)
+	patched := &db.InventorySnapshot{
+		OS:                     "windows",
+		OSBuild:                "22631.3527",
+		DaysSinceUpdate:        &days,
+		PendingSecurityUpdates: &pending,
+		AutoUpdateEnabled:      true,
+		CollectedAt:            collected,
+		LastBootAt:             &booted,
+	}
+
+	rules := []db.PolicyRule{
+		{ID: 1, Name: "Recent", Field: "days_since_update", Operator: "<=", Value: "30", Enabled: true},
+		{ID: 2, Name: "Pending", Field: "pending_security_updates", Operator: "==", Value: "0", Enabled: true},
+		{ID: 3, Name: "Auto", Field: "auto_update_enabled", Operator: "==", Value: "true", Enabled: true},
+		{ID: 4, Name: "Build", Field: "os_build", Operator: ">=", Value: "22631.3447", Enabled: true},
+		{ID: 5, Name: "Reboot", Field: "uptime_days", Operator: "<=", Value: "14", Enabled: true},
+	}
+
+	want := map[int64]bool{1: false, 2: true, 3: true, 4: true, 5: true}
+	for _, r := range Evaluate(rules, patched) {
+		if r.Passed != want[r.RuleID] {
+			t.Errorf("Rule %d (%s): expected passed=%v, got %v (actual %q)", r.RuleID, r.Expression, want[r.RuleID], r.Passed, r.Actual)
+		}
+	}
+	if r := Evaluate(rules[4:], patched)[0]; r.Actual != "10" {
+		t.Errorf("Expected 10 days of uptime, got %q", r.Actual)
+	}
+
+	// Values an older script didn't report fail every rule
+	for _, r := range Evaluate(rules, &db.InventorySnapshot{OS: "linux"}) {
+		if r.Passed {
+			t.Errorf("Rule %d (%s): expected an unreported value to fail", r.RuleID, r.Expression)
+		}
+	}
+}
+
+func TestEvaluateChecks(t *testing.T) {
+	snapshot := &db.InventorySnapshot{
+		OS:              "linux",
+		FirewallEnabled: true,
+		Checks: []db.SnapshotCheck{
+			{CheckID: "ssh_root_login_disabled", Status: "fail", Value: "yes"},
+			{CheckID: "acme.vpn_connected", Status: "unknown"},
+		},
+	}
+
+	rules := []db.PolicyRule{
+		{ID: 1, Name: "SSH", Field: "check.ssh_root_login_disabled", Operator: "==", Value: "pass", Enabled: true},
+		{ID: 2, Name: "VPN", Field: "check.acme.vpn_connected", Operator: "!=", Value: "fail", Enabled: true},
+		{ID: 3, Name: "Firewall", Field: "check.firewall_enabled", Operator: "==", Value: "pass", Enabled: true},
+		{ID: 4, Name: "UAC", Field: "check.uac_enabled", Operator: "!=", Value: "fail", Enabled: true},
+	}
+
+	// A check the machine didn't report fails even a != rule
+	want := map[int64]bool{1: false, 2: true, 3: true, 4: false}
+	for _, r := range Evaluate(rules, snapshot) {
+		if r.Passed != want[r.RuleID] {
+			t.Errorf("Rule %d (%s): expected passed=%v, got %v (actual %q)", r.RuleID, r.Expression, want[r.RuleID], r.Passed, r.Actual)
+		}
+	}
+
+	invalid := []db.PolicyRule{
+		{Name: "X", Field: "check.uac_enabled", Operator: "==", Value: "true"},
+		{Name: "X", Field: "check.uac_enabled", Operator: ">=", Value: "pass"},
+		{Name: "X", Field: "check.UAC", Operator: "==", Value: "pass"},
+		{Name: "X", Field: "check.uac_enabled", Operator: "!=", Value: "not_applicable"},
+		{Name: "X", Field: "firewall_status", Operator: "==", Value: "not_applicable"},
+	}
+	for _, rule := range invalid {
+		if Validate(rule) == nil {
+			t.Errorf("Expected %s to be rejected", rule.Expression())
+		}
+	}
+	if err := Validate(rules[1]); err != nil {
+		t.Errorf("Expected an unregistered check to be accepted, got %v", err)
+	}
+}
+
+func TestEvaluateControlStatuses(t *testing.T) {
+	snapshot := &db.InventorySnapshot{
+		DiskEncryptionStatus: db.StatusUnknown,
+		AntivirusStatus:      db.StatusNotApplicable,
+		FirewallEnabled:      true,
+		FirewallStatus:       db.StatusPass,
+	}
+
+	rules := []db.PolicyRule{
+		{ID: 1, Name: "Encryption", Field: "disk_encrypted", Operator: "==", Value: "true", Enabled: true},
+		{ID: 2, Name: "Not unencrypted", Field: "disk_encrypted", Operator: "!=", Value: "false", Enabled: true},
+		{ID: 3, Name: "Antivirus", Field: "antivirus_enabled", Operator: "==", Value: "true", Enabled: true},
+		{ID: 4, Name: "Firewall", Field: "firewall_enabled", Operator: "==", Value: "true", Enabled: true},
+		{ID: 5, Name: "Encryption checked", Field: "disk_encryption_status", Operator: "!=", Value: "unknown", Enabled: true},
+		{ID: 6, Name: "Screen lock", Field: "screen_lock_status", Operator: "==", Value: "fail", Enabled: true},
+	}
+
+	// Unknown controls fail every comparison; controls that don't apply are skipped
+	want := map[int64]bool{1: false, 2: false, 4: true, 5: false, 6: true}
+	results := Evaluate(rules, snapshot)
+	if len(results) != len(want) {
+		t.Fatalf("Expected %d results, got %+v", len(want), results)
+	}
+	for _, r := range results {
+		if r.Passed != want[r.RuleID] {
+			t.Errorf("Rule %d (%s): expected passed=%v, got %v (actual %q)", r.RuleID, r.Expression, want[r.RuleID], r.Passed, r.Actual)
+		}
+	}
+	if results[0].Actual != "unknown" {
+		t.Errorf("Expected the unknown status to be recorded, got %q", results[0].Actual)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		actual, op, expected string
+		want                 bool
+	}{
+		{"14.2.1", ">=", "14.0", true},
+		{"13.6", ">=", "14.0", false},
+		{"14", "==", "14.0.0", true},
+		{"10.0.22631 (Build 22631)", ">=", "10.0.19045", true},
+		{"22.04", "<", "24.04", true},
+		{"unknown", ">=", "1.0", false},
+	}
+
+	for _, tt := range tests {
+		got := compare(kindVersion, tt.actual, tt.op, tt.expected)
+		if got != tt.want {
+			t.Errorf("%s %s %s: expected %v, got %v", tt.actual, tt.op, tt.expected, tt.want, got)
+		}
+	}
+}
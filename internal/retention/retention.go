@@ -0,0 +1,267 @@
+// Package retention thins out old inventory snapshots
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/checks"
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+// Periods old snapshots are thinned to
+const (
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+// Periods lists the periods a policy may use
+var Periods = []string{PeriodWeek, PeriodMonth}
+
+// Policy keeps every snapshot from the last KeepDays days. Older snapshots
+// are thinned to the newest in each Period, plus the first snapshot, the
+// latest, and every snapshot where a control changed. The rest are deleted.
+type Policy struct {
+	KeepDays int
+	Period   string
+}
+
+// ParsePolicy reads a policy from the RETENTION_DAYS and RETENTION_PERIOD
+// settings. Blank or zero days disables retention; period defaults to a week.
+func ParsePolicy(days, period string) (Policy, error) {
+	p := Policy{Period: PeriodWeek}
+	if days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("retention days must be a whole number of days, got %q", days)
+		}
+		p.KeepDays = n
+	}
+	switch period {
+	case "":
+	case PeriodWeek, PeriodMonth:
+		p.Period = period
+	default:
+		return p, fmt.Errorf("retention period must be %q or %q, got %q", PeriodWeek, PeriodMonth, period)
+	}
+	return p, nil
+}
+
+// Enabled reports whether the policy deletes anything
+func (p Policy) Enabled() bool {
+	return p.KeepDays > 0
+}
+
+// Cutoff is the time before which snapshots are thinned
+func (p Policy) Cutoff(now time.Time) time.Time {
+	return now.AddDate(0, 0, -p.KeepDays)
+}
+
+// bucket identifies the period a snapshot falls in
+func (p Policy) bucket(t time.Time) int {
+	t = t.UTC()
+	if p.Period == PeriodMonth {
+		return t.Year()*100 + int(t.Month())
+	}
+	year, week := t.ISOWeek()
+	return year*100 + week
+}
+
+// MachinePlan is what a run would delete from one machine
+type MachinePlan struct {
+	MachineID string
+	Snapshots int       // Snapshots the machine has now
+	Delete    []int64   // IDs of the snapshots to delete
+	Oldest    time.Time // When the oldest snapshot to delete was collected
+	Newest    time.Time // When the newest snapshot to delete was collected
+}
+
+// Plan is what a run would delete
+type Plan struct {
+	Policy    Policy
+	Cutoff    time.Time
+	Snapshots int           // Snapshots examined, leaving out machines on legal hold
+	Machines  []MachinePlan // Machines with snapshots to delete
+}
+
+// DeleteCount returns how many snapshots the plan deletes
+func (p *Plan) DeleteCount() int {
+	n := 0
+	for _, m := range p.Machines {
+		n += len(m.Delete)
+	}
+	return n
+}
+
+// NewPlan works out which snapshots policy would delete at now. Machines on
+// legal hold are left out. Snapshots are streamed one machine at a time.
+func NewPlan(store db.RetentionStore, policy Policy, now time.Time) (*Plan, error) {
+	plan := &Plan{Policy: policy, Cutoff: policy.Cutoff(now)}
+	if !policy.Enabled() {
+		return plan, nil
+	}
+
+	var machine []db.InventorySnapshot
+	flush := func() {
+		if mp := plan.machine(machine); len(mp.Delete) > 0 {
+			plan.Machines = append(plan.Machines, mp)
+		}
+		machine = machine[:0]
+	}
+
+	err := store.EachRetentionSnapshot(func(s *db.InventorySnapshot) error {
+		if len(machine) > 0 && machine[0].MachineID != s.MachineID {
+			flush()
+		}
+		machine = append(machine, *s)
+		plan.Snapshots++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(machine) > 0 {
+		flush()
+	}
+	return plan, nil
+}
+
+// machine plans one machine's snapshots, given oldest first
+func (p *Plan) machine(snapshots []db.InventorySnapshot) MachinePlan {
+	mp := MachinePlan{MachineID: snapshots[0].MachineID, Snapshots: len(snapshots)}
+	last := len(snapshots) - 1
+	for i, s := range snapshots {
+		keep := !s.CollectedAt.Before(p.Cutoff) ||
+			i == 0 || i == last ||
+			controlsChanged(&snapshots[i-1], &s) ||
+			p.Policy.bucket(s.CollectedAt) != p.Policy.bucket(snapshots[i+1].CollectedAt)
+		if keep {
+			continue
+		}
+		if len(mp.Delete) == 0 {
+			mp.Oldest = s.CollectedAt
+		}
+		mp.Newest = s.CollectedAt
+		mp.Delete = append(mp.Delete, s.ID)
+	}
+	return mp
+}
+
+// controlsChanged reports whether any control or named check differs
+// between two snapshots
+func controlsChanged(a, b *db.InventorySnapshot) bool {
+	var ids []string
+	for _, c := range checks.All() {
+		if c.Legacy() {
+			ids = append(ids, c.ID)
+		}
+	}
+	for _, id := range append(ids, db.SnapshotCheckIDs(a, b)...) {
+		if checks.Status(a, id) != checks.Status(b, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Result describes a run
+type Result struct {
+	At      time.Time
+	Deleted int64
+	Err     error
+}
+
+// Job applies a policy on a schedule
+type Job struct {
+	db       db.RetentionStore
+	policy   Policy
+	delay    time.Duration
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	lastRun *Result
+}
+
+func New(database db.RetentionStore, policy Policy) *Job {
+	return &Job{
+		db:       database,
+		policy:   policy,
+		delay:    time.Hour,
+		interval: 24 * time.Hour,
+		now:      time.Now,
+	}
+}
+
+// Policy returns the configured policy
+func (j *Job) Policy() Policy {
+	return j.policy
+}
+
+// LastRun returns the outcome of the most recent run, or nil if there hasn't been one
+func (j *Job) LastRun() *Result {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastRun
+}
+
+// Plan works out what a run would delete now
+func (j *Job) Plan() (*Plan, error) {
+	return NewPlan(j.db, j.policy, j.now())
+}
+
+// RunOnce deletes the snapshots the policy doesn't keep
+func (j *Job) RunOnce() (int64, error) {
+	if !j.policy.Enabled() {
+		return 0, nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	result := &Result{At: j.now()}
+	j.lastRun = result
+
+	plan, err := NewPlan(j.db, j.policy, result.At)
+	if err != nil {
+		result.Err = err
+		return 0, err
+	}
+	var ids []int64
+	for _, m := range plan.Machines {
+		ids = append(ids, m.Delete...)
+	}
+	result.Deleted, result.Err = j.db.DeleteSnapshots(ids)
+	return result.Deleted, result.Err
+}
+
+// Run applies the policy daily until ctx is cancelled. The first run is an
+// hour after startup, leaving time to review the plan after enabling it.
+func (j *Job) Run(ctx context.Context) {
+	if !j.policy.Enabled() {
+		return
+	}
+
+	timer := time.NewTimer(j.delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		deleted, err := j.RunOnce()
+		if err != nil {
+			log.Printf("Snapshot retention failed: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Snapshot retention deleted %d snapshots", deleted)
+		}
+		timer.Reset(j.interval)
+	}
+}
@@ -0,0 +1,153 @@
+package retention
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+type fakeStore struct {
+	snapshots []db.InventorySnapshot
+	deleted   []int64
+}
+
+func (f *fakeStore) SetMachineLegalHold(id string, hold bool) error { return nil }
+
+func (f *fakeStore) EachRetentionSnapshot(fn func(*db.InventorySnapshot) error) error {
+	for i := range f.snapshots {
+		if err := fn(&f.snapshots[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeStore) DeleteSnapshots(ids []int64) (int64, error) {
+	f.deleted = append(f.deleted, ids...)
+	return int64(len(ids)), nil
+}
+
+// now is a Wednesday
+var now = time.Date(2026, 6, 17, 12, 0, 0, 0, time.UTC)
+
+func daysAgo(d int) time.Time {
+	return now.AddDate(0, 0, -d)
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		days, period string
+		want         Policy
+		wantErr      bool
+	}{
+		{"", "", Policy{Period: PeriodWeek}, false},
+		{"90", "", Policy{KeepDays: 90, Period: PeriodWeek}, false},
+		{"30", "month", Policy{KeepDays: 30, Period: PeriodMonth}, false},
+		{"-1", "", Policy{}, true},
+		{"ninety", "", Policy{}, true},
+		{"30", "year", Policy{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePolicy(tt.days, tt.period)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePolicy(%q, %q) error = %v, wantErr %v", tt.days, tt.period, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParsePolicy(%q, %q) = %+v, want %+v", tt.days, tt.period, got, tt.want)
+		}
+	}
+}
+
+func TestNewPlan(t *testing.T) {
+	snapshot := func(id int64, machine string, d int, on bool) db.InventorySnapshot {
+		return db.InventorySnapshot{ID: id, MachineID: machine, CollectedAt: daysAgo(d), DiskEncrypted: on}
+	}
+	store := &fakeStore{snapshots: []db.InventorySnapshot{
+		snapshot(1, "a", 40, true), // First snapshot
+		snapshot(2, "a", 39, true),
+		snapshot(3, "a", 38, true), // Newest in its week
+		snapshot(4, "a", 36, true),
+		snapshot(5, "a", 35, false), // Control changed
+		snapshot(6, "a", 34, false),
+		snapshot(7, "a", 33, false),
+		snapshot(8, "a", 32, false), // Newest in its week
+		snapshot(9, "a", 5, false),  // Recent
+		snapshot(10, "a", 1, false), // Recent
+		snapshot(11, "b", 60, true), // Only snapshot
+	}}
+
+	plan, err := NewPlan(store, Policy{KeepDays: 30, Period: PeriodWeek}, now)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	if plan.Snapshots != 11 || len(plan.Machines) != 1 {
+		t.Fatalf("Expected 11 snapshots examined and 1 machine affected, got %+v", plan)
+	}
+	mp := plan.Machines[0]
+	if want := []int64{2, 4, 6, 7}; mp.MachineID != "a" || !slices.Equal(mp.Delete, want) || plan.DeleteCount() != 4 {
+		t.Errorf("Expected to delete %v from machine a, got %+v", want, mp)
+	}
+	if !mp.Oldest.Equal(daysAgo(39)) || !mp.Newest.Equal(daysAgo(33)) {
+		t.Errorf("Expected deletions from %v to %v, got %v to %v", daysAgo(39), daysAgo(33), mp.Oldest, mp.Newest)
+	}
+
+	monthly, _ := NewPlan(store, Policy{KeepDays: 30, Period: PeriodMonth}, now)
+	if want := []int64{2, 3, 4, 6, 7}; !slices.Equal(monthly.Machines[0].Delete, want) {
+		t.Errorf("Expected to delete %v monthly, got %v", want, monthly.Machines[0].Delete)
+	}
+
+	disabled, _ := NewPlan(store, Policy{Period: PeriodWeek}, now)
+	if disabled.DeleteCount() != 0 {
+		t.Errorf("Expected a disabled policy to delete nothing, got %d", disabled.DeleteCount())
+	}
+}
+
+func TestNewPlanNamedChecks(t *testing.T) {
+	snapshot := func(id int64, d int, status string) db.InventorySnapshot {
+		return db.InventorySnapshot{ID: id, MachineID: "a", CollectedAt: daysAgo(d), OS: "linux",
+			Checks: []db.SnapshotCheck{{SnapshotID: id, CheckID: "ssh_root_login_disabled", Status: status}}}
+	}
+	store := &fakeStore{snapshots: []db.InventorySnapshot{
+		snapshot(1, 40, "pass"),
+		snapshot(2, 39, "pass"),
+		snapshot(3, 38, "fail"), // Only the named check changed
+		snapshot(4, 37, "fail"),
+		snapshot(5, 36, "fail"),
+	}}
+
+	plan, err := NewPlan(store, Policy{KeepDays: 30, Period: PeriodMonth}, now)
+	if err != nil {
+		t.Fatalf("NewPlan failed: %v", err)
+	}
+	if len(plan.Machines) != 1 || !slices.Equal(plan.Machines[0].Delete, []int64{2, 4}) {
+		t.Errorf("Expected to delete [2 4], keeping the check's change, got %+v", plan.Machines)
+	}
+}
+
+func TestJobRunOnce(t *testing.T) {
+	store := &fakeStore{snapshots: []db.InventorySnapshot{
+		{ID: 1, MachineID: "a", CollectedAt: daysAgo(20)},
+		{ID: 2, MachineID: "a", CollectedAt: daysAgo(19)},
+		{ID: 3, MachineID: "a", CollectedAt: daysAgo(18)},
+		{ID: 4, MachineID: "a", CollectedAt: daysAgo(1)},
+	}}
+
+	job := New(store, Policy{Period: PeriodWeek})
+	job.now = func() time.Time { return now }
+	if n, err := job.RunOnce(); n != 0 || err != nil || job.LastRun() != nil {
+		t.Errorf("Expected a disabled job to do nothing, got %d, %v", n, err)
+	}
+
+	job = New(store, Policy{KeepDays: 7, Period: PeriodMonth})
+	job.now = func() time.Time { return now }
+	n, err := job.RunOnce()
+	if err != nil || n != 1 || !slices.Equal(store.deleted, []int64{2}) {
+		t.Errorf("Expected snapshot 2 deleted, got %d, %v, %v", n, err, store.deleted)
+	}
+	if run := job.LastRun(); run == nil || run.Deleted != 1 || !run.At.Equal(now) {
+		t.Errorf("Expected the run to be recorded, got %+v", run)
+	}
+}
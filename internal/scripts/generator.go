@@ -11,7 +11,7 @@ import (
 var scriptTemplates embed.FS
 
 type ScriptData struct {
-	Token     string
+	Code      string // single-use bootstrap code, exchanged for the token on first run
 	ServerURL string
 	Email     string
 	Mode      string
@@ -11,6 +11,9 @@
 #   - Whether antivirus protection is active (XProtect)
 #   - Whether the firewall is enabled
 #   - Whether screen lock is configured and its timeout
+#   - macOS build, when macOS was last updated, the number of pending updates,
+#     whether automatic updates are on, and the last boot time
+#   - Whether Gatekeeper is enabled
 #
 # NO personal files, passwords, browsing history, or sensitive data is collected.
 # You can inspect this entire script before running it.
@@ -20,16 +23,42 @@
 
 set -e
 
-TOKEN="{{.Token}}"
+CODE="{{.Code}}"
 SERVER="{{.ServerURL}}"
+TOKEN_DIR="$HOME/.boxcheckr"
+TOKEN_FILE="$TOKEN_DIR/token"
+
+# Exchange the single-use bootstrap code for this machine's token on first run.
+# Later runs, including scheduled ones, use the token saved locally.
+TOKEN=""
+if [[ -n "$CODE" ]]; then
+    BOOTSTRAP=$(curl -s -X POST "$SERVER/api/v1/bootstrap" \
+        -H "Content-Type: application/json" \
+        -d "{\"code\":\"$CODE\",\"mode\":\"{{.Mode}}\"}" || true)
+    TOKEN=$(echo "$BOOTSTRAP" | sed -n 's/.*"token":"\([^"]*\)".*/\1/p')
+    if [[ -n "$TOKEN" ]]; then
+        mkdir -p "$TOKEN_DIR"
+        (umask 077 && echo "$TOKEN" > "$TOKEN_FILE")
+    fi
+fi
+if [[ -z "$TOKEN" && -f "$TOKEN_FILE" ]]; then
+    TOKEN=$(cat "$TOKEN_FILE")
+fi
+if [[ -z "$TOKEN" ]]; then
+    echo "Error: this install command has expired or was already used."
+    echo "Copy a fresh command from the machine page at $SERVER"
+    exit 1
+fi
 
 # Get system info
 OS="darwin"
 OS_VERSION=$(sw_vers -productVersion)
+OS_BUILD=$(sw_vers -buildVersion 2>/dev/null || echo "")
 HOSTNAME=$(hostname)
 
 # Check FileVault disk encryption
 DISK_ENCRYPTED=false
+DISK_STATUS=""
 DISK_DETAILS=""
 if fdesetup status 2>/dev/null | grep -q "FileVault is On"; then
     DISK_ENCRYPTED=true
@@ -40,6 +69,7 @@ fi
 
 # Check antivirus (XProtect is built into macOS)
 AV_ENABLED=false
+AV_STATUS=""
 AV_DETAILS=""
 if [[ -d "/Library/Apple/System/Library/CoreServices/XProtect.bundle" ]]; then
     AV_ENABLED=true
@@ -55,6 +85,7 @@ fi
 
 # Check firewall status
 FW_ENABLED=false
+FW_STATUS=""
 FW_DETAILS=""
 if command -v /usr/libexec/ApplicationFirewall/socketfilterfw &>/dev/null; then
     FW_STATUS=$(/usr/libexec/ApplicationFirewall/socketfilterfw --getglobalstate 2>/dev/null)
@@ -65,11 +96,13 @@ if command -v /usr/libexec/ApplicationFirewall/socketfilterfw &>/dev/null; then
         FW_DETAILS="macOS Application Firewall disabled"
     fi
 else
+    FW_STATUS="unknown"
     FW_DETAILS="Firewall status unknown"
 fi
 
 # Check screen lock settings
 SL_ENABLED=false
+SL_STATUS=""
 SL_TIMEOUT=0
 SL_DETAILS=""
 
@@ -119,11 +152,59 @@ else
     if [[ "$ASK_FOR_PWD" == "0" ]]; then
         SL_DETAILS="Password not required after sleep"
     else
+        SL_STATUS="unknown"
         SL_DETAILS="Screen lock status unknown"
     fi
 fi
 
-# Build JSON payload
+# Check patch level (null means unknown)
+DAYS_SINCE_UPDATE=null
+PENDING_UPDATES=null
+AU_ENABLED=false
+AU_DETAILS=""
+# Newest install by softwareupdated in the install history; each entry's date
+# is listed before its processName
+LAST_UPDATE=$(defaults read /Library/Receipts/InstallHistory.plist 2>/dev/null \
+    | awk -F'"' '/ date = /{d=$2} /processName = softwareupdated;/{print d}' | sort | tail -1 || echo "")
+if [[ -n "$LAST_UPDATE" ]]; then
+    LAST_UPDATE_SECS=$(date -j -f "%Y-%m-%d %H:%M:%S %z" "$LAST_UPDATE" +%s 2>/dev/null || echo "")
+    if [[ -n "$LAST_UPDATE_SECS" ]]; then
+        DAYS_SINCE_UPDATE=$(( ($(date +%s) - LAST_UPDATE_SECS) / 86400 ))
+    fi
+fi
+# softwareupdate doesn't say which updates are security fixes, so count every pending update
+if SU_OUT=$(softwareupdate -l 2>&1); then
+    PENDING_UPDATES=$(echo "$SU_OUT" | grep -c '^\* Label:' || true)
+fi
+if [[ "$(defaults read /Library/Preferences/com.apple.SoftwareUpdate AutomaticallyInstallMacOSUpdates 2>/dev/null)" == "1" ]]; then
+    AU_ENABLED=true
+    AU_DETAILS="macOS updates install automatically"
+else
+    AU_DETAILS="macOS updates not installed automatically"
+fi
+
+# Last boot time; kern.boottime looks like "{ sec = 1714552200, usec = 0 } ..."
+LAST_BOOT=""
+BOOT_SECS=$(sysctl -n kern.boottime 2>/dev/null | sed -n 's/.*sec = \([0-9]*\),.*/\1/p')
+if [[ -n "$BOOT_SECS" ]]; then
+    LAST_BOOT=$(date -u -r "$BOOT_SECS" +%Y-%m-%dT%H:%M:%SZ)
+fi
+
+# Check Gatekeeper
+GK_STATUS="unknown"
+GK_DETAILS="Gatekeeper status unknown"
+case "$(spctl --status 2>/dev/null || true)" in
+    "assessments enabled")
+        GK_STATUS="pass"
+        GK_DETAILS="Gatekeeper enabled"
+        ;;
+    "assessments disabled")
+        GK_STATUS="fail"
+        GK_DETAILS="Gatekeeper disabled"
+        ;;
+esac
+
+# Build JSON payload. The server takes empty control statuses from the booleans.
 JSON=$(cat <<EOF
 {
     "hostname": "$HOSTNAME",
@@ -137,7 +218,20 @@ JSON=$(cat <<EOF
     "firewall_details": "$FW_DETAILS",
     "screen_lock_enabled": $SL_ENABLED,
     "screen_lock_timeout": $SL_TIMEOUT,
-    "screen_lock_details": "$SL_DETAILS"
+    "screen_lock_details": "$SL_DETAILS",
+    "disk_encryption_status": "$DISK_STATUS",
+    "antivirus_status": "$AV_STATUS",
+    "firewall_status": "$FW_STATUS",
+    "screen_lock_status": "$SL_STATUS",
+    "os_build": "$OS_BUILD",
+    "days_since_update": $DAYS_SINCE_UPDATE,
+    "pending_security_updates": $PENDING_UPDATES,
+    "auto_update_enabled": $AU_ENABLED,
+    "auto_update_details": "$AU_DETAILS",
+    "last_boot_at": "$LAST_BOOT",
+    "checks": [
+        {"id": "gatekeeper_enabled", "status": "$GK_STATUS", "details": "$GK_DETAILS"}
+    ]
 }
 EOF
 )
@@ -150,6 +244,12 @@ echo "Disk Encrypted: $DISK_ENCRYPTED ($DISK_DETAILS)"
 echo "Antivirus: $AV_ENABLED ($AV_DETAILS)"
 echo "Firewall: $FW_ENABLED ($FW_DETAILS)"
 echo "Screen Lock: $SL_ENABLED ($SL_DETAILS)"
+echo "Build: $OS_BUILD"
+echo "Days Since Update: $DAYS_SINCE_UPDATE"
+echo "Pending Updates: $PENDING_UPDATES"
+echo "Automatic Updates: $AU_ENABLED ($AU_DETAILS)"
+echo "Last Boot: $LAST_BOOT"
+echo "Gatekeeper: $GK_STATUS ($GK_DETAILS)"
 echo ""
 
 # Send to server
@@ -175,11 +275,17 @@ echo "Installing weekly monitoring..."
 
 mkdir -p "$HOME/.boxcheckr"
 
+# Keep a local copy of this script, minus the spent bootstrap code, for the
+# scheduled runs. They authenticate with the saved token.
+curl -fsSL "{{.ServerURL}}/machines/{{.MachineID}}/script?mode=onetime&os=darwin&code={{.Code}}" \
+    | sed 's/^CODE=".*"$/CODE=""/' > "$HOME/.boxcheckr/agent.sh"
+chmod 700 "$HOME/.boxcheckr/agent.sh"
+
 # Create LaunchAgent plist
 PLIST_PATH="$HOME/Library/LaunchAgents/com.boxcheckr.agent.plist"
 mkdir -p "$HOME/Library/LaunchAgents"
 
-cat > "$PLIST_PATH" << 'PLIST'
+cat > "$PLIST_PATH" << PLIST
 <?xml version="1.0" encoding="UTF-8"?>
 <!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
 <plist version="1.0">
@@ -189,8 +295,7 @@ cat > "$PLIST_PATH" << 'PLIST'
     <key>ProgramArguments</key>
     <array>
         <string>/bin/bash</string>
-        <string>-c</string>
-        <string>curl -fsSL "{{.ServerURL}}/machines/{{.MachineID}}/script?mode=onetime&amp;os=darwin" | bash</string>
+        <string>$HOME/.boxcheckr/agent.sh</string>
     </array>
     <key>StartCalendarInterval</key>
     <dict>
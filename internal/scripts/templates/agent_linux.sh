@@ -11,6 +11,9 @@
 #   - Whether antivirus protection is active (ClamAV or other)
 #   - Whether the firewall is enabled (ufw/firewalld/iptables)
 #   - Whether screen lock is configured and its timeout
+#   - Kernel version, when packages were last updated, the number of pending
+#     security updates, whether automatic updates are on, and the last boot time
+#   - Whether the SSH server allows root logins (its PermitRootLogin setting)
 #
 # NO personal files, passwords, browsing history, or sensitive data is collected.
 # You can inspect this entire script before running it.
@@ -20,8 +23,10 @@
 
 set -e
 
-TOKEN="{{.Token}}"
+CODE="{{.Code}}"
 SERVER="{{.ServerURL}}"
+TOKEN_DIR="$HOME/.boxcheckr"
+TOKEN_FILE="$TOKEN_DIR/token"
 
 # Check if running as root (needed for accurate firewall detection)
 if [[ $EUID -ne 0 ]]; then
@@ -30,6 +35,28 @@ if [[ $EUID -ne 0 ]]; then
     echo ""
 fi
 
+# Exchange the single-use bootstrap code for this machine's token on first run.
+# Later runs, including scheduled ones, use the token saved locally.
+TOKEN=""
+if [[ -n "$CODE" ]]; then
+    BOOTSTRAP=$(curl -s -X POST "$SERVER/api/v1/bootstrap" \
+        -H "Content-Type: application/json" \
+        -d "{\"code\":\"$CODE\",\"mode\":\"{{.Mode}}\"}" || true)
+    TOKEN=$(echo "$BOOTSTRAP" | sed -n 's/.*"token":"\([^"]*\)".*/\1/p')
+    if [[ -n "$TOKEN" ]]; then
+        mkdir -p "$TOKEN_DIR"
+        (umask 077 && echo "$TOKEN" > "$TOKEN_FILE")
+    fi
+fi
+if [[ -z "$TOKEN" && -f "$TOKEN_FILE" ]]; then
+    TOKEN=$(cat "$TOKEN_FILE")
+fi
+if [[ -z "$TOKEN" ]]; then
+    echo "Error: this install command has expired or was already used."
+    echo "Copy a fresh command from the machine page at $SERVER"
+    exit 1
+fi
+
 # Get system info
 OS="linux"
 if [[ -f /etc/os-release ]]; then
@@ -39,10 +66,12 @@ else
     OS_VERSION="unknown"
     OS_NAME="Linux"
 fi
+OS_BUILD=$(uname -r 2>/dev/null || echo "")
 HOSTNAME=$(hostname)
 
 # Check LUKS disk encryption
 DISK_ENCRYPTED=false
+DISK_STATUS=""
 DISK_DETAILS=""
 if command -v lsblk &>/dev/null; then
     if lsblk -o TYPE 2>/dev/null | grep -q "crypt"; then
@@ -62,9 +91,14 @@ if [[ -d /sys/class/block ]] && ls /sys/class/block/dm-* &>/dev/null; then
         fi
     done
 fi
+if [[ -z "$DISK_DETAILS" ]]; then
+    DISK_STATUS="unknown"
+    DISK_DETAILS="Disk encryption status unknown"
+fi
 
 # Check antivirus
 AV_ENABLED=false
+AV_STATUS=""
 AV_DETAILS=""
 # Check ClamAV
 if systemctl is-active --quiet clamav-daemon 2>/dev/null; then
@@ -87,11 +121,16 @@ fi
 
 # Check firewall status
 FW_ENABLED=false
+FW_STATUS=""
 FW_DETAILS=""
 # Check ufw (Ubuntu/Debian)
 if command -v ufw &>/dev/null; then
     UFW_STATUS=$(ufw status 2>/dev/null | head -1)
-    if echo "$UFW_STATUS" | grep -q "active"; then
+    if [[ -z "$UFW_STATUS" ]]; then
+        FW_STATUS="unknown"
+        FW_DETAILS="ufw status unknown (requires root)"
+    # "Status: inactive" also contains "active", so match the whole line
+    elif echo "$UFW_STATUS" | grep -qx "Status: active"; then
         FW_ENABLED=true
         FW_DETAILS="ufw active"
     else
@@ -120,6 +159,7 @@ fi
 
 # Check screen lock settings
 SL_ENABLED=false
+SL_STATUS=""
 SL_TIMEOUT=0
 SL_DETAILS=""
 # Check GNOME settings
@@ -152,10 +192,83 @@ elif [[ -f "$HOME/.config/kscreenlockerrc" ]]; then
         SL_DETAILS="KDE screen lock disabled"
     fi
 else
+    SL_STATUS="unknown"
     SL_DETAILS="Screen lock settings unknown"
 fi
 
-# Build JSON payload
+# Check patch level (null means unknown)
+LAST_UPDATE=""
+DAYS_SINCE_UPDATE=null
+PENDING_UPDATES=null
+AU_ENABLED=false
+AU_DETAILS=""
+if command -v apt-get &>/dev/null; then
+    # dpkg's status file changes whenever packages are installed or upgraded
+    LAST_UPDATE=$(stat -c %Y /var/lib/dpkg/status 2>/dev/null || echo "")
+    if APT_OUT=$(apt-get -s upgrade 2>/dev/null); then
+        PENDING_UPDATES=$(echo "$APT_OUT" | grep -c '^Inst .*-security' || true)
+    fi
+    if grep -qs 'APT::Periodic::Unattended-Upgrade "1"' /etc/apt/apt.conf.d/20auto-upgrades; then
+        AU_ENABLED=true
+        AU_DETAILS="unattended-upgrades enabled"
+    else
+        AU_DETAILS="unattended-upgrades not enabled"
+    fi
+elif command -v dnf &>/dev/null; then
+    LAST_UPDATE=$(rpm -qa --qf '%{INSTALLTIME}\n' 2>/dev/null | sort -n | tail -1 || echo "")
+    if DNF_OUT=$(dnf -q updateinfo list --security 2>/dev/null); then
+        PENDING_UPDATES=$(echo "$DNF_OUT" | grep -c . || true)
+    fi
+    if systemctl is-enabled --quiet dnf-automatic.timer 2>/dev/null || systemctl is-enabled --quiet dnf-automatic-install.timer 2>/dev/null; then
+        AU_ENABLED=true
+        AU_DETAILS="dnf-automatic enabled"
+    else
+        AU_DETAILS="dnf-automatic not enabled"
+    fi
+else
+    AU_DETAILS="Package manager not recognised"
+fi
+if [[ -n "$LAST_UPDATE" ]]; then
+    DAYS_SINCE_UPDATE=$(( ($(date +%s) - LAST_UPDATE) / 86400 ))
+fi
+
+# Last boot time, from the kernel's boot timestamp
+LAST_BOOT=""
+BTIME=$(awk '/^btime / {print $2}' /proc/stat 2>/dev/null || echo "")
+if [[ -n "$BTIME" ]]; then
+    LAST_BOOT=$(date -u -d "@$BTIME" +%Y-%m-%dT%H:%M:%SZ)
+fi
+
+# Check SSH root login. sshd keeps the first PermitRootLogin it reads, and
+# stock configs include sshd_config.d before their own settings.
+SSH_STATUS="not_applicable"
+SSH_VALUE=""
+SSH_DETAILS="OpenSSH server not installed"
+if [[ -f /etc/ssh/sshd_config ]]; then
+    SSH_SOURCE="sshd -T"
+    SSH_VALUE=$(sshd -T 2>/dev/null | awk 'tolower($1) == "permitrootlogin" {print tolower($2); exit}' || true)
+    if [[ -z "$SSH_VALUE" ]]; then
+        for f in /etc/ssh/sshd_config.d/*.conf /etc/ssh/sshd_config; do
+            [[ -f "$f" ]] || continue
+            SSH_VALUE=$(awk 'tolower($1) == "match" {exit} tolower($1) == "permitrootlogin" {print tolower($2); exit}' "$f" 2>/dev/null || true)
+            if [[ -n "$SSH_VALUE" ]]; then
+                SSH_SOURCE="$f"
+                break
+            fi
+        done
+    fi
+    if [[ -z "$SSH_VALUE" ]]; then
+        SSH_VALUE="prohibit-password"
+        SSH_SOURCE="OpenSSH default"
+    fi
+    SSH_STATUS="pass"
+    if [[ "$SSH_VALUE" != "no" ]]; then
+        SSH_STATUS="fail"
+    fi
+    SSH_DETAILS="PermitRootLogin $SSH_VALUE ($SSH_SOURCE)"
+fi
+
+# Build JSON payload. The server takes empty control statuses from the booleans.
 JSON=$(cat <<EOF
 {
     "hostname": "$HOSTNAME",
@@ -169,7 +282,20 @@ JSON=$(cat <<EOF
     "firewall_details": "$FW_DETAILS",
     "screen_lock_enabled": $SL_ENABLED,
     "screen_lock_timeout": $SL_TIMEOUT,
-    "screen_lock_details": "$SL_DETAILS"
+    "screen_lock_details": "$SL_DETAILS",
+    "disk_encryption_status": "$DISK_STATUS",
+    "antivirus_status": "$AV_STATUS",
+    "firewall_status": "$FW_STATUS",
+    "screen_lock_status": "$SL_STATUS",
+    "os_build": "$OS_BUILD",
+    "days_since_update": $DAYS_SINCE_UPDATE,
+    "pending_security_updates": $PENDING_UPDATES,
+    "auto_update_enabled": $AU_ENABLED,
+    "auto_update_details": "$AU_DETAILS",
+    "last_boot_at": "$LAST_BOOT",
+    "checks": [
+        {"id": "ssh_root_login_disabled", "status": "$SSH_STATUS", "value": "$SSH_VALUE", "details": "$SSH_DETAILS"}
+    ]
 }
 EOF
 )
@@ -182,6 +308,12 @@ echo "Disk Encrypted: $DISK_ENCRYPTED ($DISK_DETAILS)"
 echo "Antivirus: $AV_ENABLED ($AV_DETAILS)"
 echo "Firewall: $FW_ENABLED ($FW_DETAILS)"
 echo "Screen Lock: $SL_ENABLED ($SL_DETAILS)"
+echo "Kernel: $OS_BUILD"
+echo "Days Since Update: $DAYS_SINCE_UPDATE"
+echo "Pending Security Updates: $PENDING_UPDATES"
+echo "Automatic Updates: $AU_ENABLED ($AU_DETAILS)"
+echo "Last Boot: $LAST_BOOT"
+echo "SSH Root Login Disabled: $SSH_STATUS ($SSH_DETAILS)"
 echo ""
 
 # Send to server
@@ -207,9 +339,14 @@ echo "Installing weekly monitoring..."
 
 mkdir -p "$HOME/.boxcheckr"
 
+# Keep a local copy of this script, minus the spent bootstrap code, for the
+# scheduled runs. They authenticate with the saved token.
+curl -fsSL "{{.ServerURL}}/machines/{{.MachineID}}/script?mode=onetime&os=linux&code={{.Code}}" \
+    | sed 's/^CODE=".*"$/CODE=""/' > "$HOME/.boxcheckr/agent.sh"
+chmod 700 "$HOME/.boxcheckr/agent.sh"
+
 # Add cron job
-CRON_CMD="curl -fsSL '{{.ServerURL}}/machines/{{.MachineID}}/script?mode=onetime&os=linux' | bash"
-CRON_ENTRY="0 9 * * 1 $CRON_CMD # boxcheckr"
+CRON_ENTRY="0 9 * * 1 /bin/bash '$HOME/.boxcheckr/agent.sh' # boxcheckr"
 (crontab -l 2>/dev/null | grep -v boxcheckr; echo "$CRON_ENTRY") | crontab -
 
 # Create uninstall helper
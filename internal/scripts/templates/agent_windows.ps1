@@ -10,6 +10,10 @@
 #   - Whether antivirus protection is active (Defender, McAfee, Norton, etc.)
 #   - Whether Windows Firewall is enabled
 #   - Whether screen lock is configured and its timeout
+#   - Windows build, when Windows Update last installed an update, the number
+#     of pending security updates, whether automatic updates are on, and the
+#     last boot time
+#   - Whether User Account Control is enabled
 #
 # NO personal files, passwords, browsing history, or sensitive data is collected.
 # You can inspect this entire script before running it.
@@ -19,32 +23,66 @@
 
 $ErrorActionPreference = "Stop"
 
-$TOKEN = "{{.Token}}"
+$CODE = "{{.Code}}"
 $SERVER = "{{.ServerURL}}"
+$TokenDir = "$env:LOCALAPPDATA\BoxCheckr"
+$TokenFile = "$TokenDir\token"
+
+# Exchange the single-use bootstrap code for this machine's token on first run.
+# Later runs, including scheduled ones, use the token saved locally.
+$TOKEN = $null
+if ($CODE) {
+    try {
+        $Body = @{ code = $CODE; mode = "{{.Mode}}" } | ConvertTo-Json
+        $Bootstrap = Invoke-RestMethod -Uri "$SERVER/api/v1/bootstrap" -Method POST -ContentType "application/json" -Body $Body
+        $TOKEN = $Bootstrap.token
+        New-Item -ItemType Directory -Path $TokenDir -Force | Out-Null
+        Set-Content -Path $TokenFile -Value $TOKEN -NoNewline
+    } catch {
+        # Code expired or already used; fall back to a saved token
+    }
+}
+if (-not $TOKEN -and (Test-Path $TokenFile)) {
+    $TOKEN = (Get-Content -Path $TokenFile -Raw).Trim()
+}
+if (-not $TOKEN) {
+    Write-Host "Error: this install command has expired or was already used."
+    Write-Host "Copy a fresh command from the machine page at $SERVER"
+    exit 1
+}
 
 # Get system info
 $Hostname = $env:COMPUTERNAME
 $OS = "windows"
 $OSVersion = (Get-CimInstance Win32_OperatingSystem).Version
 $OSBuild = (Get-CimInstance Win32_OperatingSystem).BuildNumber
+# The update build revision (UBR) changes with each cumulative update
+$UBR = (Get-ItemProperty -Path "HKLM:\SOFTWARE\Microsoft\Windows NT\CurrentVersion" -Name "UBR" -ErrorAction SilentlyContinue).UBR
+$PatchBuild = if ($UBR) { "$OSBuild.$UBR" } else { "$OSBuild" }
 
 # Check BitLocker disk encryption
 $DiskEncrypted = $false
+$DiskStatus = ""
 $DiskDetails = ""
 try {
     $BitLocker = Get-BitLockerVolume -MountPoint "C:" -ErrorAction SilentlyContinue
-    if ($BitLocker.ProtectionStatus -eq "On") {
+    if ($null -eq $BitLocker) {
+        $DiskStatus = "unknown"
+        $DiskDetails = "BitLocker status unknown (may require admin)"
+    } elseif ($BitLocker.ProtectionStatus -eq "On") {
         $DiskEncrypted = $true
         $DiskDetails = "BitLocker enabled ($($BitLocker.EncryptionMethod))"
     } else {
         $DiskDetails = "BitLocker not enabled"
     }
 } catch {
+    $DiskStatus = "unknown"
     $DiskDetails = "BitLocker status unknown (may require admin)"
 }
 
 # Check antivirus (Windows Defender + third-party like McAfee, Norton, etc.)
 $AVEnabled = $false
+$AVStatus = ""
 $AVDetails = ""
 $AVProducts = @()
 
@@ -93,6 +131,7 @@ if ($AVProducts.Count -gt 0) {
 
 # Check Windows Firewall
 $FWEnabled = $false
+$FWStatus = ""
 $FWDetails = ""
 try {
     $FWProfiles = Get-NetFirewallProfile -ErrorAction SilentlyContinue
@@ -105,11 +144,13 @@ try {
         $FWDetails = "Windows Firewall disabled"
     }
 } catch {
+    $FWStatus = "unknown"
     $FWDetails = "Firewall status unknown"
 }
 
 # Check screen lock and sign-in settings
 $SLEnabled = $false
+$SLStatus = ""
 $SLTimeout = 0
 $SLDetails = ""
 $SLFeatures = @()
@@ -181,10 +222,63 @@ try {
         $SLDetails = "No automatic lock configured"
     }
 } catch {
+    $SLStatus = "unknown"
     $SLDetails = "Screen lock settings unknown"
 }
 
-# Build payload
+# Check patch level with the Windows Update agent ($null means unknown)
+$DaysSinceUpdate = $null
+$PendingUpdates = $null
+try {
+    $UpdateSearcher = (New-Object -ComObject Microsoft.Update.Session).CreateUpdateSearcher()
+    # Skip Defender's daily signature updates, which would hide missed OS patches
+    $LastUpdate = $UpdateSearcher.QueryHistory(0, $UpdateSearcher.GetTotalHistoryCount()) |
+        Where-Object { $_.ResultCode -eq 2 -and $_.Title -notmatch 'Security Intelligence|Definition Update' } |
+        Sort-Object Date -Descending | Select-Object -First 1
+    if ($LastUpdate) {
+        $DaysSinceUpdate = [int][math]::Floor(((Get-Date).ToUniversalTime() - $LastUpdate.Date.ToUniversalTime()).TotalDays)
+    }
+} catch {
+    # Update history unavailable
+}
+try {
+    $UpdateSearcher = (New-Object -ComObject Microsoft.Update.Session).CreateUpdateSearcher()
+    $PendingUpdates = @($UpdateSearcher.Search("IsInstalled=0 and IsHidden=0 and Type='Software'").Updates |
+        Where-Object { $_.Categories | Where-Object { $_.Name -eq 'Security Updates' } }).Count
+} catch {
+    # Windows Update search failed (offline or service disabled)
+}
+$NoAutoUpdate = (Get-ItemProperty -Path "HKLM:\SOFTWARE\Policies\Microsoft\Windows\WindowsUpdate\AU" -Name "NoAutoUpdate" -ErrorAction SilentlyContinue).NoAutoUpdate
+if ($NoAutoUpdate -eq 1) {
+    $AUEnabled = $false
+    $AUDetails = "Automatic updates disabled by policy"
+} else {
+    $AUEnabled = $true
+    $AUDetails = "Windows Update installs automatically"
+}
+
+# Last boot time
+$LastBoot = ""
+try {
+    $LastBoot = (Get-CimInstance Win32_OperatingSystem).LastBootUpTime.ToUniversalTime().ToString("yyyy-MM-ddTHH:mm:ssZ")
+} catch {
+    # Boot time unavailable
+}
+
+# Check User Account Control (EnableLUA is 1 unless UAC has been turned off)
+$EnableLUA = (Get-ItemProperty -Path "HKLM:\SOFTWARE\Microsoft\Windows\CurrentVersion\Policies\System" -Name "EnableLUA" -ErrorAction SilentlyContinue).EnableLUA
+if ($null -eq $EnableLUA) {
+    $UACStatus = "unknown"
+    $UACDetails = "UAC status unknown"
+} elseif ($EnableLUA -eq 1) {
+    $UACStatus = "pass"
+    $UACDetails = "User Account Control enabled"
+} else {
+    $UACStatus = "fail"
+    $UACDetails = "User Account Control disabled"
+}
+
+# Build payload. The server takes empty control statuses from the booleans.
 $Payload = @{
     hostname = $Hostname
     os = $OS
@@ -198,7 +292,20 @@ $Payload = @{
     screen_lock_enabled = $SLEnabled
     screen_lock_timeout = $SLTimeout
     screen_lock_details = $SLDetails
-} | ConvertTo-Json
+    disk_encryption_status = $DiskStatus
+    antivirus_status = $AVStatus
+    firewall_status = $FWStatus
+    screen_lock_status = $SLStatus
+    os_build = $PatchBuild
+    days_since_update = $DaysSinceUpdate
+    pending_security_updates = $PendingUpdates
+    auto_update_enabled = $AUEnabled
+    auto_update_details = $AUDetails
+    last_boot_at = $LastBoot
+    checks = @(
+        @{ id = "uac_enabled"; status = $UACStatus; details = $UACDetails }
+    )
+} | ConvertTo-Json -Depth 4
 
 Write-Host "BoxCheckr Agent"
 Write-Host "==============="
@@ -208,6 +315,12 @@ Write-Host "Disk Encrypted: $DiskEncrypted ($DiskDetails)"
 Write-Host "Antivirus: $AVEnabled ($AVDetails)"
 Write-Host "Firewall: $FWEnabled ($FWDetails)"
 Write-Host "Screen Lock: $SLEnabled ($SLDetails)"
+Write-Host "Build: $PatchBuild"
+Write-Host "Days Since Update: $DaysSinceUpdate"
+Write-Host "Pending Security Updates: $PendingUpdates"
+Write-Host "Automatic Updates: $AUEnabled ($AUDetails)"
+Write-Host "Last Boot: $LastBoot"
+Write-Host "User Account Control: $UACStatus ($UACDetails)"
 Write-Host ""
 
 # Send to server
@@ -236,10 +349,16 @@ if (-not (Test-Path $ScriptDir)) {
     New-Item -ItemType Directory -Path $ScriptDir -Force | Out-Null
 }
 
+# Keep a local copy of this script, minus the spent bootstrap code, for the
+# scheduled runs. They authenticate with the saved token.
+$LocalScript = "$ScriptDir\agent.ps1"
+$ScriptURL = "{{.ServerURL}}/machines/{{.MachineID}}/script?mode=onetime&os=windows&code={{.Code}}"
+(Invoke-WebRequest -Uri $ScriptURL -UseBasicParsing).Content -replace '(?m)^\$CODE = ".*"', '$$CODE = ""' |
+    Set-Content -Path $LocalScript
+
 # Create scheduled task
-$ScriptURL = "{{.ServerURL}}/machines/{{.MachineID}}/script?mode=onetime&os=windows"
 $TaskAction = New-ScheduledTaskAction -Execute "PowerShell.exe" `
-    -Argument "-NoProfile -ExecutionPolicy Bypass -Command `"irm '$ScriptURL' | iex`""
+    -Argument "-NoProfile -ExecutionPolicy Bypass -File `"$LocalScript`""
 $TaskTrigger = New-ScheduledTaskTrigger -Weekly -DaysOfWeek Monday -At 9am
 $TaskSettings = New-ScheduledTaskSettingsSet -StartWhenAvailable -DontStopOnIdleEnd
 
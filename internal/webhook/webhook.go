@@ -0,0 +1,228 @@
+// Package webhook posts signed JSON events to admin-configured URLs.
+//
+// Events are queued in the database when they happen and delivered by a
+// Worker, which retries failures with exponential backoff. Each request body
+// is signed with the webhook's secret:
+//
+//	X-BoxCheckr-Signature: sha256=<hex HMAC-SHA256 of the body>
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jclement/boxcheckr/internal/checks"
+	"github.com/jclement/boxcheckr/internal/db"
+	"github.com/jclement/boxcheckr/internal/inventory"
+)
+
+// Event types
+const (
+	EventMachineEnrolled   = "machine.enrolled"
+	EventSnapshotSubmitted = "snapshot.submitted"
+	EventControlFailed     = "machine.control_failed"
+	EventMachineArchived   = "machine.archived"
+	EventMachineRestored   = "machine.restored"
+	EventMachineDeleted    = "machine.deleted"
+	EventShareLinkCreated  = "share_link.created"
+)
+
+// Events lists every event type a webhook can subscribe to
+var Events = []string{
+	EventMachineEnrolled,
+	EventSnapshotSubmitted,
+	EventControlFailed,
+	EventMachineArchived,
+	EventMachineRestored,
+	EventMachineDeleted,
+	EventShareLinkCreated,
+}
+
+// Request headers
+const (
+	SignatureHeader = "X-BoxCheckr-Signature"
+	EventHeader     = "X-BoxCheckr-Event"
+	EventIDHeader   = "X-BoxCheckr-Event-Id"
+)
+
+// Retry schedule: the delay doubles after each failed attempt, up to
+// maxBackoff, and the delivery is abandoned after maxAttempts.
+const (
+	initialBackoff = time.Minute
+	maxBackoff     = time.Hour
+	maxAttempts    = 10
+)
+
+// Event is the JSON body posted to webhooks
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Machine identifies a machine in event data. It deliberately leaves out the
+// enrollment token.
+type Machine struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	OwnerID    string `json:"owner_id"`
+	OwnerEmail string `json:"owner_email,omitempty"`
+	URL        string `json:"url"`
+}
+
+// Emit queues an event for every webhook subscribed to it
+func Emit(database db.WebhookStore, eventType string, data interface{}) error {
+	event := Event{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return database.EnqueueWebhookEvent(event.ID, eventType, payload)
+}
+
+// Sign returns the signature header value for a request body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns the delay before retrying a delivery that has failed attempts times
+func Backoff(attempts int) time.Duration {
+	d := initialBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// FailedControls returns the checks that passed in the previous snapshot
+// and fail in the current one, named after their check IDs (the agent JSON
+// keys for the original controls)
+func FailedControls(previous, current *db.InventorySnapshot) []string {
+	if previous == nil || current == nil {
+		return nil
+	}
+
+	var failed []string
+	for _, r := range checks.Results(current) {
+		if r.Failed() && checks.Status(previous, r.ID) == inventory.CheckPass {
+			failed = append(failed, r.ID)
+		}
+	}
+	return failed
+}
+
+// Worker delivers queued events
+type Worker struct {
+	db       db.WebhookStore
+	client   *http.Client
+	interval time.Duration
+	now      func() time.Time
+}
+
+func NewWorker(database db.WebhookStore) *Worker {
+	return &Worker{
+		db:       database,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		interval: 15 * time.Second,
+		now:      time.Now,
+	}
+}
+
+// Run delivers due events until ctx is cancelled
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.DeliverDue(ctx); err != nil {
+			log.Printf("Webhook delivery failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue attempts every delivery that is due and records the outcome
+func (w *Worker) DeliverDue(ctx context.Context) error {
+	deliveries, err := w.db.DueWebhookDeliveries(w.now(), 100)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deliveries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		statusCode, err := w.post(ctx, d)
+		status := db.DeliveryDelivered
+		errMsg := ""
+		next := w.now()
+		if err != nil {
+			errMsg = err.Error()
+			status = db.DeliveryPending
+			next = next.Add(Backoff(d.Attempts + 1))
+			if d.Attempts+1 >= maxAttempts {
+				status = db.DeliveryFailed
+			}
+		}
+
+		if err := w.db.RecordWebhookAttempt(d.ID, status, statusCode, errMsg, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post sends one delivery. Any 2xx response counts as delivered.
+func (w *Worker) post(ctx context.Context, d db.WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "BoxCheckr-Webhook")
+	req.Header.Set(SignatureHeader, Sign(d.Secret, body))
+	req.Header.Set(EventHeader, d.Event)
+	req.Header.Set(EventIDHeader, d.EventID)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
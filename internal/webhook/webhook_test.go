@@ -0,0 +1,191 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jclement/boxcheckr/internal/db"
+)
+
+func setupTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	tmpFile, err := os.CreateTemp("", "boxcheckr-webhook-test-*.db")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	tmpFile.Close()
+
+	database, err := db.New(tmpFile.Name())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+
+	t.Cleanup(func() {
+		database.Close()
+		os.Remove(tmpFile.Name())
+	})
+
+	return database
+}
+
+func TestSign(t *testing.T) {
+	// Well-known HMAC-SHA256 example
+	got := Sign("key", []byte("The quick brown fox jumps over the lazy dog"))
+	want := "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{7, time.Hour},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestFailedControls(t *testing.T) {
+	prev := &db.InventorySnapshot{DiskEncrypted: true, AntivirusEnabled: true, FirewallEnabled: false, ScreenLockEnabled: true,
+		Checks: []db.SnapshotCheck{{CheckID: "gatekeeper_enabled", Status: "pass"}, {CheckID: "acme.vpn_connected", Status: "unknown"}}}
+	cur := &db.InventorySnapshot{DiskEncrypted: false, AntivirusEnabled: true, FirewallEnabled: false, ScreenLockEnabled: false,
+		Checks: []db.SnapshotCheck{{CheckID: "gatekeeper_enabled", Status: "fail"}, {CheckID: "acme.vpn_connected", Status: "fail"}}}
+
+	got := FailedControls(prev, cur)
+	if len(got) != 3 || got[0] != "disk_encrypted" || got[1] != "screen_lock_enabled" || got[2] != "gatekeeper_enabled" {
+		t.Errorf("Expected disk_encrypted, screen_lock_enabled and gatekeeper_enabled, got %v", got)
+	}
+
+	// A control that was already failing is not a new failure, and the
+	// first snapshot has nothing to compare against
+	if got := FailedControls(cur, cur); len(got) != 0 {
+		t.Errorf("Expected no transitions, got %v", got)
+	}
+	if got := FailedControls(nil, cur); len(got) != 0 {
+		t.Errorf("Expected no transitions without a previous snapshot, got %v", got)
+	}
+}
+
+func TestWorkerDelivers(t *testing.T) {
+	database := setupTestDB(t)
+
+	var received []*http.Request
+	var bodies [][]byte
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	hook, err := database.CreateWebhook(server.URL, []string{EventMachineEnrolled})
+	if err != nil {
+		t.Fatalf("Failed to create webhook: %v", err)
+	}
+
+	// Only subscribed events are queued
+	if err := Emit(database, EventMachineDeleted, map[string]string{"id": "m1"}); err != nil {
+		t.Fatalf("Failed to emit: %v", err)
+	}
+	if err := Emit(database, EventMachineEnrolled, map[string]string{"id": "m1"}); err != nil {
+		t.Fatalf("Failed to emit: %v", err)
+	}
+
+	worker := NewWorker(database)
+	if err := worker.DeliverDue(context.Background()); err != nil {
+		t.Fatalf("DeliverDue failed: %v", err)
+	}
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(received))
+	}
+
+	req := received[0]
+	if req.Header.Get(EventHeader) != EventMachineEnrolled {
+		t.Errorf("Expected event header, got %q", req.Header.Get(EventHeader))
+	}
+	if req.Header.Get(SignatureHeader) != Sign(hook.Secret, bodies[0]) {
+		t.Error("Signature does not match body")
+	}
+	var event Event
+	if err := json.Unmarshal(bodies[0], &event); err != nil || event.Type != EventMachineEnrolled || event.ID != req.Header.Get(EventIDHeader) {
+		t.Errorf("Unexpected body %s: %v", bodies[0], err)
+	}
+
+	// The failure is recorded and retried later, not immediately
+	deliveries, _ := database.RecentWebhookDeliveries(10)
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d", len(deliveries))
+	}
+	d := deliveries[0]
+	if d.Status != db.DeliveryPending || d.Attempts != 1 || d.LastStatusCode != 500 || d.LastError == "" {
+		t.Errorf("Unexpected delivery after failure: %+v", d)
+	}
+	if !d.NextAttemptAt.After(time.Now()) {
+		t.Errorf("Expected retry in the future, got %v", d.NextAttemptAt)
+	}
+	worker.DeliverDue(context.Background())
+	if len(received) != 1 {
+		t.Fatalf("Expected no retry before backoff, got %d requests", len(received))
+	}
+
+	// A worker running after the backoff, e.g. following a restart, picks it up
+	fail = false
+	later := NewWorker(database)
+	later.now = func() time.Time { return time.Now().Add(Backoff(1) + time.Second) }
+	if err := later.DeliverDue(context.Background()); err != nil {
+		t.Fatalf("DeliverDue failed: %v", err)
+	}
+	deliveries, _ = database.RecentWebhookDeliveries(10)
+	if d := deliveries[0]; d.Status != db.DeliveryDelivered || d.Attempts != 2 || d.LastError != "" {
+		t.Errorf("Unexpected delivery after success: %+v", d)
+	}
+}
+
+func TestWorkerGivesUp(t *testing.T) {
+	database := setupTestDB(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	database.CreateWebhook(server.URL, nil)
+	Emit(database, EventShareLinkCreated, nil)
+
+	// Step the clock past each backoff
+	clock := time.Now()
+	worker := NewWorker(database)
+	worker.now = func() time.Time { return clock }
+	for i := 0; i < maxAttempts+2; i++ {
+		worker.DeliverDue(context.Background())
+		clock = clock.Add(maxBackoff + time.Minute)
+	}
+
+	deliveries, _ := database.RecentWebhookDeliveries(1)
+	if d := deliveries[0]; d.Status != db.DeliveryFailed || d.Attempts != maxAttempts {
+		t.Errorf("Expected delivery to be abandoned after %d attempts, got %+v", maxAttempts, d)
+	}
+}